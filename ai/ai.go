@@ -1,4 +1,6 @@
-package main
+// Package ai rewrites dictated text with an OpenAI-compatible chat API:
+// tidying it up, making it formal or translating it.
+package ai
 
 import (
 	"bytes"
@@ -6,79 +8,126 @@ import (
 	"fmt"
 	"io"
 	"net/http"
-	"os"
 	"strings"
+	"sync"
 	"time"
 )
 
-// AIMode represents the text processing mode.
-type AIMode string
+// Defaults for an OpenAI-compatible chat completions API.
+const (
+	DefaultBaseURL = "https://api.deepseek.com"
+	DefaultModel   = "deepseek-chat"
+)
+
+// Mode represents the text processing mode.
+type Mode string
 
 const (
-	ModeRaw       AIMode = "raw"       // No processing, direct input
-	ModeTidy      AIMode = "tidy"      // Remove duplicates, filler words, add punctuation
-	ModeFormal    AIMode = "formal"    // Tidy + convert to formal/written style
-	ModeTranslate AIMode = "translate" // Translate to/from English
+	ModeRaw       Mode = "raw"       // No processing, direct input
+	ModeTidy      Mode = "tidy"      // Remove duplicates, filler words, add punctuation
+	ModeFormal    Mode = "formal"    // Tidy + convert to formal/written style
+	ModeTranslate Mode = "translate" // Translate to/from English
 )
 
-// AIProcessor handles text processing via LLM API.
-type AIProcessor struct {
+// Options configure a Processor.
+type Options struct {
+	APIKey  string // AI is unavailable without one
+	BaseURL string // default DefaultBaseURL
+	Model   string // default DefaultModel
+	// HTTPClient makes the API calls (default: a client with a 30s timeout).
+	HTTPClient *http.Client
+}
+
+// Processor handles text processing via LLM API. Its settings can be
+// changed while it is in use.
+type Processor struct {
+	mu      sync.RWMutex
 	apiKey  string
 	baseURL string
 	model   string
 	client  *http.Client
 }
 
-// NewAIProcessor creates a new AI processor.
-// It first reads saved config from disk, then falls back to environment variables.
-func NewAIProcessor() *AIProcessor {
-	// Load persistent config first
-	cfg := LoadConfig()
-
-	apiKey := cfg.APIKey
-	if apiKey == "" {
-		apiKey = os.Getenv("DEEPSEEK_API_KEY")
+// New creates a processor from opts.
+func New(opts Options) *Processor {
+	p := &Processor{client: opts.HTTPClient}
+	if p.client == nil {
+		p.client = &http.Client{
+			Timeout: 30 * time.Second,
+		}
 	}
-
-	baseURL := cfg.BaseURL
-	if baseURL == "" {
-		baseURL = os.Getenv("DEEPSEEK_BASE_URL")
+	p.SetAPIKey(opts.APIKey)
+	if !p.SetBaseURL(opts.BaseURL) {
+		p.baseURL = DefaultBaseURL
 	}
-	if baseURL == "" {
-		baseURL = "https://api.deepseek.com"
+	if !p.SetModel(opts.Model) {
+		p.model = DefaultModel
 	}
+	return p
+}
 
-	model := cfg.Model
-	if model == "" {
-		model = os.Getenv("DEEPSEEK_MODEL")
-	}
-	if model == "" {
-		model = "deepseek-chat"
-	}
+// IsAvailable returns true if the API key is configured.
+func (p *Processor) IsAvailable() bool {
+	return p.APIKey() != ""
+}
 
-	return &AIProcessor{
-		apiKey:  apiKey,
-		baseURL: baseURL,
-		model:   model,
-		client: &http.Client{
-			Timeout: 30 * time.Second,
-		},
-	}
+// APIKey returns the API key.
+func (p *Processor) APIKey() string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.apiKey
 }
 
-// IsAvailable returns true if the API key is configured.
-func (ai *AIProcessor) IsAvailable() bool {
-	return ai.apiKey != ""
+// BaseURL returns the API's base URL.
+func (p *Processor) BaseURL() string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.baseURL
+}
+
+// Model returns the model name.
+func (p *Processor) Model() string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.model
+}
+
+// SetAPIKey sets the API key at runtime. An empty key turns AI off.
+func (p *Processor) SetAPIKey(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.apiKey = strings.TrimSpace(key)
+}
+
+// SetBaseURL changes the API's base URL. An empty URL is ignored, and
+// SetBaseURL reports whether it changed anything.
+func (p *Processor) SetBaseURL(baseURL string) bool {
+	baseURL = strings.TrimRight(strings.TrimSpace(baseURL), "/")
+	if baseURL == "" {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.baseURL = baseURL
+	return true
 }
 
-// SetAPIKey sets the API key at runtime.
-func (ai *AIProcessor) SetAPIKey(key string) {
-	ai.apiKey = strings.TrimSpace(key)
+// SetModel changes the model. An empty name is ignored, and SetModel
+// reports whether it changed anything.
+func (p *Processor) SetModel(model string) bool {
+	model = strings.TrimSpace(model)
+	if model == "" {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.model = model
+	return true
 }
 
 // Process processes text according to the given mode.
-func (ai *AIProcessor) Process(text string, mode AIMode) (string, error) {
-	if !ai.IsAvailable() {
+func (p *Processor) Process(text string, mode Mode) (string, error) {
+	if !p.IsAvailable() {
 		return text, fmt.Errorf("AI not configured: set DEEPSEEK_API_KEY environment variable")
 	}
 
@@ -87,10 +136,10 @@ func (ai *AIProcessor) Process(text string, mode AIMode) (string, error) {
 	}
 
 	prompt := buildPrompt(text, mode)
-	return ai.callAPI(prompt)
+	return p.callAPI(prompt)
 }
 
-func buildPrompt(text string, mode AIMode) string {
+func buildPrompt(text string, mode Mode) string {
 	switch mode {
 	case ModeTidy:
 		return fmt.Sprintf(`你是一个语音转文字的文本整理助手。请对以下语音识别的原始文本进行整理：
@@ -159,9 +208,13 @@ type ChatResponse struct {
 	} `json:"error,omitempty"`
 }
 
-func (ai *AIProcessor) callAPI(prompt string) (string, error) {
+func (p *Processor) callAPI(prompt string) (string, error) {
+	p.mu.RLock()
+	apiKey, baseURL, model := p.apiKey, p.baseURL, p.model
+	p.mu.RUnlock()
+
 	reqBody := ChatRequest{
-		Model: ai.model,
+		Model: model,
 		Messages: []ChatMessage{
 			{Role: "user", Content: prompt},
 		},
@@ -174,16 +227,16 @@ func (ai *AIProcessor) callAPI(prompt string) (string, error) {
 		return "", fmt.Errorf("marshal request: %w", err)
 	}
 
-	url := fmt.Sprintf("%s/v1/chat/completions", ai.baseURL)
+	url := fmt.Sprintf("%s/v1/chat/completions", baseURL)
 	req, err := http.NewRequest("POST", url, bytes.NewReader(jsonData))
 	if err != nil {
 		return "", fmt.Errorf("create request: %w", err)
 	}
 
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+ai.apiKey)
+	req.Header.Set("Authorization", "Bearer "+apiKey)
 
-	resp, err := ai.client.Do(req)
+	resp, err := p.client.Do(req)
 	if err != nil {
 		return "", fmt.Errorf("API call failed: %w", err)
 	}
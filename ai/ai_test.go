@@ -0,0 +1,93 @@
+package ai
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNewDefaults(t *testing.T) {
+	p := New(Options{APIKey: "  sk-test  ", BaseURL: "https://api.example.com/"})
+	if p.APIKey() != "sk-test" || p.BaseURL() != "https://api.example.com" || p.Model() != DefaultModel {
+		t.Errorf("New = key %q, base %q, model %q", p.APIKey(), p.BaseURL(), p.Model())
+	}
+	if p.SetModel("  ") || p.SetBaseURL("") {
+		t.Error("empty settings applied")
+	}
+	if p.Model() != DefaultModel || p.BaseURL() != "https://api.example.com" {
+		t.Error("empty settings changed the processor")
+	}
+	if q := New(Options{}); q.IsAvailable() || q.BaseURL() != DefaultBaseURL {
+		t.Errorf("zero Options: available %v, base %q", q.IsAvailable(), q.BaseURL())
+	}
+}
+
+func TestProcess(t *testing.T) {
+	var got ChatRequest
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/chat/completions" {
+			http.NotFound(w, r)
+			return
+		}
+		auth = r.Header.Get("Authorization")
+		json.NewDecoder(r.Body).Decode(&got)
+		w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"  Tidied.  "}}]}`))
+	}))
+	defer srv.Close()
+
+	p := New(Options{APIKey: "sk-test", BaseURL: srv.URL, Model: "m1"})
+	out, err := p.Process("um tidied tidied", ModeTidy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "Tidied." {
+		t.Errorf("Process = %q, want Tidied.", out)
+	}
+	if auth != "Bearer sk-test" || got.Model != "m1" || len(got.Messages) != 1 ||
+		!strings.Contains(got.Messages[0].Content, "um tidied tidied") {
+		t.Errorf("request: auth %q, %+v", auth, got)
+	}
+
+	// Raw and blank text never reach the API.
+	got = ChatRequest{}
+	for _, tc := range []struct {
+		text string
+		mode Mode
+	}{{"as is", ModeRaw}, {"   ", ModeFormal}} {
+		if out, err := p.Process(tc.text, tc.mode); err != nil || out != tc.text {
+			t.Errorf("Process(%q, %s) = %q, %v", tc.text, tc.mode, out, err)
+		}
+	}
+	if got.Model != "" {
+		t.Error("API called for raw or blank text")
+	}
+}
+
+func TestProcessErrors(t *testing.T) {
+	for name, tc := range map[string]struct {
+		status int
+		body   string
+	}{
+		"status":     {http.StatusBadGateway, `{}`},
+		"api error":  {http.StatusOK, `{"error":{"message":"quota"}}`},
+		"no choices": {http.StatusOK, `{"choices":[]}`},
+		"bad json":   {http.StatusOK, `{`},
+	} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tc.status)
+			w.Write([]byte(tc.body))
+		}))
+		p := New(Options{APIKey: "sk-test", BaseURL: srv.URL})
+		if _, err := p.Process("text", ModeTranslate); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+		srv.Close()
+	}
+
+	if _, err := New(Options{}).Process("text", ModeTidy); err == nil {
+		t.Error("Process without an API key succeeded")
+	}
+}
@@ -3,23 +3,106 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"fmt"
+	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+
+	"github.com/gold16/ginkgo-talk/server"
 )
 
-func runApp() error {
-	server := NewServer(defaultPort)
-	printStartupInfo(server)
+func runApp(lock *instanceLock) error {
+	srv := newServer()
+	if lock != nil {
+		go lock.serve(srv)
+	}
+	if isTerminal(os.Stdin) {
+		srv.SetPairRequestHandler(newTerminalApprover(srv))
+	}
+	printStartupInfo(srv)
 
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	serverErrCh := make(chan error, 1)
+	go func() {
+		serverErrCh <- srv.Start()
+	}()
+
+	select {
+	case err := <-serverErrCh:
+		return err
+	case <-sigCh:
+	}
+	fmt.Println()
 	go func() {
 		<-sigCh
-		fmt.Println("\nShutting down...")
-		os.Exit(0)
+		log.Printf("Second interrupt, exiting immediately")
+		os.Exit(1)
 	}()
 
-	return server.Start()
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	return srv.Shutdown(ctx)
+}
+
+// newTerminalApprover returns a pair request handler that asks on the
+// terminal whether to let each new device in. Requests are asked about one
+// at a time; anything left unanswered simply times out on the srv.
+func newTerminalApprover(srv *server.Server) func(server.PendingPair) {
+	reqCh := make(chan server.PendingPair, 16)
+	go func() {
+		stdin := bufio.NewReader(os.Stdin)
+		for req := range reqCh {
+			fmt.Printf("\nPairing request %s\n", req.ID)
+			fmt.Printf("  Device:     %s\n", req.DisplayName())
+			fmt.Printf("  Address:    %s\n", req.RemoteAddr)
+			fmt.Printf("  User agent: %s\n", req.UserAgent)
+			if req.Replaces {
+				fmt.Printf("  Warning:    device %s is already known; approving unpairs it and gives this device its permissions\n", req.DeviceID)
+			}
+			fmt.Print("Approve? [y/N] ")
+
+			line, err := stdin.ReadString('\n')
+			if err != nil {
+				fmt.Println()
+				return
+			}
+			var decideErr error
+			if strings.EqualFold(strings.TrimSpace(line), "y") {
+				decideErr = srv.ApprovePair(req.ID)
+			} else {
+				decideErr = srv.DenyPair(req.ID)
+			}
+			if decideErr != nil {
+				fmt.Printf("Pairing request %s: %v\n", req.ID, decideErr)
+			}
+		}
+	}()
+
+	return func(req server.PendingPair) {
+		select {
+		case reqCh <- req:
+		default:
+			// Too many requests queued; this one will time out.
+		}
+	}
+}
+
+// attachParentConsole is only needed for the Windows GUI build.
+func attachParentConsole() {}
+
+// openBrowser opens rawURL with the desktop's default handler.
+func openBrowser(rawURL string) {
+	if err := server.OpenURL(rawURL); err != nil {
+		log.Printf("open browser failed: %v", err)
+	}
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
 }
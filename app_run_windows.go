@@ -3,24 +3,29 @@
 package main
 
 import (
+	"context"
 	_ "embed"
 	"fmt"
 	"log"
 	"net"
-	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
 	"unsafe"
 
 	"github.com/getlantern/systray"
+	"github.com/gold16/ginkgo-talk/config"
+	"github.com/gold16/ginkgo-talk/server"
 )
 
 //go:embed web/tray-icon.ico
 var trayIcon []byte
 
+var user32 = syscall.NewLazyDLL("user32.dll")
+
 func hideConsoleWindow() {
 	kernel32 := syscall.NewLazyDLL("kernel32.dll")
 	getConsoleWindow := kernel32.NewProc("GetConsoleWindow")
@@ -32,14 +37,52 @@ func hideConsoleWindow() {
 	}
 }
 
-func runApp() error {
+// attachParentConsole lets subcommands print to the console they were run
+// from: the executable is built as a GUI program, which has none of its own.
+func attachParentConsole() {
+	kernel32 := syscall.NewLazyDLL("kernel32.dll")
+	attachConsole := kernel32.NewProc("AttachConsole")
+	const attachParentProcess = ^uintptr(0) // (DWORD)-1
+	if ret, _, _ := attachConsole.Call(attachParentProcess); ret == 0 {
+		return
+	}
+	if out, err := os.OpenFile("CONOUT$", os.O_WRONLY, 0); err == nil {
+		os.Stdout = out
+		os.Stderr = out
+		log.SetOutput(out)
+	}
+}
+
+func runApp(lock *instanceLock) error {
 	hideConsoleWindow()
 
-	server := NewServer(defaultPort)
+	srv := newServer()
+	if lock != nil {
+		go lock.serve(srv)
+	}
+	pairReqCh := make(chan server.PendingPair, 16)
+	srv.SetPairRequestHandler(func(req server.PendingPair) {
+		select {
+		case pairReqCh <- req:
+		default:
+		}
+	})
+	pairCodeCh := make(chan string, 1)
+	srv.SetPairCodeHandler(func(code string) {
+		// Only the latest code matters.
+		select {
+		case <-pairCodeCh:
+		default:
+		}
+		select {
+		case pairCodeCh <- code:
+		default:
+		}
+	})
 
 	serverErrCh := make(chan error, 1)
 	go func() {
-		serverErrCh <- server.Start()
+		serverErrCh <- srv.Start()
 	}()
 
 	resultCh := make(chan error, 1)
@@ -47,30 +90,41 @@ func runApp() error {
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 
 	systray.Run(func() {
-		setupTray(server, serverErrCh, sigCh, resultCh)
+		setupTray(srv, serverErrCh, pairReqCh, pairCodeCh, sigCh, resultCh)
 	}, func() {})
 
 	err := <-resultCh
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if shutErr := srv.Shutdown(ctx); err == nil {
+		err = shutErr
+	}
 	return err
 }
 
-func setupTray(server *Server, serverErrCh <-chan error, sigCh <-chan os.Signal, resultCh chan<- error) {
+func setupTray(srv *server.Server, serverErrCh <-chan error, pairReqCh <-chan server.PendingPair, pairCodeCh <-chan string, sigCh <-chan os.Signal, resultCh chan<- error) {
 	systray.SetTitle(appName)
 	systray.SetTooltip("Ginkgo Talk")
 	if len(trayIcon) > 0 {
 		systray.SetIcon(trayIcon)
 	}
 
-	lanIP := server.LanIP()
-	qrURL := fmt.Sprintf("https://%s%s/qrcode", lanIP, defaultPort)
+	lanIP := srv.LanIP()
+	qrURL := srv.BaseURL() + "/qrcode"
 
-	ipItem := systray.AddMenuItem(fmt.Sprintf("IP: %s%s", lanIP, defaultPort), "Current server address")
+	ipItem := systray.AddMenuItem("IP: "+net.JoinHostPort(lanIP, strconv.Itoa(srv.Port())), "Current server address")
 	ipItem.Disable()
 	setIPItem := systray.AddMenuItem("Set IP...", "Set LAN IP address")
 	systray.AddSeparator()
 	openQRItem := systray.AddMenuItem("Open QR Code", "Open QR code page in browser")
-	pairCodeItem := systray.AddMenuItem(fmt.Sprintf("Pair Code: %s", server.pairCode), "Current pair code")
+	pairCodeLabel := "Pair Code: not used"
+	if code, err := srv.PairCode(); err == nil {
+		pairCodeLabel = "Pair Code: " + code
+	}
+	pairCodeItem := systray.AddMenuItem(pairCodeLabel, "Current pair code")
 	pairCodeItem.Disable()
+	pendingItem := systray.AddMenuItem("No pending pairing requests", "Approve or deny new devices")
+	pendingItem.Disable()
 	systray.AddSeparator()
 	quitItem := systray.AddMenuItem("Quit", "Quit Ginkgo Talk")
 
@@ -78,13 +132,21 @@ func setupTray(server *Server, serverErrCh <-chan error, sigCh <-chan os.Signal,
 		for {
 			select {
 			case <-setIPItem.ClickedCh:
-				newIP := showIPInputDialog(server.LanIP())
+				newIP := showIPInputDialog(srv.LanIP())
 				if newIP != "" {
-					applyIPChange(server, newIP, ipItem)
+					applyIPChange(srv, newIP, ipItem)
 				}
+			case code := <-pairCodeCh:
+				pairCodeItem.SetTitle("Pair Code: " + code)
+			case req := <-pairReqCh:
+				updatePendingItem(srv, pendingItem)
+				systray.SetTooltip(fmt.Sprintf("Ginkgo Talk - pairing request from %s", req.DisplayName()))
+			case <-pendingItem.ClickedCh:
+				reviewPendingPair(srv)
+				updatePendingItem(srv, pendingItem)
+				systray.SetTooltip("Ginkgo Talk")
 			case <-openQRItem.ClickedCh:
-				curIP := server.LanIP()
-				qrURL = fmt.Sprintf("https://%s%s/qrcode", curIP, defaultPort)
+				qrURL = srv.BaseURL() + "/qrcode"
 				openBrowser(qrURL)
 			case <-quitItem.ClickedCh:
 				resultCh <- nil
@@ -126,27 +188,71 @@ if ($result -ne "") { Write-Output $result }
 }
 
 // applyIPChange validates and applies a new IP, updates tray display and saves config.
-func applyIPChange(server *Server, input string, ipItem *systray.MenuItem) {
+func applyIPChange(srv *server.Server, input string, ipItem *systray.MenuItem) {
 	if strings.EqualFold(input, "auto") {
-		server.SetLanIPOverride("")
-		newIP := server.LanIP()
-		ipItem.SetTitle(fmt.Sprintf("IP: %s%s", newIP, defaultPort))
+		srv.SetLanIPOverride("")
+		newIP := srv.LanIP()
+		ipItem.SetTitle("IP: " + net.JoinHostPort(newIP, strconv.Itoa(srv.Port())))
 		log.Printf("LAN IP reset to auto-detect: %s", newIP)
 	} else {
-		ip := net.ParseIP(strings.TrimSpace(input))
-		if ip == nil || ip.To4() == nil {
-			log.Printf("Invalid IP from dialog: %s", input)
-			showErrorDialog("Invalid IP address: " + input)
+		if err := srv.SetLanIPOverride(input); err != nil {
+			log.Printf("Invalid IP from dialog: %v", err)
+			showErrorDialog("Invalid IP address: " + err.Error())
 			return
 		}
-		server.SetLanIPOverride(ip.String())
-		ipItem.SetTitle(fmt.Sprintf("IP: %s%s", ip.String(), defaultPort))
-		log.Printf("LAN IP set to: %s", ip.String())
+		ip := srv.GetLanIPOverride()
+		ipItem.SetTitle("IP: " + net.JoinHostPort(ip, strconv.Itoa(srv.Port())))
+		log.Printf("LAN IP set to: %s", ip)
 	}
 	// Persist to config
-	cfg := LoadConfig()
-	cfg.LanIP = server.GetLanIPOverride()
-	SaveConfig(cfg)
+	cfg := config.Load(configPath())
+	cfg.LanIP = srv.GetLanIPOverride()
+	config.Save(configPath(), cfg)
+}
+
+// updatePendingItem refreshes the tray entry for pending pairing requests.
+func updatePendingItem(srv *server.Server, item *systray.MenuItem) {
+	pending := srv.PendingPairs()
+	if len(pending) == 0 {
+		item.SetTitle("No pending pairing requests")
+		item.Disable()
+		return
+	}
+	item.SetTitle(fmt.Sprintf("Approve pairing: %s (%d pending)...", pending[0].DisplayName(), len(pending)))
+	item.Enable()
+}
+
+// reviewPendingPair asks whether to approve the oldest pending pairing request.
+func reviewPendingPair(srv *server.Server) {
+	pending := srv.PendingPairs()
+	if len(pending) == 0 {
+		return
+	}
+	req := pending[0]
+	msg := fmt.Sprintf("Allow this device to pair with Ginkgo Talk?\n\nDevice: %s\nAddress: %s\nUser agent: %s",
+		req.DisplayName(), req.RemoteAddr, req.UserAgent)
+	if req.Replaces {
+		msg += fmt.Sprintf("\n\nWarning: device %s is already known. Approving unpairs it and gives this device its permissions.", req.DeviceID)
+	}
+
+	var err error
+	if showConfirmDialog(msg) {
+		err = srv.ApprovePair(req.ID)
+	} else {
+		err = srv.DenyPair(req.ID)
+	}
+	if err != nil {
+		showErrorDialog("Pairing request " + req.ID + ": " + err.Error())
+	}
+}
+
+// showConfirmDialog shows a Yes/No message box and reports whether Yes was chosen.
+func showConfirmDialog(msg string) bool {
+	msgBox := user32.NewProc("MessageBoxW")
+	title, _ := syscall.UTF16PtrFromString("Ginkgo Talk")
+	text, _ := syscall.UTF16PtrFromString(msg)
+	ret, _, _ := msgBox.Call(0, uintptr(unsafe.Pointer(text)), uintptr(unsafe.Pointer(title)), 0x24) // MB_YESNO | MB_ICONQUESTION
+	return ret == 6                                                                                  // IDYES
 }
 
 // showErrorDialog shows a simple Windows error message box.
@@ -158,11 +264,7 @@ func showErrorDialog(msg string) {
 }
 
 func openBrowser(rawURL string) {
-	if _, err := url.ParseRequestURI(rawURL); err != nil {
-		log.Printf("invalid URL: %s", rawURL)
-		return
-	}
-	if err := exec.Command("rundll32", "url.dll,FileProtocolHandler", rawURL).Start(); err != nil {
+	if err := server.OpenURL(rawURL); err != nil {
 		log.Printf("open browser failed: %v", err)
 	}
 }
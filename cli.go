@@ -0,0 +1,440 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/gold16/ginkgo-talk/ai"
+	"github.com/gold16/ginkgo-talk/config"
+	"github.com/gold16/ginkgo-talk/server"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+const cliUsage = `Usage: ginkgo-talk [command]
+
+Commands:
+  serve                         run the server (the default)
+  status [--json]               show the server address and the phone's connection
+  pair-code                     print the pair code
+  qr                            print a one-time pairing QR code in the terminal
+  show                          open the QR page in the browser
+  devices list [--json]         list paired devices
+  devices revoke <device-id>    revoke a device's credentials
+  devices policy <device-id> <policy>
+                                set what a device may do: full, guest or a
+                                policy from the config
+  type [--mode <mode>] <text>   type text on this computer; mode is raw (default),
+                                tidy, formal or translate
+  config get [key]              print the configuration, or one setting
+  config set <key> <value>      change a setting
+  tokens list [--json]          list API tokens
+  tokens create <name> --scopes <scopes> [--expires <ttl>]
+                                create an API token; scopes are a comma-separated
+                                list of type, command, ai, config:read,
+                                config:write, script, action, or all, plus
+                                events:text; ttl is e.g. 90d or 12h
+  tokens revoke <name>          delete an API token
+
+Every command except serve talks to the running server. config and tokens
+also work while the server is stopped.
+`
+
+// runCommand runs a command-line subcommand against the running server.
+func runCommand(args []string) error {
+	switch args[0] {
+	case "help", "-h", "--help":
+		fmt.Print(cliUsage)
+		return nil
+	}
+
+	out, err := forwardToInstance(args)
+	if errors.Is(err, errNotRunning) {
+		switch args[0] {
+		case "config":
+			out, err = runConfigCommand(nil, args[1:])
+		case "tokens":
+			var tokens *server.TokenStore
+			if tokens, err = server.LoadTokenStore(filepath.Join(appDir(), server.TokensFileName)); err == nil {
+				flags, rest := splitFlags(args[1:])
+				out, err = tokensCommand(tokens, rest, flags)
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if args[0] == "qr" {
+		printQRCode(out)
+		return nil
+	}
+	if out != "" {
+		fmt.Println(out)
+	}
+	return nil
+}
+
+// runControlCommand carries out a command forwarded to the running server.
+// Launching again without arguments brings up the QR page.
+func runControlCommand(s *server.Server, args []string) (string, error) {
+	if len(args) == 0 {
+		args = []string{"show"}
+	}
+	flags, rest := splitFlags(args[1:])
+
+	switch args[0] {
+	case "show":
+		qrURL := s.BaseURL() + "/qrcode"
+		openBrowser(qrURL)
+		return "Opened " + qrURL, nil
+
+	case "status":
+		if err := checkFlags(flags, "json"); err != nil {
+			return "", err
+		}
+		return statusText(s.Status(), flags["json"] != "")
+
+	case "pair-code":
+		return s.PairCode()
+
+	case "qr":
+		return s.PairLink()
+
+	case "devices":
+		return devicesCommand(s, rest, flags)
+
+	case "type":
+		if err := checkFlags(flags, "mode"); err != nil {
+			return "", err
+		}
+		return typeCommand(s, strings.Join(rest, " "), ai.Mode(flags["mode"]))
+
+	case "config":
+		return runConfigCommand(s, args[1:])
+
+	case "tokens":
+		return tokensCommand(s.Tokens(), rest, flags)
+	}
+	return "", fmt.Errorf("unknown command %q, see --help", args[0])
+}
+
+// valueFlags take the next argument as their value.
+var valueFlags = map[string]bool{"mode": true, "scopes": true, "expires": true}
+
+// splitFlags separates --name, --name=value and --name value (for
+// valueFlags) from the other arguments. "--" ends the flags.
+func splitFlags(args []string) (map[string]string, []string) {
+	flags := make(map[string]string)
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		name, ok := strings.CutPrefix(args[i], "--")
+		if !ok {
+			rest = append(rest, args[i])
+			continue
+		}
+		if name == "" {
+			rest = append(rest, args[i+1:]...)
+			break
+		}
+		if k, v, hasValue := strings.Cut(name, "="); hasValue {
+			flags[k] = v
+		} else if valueFlags[name] && i+1 < len(args) {
+			flags[name] = args[i+1]
+			i++
+		} else {
+			flags[name] = "true"
+		}
+	}
+	return flags, rest
+}
+
+func checkFlags(flags map[string]string, allowed ...string) error {
+	for name := range flags {
+		found := false
+		for _, a := range allowed {
+			found = found || name == a
+		}
+		if !found {
+			return fmt.Errorf("unknown flag --%s", name)
+		}
+	}
+	return nil
+}
+
+func statusText(st server.Status, asJSON bool) (string, error) {
+	if asJSON {
+		data, err := json.MarshalIndent(st, "", "  ")
+		return string(data), err
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s v%s (%s)\n", appName, st.Version, st.Name)
+	fmt.Fprintf(&b, "URL:       %s\n", st.URL)
+	phone := string(st.Connection.State)
+	if st.ClientAddr != "" {
+		phone += " from " + st.ClientAddr
+	}
+	if st.Connection.Since != "" {
+		phone += " since " + st.Connection.Since
+	}
+	fmt.Fprintf(&b, "Phone:     %s\n", phone)
+	fmt.Fprintf(&b, "Devices:   %d paired\n", st.Devices)
+	fmt.Fprintf(&b, "Pair mode: %s\n", st.PairMode)
+	if st.AIAvailable {
+		fmt.Fprintf(&b, "AI:        enabled (%s)", st.Model)
+	} else {
+		fmt.Fprintf(&b, "AI:        disabled")
+	}
+	if st.CAFingerprint != "" {
+		fmt.Fprintf(&b, "\nCA:        %s", st.CAFingerprint)
+	}
+	return b.String(), nil
+}
+
+func devicesCommand(s *server.Server, args []string, flags map[string]string) (string, error) {
+	sub := "list"
+	if len(args) > 0 {
+		sub = args[0]
+	}
+	switch sub {
+	case "list":
+		if err := checkFlags(flags, "json"); err != nil {
+			return "", err
+		}
+		devices := s.Devices()
+		if flags["json"] != "" {
+			data, err := json.MarshalIndent(devices, "", "  ")
+			return string(data), err
+		}
+		if len(devices) == 0 {
+			return "No paired devices", nil
+		}
+		connected := s.ConnectedDevice()
+
+		var b strings.Builder
+		tw := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "DEVICE\tPOLICY\tADDRESS\tPAIRED\tEXPIRES\t")
+		for _, d := range devices {
+			id := d.DeviceID
+			if id == connected {
+				id += " (connected)"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t\n", id, d.Policy, d.RemoteAddr, d.PairedAt, d.PairExpiresAt)
+		}
+		tw.Flush()
+		return strings.TrimRight(b.String(), "\n"), nil
+
+	case "revoke":
+		if len(args) != 2 {
+			return "", errors.New("usage: devices revoke <device-id>")
+		}
+		if !s.RevokeDevice(args[1]) {
+			return "", fmt.Errorf("unknown device %q", args[1])
+		}
+		return "Revoked " + args[1], nil
+
+	case "policy":
+		if len(args) != 3 {
+			return "", errors.New("usage: devices policy <device-id> <policy>")
+		}
+		if err := s.SetDevicePolicy(args[1], args[2]); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s now has the %s policy", args[1], args[2]), nil
+	}
+	return "", fmt.Errorf("unknown devices command %q (list, revoke or policy)", sub)
+}
+
+func tokensCommand(tokens *server.TokenStore, args []string, flags map[string]string) (string, error) {
+	sub := "list"
+	if len(args) > 0 {
+		sub = args[0]
+	}
+	switch sub {
+	case "list":
+		if err := checkFlags(flags, "json"); err != nil {
+			return "", err
+		}
+		infos := tokens.List()
+		if flags["json"] != "" {
+			data, err := json.MarshalIndent(infos, "", "  ")
+			return string(data), err
+		}
+		if len(infos) == 0 {
+			return "No API tokens", nil
+		}
+		var b strings.Builder
+		tw := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tSCOPES\tCREATED\tEXPIRES\tLAST USED\t")
+		for _, t := range infos {
+			scopes := make([]string, len(t.Scopes))
+			for i, sc := range t.Scopes {
+				scopes[i] = string(sc)
+			}
+			expires := t.ExpiresAt
+			if expires == "" {
+				expires = "never"
+			} else if t.Expired {
+				expires += " (expired)"
+			}
+			lastUsed := t.LastUsedAt
+			if lastUsed == "" {
+				lastUsed = "never"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t\n", t.Name, strings.Join(scopes, ","), t.CreatedAt, expires, lastUsed)
+		}
+		tw.Flush()
+		return strings.TrimRight(b.String(), "\n"), nil
+
+	case "create":
+		if err := checkFlags(flags, "scopes", "expires"); err != nil {
+			return "", err
+		}
+		if len(args) != 2 || flags["scopes"] == "" {
+			return "", errors.New("usage: tokens create <name> --scopes <scopes> [--expires <ttl>]")
+		}
+		scopes, err := server.ParseScopes(flags["scopes"])
+		if err != nil {
+			return "", err
+		}
+		ttl, err := server.ParseTokenTTL(flags["expires"])
+		if err != nil {
+			return "", err
+		}
+		secret, info, err := tokens.Create(args[1], scopes, ttl)
+		if err != nil {
+			return "", err
+		}
+		log.Printf("API token %q created with scopes %v", info.Name, info.Scopes)
+		return secret, nil // alone, so scripts can capture it
+
+	case "revoke":
+		if len(args) != 2 {
+			return "", errors.New("usage: tokens revoke <name>")
+		}
+		if err := tokens.Revoke(args[1]); err != nil {
+			return "", err
+		}
+		log.Printf("API token %q revoked", args[1])
+		return "Revoked " + args[1], nil
+	}
+	return "", fmt.Errorf("unknown tokens command %q (list, create or revoke)", sub)
+}
+
+// typeCommand types text on this computer, optionally running it through
+// the AI first. Unlike text from the phone, nothing is submitted with Enter.
+func typeCommand(s *server.Server, text string, mode ai.Mode) (string, error) {
+	if text == "" {
+		return "", errors.New("usage: type [--mode <mode>] <text>")
+	}
+	typed, err := s.Type(text, mode)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Typed %d characters", len([]rune(typed))), nil
+}
+
+// runConfigCommand reads or changes gtalk_config.json. With a running
+// server, settings that can change at runtime are applied right away.
+func runConfigCommand(s *server.Server, args []string) (string, error) {
+	if len(args) == 0 {
+		return "", errors.New("usage: config get [key] | config set <key> <value>")
+	}
+	cfg := config.Load(configPath())
+	switch args[0] {
+	case "get":
+		cfg = config.Masked(cfg)
+		if len(args) == 1 {
+			data, err := json.MarshalIndent(cfg, "", "  ")
+			return string(data), err
+		}
+		if !config.IsKey(args[1]) {
+			return "", fmt.Errorf("unknown setting %q (one of %s)", args[1], strings.Join(config.Keys(), ", "))
+		}
+		values, err := config.Values(cfg)
+		if err != nil {
+			return "", err
+		}
+		raw, ok := values[args[1]]
+		if !ok {
+			return "", nil // not set
+		}
+		var str string
+		if json.Unmarshal(raw, &str) == nil {
+			return str, nil
+		}
+		return string(raw), nil
+
+	case "set":
+		if len(args) != 3 {
+			return "", errors.New("usage: config set <key> <value>")
+		}
+		key, value := args[1], args[2]
+		if !config.IsKey(key) {
+			return "", fmt.Errorf("unknown setting %q (one of %s)", key, strings.Join(config.Keys(), ", "))
+		}
+		if key == "lanIp" {
+			if strings.EqualFold(value, "auto") {
+				value = ""
+			} else if value != "" {
+				ip, err := server.CheckLanIP(cfg, value)
+				if err != nil {
+					return "", fmt.Errorf("invalid lanIp: %w", err)
+				}
+				value = ip
+			}
+		}
+		if err := config.Set(&cfg, key, value); err != nil {
+			return "", err
+		}
+		if err := config.Save(configPath(), cfg); err != nil {
+			return "", err
+		}
+		if s != nil && s.ApplyConfig(key, cfg) {
+			return "Saved " + key, nil
+		}
+		if s != nil {
+			return fmt.Sprintf("Saved %s; restart %s to apply it", key, appName), nil
+		}
+		return "Saved " + key, nil
+	}
+	return "", fmt.Errorf("unknown config command %q (get or set)", args[0])
+}
+
+// printQRCode draws a QR code for link with half-height block characters,
+// two modules per character, black on white so it scans on dark terminals.
+func printQRCode(link string) {
+	q, err := qrcode.New(link, qrcode.Medium)
+	if err != nil {
+		fmt.Println(link)
+		return
+	}
+	bitmap := q.Bitmap()
+	for y := 0; y < len(bitmap); y += 2 {
+		var b strings.Builder
+		b.WriteString("\x1b[30;47m")
+		for x := range bitmap[y] {
+			top := bitmap[y][x]
+			bottom := y+1 < len(bitmap) && bitmap[y+1][x]
+			switch {
+			case top && bottom:
+				b.WriteString("█")
+			case top:
+				b.WriteString("▀")
+			case bottom:
+				b.WriteString("▄")
+			default:
+				b.WriteString(" ")
+			}
+		}
+		b.WriteString("\x1b[0m")
+		fmt.Println(b.String())
+	}
+	fmt.Println()
+	fmt.Println(link)
+	fmt.Println("The code pairs one phone and expires in 2 minutes.")
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gold16/ginkgo-talk/server"
+)
+
+func TestSplitFlags(t *testing.T) {
+	flags, rest := splitFlags([]string{"ci", "--scopes", "type,command", "--json", "--expires=90d", "--", "--not-a-flag"})
+	if flags["scopes"] != "type,command" || flags["json"] != "true" || flags["expires"] != "90d" || len(flags) != 3 {
+		t.Errorf("flags = %v", flags)
+	}
+	if strings.Join(rest, " ") != "ci --not-a-flag" {
+		t.Errorf("rest = %q", rest)
+	}
+	// A value flag at the end has no value to take.
+	if flags, _ := splitFlags([]string{"--mode"}); flags["mode"] != "true" {
+		t.Errorf("trailing --mode = %v", flags)
+	}
+
+	if err := checkFlags(map[string]string{"json": "true"}, "json"); err != nil {
+		t.Error(err)
+	}
+	if err := checkFlags(map[string]string{"jsn": "true"}, "json"); err == nil {
+		t.Error("unknown flag accepted")
+	}
+}
+
+func TestTokensCommand(t *testing.T) {
+	tokens, err := server.LoadTokenStore(filepath.Join(t.TempDir(), server.TokensFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	run := func(args ...string) (string, error) {
+		flags, rest := splitFlags(args)
+		return tokensCommand(tokens, rest, flags)
+	}
+
+	if out, err := run("list"); err != nil || out != "No API tokens" {
+		t.Errorf("empty list = %q, %v", out, err)
+	}
+	secret, err := run("create", "ci", "--scopes", "type", "--expires", "90d")
+	if err != nil || !strings.HasPrefix(secret, "gtk_") || strings.Contains(secret, "\n") {
+		t.Fatalf("create = %q, %v; want the token alone", secret, err)
+	}
+	for _, args := range [][]string{
+		{"create", "nope"},
+		{"create", "nope", "--scopes", "everything"},
+		{"create", "nope", "--scopes", "type", "--expires", "soon"},
+		{"list", "--verbose"},
+		{"revoke", "missing"},
+		{"rename"},
+	} {
+		if _, err := run(args...); err == nil {
+			t.Errorf("%v succeeded", args)
+		}
+	}
+	out, err := run("list")
+	if err != nil || !strings.Contains(out, "ci") || !strings.Contains(out, "never") {
+		t.Errorf("list = %q, %v", out, err)
+	}
+	if out, err := run("revoke", "ci"); err != nil || out != "Revoked ci" {
+		t.Errorf("revoke = %q, %v", out, err)
+	}
+}
+
+func TestRunControlCommand(t *testing.T) {
+	s := newTestServer(t)
+	for _, args := range [][]string{
+		{"bogus"},
+		{"status", "--verbose"},
+		{"type"},
+		{"devices", "revoke", "missing"},
+		{"devices", "policy", "missing"},
+		{"devices", "explode"},
+		{"config", "get", "notASetting"},
+		{"config", "set", "lanIp", "8.8.8.8"},
+	} {
+		if _, err := runControlCommand(s, args); err == nil {
+			t.Errorf("%v succeeded", args)
+		}
+	}
+
+	out, err := runControlCommand(s, []string{"status"})
+	if err != nil || !strings.Contains(out, "Pair mode: code") || !strings.Contains(out, "AI:        disabled") {
+		t.Errorf("status = %q, %v", out, err)
+	}
+	if out, err := runControlCommand(s, []string{"status", "--json"}); err != nil || !strings.HasPrefix(out, "{") {
+		t.Errorf("status --json = %q, %v", out, err)
+	}
+	if out, err := runControlCommand(s, []string{"devices"}); err != nil || out != "No paired devices" {
+		t.Errorf("devices = %q, %v", out, err)
+	}
+	if out, err := runControlCommand(s, []string{"qr"}); err != nil || !strings.Contains(out, "#pair=") {
+		t.Errorf("qr = %q, %v", out, err)
+	}
+}
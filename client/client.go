@@ -0,0 +1,530 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// refreshBefore is how long before the access token runs out it is
+	// replaced.
+	refreshBefore = time.Minute
+
+	// pairPollInterval is how often a pairing that waits for approval on
+	// the desktop is checked.
+	pairPollInterval = time.Second
+)
+
+var (
+	// ErrNotPaired is returned when an operation needs a paired client.
+	ErrNotPaired = errors.New("not paired")
+	// ErrPairingDenied is returned when the desktop user rejects a pairing.
+	ErrPairingDenied = errors.New("pairing denied on the desktop")
+	// ErrPairingExpired is returned when a pairing request or session ran
+	// out; pair again.
+	ErrPairingExpired = errors.New("pairing expired")
+	// ErrWrongCode is returned when pairing with a pair code or link the
+	// server doesn't accept.
+	ErrWrongCode = errors.New("wrong pair code or expired pairing link")
+)
+
+// Error is an error reported by the server.
+type Error struct {
+	StatusCode int    // HTTP status, 0 for errors sent over the WebSocket
+	Code       string // machine-readable, e.g. "permission_denied"; may be empty
+	Permission string // the missing permission, for "permission_denied"
+	Message    string
+}
+
+func (e *Error) Error() string {
+	if e.StatusCode != 0 {
+		return fmt.Sprintf("ginkgo talk: %s (HTTP %d)", e.Message, e.StatusCode)
+	}
+	return "ginkgo talk: " + e.Message
+}
+
+// Options configure a Client. The zero value works for a server with a
+// publicly trusted certificate, without persisting credentials.
+type Options struct {
+	// DeviceID identifies this client to the server. By default it comes
+	// from saved credentials, or is generated.
+	DeviceID string
+	// DeviceName is shown on the desktop when a pairing waits for approval.
+	DeviceName string
+	// Store persists credentials. Saved credentials for the same server
+	// are loaded by New.
+	Store CredentialStore
+	// CAFingerprint is the SHA-256 fingerprint of the server's local CA, as
+	// shown on its QR page and in its startup log. Pairing checks the CA
+	// against it before trusting it.
+	CAFingerprint string
+	// TrustOnFirstUse pins whatever local CA the server presents while
+	// pairing, when no CAFingerprint is given. Only use it on a network
+	// you trust.
+	TrustOnFirstUse bool
+}
+
+// Client talks to one Ginkgo Talk server as a paired device.
+type Client struct {
+	base *url.URL
+	opts Options
+
+	mu    sync.Mutex
+	creds Credentials
+	http  *http.Client // trusts creds.CACert; replaced when it changes
+
+	refreshMu sync.Mutex // held while refreshing; refresh tokens are single-use
+}
+
+// New creates a client for the server at serverURL, e.g.
+// "https://192.168.1.20:9527". A pairing link such as the one printed by
+// `ginkgo-talk qr` works too; pass it to PairWithLink as well.
+func New(serverURL string, opts Options) (*Client, error) {
+	base, err := url.Parse(serverURL)
+	if err != nil {
+		return nil, fmt.Errorf("server URL: %w", err)
+	}
+	if base.Scheme != "https" && base.Scheme != "http" {
+		return nil, fmt.Errorf("server URL %q must start with https://", serverURL)
+	}
+	base.Fragment, base.RawQuery = "", ""
+	base.Path = strings.TrimRight(base.Path, "/")
+
+	c := &Client{base: base, opts: opts}
+	if opts.Store != nil {
+		creds, err := opts.Store.Load()
+		if err != nil && !errors.Is(err, ErrNoCredentials) {
+			return nil, err
+		}
+		if err == nil && creds.ServerURL == base.String() {
+			c.creds = creds
+		}
+	}
+	c.creds.ServerURL = base.String()
+	switch {
+	case opts.DeviceID != "":
+		c.creds.DeviceID = opts.DeviceID
+	case c.creds.DeviceID == "":
+		buf := make([]byte, 16)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, err
+		}
+		c.creds.DeviceID = hex.EncodeToString(buf)
+	}
+	c.http = newHTTPClient(c.creds.CACert)
+	return c, nil
+}
+
+// Credentials returns a copy of the current credentials.
+func (c *Client) Credentials() Credentials {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.creds
+}
+
+// Paired reports whether the client holds a pairing that hasn't expired.
+func (c *Client) Paired() bool {
+	return c.Credentials().Paired()
+}
+
+// PairWithCode pairs using the 4-digit code shown on the desktop. The code
+// feeds a SPAKE2 key exchange, like on the phone, so it is never sent and
+// the connection's frames are end-to-end encrypted afterwards. If the
+// server also wants the pairing approved, PairWithCode waits for that
+// until ctx is done. Servers that pair by approval alone take an empty
+// code; those pairings aren't end-to-end encrypted.
+func (c *Client) PairWithCode(ctx context.Context, code string) error {
+	code = strings.TrimSpace(code)
+	if code == "" {
+		return c.pairWithApproval(ctx)
+	}
+	return c.pairWithSecret(ctx, "code", code)
+}
+
+// PairWithLink pairs using a one-time pairing link from the QR code, of
+// the form https://host:port/#pair=<nonce>.
+func (c *Client) PairWithLink(ctx context.Context, link string) error {
+	u, err := url.Parse(link)
+	if err != nil {
+		return fmt.Errorf("pairing link: %w", err)
+	}
+	fragment, _ := url.ParseQuery(u.Fragment)
+	nonce := fragment.Get("pair")
+	if nonce == "" {
+		return errors.New("pairing link has no #pair= part")
+	}
+	return c.pairWithSecret(ctx, "nonce", nonce)
+}
+
+// pairWithSecret runs SPAKE2 with the pair code or QR nonce.
+func (c *Client) pairWithSecret(ctx context.Context, method, secret string) error {
+	if err := c.trustServer(ctx); err != nil {
+		return err
+	}
+	creds := c.Credentials()
+	exchange, err := newPakeExchange(creds.DeviceID, secret)
+	if err != nil {
+		return err
+	}
+	body := map[string]string{"deviceId": creds.DeviceID, "method": method, "share": exchange.share()}
+	if c.opts.DeviceName != "" {
+		body["deviceName"] = c.opts.DeviceName
+	}
+	var step struct {
+		Session string `json:"session"`
+		Share   string `json:"share"`
+		Confirm string `json:"confirm"`
+	}
+	if err := c.post(ctx, "/api/pair/pake", "", body, &step); err != nil {
+		return err
+	}
+	key, confirm, err := exchange.finish(step.Share, step.Confirm)
+	if err != nil {
+		return err
+	}
+
+	var resp pairResponse
+	err = c.post(ctx, "/api/pair/pake/confirm", "", map[string]string{
+		"session": step.Session,
+		"confirm": hex.EncodeToString(confirm),
+	}, &resp)
+	var apiErr *Error
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusForbidden {
+		return ErrWrongCode
+	} else if err != nil {
+		return err
+	}
+	return c.finishPairing(ctx, resp, key)
+}
+
+// pairWithApproval asks the desktop user to approve the pairing.
+func (c *Client) pairWithApproval(ctx context.Context) error {
+	if err := c.trustServer(ctx); err != nil {
+		return err
+	}
+	body := map[string]string{"deviceId": c.Credentials().DeviceID}
+	if c.opts.DeviceName != "" {
+		body["deviceName"] = c.opts.DeviceName
+	}
+	var resp pairResponse
+	if err := c.post(ctx, "/api/pair", "", body, &resp); err != nil {
+		return err
+	}
+	return c.finishPairing(ctx, resp, nil)
+}
+
+// finishPairing waits for a pending pairing to be approved and saves the
+// credentials with the end-to-end key, if any.
+func (c *Client) finishPairing(ctx context.Context, resp pairResponse, e2eKey []byte) error {
+	for resp.Status == "pending" {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(pairPollInterval):
+		}
+		ticket := resp.Ticket
+		resp = pairResponse{}
+		if err := c.post(ctx, "/api/pair/wait", "", map[string]string{"ticket": ticket}, &resp); err != nil {
+			return err
+		}
+		resp.Ticket = ticket
+	}
+	switch resp.Status {
+	case "denied":
+		return ErrPairingDenied
+	case "expired":
+		return ErrPairingExpired
+	}
+	c.mu.Lock()
+	c.creds.E2EKey = e2eKey
+	c.mu.Unlock()
+	return c.saveTokens(resp.tokens)
+}
+
+// pairResponse covers /api/pair, /api/pair/wait and /api/token/refresh.
+type pairResponse struct {
+	Status string `json:"status"` // "pending", "approved", "denied" or "expired"; "" when paired directly
+	Ticket string `json:"ticket"`
+	tokens
+}
+
+type tokens struct {
+	AccessToken     string `json:"accessToken"`
+	AccessExpiresAt string `json:"accessExpiresAt"`
+	RefreshToken    string `json:"refreshToken"`
+	PairExpiresAt   string `json:"pairExpiresAt"`
+}
+
+func (c *Client) saveTokens(t tokens) error {
+	if t.AccessToken == "" || t.RefreshToken == "" {
+		return errors.New("server returned no credentials")
+	}
+	accessExpires, err := time.Parse(time.RFC3339, t.AccessExpiresAt)
+	if err != nil {
+		return fmt.Errorf("accessExpiresAt: %w", err)
+	}
+	pairExpires, err := time.Parse(time.RFC3339, t.PairExpiresAt)
+	if err != nil {
+		return fmt.Errorf("pairExpiresAt: %w", err)
+	}
+
+	c.mu.Lock()
+	c.creds.AccessToken = t.AccessToken
+	c.creds.AccessExpiresAt = accessExpires
+	c.creds.RefreshToken = t.RefreshToken
+	c.creds.PairExpiresAt = pairExpires
+	creds := c.creds
+	c.mu.Unlock()
+
+	if c.opts.Store != nil {
+		return c.opts.Store.Save(creds)
+	}
+	return nil
+}
+
+// accessToken returns a valid access token, refreshing it first if it is
+// about to run out.
+func (c *Client) accessToken(ctx context.Context) (string, error) {
+	creds := c.Credentials()
+	if !creds.Paired() {
+		return "", ErrNotPaired
+	}
+	if time.Until(creds.AccessExpiresAt) > refreshBefore {
+		return creds.AccessToken, nil
+	}
+
+	// Another caller may have refreshed while this one waited; its new
+	// refresh token replaced the one read above.
+	c.refreshMu.Lock()
+	defer c.refreshMu.Unlock()
+	creds = c.Credentials()
+	if !creds.Paired() {
+		return "", ErrNotPaired
+	}
+	if time.Until(creds.AccessExpiresAt) > refreshBefore {
+		return creds.AccessToken, nil
+	}
+
+	var resp pairResponse
+	err := c.post(ctx, "/api/token/refresh", "", map[string]string{"refreshToken": creds.RefreshToken}, &resp)
+	var apiErr *Error
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusUnauthorized {
+		return "", ErrPairingExpired
+	} else if err != nil {
+		return "", err
+	}
+	if err := c.saveTokens(resp.tokens); err != nil {
+		return "", err
+	}
+	return resp.AccessToken, nil
+}
+
+// trustServer pins the server's local CA before pairing, unless the server
+// has a certificate the system already trusts.
+func (c *Client) trustServer(ctx context.Context) error {
+	if c.base.Scheme != "https" || len(c.Credentials().CACert) > 0 {
+		return nil
+	}
+	probe, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url("/api/pair"), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(probe)
+	if err == nil {
+		resp.Body.Close()
+		return nil
+	}
+	var unknownCA x509.UnknownAuthorityError
+	if !errors.As(err, &unknownCA) {
+		return err
+	}
+
+	// The certificate comes from the server's own CA. Fetch it without
+	// verification, then check it against the fingerprint.
+	insecure := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url("/ca.crt"), nil)
+	if err != nil {
+		return err
+	}
+	resp, err = insecure.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	der, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetch CA certificate: HTTP %d", resp.StatusCode)
+	}
+	if _, err := x509.ParseCertificate(der); err != nil {
+		return fmt.Errorf("CA certificate: %w", err)
+	}
+
+	sum := sha256.Sum256(der)
+	got := hex.EncodeToString(sum[:])
+	switch want := normalizeFingerprint(c.opts.CAFingerprint); {
+	case want != "" && want != got:
+		return fmt.Errorf("server CA fingerprint %s doesn't match %s", formatFingerprint(sum[:]), c.opts.CAFingerprint)
+	case want == "" && !c.opts.TrustOnFirstUse:
+		return fmt.Errorf("server uses a local CA with fingerprint %s; set Options.CAFingerprint after checking it on the QR page", formatFingerprint(sum[:]))
+	}
+
+	c.mu.Lock()
+	c.creds.CACert = der
+	old := c.http
+	c.http = newHTTPClient(der)
+	c.mu.Unlock()
+	old.CloseIdleConnections()
+	return nil
+}
+
+func normalizeFingerprint(fp string) string {
+	return strings.ToLower(strings.NewReplacer(":", "", " ", "").Replace(fp))
+}
+
+func formatFingerprint(sum []byte) string {
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
+
+// tlsConfig trusts the pinned CA, or the system roots if there is none.
+func (c *Client) tlsConfig() *tls.Config {
+	return caTLSConfig(c.Credentials().CACert)
+}
+
+// caTLSConfig trusts the CA certificate der, or the system roots if it is
+// empty.
+func caTLSConfig(der []byte) *tls.Config {
+	if len(der) == 0 {
+		return nil
+	}
+	pool := x509.NewCertPool()
+	if cert, err := x509.ParseCertificate(der); err == nil {
+		pool.AddCert(cert)
+	}
+	return &tls.Config{RootCAs: pool}
+}
+
+// httpClient returns the client's shared HTTP client, so requests reuse
+// connections.
+func (c *Client) httpClient() *http.Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.http
+}
+
+func newHTTPClient(caCert []byte) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: caTLSConfig(caCert),
+	}}
+}
+
+func (c *Client) url(path string) string {
+	return c.base.String() + path
+}
+
+// post sends body as JSON and decodes the answer into out. token, if set,
+// is sent as a bearer token.
+func (c *Client) post(ctx context.Context, path, token string, body, out interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	return c.do(ctx, http.MethodPost, path, token, bytes.NewReader(data), out)
+}
+
+func (c *Client) do(ctx context.Context, method, path, token string, body io.Reader, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, c.url(path), body)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var e struct {
+			Error      string `json:"error"`
+			Code       string `json:"code"`
+			Permission string `json:"permission"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		if e.Error == "" {
+			e.Error = http.StatusText(resp.StatusCode)
+		}
+		return &Error{StatusCode: resp.StatusCode, Code: e.Code, Permission: e.Permission, Message: e.Error}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Status is the server's view of this client, from /api/status.
+type Status struct {
+	ServerName    string   `json:"serverName"`
+	ServerAddr    string   `json:"serverAddr"`
+	Connected     bool     `json:"connected"` // a phone or client holds the WebSocket
+	AIAvailable   bool     `json:"aiAvailable"`
+	PairExpiresAt string   `json:"pairExpiresAt"`
+	Policy        string   `json:"policy"`
+	Permissions   []string `json:"permissions"`
+	Scripts       []Script `json:"scripts"` // if this device may run them
+	Actions       []Action `json:"actions"` // the desktop actions this device may run
+}
+
+// Script is a command defined by a script on the desktop.
+type Script struct {
+	Name  string `json:"name"`
+	Label string `json:"label"`
+}
+
+// Action is a desktop action: opening a URL, launching an app or running
+// a program, as set up in the server's config.
+type Action struct {
+	Name    string `json:"name"`
+	Label   string `json:"label"`
+	Kind    string `json:"kind"`    // "url", "launch" or "run"
+	Confirm bool   `json:"confirm"` // RunAction must be called with confirmed set
+}
+
+// Status asks the server for its status and this device's permissions.
+func (c *Client) Status(ctx context.Context) (Status, error) {
+	var st Status
+	token, err := c.accessToken(ctx)
+	if err != nil {
+		return st, err
+	}
+	err = c.do(ctx, http.MethodGet, "/api/status", token, nil, &st)
+	return st, err
+}
@@ -0,0 +1,187 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// refreshServer hands out single-use refresh tokens, as the server does.
+type refreshServer struct {
+	mu        sync.Mutex
+	current   string
+	refreshes int
+}
+
+func (rs *refreshServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		RefreshToken string `json:"refreshToken"`
+	}
+	json.NewDecoder(r.Body).Decode(&body)
+	time.Sleep(10 * time.Millisecond)
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if body.RefreshToken != rs.current {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid refresh token"})
+		return
+	}
+	rs.refreshes++
+	rs.current = fmt.Sprintf("refresh-%d", rs.refreshes)
+	json.NewEncoder(w).Encode(map[string]string{
+		"accessToken":     fmt.Sprintf("access-%d", rs.refreshes),
+		"accessExpiresAt": time.Now().Add(time.Hour).Format(time.RFC3339),
+		"refreshToken":    rs.current,
+		"pairExpiresAt":   time.Now().Add(24 * time.Hour).Format(time.RFC3339),
+	})
+}
+
+func TestAccessTokenRefreshesOnce(t *testing.T) {
+	rs := &refreshServer{current: "refresh-0"}
+	srv := httptest.NewServer(rs)
+	defer srv.Close()
+
+	c, err := New(srv.URL, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.creds.AccessToken = "access-0"
+	c.creds.AccessExpiresAt = time.Now()
+	c.creds.RefreshToken = "refresh-0"
+	c.creds.PairExpiresAt = time.Now().Add(24 * time.Hour)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			token, err := c.accessToken(context.Background())
+			if err == nil && token != "access-1" {
+				err = fmt.Errorf("got token %q, want access-1", token)
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if rs.refreshes != 1 {
+		t.Errorf("%d refreshes, want 1", rs.refreshes)
+	}
+	if c.Credentials().RefreshToken != "refresh-1" {
+		t.Errorf("refresh token %q, want refresh-1", c.Credentials().RefreshToken)
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	store := FileStore{Path: filepath.Join(t.TempDir(), "sub", "creds.json")}
+	if _, err := store.Load(); !errors.Is(err, ErrNoCredentials) {
+		t.Fatalf("missing file: error %v, want %v", err, ErrNoCredentials)
+	}
+	want := Credentials{
+		ServerURL:     "https://192.0.2.1:9527",
+		DeviceID:      "dev",
+		RefreshToken:  "refresh",
+		PairExpiresAt: time.Now().Add(time.Hour).UTC().Truncate(time.Second),
+		E2EKey:        []byte("0123456789abcdef0123456789abcdef"),
+	}
+	if err := store.Save(want); err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.DeviceID != want.DeviceID || got.RefreshToken != want.RefreshToken ||
+		!got.PairExpiresAt.Equal(want.PairExpiresAt) || string(got.E2EKey) != string(want.E2EKey) {
+		t.Errorf("Load = %+v, want %+v", got, want)
+	}
+	if runtime.GOOS != "windows" {
+		info, err := os.Stat(store.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != 0600 {
+			t.Errorf("file mode %v, want 0600", info.Mode().Perm())
+		}
+	}
+}
+
+func TestNewLoadsCredentialsForSameServer(t *testing.T) {
+	store := FileStore{Path: filepath.Join(t.TempDir(), "creds.json")}
+	saved := Credentials{
+		ServerURL:     "https://192.0.2.1:9527",
+		DeviceID:      "saved-device",
+		RefreshToken:  "refresh",
+		PairExpiresAt: time.Now().Add(time.Hour),
+	}
+	if err := store.Save(saved); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := New("https://192.0.2.1:9527/", Options{Store: store})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.Paired() || c.Credentials().DeviceID != "saved-device" {
+		t.Errorf("same server: %+v, want the saved credentials", c.Credentials())
+	}
+
+	other, err := New("https://192.0.2.2:9527", Options{Store: store})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.Paired() || other.Credentials().DeviceID == "saved-device" {
+		t.Errorf("other server: %+v, want fresh credentials", other.Credentials())
+	}
+
+	if _, err := New("ftp://192.0.2.1", Options{}); err == nil {
+		t.Error("ftp URL accepted")
+	}
+}
+
+func TestAccessTokenPairingExpired(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid refresh token"})
+	}))
+	defer srv.Close()
+
+	c, err := New(srv.URL, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.accessToken(context.Background()); !errors.Is(err, ErrNotPaired) {
+		t.Errorf("unpaired: error %v, want %v", err, ErrNotPaired)
+	}
+	c.creds.RefreshToken = "revoked"
+	c.creds.PairExpiresAt = time.Now().Add(time.Hour)
+	if _, err := c.accessToken(context.Background()); !errors.Is(err, ErrPairingExpired) {
+		t.Errorf("revoked: error %v, want %v", err, ErrPairingExpired)
+	}
+}
+
+func TestPairWithLinkNeedsNonce(t *testing.T) {
+	c, err := New("https://192.0.2.1:9527", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.PairWithLink(context.Background(), "https://192.0.2.1:9527/"); err == nil {
+		t.Error("link without #pair= accepted")
+	}
+}
@@ -0,0 +1,395 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Mode is how typed text is processed first.
+type Mode string
+
+const (
+	ModeRaw       Mode = "raw"       // typed as is
+	ModeTidy      Mode = "tidy"      // AI fixes punctuation and filler words
+	ModeFormal    Mode = "formal"    // AI rewrites it formally
+	ModeTranslate Mode = "translate" // AI translates between Chinese and English
+)
+
+// Commands accepted by Command.
+const (
+	CommandClear      = "clear" // select all and delete
+	CommandEnter      = "enter"
+	CommandShiftEnter = "shift_enter"
+	CommandUndo       = "ctrl_z"
+	CommandPaste      = "ctrl_v"
+	CommandTab        = "tab"
+	CommandEscape     = "escape"
+)
+
+var knownCommands = map[string]bool{
+	CommandClear: true, CommandEnter: true, CommandShiftEnter: true,
+	CommandUndo: true, CommandPaste: true, CommandTab: true, CommandEscape: true,
+}
+
+// Event types the server pushes.
+const (
+	EventAIConfigChanged = "ai_config_changed"
+	EventPairExpiring    = "pair_expiring"
+	EventDeviceConnected = "device_connected" // another device took over the connection
+	EventBackendError    = "backend_error"
+	EventShutdown        = "server_shutdown"
+)
+
+// eventQueueSize is how many events may wait unread before new ones are dropped.
+const eventQueueSize = 32
+
+// ErrClosed is returned by a Conn whose WebSocket has closed.
+var ErrClosed = errors.New("connection closed")
+
+// Event is something that happened on the server.
+type Event struct {
+	ID   uint64
+	Type string
+	Time time.Time
+	Data json.RawMessage // depends on Type; see the server's README
+}
+
+// Result is what the server typed.
+type Result struct {
+	Text     string // the text typed, after AI processing and the server's filters
+	Original string
+	Mode     Mode
+	Status   string // "sent", or "preview" from Preview
+}
+
+// ActionResult is what a desktop action did.
+type ActionResult struct {
+	Name      string `json:"name"`
+	Status    string `json:"status"`   // "opened", "launched" or "finished"
+	ExitCode  *int   `json:"exitCode"` // for run actions
+	Output    string `json:"output"`   // for run actions: the start of stdout and stderr
+	Truncated bool   `json:"truncated"`
+}
+
+// message is any message from the server.
+type message struct {
+	Type       string          `json:"type"`
+	Text       string          `json:"text"`
+	Original   string          `json:"original"`
+	Mode       Mode            `json:"mode"`
+	Status     string          `json:"status"`
+	Error      string          `json:"error"`
+	Code       string          `json:"code"`
+	Permission string          `json:"permission"`
+	E2E        bool            `json:"e2e"`
+	Conn       string          `json:"conn"`
+	ID         uint64          `json:"id"`
+	Event      string          `json:"event"`
+	Time       string          `json:"time"`
+	Data       json.RawMessage `json:"data"`
+}
+
+// Conn is an open WebSocket to the server. The server answers requests in
+// order, so a Conn runs one request at a time.
+type Conn struct {
+	ws *websocket.Conn
+
+	e2e *e2eSession // nil unless paired through SPAKE2
+
+	reqMu   sync.Mutex // held for a whole request
+	writeMu sync.Mutex // also orders sealed frames
+	replies chan message
+	events  chan Event
+
+	done      chan struct{}
+	closeOnce sync.Once
+	err       error // why the connection ended, set before done is closed
+}
+
+// Connect opens the WebSocket. Only one device can hold the server's
+// connection at a time; connecting takes it over from the phone.
+func (c *Client) Connect(ctx context.Context) (*Conn, error) {
+	token, err := c.accessToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	wsURL := *c.base
+	wsURL.Scheme = "wss"
+	if c.base.Scheme == "http" {
+		wsURL.Scheme = "ws"
+	}
+	wsURL.Path += "/ws"
+
+	dialer := websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		TLSClientConfig:  c.tlsConfig(),
+		HandshakeTimeout: 10 * time.Second,
+	}
+	ws, resp, err := dialer.DialContext(ctx, wsURL.String(), http.Header{"Authorization": {"Bearer " + token}})
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusUnauthorized {
+			return nil, ErrNotPaired
+		}
+		return nil, err
+	}
+
+	var hello message
+	if deadline, ok := ctx.Deadline(); ok {
+		ws.SetReadDeadline(deadline)
+	}
+	if err := ws.ReadJSON(&hello); err != nil {
+		ws.Close()
+		return nil, fmt.Errorf("read hello: %w", err)
+	}
+	ws.SetReadDeadline(time.Time{})
+	key := c.Credentials().E2EKey
+	if hello.Type != "hello" || hello.E2E != (len(key) > 0) {
+		// The server encrypts exactly when the device was paired through
+		// SPAKE2; anything else means the pairing is out of date.
+		ws.Close()
+		return nil, errors.New("server and client disagree on end-to-end encryption; pair again")
+	}
+
+	conn := &Conn{
+		ws:      ws,
+		replies: make(chan message, 1),
+		events:  make(chan Event, eventQueueSize),
+		done:    make(chan struct{}),
+	}
+	if len(key) > 0 {
+		if conn.e2e, err = newE2ESession(key, hello.Conn); err != nil {
+			ws.Close()
+			return nil, err
+		}
+	}
+	go conn.readLoop()
+	return conn, nil
+}
+
+// Events delivers the server's events. It is closed when the connection
+// ends. Events that arrive while eventQueueSize are waiting are dropped.
+func (cn *Conn) Events() <-chan Event {
+	return cn.events
+}
+
+// Done is closed when the connection ends; Err then says why.
+func (cn *Conn) Done() <-chan struct{} {
+	return cn.done
+}
+
+// Err returns why the connection ended, or nil while it is open.
+func (cn *Conn) Err() error {
+	select {
+	case <-cn.done:
+		return cn.err
+	default:
+		return nil
+	}
+}
+
+// Close closes the connection.
+func (cn *Conn) Close() error {
+	cn.writeMu.Lock()
+	cn.ws.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	cn.writeMu.Unlock()
+	cn.finish(ErrClosed)
+	return nil
+}
+
+func (cn *Conn) finish(err error) {
+	cn.closeOnce.Do(func() {
+		cn.err = err
+		cn.ws.Close()
+		close(cn.done)
+	})
+}
+
+func (cn *Conn) readLoop() {
+	defer close(cn.events)
+	for {
+		_, raw, err := cn.ws.ReadMessage()
+		if err != nil {
+			var closeErr *websocket.CloseError
+			if errors.As(err, &closeErr) {
+				err = fmt.Errorf("%w: %s", ErrClosed, closeErr.Text)
+			}
+			cn.finish(err)
+			return
+		}
+		if cn.e2e != nil {
+			if raw, err = cn.e2e.open(raw); err != nil {
+				cn.finish(err)
+				return
+			}
+		}
+		var msg message
+		if err := json.Unmarshal(raw, &msg); err != nil {
+			cn.finish(err)
+			return
+		}
+		switch msg.Type {
+		case "event":
+			ev := Event{ID: msg.ID, Type: msg.Event, Data: msg.Data}
+			ev.Time, _ = time.Parse(time.RFC3339, msg.Time)
+			select {
+			case cn.events <- ev:
+			default:
+			}
+		case "processing", "hello":
+			// progress only
+		default:
+			select {
+			case cn.replies <- msg:
+			default: // nobody is waiting
+			}
+		}
+	}
+}
+
+// Type types text on the desktop and presses Enter, like sending from the
+// phone. With an AI mode the text is processed first and the result typed.
+func (cn *Conn) Type(ctx context.Context, text string, mode Mode) (Result, error) {
+	if mode == "" {
+		mode = ModeRaw
+	}
+	cn.reqMu.Lock()
+	defer cn.reqMu.Unlock()
+
+	res := Result{Text: text, Original: text, Mode: mode}
+	if mode != ModeRaw {
+		preview, err := cn.request(ctx, map[string]string{"type": "text", "text": text, "mode": string(mode)}, "ai_preview", "ack")
+		if err != nil {
+			return res, err
+		}
+		if preview.Type == "ack" {
+			// AI is off on the server, which typed the text as is.
+			res.Text, res.Mode, res.Status = preview.Text, ModeRaw, preview.Status
+			return res, nil
+		}
+		res.Text = preview.Text
+	}
+	// Confirming keeps the AI mode, for the server's filters for that mode;
+	// the preview has been through them, so it is typed as is.
+	msg := map[string]interface{}{"type": "text", "text": res.Text, "mode": string(ModeRaw)}
+	if mode != ModeRaw {
+		msg["mode"], msg["confirmed"] = string(mode), true
+	}
+	ack, err := cn.request(ctx, msg, "ack")
+	if err != nil {
+		return res, err
+	}
+	res.Text, res.Status = ack.Text, ack.Status
+	return res, nil
+}
+
+// Preview runs text through an AI mode and returns the result without
+// typing anything. Check Status.AIAvailable first: a server without AI
+// types the text as is, and Preview then returns an error.
+func (cn *Conn) Preview(ctx context.Context, text string, mode Mode) (Result, error) {
+	if mode == "" || mode == ModeRaw {
+		return Result{}, errors.New("preview needs an AI mode")
+	}
+	cn.reqMu.Lock()
+	defer cn.reqMu.Unlock()
+
+	preview, err := cn.request(ctx, map[string]string{"type": "text", "text": text, "mode": string(mode)}, "ai_preview", "ack")
+	if err != nil {
+		return Result{}, err
+	}
+	if preview.Type == "ack" {
+		return Result{}, &Error{Message: "AI is not available on the server, so the text was typed as is"}
+	}
+	return Result{Text: preview.Text, Original: text, Mode: mode, Status: "preview"}, nil
+}
+
+// Command presses one of the phone's command keys, such as CommandEnter.
+func (cn *Conn) Command(ctx context.Context, name string) error {
+	if !knownCommands[name] {
+		return fmt.Errorf("unknown command %q", name)
+	}
+	cn.reqMu.Lock()
+	defer cn.reqMu.Unlock()
+
+	_, err := cn.request(ctx, map[string]string{"type": "command", "text": name}, "ack")
+	return err
+}
+
+// RunScript runs a script command, one of Status.Scripts, and returns once
+// it has finished.
+func (cn *Conn) RunScript(ctx context.Context, name string) error {
+	cn.reqMu.Lock()
+	defer cn.reqMu.Unlock()
+
+	_, err := cn.request(ctx, map[string]string{"type": "script", "text": name}, "ack")
+	return err
+}
+
+// RunAction runs a desktop action, one of Status.Actions. Set confirmed for
+// actions that need confirming, once the user has; otherwise the server
+// refuses them with code "confirmation_required". Run actions return once
+// the program has exited.
+func (cn *Conn) RunAction(ctx context.Context, name string, confirmed bool) (ActionResult, error) {
+	cn.reqMu.Lock()
+	defer cn.reqMu.Unlock()
+
+	reply, err := cn.request(ctx, map[string]interface{}{"type": "action", "text": name, "confirmed": confirmed}, "action_result")
+	if err != nil {
+		return ActionResult{}, err
+	}
+	var res ActionResult
+	err = json.Unmarshal(reply.Data, &res)
+	return res, err
+}
+
+// request sends v and waits for a reply of one of the wanted types. If ctx ends first,
+// the connection is closed: a late reply could otherwise be taken as the
+// answer to the next request.
+func (cn *Conn) request(ctx context.Context, v interface{}, want ...string) (message, error) {
+	cn.writeMu.Lock()
+	err := cn.write(v)
+	cn.writeMu.Unlock()
+	if err != nil {
+		cn.finish(err)
+		return message{}, err
+	}
+
+	select {
+	case msg := <-cn.replies:
+		for _, w := range want {
+			if msg.Type == w {
+				return msg, nil
+			}
+		}
+		if msg.Error == "" {
+			msg.Error = "unexpected " + msg.Type + " reply"
+		}
+		return message{}, &Error{Code: msg.Code, Permission: msg.Permission, Message: msg.Error}
+	case <-cn.done:
+		return message{}, cn.err
+	case <-ctx.Done():
+		cn.finish(ctx.Err())
+		return message{}, ctx.Err()
+	}
+}
+
+// write sends v, sealed if the connection is encrypted. The caller holds
+// writeMu.
+func (cn *Conn) write(v interface{}) error {
+	cn.ws.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if cn.e2e == nil {
+		return cn.ws.WriteJSON(v)
+	}
+	env, err := cn.e2e.seal(v)
+	if err != nil {
+		return err
+	}
+	return cn.ws.WriteJSON(env)
+}
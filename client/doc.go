@@ -0,0 +1,29 @@
+// Package client drives a Ginkgo Talk server from Go, the way the phone
+// app does: it pairs as a device, keeps the credentials fresh and types
+// text or presses keys over the server's WebSocket.
+//
+//	c, err := client.New("https://192.168.1.20:9527", client.Options{
+//		DeviceName:    "build-bot",
+//		Store:         client.FileStore{Path: "gtalk-client.json"},
+//		CAFingerprint: "AB:CD:...", // from the QR page
+//	})
+//	if err != nil { ... }
+//	if !c.Paired() {
+//		if err := c.PairWithCode(ctx, "1234"); err != nil { ... }
+//	}
+//	conn, err := c.Connect(ctx)
+//	if err != nil { ... }
+//	defer conn.Close()
+//	res, err := conn.Type(ctx, "deploy finished", client.ModeTidy)
+//	go func() {
+//		for ev := range conn.Events() { ... }
+//	}()
+//
+// Only one device holds the server's WebSocket at a time, so connecting
+// takes it over from the phone. For one-off requests without that, use an
+// API token with the server's /api/type and /api/command endpoints.
+//
+// Pairing with a code or link runs SPAKE2 like the phone, so the
+// WebSocket frames are end-to-end encrypted as well; still pin the
+// server's CA with Options.CAFingerprint.
+package client
@@ -0,0 +1,98 @@
+package client
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Clients paired through SPAKE2 wrap every WebSocket frame in an envelope
+// encrypted with the key from the exchange, as server/e2e.go expects. The
+// additional data binds a frame to its direction, the connection ID from
+// the server's hello and a sequence number.
+
+// envelope is an encrypted WebSocket frame.
+type envelope struct {
+	Type string `json:"type"` // always "enc"
+	Seq  uint64 `json:"seq"`
+	IV   string `json:"iv"`
+	Data string `json:"data"`
+}
+
+var errPlaintextFrame = errors.New("server sent an unencrypted frame")
+
+// e2eSession encrypts one connection's frames.
+type e2eSession struct {
+	aead    cipher.AEAD
+	connID  string
+	sendSeq uint64
+	recvSeq uint64
+}
+
+func newE2ESession(key []byte, connID string) (*e2eSession, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &e2eSession{aead: aead, connID: connID}, nil
+}
+
+// seal encrypts v as the next frame to the server. Frames must be sent in
+// the order they are sealed.
+func (s *e2eSession) seal(v interface{}) (envelope, error) {
+	plaintext, err := json.Marshal(v)
+	if err != nil {
+		return envelope{}, err
+	}
+	s.sendSeq++
+	iv := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(iv); err != nil {
+		return envelope{}, err
+	}
+	return envelope{
+		Type: "enc",
+		Seq:  s.sendSeq,
+		IV:   base64.StdEncoding.EncodeToString(iv),
+		Data: base64.StdEncoding.EncodeToString(s.aead.Seal(nil, iv, plaintext, s.additionalData("c2s", s.sendSeq))),
+	}, nil
+}
+
+// open decrypts a frame from the server, which must come after the last one.
+func (s *e2eSession) open(raw []byte) ([]byte, error) {
+	var env envelope
+	if err := json.Unmarshal(raw, &env); err != nil {
+		return nil, err
+	}
+	if env.Type != "enc" {
+		return nil, errPlaintextFrame
+	}
+	if env.Seq <= s.recvSeq {
+		return nil, fmt.Errorf("replayed frame (seq %d)", env.Seq)
+	}
+	iv, err := base64.StdEncoding.DecodeString(env.IV)
+	if err != nil || len(iv) != s.aead.NonceSize() {
+		return nil, errors.New("invalid iv")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(env.Data)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := s.aead.Open(nil, iv, sealed, s.additionalData("s2c", env.Seq))
+	if err != nil {
+		return nil, fmt.Errorf("decrypt frame: %w", err)
+	}
+	s.recvSeq = env.Seq
+	return plaintext, nil
+}
+
+func (s *e2eSession) additionalData(dir string, seq uint64) []byte {
+	return []byte(fmt.Sprintf("gtalk-e2e|%s|%s|%d", dir, s.connID, seq))
+}
@@ -0,0 +1,148 @@
+package client
+
+import (
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"math/big"
+)
+
+// Client half of the server's SPAKE2 pairing, like web/pake.js for the
+// phone: the pair code or QR nonce is the password, and the exchange
+// yields the key for end-to-end encrypted WebSocket frames. The group,
+// the M and N points and the transcript must match server/pake.go.
+
+const (
+	pakeGroupSize = 256 // bytes per encoded group element
+	pakeServerID  = "ginkgo-talk"
+)
+
+const rfc3526Group14 = "FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD1" +
+	"29024E088A67CC74020BBEA63B139B22514A08798E3404DD" +
+	"EF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245" +
+	"E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7ED" +
+	"EE386BFB5A899FA5AE9F24117C4B1FE649286651ECE45B3D" +
+	"C2007CB8A163BF0598DA48361C55D39A69163FA8FD24CF5F" +
+	"83655D23DCA3AD961C62F356208552BB9ED529077096966D" +
+	"670C354E4ABC9804F1746C08CA18217C32905E462E36CE3B" +
+	"E39E772C180E86039B2783A2EC07A28FB5C55DF06F4C52C9" +
+	"DE2BCBF6955817183995497CEA956AE515D2261898FA0510" +
+	"15728E5A8AACAA68FFFFFFFFFFFFFFFF"
+
+var pakeP, pakeQ, pakeG, pakeM, pakeN *big.Int
+
+var errPakeBadShare = errors.New("server sent an invalid key share")
+
+func init() {
+	pakeP, _ = new(big.Int).SetString(rfc3526Group14, 16)
+	pakeQ = new(big.Int).Rsh(new(big.Int).Sub(pakeP, big.NewInt(1)), 1)
+	pakeG = big.NewInt(2)
+	pakeM = pakeHashToGroup("gtalk-spake2-M")
+	pakeN = pakeHashToGroup("gtalk-spake2-N")
+}
+
+func pakeHashToGroup(label string) *big.Int {
+	var buf []byte
+	for i := byte(0); len(buf) < pakeGroupSize+32; i++ {
+		h := sha256.Sum256(append([]byte(label), i))
+		buf = append(buf, h[:]...)
+	}
+	x := new(big.Int).SetBytes(buf)
+	x.Mod(x, pakeP)
+	return x.Exp(x, big.NewInt(2), pakeP)
+}
+
+func pakePassword(deviceID, secret string) *big.Int {
+	h := sha256.Sum256([]byte("gtalk-spake2-w\x00" + deviceID + "\x00" + secret))
+	return new(big.Int).SetBytes(h[:])
+}
+
+// pakeExchange is one SPAKE2 run from the client's side.
+type pakeExchange struct {
+	deviceID string
+	w, x, X  *big.Int
+}
+
+func newPakeExchange(deviceID, secret string) (*pakeExchange, error) {
+	xBytes := make([]byte, 32)
+	if _, err := rand.Read(xBytes); err != nil {
+		return nil, err
+	}
+	e := &pakeExchange{deviceID: deviceID, w: pakePassword(deviceID, secret), x: new(big.Int).SetBytes(xBytes)}
+	if e.x.Sign() == 0 {
+		e.x.SetInt64(1)
+	}
+	// X = g^x * M^w
+	e.X = new(big.Int).Exp(pakeG, e.x, pakeP)
+	e.X.Mul(e.X, new(big.Int).Exp(pakeM, e.w, pakeP)).Mod(e.X, pakeP)
+	return e, nil
+}
+
+// share is the client's key share as sent to the server.
+func (e *pakeExchange) share() string {
+	return hex.EncodeToString(e.X.FillBytes(make([]byte, pakeGroupSize)))
+}
+
+// finish takes the server's share and key confirmation. It returns the
+// end-to-end key and the client's confirmation, or ErrWrongCode if the
+// server used a different secret.
+func (e *pakeExchange) finish(shareHex, confirmHex string) (key, confirm []byte, err error) {
+	b, err := hex.DecodeString(shareHex)
+	if err != nil || len(b) != pakeGroupSize {
+		return nil, nil, errPakeBadShare
+	}
+	Y := new(big.Int).SetBytes(b)
+	if Y.Cmp(big.NewInt(1)) <= 0 || Y.Cmp(new(big.Int).Sub(pakeP, big.NewInt(1))) >= 0 ||
+		new(big.Int).Exp(Y, pakeQ, pakeP).Cmp(big.NewInt(1)) != 0 {
+		return nil, nil, errPakeBadShare
+	}
+	serverConfirm, err := hex.DecodeString(confirmHex)
+	if err != nil {
+		return nil, nil, errPakeBadShare
+	}
+
+	// K = (Y / N^w)^x
+	nw := new(big.Int).Exp(pakeN, e.w, pakeP)
+	K := new(big.Int).Mul(Y, new(big.Int).ModInverse(nw, pakeP))
+	K.Mod(K, pakeP).Exp(K, e.x, pakeP)
+
+	var tt []byte
+	appendField := func(b []byte) {
+		tt = binary.LittleEndian.AppendUint64(tt, uint64(len(b)))
+		tt = append(tt, b...)
+	}
+	appendField([]byte(e.deviceID))
+	appendField([]byte(pakeServerID))
+	appendField(e.X.FillBytes(make([]byte, pakeGroupSize)))
+	appendField(Y.FillBytes(make([]byte, pakeGroupSize)))
+	appendField(K.FillBytes(make([]byte, pakeGroupSize)))
+	appendField(e.w.FillBytes(make([]byte, 32)))
+	hash := sha256.Sum256(tt)
+
+	kcB, err := hkdf.Key(sha256.New, hash[:], nil, "gtalk confirm server", 32)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !hmac.Equal(serverConfirm, pakeMAC(kcB, hash[:])) {
+		return nil, nil, ErrWrongCode
+	}
+	kcA, err := hkdf.Key(sha256.New, hash[:], nil, "gtalk confirm client", 32)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err = hkdf.Key(sha256.New, hash[:], nil, "gtalk e2e key", 32)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, pakeMAC(kcA, hash[:]), nil
+}
+
+func pakeMAC(key, msg []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(msg)
+	return mac.Sum(nil)
+}
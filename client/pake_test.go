@@ -0,0 +1,183 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gold16/ginkgo-talk/config"
+	"github.com/gold16/ginkgo-talk/server"
+)
+
+// recordingInput remembers what was typed instead of typing it.
+type recordingInput struct {
+	mu    sync.Mutex
+	typed []string
+}
+
+func (in *recordingInput) TypeText(text string) error {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.typed = append(in.typed, text)
+	return nil
+}
+
+func (in *recordingInput) text() []string {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return append([]string(nil), in.typed...)
+}
+
+func (*recordingInput) SelectAllAndDelete() error { return nil }
+func (*recordingInput) PressEnter() error         { return nil }
+func (*recordingInput) PressShiftEnter() error    { return nil }
+func (*recordingInput) PressCtrlZ() error         { return nil }
+func (*recordingInput) PressCtrlV() error         { return nil }
+func (*recordingInput) PressTab() error           { return nil }
+func (*recordingInput) PressEscape() error        { return nil }
+func (*recordingInput) ReleaseModifiers() error   { return nil }
+
+// startServer runs a server on a free loopback port and returns its URL.
+func startServer(t *testing.T, in *recordingInput) (*server.Server, string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	off := false
+	s := server.New(server.Options{
+		Config:  config.Config{Port: port, Bind: []string{"127.0.0.1"}, MDNS: &off},
+		DataDir: t.TempDir(),
+		Input:   in,
+		Version: "test",
+	})
+	done := make(chan error, 1)
+	go func() { done <- s.Start() }()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		s.Shutdown(ctx)
+		<-done
+	})
+
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+		select {
+		case err := <-done:
+			t.Fatalf("Start: %v", err)
+		default:
+		}
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("server didn't start listening")
+		}
+	}
+	return s, "https://" + addr
+}
+
+func TestPairWithCodeEncryptsFrames(t *testing.T) {
+	in := &recordingInput{}
+	s, url := startServer(t, in)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	c, err := New(url, Options{DeviceName: "test", TrustOnFirstUse: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := s.PairCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrong := "0000"
+	if code == wrong {
+		wrong = "1111"
+	}
+	if err := c.PairWithCode(ctx, wrong); !errors.Is(err, ErrWrongCode) {
+		t.Fatalf("wrong code: error %v, want %v", err, ErrWrongCode)
+	}
+	if c.Paired() {
+		t.Fatal("paired with the wrong code")
+	}
+
+	if code, err = s.PairCode(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.PairWithCode(ctx, code); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Credentials().E2EKey) != 32 {
+		t.Fatal("no end-to-end key saved")
+	}
+
+	conn, err := c.Connect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Type(ctx, "hello", ModeRaw); err != nil {
+		t.Fatal(err)
+	}
+	if typed := in.text(); len(typed) != 1 || typed[0] != "hello" {
+		t.Errorf("typed %q, want hello", typed)
+	}
+
+	// The server drops frames sealed with a key it doesn't share.
+	c.mu.Lock()
+	c.creds.E2EKey = make([]byte, 32)
+	c.mu.Unlock()
+	conn.Close()
+	bad, err := c.Connect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bad.Close()
+	short, cancelShort := context.WithTimeout(ctx, time.Second)
+	defer cancelShort()
+	if _, err := bad.Type(short, "tampered", ModeRaw); err == nil {
+		t.Error("typing with the wrong key succeeded")
+	}
+	if typed := in.text(); len(typed) != 1 {
+		t.Errorf("typed %q with the wrong key", typed)
+	}
+}
+
+func TestPairWithLink(t *testing.T) {
+	s, url := startServer(t, &recordingInput{})
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	link, err := s.PairLink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := New(url, Options{TrustOnFirstUse: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.PairWithLink(ctx, link); err != nil {
+		t.Fatal(err)
+	}
+	if !c.Paired() || len(c.Credentials().E2EKey) != 32 {
+		t.Fatal("not paired with an end-to-end key")
+	}
+
+	// The link works once.
+	again, err := New(url, Options{TrustOnFirstUse: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := again.PairWithLink(ctx, link); err == nil {
+		t.Error("pairing link redeemed twice")
+	}
+}
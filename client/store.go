@@ -0,0 +1,77 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ErrNoCredentials is returned by a CredentialStore that has nothing saved.
+var ErrNoCredentials = errors.New("no saved credentials")
+
+// Credentials are what a client needs to reconnect without pairing again.
+// They are as sensitive as the pair code: anyone holding them can type on
+// the desktop until the pairing expires.
+type Credentials struct {
+	ServerURL       string    `json:"serverUrl"`
+	DeviceID        string    `json:"deviceId"`
+	AccessToken     string    `json:"accessToken,omitempty"`
+	AccessExpiresAt time.Time `json:"accessExpiresAt,omitempty"`
+	RefreshToken    string    `json:"refreshToken,omitempty"`
+	PairExpiresAt   time.Time `json:"pairExpiresAt,omitempty"`
+	// CACert is the server's local CA in DER form, pinned while pairing.
+	// It is empty for servers with a publicly trusted certificate.
+	CACert []byte `json:"caCert,omitempty"`
+	// E2EKey encrypts the WebSocket frames of clients paired through
+	// SPAKE2, with a pair code or link.
+	E2EKey []byte `json:"e2eKey,omitempty"`
+}
+
+// Paired reports whether the credentials are still good for connecting.
+func (c Credentials) Paired() bool {
+	return c.RefreshToken != "" && time.Now().Before(c.PairExpiresAt)
+}
+
+// CredentialStore persists Credentials between runs. The client saves them
+// after pairing and after every token refresh.
+type CredentialStore interface {
+	Load() (Credentials, error)
+	Save(Credentials) error
+}
+
+// FileStore keeps credentials in a JSON file readable only by the owner.
+type FileStore struct {
+	Path string
+}
+
+// Load reads the credentials, or returns ErrNoCredentials if the file
+// doesn't exist.
+func (f FileStore) Load() (Credentials, error) {
+	var creds Credentials
+	data, err := os.ReadFile(f.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return creds, ErrNoCredentials
+	} else if err != nil {
+		return creds, err
+	}
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return creds, fmt.Errorf("parse %s: %w", f.Path, err)
+	}
+	return creds, nil
+}
+
+// Save writes the credentials, creating the file's directory if needed.
+func (f FileStore) Save(creds Credentials) error {
+	data, err := json.MarshalIndent(creds, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(f.Path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(f.Path, data, 0600)
+}
@@ -0,0 +1,267 @@
+// Package config reads and writes Ginkgo Talk's settings file,
+// gtalk_config.json.
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// FileName is the config file's usual name; the ginkgo-talk binary keeps it
+// next to the executable.
+const FileName = "gtalk_config.json"
+
+// Config represents the persistent application configuration.
+type Config struct {
+	APIKey  string `json:"apiKey,omitempty"`
+	BaseURL string `json:"baseUrl,omitempty"`
+	Model   string `json:"model,omitempty"`
+	LanIP   string `json:"lanIp,omitempty"`
+
+	// Name is shown on phones that know several computers (default: the hostname).
+	Name string `json:"name,omitempty"`
+
+	// PairMode is "code" (default), "approve" or "code+approve".
+	PairMode string `json:"pairMode,omitempty"`
+
+	// Policies defines permission sets for paired devices, in addition to
+	// the built-in "full" and "guest". DevicePolicies maps device IDs to a
+	// policy; DefaultPolicy applies to the rest (default "full").
+	Policies       map[string][]string `json:"policies,omitempty"`
+	DevicePolicies map[string]string   `json:"devicePolicies,omitempty"`
+	DefaultPolicy  string              `json:"defaultPolicy,omitempty"`
+
+	// PingInterval and PongTimeout, in seconds, control how quickly a phone
+	// that dropped off the network is noticed (defaults 20 and 45).
+	PingInterval int `json:"pingInterval,omitempty"`
+	PongTimeout  int `json:"pongTimeout,omitempty"`
+	// IdleTimeout is how many seconds without messages count as idle (default 120).
+	IdleTimeout int `json:"idleTimeout,omitempty"`
+	// MaxMessageSize caps a single message from the phone, in bytes (default 65536).
+	MaxMessageSize int64 `json:"maxMessageSize,omitempty"`
+
+	// Port is the HTTPS port (default 9527).
+	Port int `json:"port,omitempty"`
+	// Bind lists interface names or IP addresses to listen on; empty means all.
+	Bind []string `json:"bind,omitempty"`
+	// MDNS advertises the server as gtalk-<hostname>.local (default true).
+	MDNS *bool `json:"mdns,omitempty"`
+	// TLSCertFile and TLSKeyFile replace the local CA with your own certificate.
+	TLSCertFile string `json:"tlsCertFile,omitempty"`
+	TLSKeyFile  string `json:"tlsKeyFile,omitempty"`
+	// HTTPListen adds a plain-HTTP listener for a reverse proxy, either a
+	// loopback address like "127.0.0.1:9528" or "unix:/path/to/socket".
+	HTTPListen string `json:"httpListen,omitempty"`
+	// RedirectPort, if set, redirects plain HTTP on that port to HTTPS.
+	RedirectPort int `json:"redirectPort,omitempty"`
+	// BasePath serves the app under a URL prefix, e.g. "/gtalk".
+	BasePath string `json:"basePath,omitempty"`
+	// AllowedHosts lists extra host names the server answers to, such as a
+	// reverse proxy's public name. IP addresses and localhost always work.
+	AllowedHosts []string `json:"allowedHosts,omitempty"`
+
+	// Filters run, in order, on text just before it is typed.
+	Filters []Filter `json:"filters,omitempty"`
+
+	// Actions are the desktop actions the phone may trigger, by name.
+	// Nothing else can be opened, launched or run from the phone.
+	Actions []Action `json:"actions,omitempty"`
+
+	// ScriptTimeout stops a script command after this many seconds (default 30).
+	ScriptTimeout int `json:"scriptTimeout,omitempty"`
+
+	// Webhooks and MQTT receive the server's events, for home automation
+	// and logging.
+	Webhooks []Webhook `json:"webhooks,omitempty"`
+	MQTT     *MQTT     `json:"mqtt,omitempty"`
+}
+
+// Filter is an external command that rewrites text before it is typed,
+// such as a spell-checker or a redaction tool. It reads the text on stdin
+// and writes the result to stdout; GTALK_FILTER_META in its environment
+// holds JSON with the mode, source, device and target app.
+type Filter struct {
+	Name string `json:"name,omitempty"` // for the log (default: the program)
+	// Command is the program and its arguments. It is not run through a
+	// shell; use ["sh", "-c", "..."] for pipelines.
+	Command []string `json:"command"`
+	// Timeout is in seconds (default 5).
+	Timeout int `json:"timeout,omitempty"`
+	// Modes limits the filter to these modes; empty means all.
+	Modes []string `json:"modes,omitempty"`
+	// OnError is "pass" (default) to type the text as it was when the
+	// filter fails, or "block" to type nothing.
+	OnError string `json:"onError,omitempty"`
+}
+
+// Action is a named desktop action. Exactly one of URL, Launch and Run is set.
+type Action struct {
+	Name  string `json:"name"`
+	Label string `json:"label,omitempty"` // for the phone's button (default: the name)
+
+	// URL is opened in the default browser.
+	URL string `json:"url,omitempty"`
+	// Launch starts an application with fixed arguments, without waiting.
+	Launch []string `json:"launch,omitempty"`
+	// Run runs a program with fixed arguments and reports its exit code
+	// and output. Timeout is in seconds (default 30).
+	Run     []string `json:"run,omitempty"`
+	Timeout int      `json:"timeout,omitempty"`
+
+	// Confirm makes the phone ask before the action runs.
+	Confirm bool `json:"confirm,omitempty"`
+	// Permissions are needed on top of "action", e.g. ["devices"] for
+	// devices with full access only.
+	Permissions []string `json:"permissions,omitempty"`
+}
+
+// Webhook posts each event as JSON to a URL.
+type Webhook struct {
+	URL string `json:"url"`
+	// Secret signs each body with HMAC-SHA256, sent as
+	// X-Gtalk-Signature-256: sha256=<hex>.
+	Secret string `json:"secret,omitempty"`
+	// Events limits delivery to these event types; empty means all.
+	Events []string `json:"events,omitempty"`
+	// RedactText leaves the text out of text_typed and ai_processed events.
+	RedactText bool `json:"redactText,omitempty"`
+}
+
+// MQTT publishes each event to <topic>/<event type> on a broker.
+type MQTT struct {
+	// Broker is tcp://host:1883, or tls://host:8883 for TLS.
+	Broker   string `json:"broker"`
+	Topic    string `json:"topic,omitempty"` // default "ginkgo-talk"
+	ClientID string `json:"clientId,omitempty"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	// QoS is 0 (at most once) or 1 (at least once, the default).
+	QoS        *int     `json:"qos,omitempty"`
+	Events     []string `json:"events,omitempty"`
+	RedactText bool     `json:"redactText,omitempty"`
+}
+
+// Load reads the config from path. A missing or unreadable file gives the
+// empty config, which means defaults everywhere.
+func Load(path string) Config {
+	var cfg Config
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg // file doesn't exist yet, return empty
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		log.Printf("⚠️  Config file parse error: %v", err)
+		return Config{}
+	}
+	log.Printf("📁 Loaded config from %s", path)
+	return cfg
+}
+
+// Save writes the config to path, readable only by the owner.
+func Save(path string, cfg Config) error {
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return err
+	}
+	log.Printf("💾 Config saved to %s", path)
+	return nil
+}
+
+// Keys lists the JSON names of the Config fields.
+func Keys() []string {
+	t := reflect.TypeOf(Config{})
+	keys := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			keys = append(keys, name)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// IsKey reports whether key is one of Keys.
+func IsKey(key string) bool {
+	for _, k := range Keys() {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Values returns the settings that are set, keyed by their JSON names.
+func Values(cfg Config) (map[string]json.RawMessage, error) {
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+	var values map[string]json.RawMessage
+	err = json.Unmarshal(data, &values)
+	return values, err
+}
+
+// Set sets key to value, which is taken as JSON if it parses (numbers,
+// booleans, lists) and as a plain string otherwise.
+func Set(cfg *Config, key, value string) error {
+	values, err := Values(*cfg)
+	if err != nil {
+		return err
+	}
+	if json.Valid([]byte(value)) {
+		values[key] = json.RawMessage(value)
+	} else {
+		quoted, _ := json.Marshal(value)
+		values[key] = quoted
+	}
+	data, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	var updated Config
+	if err := json.Unmarshal(data, &updated); err != nil {
+		return fmt.Errorf("invalid value for %s: %w", key, err)
+	}
+	*cfg = updated
+	return nil
+}
+
+// Masked returns cfg with the API key, webhook secrets and MQTT password
+// masked, for showing to the user.
+func Masked(cfg Config) Config {
+	cfg.APIKey = MaskAPIKey(cfg.APIKey)
+	if cfg.Webhooks != nil {
+		webhooks := make([]Webhook, len(cfg.Webhooks))
+		for i, wh := range cfg.Webhooks {
+			wh.Secret = MaskAPIKey(wh.Secret)
+			webhooks[i] = wh
+		}
+		cfg.Webhooks = webhooks
+	}
+	if cfg.MQTT != nil {
+		mqtt := *cfg.MQTT
+		mqtt.Password = MaskAPIKey(mqtt.Password)
+		cfg.MQTT = &mqtt
+	}
+	return cfg
+}
+
+// MaskAPIKey keeps just enough of an API key to tell keys apart.
+func MaskAPIKey(k string) string {
+	if k == "" {
+		return ""
+	}
+	if len(k) > 8 {
+		return k[:4] + "****" + k[len(k)-4:]
+	}
+	return "****"
+}
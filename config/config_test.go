@@ -0,0 +1,96 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestSaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), FileName)
+	if cfg := Load(path); cfg.Port != 0 || cfg.APIKey != "" {
+		t.Errorf("missing file: %+v, want the empty config", cfg)
+	}
+	off := false
+	want := Config{APIKey: "sk-test", Port: 9600, MDNS: &off, Bind: []string{"eth0"}}
+	if err := Save(path, want); err != nil {
+		t.Fatal(err)
+	}
+	got := Load(path)
+	if got.APIKey != "sk-test" || got.Port != 9600 || got.MDNS == nil || *got.MDNS || len(got.Bind) != 1 {
+		t.Errorf("Load = %+v, want %+v", got, want)
+	}
+	if runtime.GOOS != "windows" {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != 0600 {
+			t.Errorf("file mode %v, want 0600", info.Mode().Perm())
+		}
+	}
+
+	if err := os.WriteFile(path, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if cfg := Load(path); cfg.APIKey != "" {
+		t.Errorf("corrupt file: %+v, want the empty config", cfg)
+	}
+}
+
+func TestSet(t *testing.T) {
+	var cfg Config
+	for key, value := range map[string]string{
+		"port":         "9600",
+		"mdns":         "false",
+		"bind":         `["eth0","192.168.1.20"]`,
+		"model":        "deepseek-reasoner",
+		"allowedHosts": `["talk.example.com"]`,
+	} {
+		if err := Set(&cfg, key, value); err != nil {
+			t.Fatalf("Set(%s, %s): %v", key, value, err)
+		}
+	}
+	if cfg.Port != 9600 || cfg.MDNS == nil || *cfg.MDNS || len(cfg.Bind) != 2 ||
+		cfg.Model != "deepseek-reasoner" || len(cfg.AllowedHosts) != 1 {
+		t.Errorf("after Set: %+v", cfg)
+	}
+
+	if err := Set(&cfg, "port", "not a number"); err == nil {
+		t.Error("port set to a string")
+	}
+	if cfg.Port != 9600 {
+		t.Errorf("failed Set changed the port to %d", cfg.Port)
+	}
+}
+
+func TestKeys(t *testing.T) {
+	for _, key := range []string{"apiKey", "lanIp", "port", "mqtt"} {
+		if !IsKey(key) {
+			t.Errorf("%s is not a key", key)
+		}
+	}
+	if IsKey("APIKey") || IsKey("") {
+		t.Error("Go field name or empty string taken as a key")
+	}
+}
+
+func TestMasked(t *testing.T) {
+	cfg := Config{
+		APIKey:   "sk-1234567890abcdef",
+		Webhooks: []Webhook{{URL: "https://hooks.example.com", Secret: "whsec-secret-value"}},
+		MQTT:     &MQTT{Broker: "tcp://broker:1883", Password: "short"},
+	}
+	masked := Masked(cfg)
+	if masked.APIKey != "sk-1****cdef" || masked.Webhooks[0].Secret != "whse****alue" || masked.MQTT.Password != "****" {
+		t.Errorf("Masked = %+v, webhook %+v, mqtt %+v", masked, masked.Webhooks[0], masked.MQTT)
+	}
+	// The original is untouched.
+	if cfg.Webhooks[0].Secret != "whsec-secret-value" || cfg.MQTT.Password != "short" {
+		t.Error("Masked changed its argument")
+	}
+	if MaskAPIKey("") != "" {
+		t.Error("empty key masked")
+	}
+}
@@ -0,0 +1,112 @@
+//go:build windows
+
+package input
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+var (
+	procOpenClipboard              = user32.NewProc("OpenClipboard")
+	procCloseClipboard             = user32.NewProc("CloseClipboard")
+	procEmptyClipboard             = user32.NewProc("EmptyClipboard")
+	procGetClipboardData           = user32.NewProc("GetClipboardData")
+	procSetClipboardData           = user32.NewProc("SetClipboardData")
+	procIsClipboardFormatAvailable = user32.NewProc("IsClipboardFormatAvailable")
+	procGlobalAlloc                = kernel32.NewProc("GlobalAlloc")
+	procGlobalFree                 = kernel32.NewProc("GlobalFree")
+	procGlobalLock                 = kernel32.NewProc("GlobalLock")
+	procGlobalUnlock               = kernel32.NewProc("GlobalUnlock")
+	procGlobalSize                 = kernel32.NewProc("GlobalSize")
+	procRtlMoveMemory              = kernel32.NewProc("RtlMoveMemory")
+)
+
+const (
+	cfUnicodeText = 13
+	gmemMoveable  = 0x0002
+)
+
+// openClipboard opens the clipboard for the calling thread, waiting a
+// little if another program has it open.
+func openClipboard() error {
+	var err error
+	for i := 0; i < 10; i++ {
+		r, _, callErr := procOpenClipboard.Call(0)
+		if r != 0 {
+			return nil
+		}
+		err = callErr
+		time.Sleep(20 * time.Millisecond)
+	}
+	return fmt.Errorf("open clipboard: %w", err)
+}
+
+// ClipboardText returns the clipboard's text, or "" if it holds none.
+func (SendInput) ClipboardText() (string, error) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if err := openClipboard(); err != nil {
+		return "", err
+	}
+	defer procCloseClipboard.Call()
+
+	if r, _, _ := procIsClipboardFormatAvailable.Call(cfUnicodeText); r == 0 {
+		return "", nil
+	}
+	h, _, err := procGetClipboardData.Call(cfUnicodeText)
+	if h == 0 {
+		return "", fmt.Errorf("read clipboard: %w", err)
+	}
+	size, _, _ := procGlobalSize.Call(h)
+	p, _, err := procGlobalLock.Call(h)
+	if p == 0 {
+		return "", fmt.Errorf("read clipboard: %w", err)
+	}
+	defer procGlobalUnlock.Call(h)
+	if size < 2 {
+		return "", nil
+	}
+	buf := make([]uint16, size/2)
+	procRtlMoveMemory.Call(uintptr(unsafe.Pointer(&buf[0])), p, size/2*2)
+	return syscall.UTF16ToString(buf), nil
+}
+
+// SetClipboardText replaces the clipboard's contents with text.
+func (SendInput) SetClipboardText(text string) error {
+	utf16, err := syscall.UTF16FromString(text)
+	if err != nil {
+		return err
+	}
+	size := uintptr(len(utf16) * 2)
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if err := openClipboard(); err != nil {
+		return err
+	}
+	defer procCloseClipboard.Call()
+
+	h, _, err := procGlobalAlloc.Call(gmemMoveable, size)
+	if h == 0 {
+		return fmt.Errorf("set clipboard: %w", err)
+	}
+	p, _, err := procGlobalLock.Call(h)
+	if p == 0 {
+		procGlobalFree.Call(h)
+		return fmt.Errorf("set clipboard: %w", err)
+	}
+	procRtlMoveMemory.Call(p, uintptr(unsafe.Pointer(&utf16[0])), size)
+	procGlobalUnlock.Call(h)
+
+	procEmptyClipboard.Call()
+	if r, _, err := procSetClipboardData.Call(cfUnicodeText, h); r == 0 {
+		// The clipboard only takes ownership of the memory on success.
+		procGlobalFree.Call(h)
+		return fmt.Errorf("set clipboard: %w", err)
+	}
+	return nil
+}
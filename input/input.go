@@ -0,0 +1,38 @@
+// Package input types text and presses keys on the desktop.
+package input
+
+import "errors"
+
+// ErrUnsupported is returned by the default backend on platforms without one.
+var ErrUnsupported = errors.New("typing is not supported on this platform")
+
+// Backend types into whichever window has the keyboard focus. Text may
+// contain newlines, which are typed as Shift+Enter.
+type Backend interface {
+	TypeText(text string) error
+	SelectAllAndDelete() error // Ctrl+A, then Delete
+	PressEnter() error
+	PressShiftEnter() error
+	PressCtrlZ() error
+	PressCtrlV() error
+	PressTab() error
+	PressEscape() error
+	// ReleaseModifiers lifts any Shift, Ctrl, Alt or Windows key still
+	// held, so stopping mid-shortcut doesn't leave one stuck.
+	ReleaseModifiers() error
+}
+
+// AppReporter is implemented by backends that can tell which application
+// will receive the typing.
+type AppReporter interface {
+	// ForegroundApp returns the focused application's name, such as
+	// "WINWORD.EXE".
+	ForegroundApp() (string, error)
+}
+
+// Clipboard is implemented by backends that can read and set the
+// clipboard's text.
+type Clipboard interface {
+	ClipboardText() (string, error)
+	SetClipboardText(text string) error
+}
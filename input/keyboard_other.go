@@ -0,0 +1,21 @@
+//go:build !windows
+
+package input
+
+// Default returns the platform's input backend. Only Windows has one so
+// far; elsewhere every call fails with ErrUnsupported.
+func Default() Backend {
+	return unsupported{}
+}
+
+type unsupported struct{}
+
+func (unsupported) TypeText(string) error     { return ErrUnsupported }
+func (unsupported) SelectAllAndDelete() error { return ErrUnsupported }
+func (unsupported) PressEnter() error         { return ErrUnsupported }
+func (unsupported) PressShiftEnter() error    { return ErrUnsupported }
+func (unsupported) PressCtrlZ() error         { return ErrUnsupported }
+func (unsupported) PressCtrlV() error         { return ErrUnsupported }
+func (unsupported) PressTab() error           { return ErrUnsupported }
+func (unsupported) PressEscape() error        { return ErrUnsupported }
+func (unsupported) ReleaseModifiers() error   { return nil }
@@ -1,4 +1,6 @@
-package main
+//go:build windows
+
+package input
 
 import (
 	"fmt"
@@ -9,8 +11,9 @@ import (
 )
 
 var (
-	user32        = syscall.NewLazyDLL("user32.dll")
-	procSendInput = user32.NewProc("SendInput")
+	user32               = syscall.NewLazyDLL("user32.dll")
+	procSendInput        = user32.NewProc("SendInput")
+	procGetAsyncKeyState = user32.NewProc("GetAsyncKeyState")
 )
 
 const (
@@ -26,6 +29,15 @@ const (
 	inputSize32 = 28
 )
 
+// SendInput types with the Win32 SendInput API, into whichever window has
+// the keyboard focus.
+type SendInput struct{}
+
+// Default returns the platform's input backend.
+func Default() Backend {
+	return SendInput{}
+}
+
 // inputSize returns the correct size of the INPUT struct for the current architecture.
 func inputSize() uintptr {
 	if unsafe.Sizeof(uintptr(0)) == 8 {
@@ -77,7 +89,7 @@ func makeKeyInput(wVk uint16, wScan uint16, dwFlags uint32) []byte {
 
 // TypeText simulates keyboard input for the given Unicode string.
 // It uses SendInput with KEYEVENTF_UNICODE to support any character including CJK.
-func TypeText(text string) error {
+func (SendInput) TypeText(text string) error {
 	runes := []rune(text)
 	if len(runes) == 0 {
 		return nil
@@ -158,7 +170,7 @@ func typeChunk(runes []rune, size uintptr) error {
 }
 
 // SelectAllAndDelete sends Ctrl+A then Delete to clear the focused input field.
-func SelectAllAndDelete() error {
+func (SendInput) SelectAllAndDelete() error {
 	size := inputSize()
 
 	// VK codes
@@ -197,12 +209,12 @@ func SelectAllAndDelete() error {
 }
 
 // PressEnter sends an Enter key press.
-func PressEnter() error {
+func (SendInput) PressEnter() error {
 	return pressKey(0x0D, false) // VK_RETURN
 }
 
 // PressShiftEnter sends Shift+Enter key press (new line in many editors).
-func PressShiftEnter() error {
+func (SendInput) PressShiftEnter() error {
 	size := inputSize()
 	const (
 		vkShift  = 0x10
@@ -265,21 +277,50 @@ func pressCtrlKey(vk uint16) error {
 }
 
 // PressCtrlZ sends Ctrl+Z (undo).
-func PressCtrlZ() error {
+func (SendInput) PressCtrlZ() error {
 	return pressCtrlKey(0x5A) // VK_Z
 }
 
 // PressCtrlV sends Ctrl+V (paste).
-func PressCtrlV() error {
+func (SendInput) PressCtrlV() error {
 	return pressCtrlKey(0x56) // VK_V
 }
 
 // PressTab sends a Tab key press.
-func PressTab() error {
+func (SendInput) PressTab() error {
 	return pressKey(0x09, false) // VK_TAB
 }
 
 // PressEscape sends an Escape key press.
-func PressEscape() error {
+func (SendInput) PressEscape() error {
 	return pressKey(0x1B, false) // VK_ESCAPE
 }
+
+// ReleaseModifiers sends key-up for any Shift, Ctrl, Alt or Windows key
+// that is still down, so quitting mid-shortcut doesn't leave one stuck.
+func (SendInput) ReleaseModifiers() error {
+	size := inputSize()
+	var inputs []byte
+	count := 0
+	for _, vk := range []uint16{0x10, 0x11, 0x12, 0x5B, 0x5C} { // VK_SHIFT, VK_CONTROL, VK_MENU, VK_LWIN, VK_RWIN
+		state, _, _ := procGetAsyncKeyState.Call(uintptr(vk))
+		if state&0x8000 == 0 {
+			continue
+		}
+		inputs = append(inputs, makeKeyInput(vk, 0, keyeventfKeyup)...)
+		count++
+	}
+	if count == 0 {
+		return nil
+	}
+
+	ret, _, err := procSendInput.Call(
+		uintptr(count),
+		uintptr(unsafe.Pointer(&inputs[0])),
+		size,
+	)
+	if ret == 0 {
+		return fmt.Errorf("SendInput (release modifiers) failed: %w", err)
+	}
+	return nil
+}
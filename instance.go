@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gold16/ginkgo-talk/server"
+)
+
+const (
+	lockFileName = "gtalk.lock"
+
+	// controlTimeout bounds one forwarded command, including typing.
+	controlTimeout = 30 * time.Second
+)
+
+var (
+	errAlreadyRunning = errors.New("Ginkgo Talk is already running")
+	errNotRunning     = errors.New("Ginkgo Talk is not running")
+)
+
+// instanceLock is the single-instance lock. The lock file names a loopback
+// control socket on which the running instance accepts commands from later
+// launches, and the token they must present.
+type instanceLock struct {
+	path     string
+	listener net.Listener
+	token    string
+}
+
+type lockInfo struct {
+	PID   int    `json:"pid"`
+	Addr  string `json:"addr"`
+	Token string `json:"token"`
+}
+
+// controlRequest is a command forwarded by a second launch.
+type controlRequest struct {
+	Token string   `json:"token"`
+	Args  []string `json:"args"`
+}
+
+type controlResponse struct {
+	OK     bool   `json:"ok"`
+	Output string `json:"output,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+func lockPath() string {
+	return filepath.Join(appDir(), lockFileName)
+}
+
+// acquireInstanceLock takes the lock, or returns errAlreadyRunning if
+// another instance holds it. A lock whose control socket doesn't answer was
+// left by a crash and is removed.
+func acquireInstanceLock() (*instanceLock, error) {
+	path := lockPath()
+	for attempt := 0; attempt < 3; attempt++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return nil, fmt.Errorf("control socket: %w", err)
+		}
+		token, err := newControlToken()
+		if err != nil {
+			ln.Close()
+			return nil, err
+		}
+		data, _ := json.Marshal(lockInfo{PID: os.Getpid(), Addr: ln.Addr().String(), Token: token})
+
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			_, err = f.Write(data)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				ln.Close()
+				os.Remove(path)
+				return nil, fmt.Errorf("write lock file: %w", err)
+			}
+			return &instanceLock{path: path, listener: ln, token: token}, nil
+		}
+		ln.Close()
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, fmt.Errorf("create lock file: %w", err)
+		}
+
+		info, err := readLock(path)
+		if err == nil && info.alive() {
+			return nil, errAlreadyRunning
+		}
+		if err != nil {
+			// The other instance may be between creating and writing the file.
+			time.Sleep(200 * time.Millisecond)
+			if info, err = readLock(path); err == nil && info.alive() {
+				return nil, errAlreadyRunning
+			}
+		}
+		log.Printf("Removing stale lock %s (pid %d)", path, info.PID)
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("remove stale lock: %w", err)
+		}
+	}
+	return nil, fmt.Errorf("could not take lock %s", path)
+}
+
+// newControlToken returns the random token later launches must present.
+func newControlToken() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func readLock(path string) (lockInfo, error) {
+	var info lockInfo
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return info, err
+	}
+	err = json.Unmarshal(data, &info)
+	return info, err
+}
+
+// alive reports whether the instance that wrote the lock still answers.
+func (info lockInfo) alive() bool {
+	conn, err := net.DialTimeout("tcp", info.Addr, time.Second)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// release closes the control socket and removes the lock file.
+func (l *instanceLock) release() {
+	l.listener.Close()
+	if info, err := readLock(l.path); err == nil && info.Token == l.token {
+		os.Remove(l.path)
+	}
+}
+
+// serve answers commands from later launches until the lock is released.
+func (l *instanceLock) serve(s *server.Server) {
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			return
+		}
+		go l.handle(s, conn)
+	}
+}
+
+func (l *instanceLock) handle(s *server.Server, conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(controlTimeout))
+
+	var req controlRequest
+	if err := json.NewDecoder(bufio.NewReader(conn)).Decode(&req); err != nil {
+		return // a liveness probe, or garbage
+	}
+	var resp controlResponse
+	if subtle.ConstantTimeCompare([]byte(req.Token), []byte(l.token)) != 1 {
+		resp.Error = "invalid control token"
+	} else if out, err := runControlCommand(s, req.Args); err != nil {
+		resp.Error = err.Error()
+	} else {
+		resp.OK, resp.Output = true, out
+	}
+	json.NewEncoder(conn).Encode(resp)
+}
+
+// forwardToInstance sends args to the running instance and returns its output.
+func forwardToInstance(args []string) (string, error) {
+	info, err := readLock(lockPath())
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", errNotRunning
+	} else if err != nil {
+		return "", fmt.Errorf("read lock file: %w", err)
+	}
+	conn, err := net.DialTimeout("tcp", info.Addr, time.Second)
+	if err != nil {
+		return "", errNotRunning // the lock is stale
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(controlTimeout))
+
+	if err := json.NewEncoder(conn).Encode(controlRequest{Token: info.Token, Args: args}); err != nil {
+		return "", err
+	}
+	var resp controlResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return "", fmt.Errorf("no answer from running instance: %w", err)
+	}
+	if !resp.OK {
+		return "", errors.New(resp.Error)
+	}
+	return resp.Output, nil
+}
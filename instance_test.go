@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/gold16/ginkgo-talk/config"
+	"github.com/gold16/ginkgo-talk/server"
+)
+
+// newTestServer returns a server that keeps its files in a temporary
+// directory and isn't started.
+func newTestServer(t *testing.T) *server.Server {
+	t.Helper()
+	off := false
+	return server.New(server.Options{
+		Config:  config.Config{MDNS: &off, Bind: []string{"127.0.0.1"}},
+		DataDir: t.TempDir(),
+		Version: "test",
+	})
+}
+
+func TestInstanceLock(t *testing.T) {
+	lock, err := acquireInstanceLock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.release()
+	s := newTestServer(t)
+	go lock.serve(s)
+
+	if _, err := acquireInstanceLock(); !errors.Is(err, errAlreadyRunning) {
+		t.Fatalf("second lock: error %v, want %v", err, errAlreadyRunning)
+	}
+
+	// Later launches forward their command to the running instance.
+	code, err := s.PairCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, err := forwardToInstance([]string{"pair-code"}); err != nil || out != code {
+		t.Errorf("pair-code = %q, %v; want %q", out, err, code)
+	}
+	if _, err := forwardToInstance([]string{"bogus"}); err == nil {
+		t.Error("unknown command forwarded without error")
+	}
+
+	// Only with the token from the lock file.
+	conn, err := net.Dial("tcp", lock.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	json.NewEncoder(conn).Encode(controlRequest{Token: "wrong", Args: []string{"pair-code"}})
+	var resp controlResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.OK || resp.Output != "" {
+		t.Errorf("wrong token: %+v", resp)
+	}
+
+	lock.release()
+	if _, err := os.Stat(lockPath()); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("lock file left behind: %v", err)
+	}
+	if _, err := forwardToInstance([]string{"pair-code"}); !errors.Is(err, errNotRunning) {
+		t.Errorf("after release: error %v, want %v", err, errNotRunning)
+	}
+}
+
+func TestStaleInstanceLock(t *testing.T) {
+	// A lock left by a crash names a control socket nobody listens on.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	data, _ := json.Marshal(lockInfo{PID: 1, Addr: addr, Token: "old"})
+	if err := os.WriteFile(lockPath(), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(lockPath())
+
+	if _, err := forwardToInstance([]string{"status"}); !errors.Is(err, errNotRunning) {
+		t.Errorf("forward to a stale lock: error %v, want %v", err, errNotRunning)
+	}
+	lock, err := acquireInstanceLock()
+	if err != nil {
+		t.Fatalf("stale lock not taken over: %v", err)
+	}
+	defer lock.release()
+	if info, err := readLock(lockPath()); err != nil || info.Token != lock.token {
+		t.Errorf("lock file = %+v, %v; want the new instance", info, err)
+	}
+}
@@ -1,27 +1,146 @@
 package main
 
 import (
+	"embed"
+	"errors"
 	"fmt"
+	"io/fs"
 	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gold16/ginkgo-talk/config"
+	"github.com/gold16/ginkgo-talk/server"
 )
 
 const (
-	defaultPort = ":9527"
-	appName     = "Ginkgo Talk"
-	appVersion  = "0.1.0"
+	appName    = "Ginkgo Talk"
+	appVersion = "0.1.0"
 )
 
+// shutdownTimeout bounds how long a stop waits for typing to finish and
+// connections to close.
+const shutdownTimeout = 10 * time.Second
+
+//go:embed web/*
+var webFS embed.FS
+
+// main exits with status 0 after a normal stop (Ctrl+C, SIGTERM or Quit in
+// the tray) and 1 when the server fails or can't shut down cleanly.
+//
+// Any argument other than "serve" is a subcommand for the running
+// instance; see cliUsage.
 func main() {
-	if err := runApp(); err != nil {
+	args := os.Args[1:]
+	if len(args) > 0 && args[0] != "serve" {
+		attachParentConsole()
+		if err := runCommand(args); err != nil {
+			log.Fatalf("%v", err)
+		}
+		return
+	}
+	serve(len(args) == 0)
+}
+
+// serve runs the server. Only one instance runs at a time: launching again
+// without arguments brings up the running instance's QR page instead.
+func serve(implicit bool) {
+	lock, err := acquireInstanceLock()
+	if errors.Is(err, errAlreadyRunning) {
+		if !implicit {
+			log.Fatalf("%v", err)
+		}
+		if _, err := forwardToInstance([]string{"show"}); err != nil {
+			log.Fatalf("%v", err)
+		}
+		return
+	}
+	if err != nil {
+		log.Printf("Single-instance lock unavailable, continuing without it: %v", err)
+	}
+
+	err = runApp(lock)
+	if lock != nil {
+		lock.release()
+	}
+	if err != nil {
 		log.Fatalf("Server failed: %v", err)
 	}
 }
 
-func printStartupInfo(server *Server) {
+// appDir returns the directory holding the config, certificates, API
+// tokens and lock file: the one the executable is in.
+func appDir() string {
+	exe, err := os.Executable()
+	if err != nil {
+		return "."
+	}
+	return filepath.Dir(exe)
+}
+
+func configPath() string {
+	return filepath.Join(appDir(), config.FileName)
+}
+
+// newServer creates the server from gtalk_config.json and the environment.
+func newServer() *server.Server {
+	web, err := fs.Sub(webFS, "web")
+	if err != nil {
+		log.Fatalf("web files: %v", err)
+	}
+	cfg := config.Load(configPath())
+	applyEnv(&cfg)
+	return server.New(server.Options{
+		Config:     cfg,
+		ConfigPath: configPath(),
+		DataDir:    appDir(),
+		Web:        web,
+		Version:    appVersion,
+	})
+}
+
+// applyEnv applies the environment variables that override settings.
+// The DEEPSEEK_* variables only fill in AI settings the config leaves out.
+func applyEnv(cfg *config.Config) {
+	if env := strings.TrimSpace(os.Getenv("GTALK_PAIR_MODE")); env != "" {
+		cfg.PairMode = env
+	}
+	if env := strings.TrimSpace(os.Getenv("GTALK_LAN_IP")); env != "" {
+		cfg.LanIP = env
+	}
+	if env := strings.TrimSpace(os.Getenv("GTALK_BIND")); env != "" {
+		cfg.Bind = strings.Split(env, ",")
+	}
+	if env := strings.TrimSpace(os.Getenv("GTALK_PORT")); env != "" {
+		port, err := strconv.Atoi(env)
+		if err != nil {
+			log.Printf("invalid GTALK_PORT: %s, ignoring", env)
+		} else {
+			cfg.Port = port
+		}
+	}
+	if cfg.APIKey == "" {
+		cfg.APIKey = os.Getenv("DEEPSEEK_API_KEY")
+	}
+	if cfg.BaseURL == "" {
+		cfg.BaseURL = os.Getenv("DEEPSEEK_BASE_URL")
+	}
+	if cfg.Model == "" {
+		cfg.Model = os.Getenv("DEEPSEEK_MODEL")
+	}
+}
+
+func printStartupInfo(srv *server.Server) {
 	fmt.Printf("%s v%s - AI mobile keyboard\n", appName, appVersion)
-	lanIP := server.LanIP()
+	lanIP := srv.LanIP()
 	log.Printf("Local IP: %s", lanIP)
-	log.Printf("URL: https://%s%s", lanIP, defaultPort)
-	log.Printf("Open https://%s%s/qrcode in browser to see QR code", lanIP, defaultPort)
+	log.Printf("URL: %s", srv.BaseURL())
+	for _, addr := range srv.Addresses() {
+		log.Printf("Address: %s (%s)", addr.URL, addr.Interface)
+	}
+	log.Printf("Open %s/qrcode in browser to see QR code", srv.BaseURL())
 	fmt.Println()
 }
@@ -0,0 +1,172 @@
+package script
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+// Thread-local keys for the running command's host and context.
+const (
+	hostKey    = "host"
+	contextKey = "context"
+)
+
+// builtins are the functions scripts can call besides command.
+func builtins() starlark.StringDict {
+	return starlark.StringDict{
+		"type":  starlark.NewBuiltin("type", builtinType),
+		"keys":  starlark.NewBuiltin("keys", builtinKeys),
+		"ai":    starlark.NewBuiltin("ai", builtinAI),
+		"app":   starlark.NewBuiltin("app", builtinApp),
+		"sleep": starlark.NewBuiltin("sleep", builtinSleep),
+		"clipboard": &starlarkstruct.Module{
+			Name: "clipboard",
+			Members: starlark.StringDict{
+				"get": starlark.NewBuiltin("clipboard.get", builtinClipboardGet),
+				"set": starlark.NewBuiltin("clipboard.set", builtinClipboardSet),
+			},
+		},
+	}
+}
+
+// hostFor returns the host of the command running on thread. The desktop
+// can only be used from commands, not while a script loads.
+func hostFor(thread *starlark.Thread, b *starlark.Builtin) (Host, error) {
+	host, ok := thread.Local(hostKey).(Host)
+	if !ok {
+		return nil, fmt.Errorf("%s: can only be called from a command", b.Name())
+	}
+	return host, nil
+}
+
+// type(text, submit=False) types text, then presses Enter if submit is true.
+func builtinType(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var text string
+	var submit bool
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "text", &text, "submit?", &submit); err != nil {
+		return nil, err
+	}
+	host, err := hostFor(thread, b)
+	if err != nil {
+		return nil, err
+	}
+	if err := host.Type(text, submit); err != nil {
+		return nil, fmt.Errorf("%s: %w", b.Name(), err)
+	}
+	return starlark.None, nil
+}
+
+// keys(name, ...) presses command keys in order, e.g. keys("ctrl_v", "enter").
+func builtinKeys(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if len(kwargs) > 0 {
+		return nil, fmt.Errorf("%s: unexpected keyword arguments", b.Name())
+	}
+	names := make([]string, len(args))
+	for i, arg := range args {
+		name, ok := starlark.AsString(arg)
+		if !ok {
+			return nil, fmt.Errorf("%s: got %s, want string", b.Name(), arg.Type())
+		}
+		names[i] = name
+	}
+	host, err := hostFor(thread, b)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		if err := host.Key(name); err != nil {
+			return nil, fmt.Errorf("%s: %w", b.Name(), err)
+		}
+	}
+	return starlark.None, nil
+}
+
+// ai(text, mode="tidy") returns text rewritten in an AI mode.
+func builtinAI(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var text string
+	mode := "tidy"
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "text", &text, "mode?", &mode); err != nil {
+		return nil, err
+	}
+	host, err := hostFor(thread, b)
+	if err != nil {
+		return nil, err
+	}
+	processed, err := host.AI(text, mode)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", b.Name(), err)
+	}
+	return starlark.String(processed), nil
+}
+
+// app() names the application with the keyboard focus, or returns "".
+func builtinApp(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 0); err != nil {
+		return nil, err
+	}
+	host, err := hostFor(thread, b)
+	if err != nil {
+		return nil, err
+	}
+	return starlark.String(host.App()), nil
+}
+
+// sleep(seconds) pauses the command; the time counts towards its limit.
+func builtinSleep(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var v starlark.Value
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &v); err != nil {
+		return nil, err
+	}
+	seconds, ok := starlark.AsFloat(v)
+	if !ok || seconds < 0 {
+		return nil, fmt.Errorf("%s: want a number of seconds, got %s", b.Name(), v)
+	}
+	ctx, ok := thread.Local(contextKey).(context.Context)
+	if !ok {
+		return nil, fmt.Errorf("%s: can only be called from a command", b.Name())
+	}
+	timer := time.NewTimer(time.Duration(seconds * float64(time.Second)))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return starlark.None, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("%s: %w", b.Name(), ctx.Err())
+	}
+}
+
+// clipboard.get() returns the clipboard's text.
+func builtinClipboardGet(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 0); err != nil {
+		return nil, err
+	}
+	host, err := hostFor(thread, b)
+	if err != nil {
+		return nil, err
+	}
+	text, err := host.Clipboard()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", b.Name(), err)
+	}
+	return starlark.String(text), nil
+}
+
+// clipboard.set(text) puts text on the clipboard.
+func builtinClipboardSet(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var text string
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &text); err != nil {
+		return nil, err
+	}
+	host, err := hostFor(thread, b)
+	if err != nil {
+		return nil, err
+	}
+	if err := host.SetClipboard(text); err != nil {
+		return nil, fmt.Errorf("%s: %w", b.Name(), err)
+	}
+	return starlark.None, nil
+}
@@ -0,0 +1,301 @@
+// Package script runs user scripts that add commands to Ginkgo Talk.
+//
+// Scripts are written in Starlark, a small dialect of Python, and kept as
+// .star files in one directory. Each file registers commands when it is
+// loaded:
+//
+//	def paste_and_send():
+//	    keys("ctrl_v", "enter")
+//
+//	command("paste_send", paste_and_send, label="Paste + Send")
+//
+// A command can call type, keys, ai, app, sleep, clipboard.get and
+// clipboard.set; see the README for what each does. Scripts can't read
+// files, open connections or run programs, and every run is stopped after
+// a time limit.
+package script
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+const (
+	// DirName is the scripts directory, next to the config file.
+	DirName = "scripts"
+	// Extension marks script files in the directory.
+	Extension = ".star"
+
+	// DefaultTimeout is how long a command may run.
+	DefaultTimeout = 30 * time.Second
+
+	// loadTimeout bounds running a file's top level, which should do little
+	// more than define commands.
+	loadTimeout = 5 * time.Second
+
+	// watchInterval is how often the directory is checked for changes.
+	watchInterval = 2 * time.Second
+)
+
+// ErrUnknownCommand is returned by Run for a command no script registered.
+var ErrUnknownCommand = errors.New("unknown script command")
+
+var commandNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+// fileOptions allows the Python features the scripts' time limit makes
+// safe: while loops, and if and for statements outside functions.
+var fileOptions = &syntax.FileOptions{Set: true, While: true, TopLevelControl: true, GlobalReassign: true}
+
+// Host is what commands act on. Its methods are called from the goroutine
+// running the command.
+type Host interface {
+	// Type types text, pressing Enter afterwards if submit is set.
+	Type(text string, submit bool) error
+	// Key presses one of the phone's command keys, such as "enter".
+	Key(name string) error
+	// AI rewrites text in an AI mode such as "tidy".
+	AI(text, mode string) (string, error)
+	Clipboard() (string, error)
+	SetClipboard(text string) error
+	// App names the application that has the keyboard focus, or "".
+	App() string
+}
+
+// Command is a command registered by a script.
+type Command struct {
+	Name  string `json:"name"`
+	Label string `json:"label"`
+	File  string `json:"file"`
+}
+
+type command struct {
+	Command
+	fn starlark.Callable
+}
+
+// Engine loads the scripts in a directory and runs their commands.
+type Engine struct {
+	dir     string
+	timeout time.Duration
+
+	mu       sync.RWMutex
+	commands []*command // in file order, then the order they were registered
+	stamp    string     // the files as last loaded, see scan
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// New returns an engine for the scripts in dir, stopping commands after
+// timeout (DefaultTimeout if zero). Call Load to read the scripts.
+func New(dir string, timeout time.Duration) *Engine {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	return &Engine{dir: dir, timeout: timeout, done: make(chan struct{})}
+}
+
+// Dir returns the scripts directory.
+func (e *Engine) Dir() string {
+	return e.dir
+}
+
+// Commands lists the registered commands.
+func (e *Engine) Commands() []Command {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	list := make([]Command, len(e.commands))
+	for i, c := range e.commands {
+		list[i] = c.Command
+	}
+	return list
+}
+
+// Load reads every script in the directory, replacing the commands loaded
+// before. A script that fails to load is logged and skipped; a missing
+// directory just means no commands.
+func (e *Engine) Load() {
+	stamp, files := e.scan()
+	var commands []*command
+	byName := make(map[string]*command)
+	for _, name := range files {
+		cmds, err := loadFile(filepath.Join(e.dir, name))
+		if err != nil {
+			log.Printf("Skipping script %s: %v", name, err)
+			continue
+		}
+		for _, c := range cmds {
+			if prev, ok := byName[c.Name]; ok {
+				log.Printf("Script %s: command %q is already defined in %s", name, c.Name, prev.File)
+				continue
+			}
+			byName[c.Name] = c
+			commands = append(commands, c)
+		}
+	}
+	if len(files) > 0 {
+		log.Printf("Loaded %d script command(s) from %s", len(commands), e.dir)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.commands = commands
+	e.stamp = stamp
+}
+
+// Watch reloads the scripts whenever a file in the directory changes, and
+// then calls changed, until Close.
+func (e *Engine) Watch(changed func()) {
+	go func() {
+		ticker := time.NewTicker(watchInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-e.done:
+				return
+			}
+			stamp, _ := e.scan()
+			e.mu.RLock()
+			same := stamp == e.stamp
+			e.mu.RUnlock()
+			if same {
+				continue
+			}
+			log.Printf("Scripts changed, reloading")
+			e.Load()
+			changed()
+		}
+	}()
+}
+
+// Close stops watching the directory.
+func (e *Engine) Close() {
+	e.closeOnce.Do(func() { close(e.done) })
+}
+
+// scan lists the script files, and describes them by name, size and
+// modification time so a change to any of them changes the stamp.
+func (e *Engine) scan() (string, []string) {
+	entries, err := os.ReadDir(e.dir)
+	if err != nil {
+		return "", nil
+	}
+	var b strings.Builder
+	var files []string
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != Extension {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, entry.Name())
+		fmt.Fprintf(&b, "%s:%d:%d;", entry.Name(), info.Size(), info.ModTime().UnixNano())
+	}
+	sort.Strings(files)
+	return b.String(), files
+}
+
+// Run runs the named command against host. It is stopped when ctx ends or
+// after the engine's time limit.
+func (e *Engine) Run(ctx context.Context, name string, host Host) error {
+	e.mu.RLock()
+	var cmd *command
+	for _, c := range e.commands {
+		if c.Name == name {
+			cmd = c
+		}
+	}
+	e.mu.RUnlock()
+	if cmd == nil {
+		return fmt.Errorf("%w %q", ErrUnknownCommand, name)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, e.timeout)
+	defer cancel()
+	thread := &starlark.Thread{Name: name, Print: printer(cmd.File)}
+	thread.SetLocal(hostKey, host)
+	thread.SetLocal(contextKey, ctx)
+	stop := context.AfterFunc(ctx, func() { thread.Cancel("time limit reached") })
+	defer stop()
+
+	_, err := starlark.Call(thread, cmd.fn, nil, nil)
+	if err == nil {
+		return nil
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%s: stopped after %s", name, e.timeout)
+	}
+	var evalErr *starlark.EvalError
+	if errors.As(err, &evalErr) {
+		log.Printf("Script command %s failed:\n%s", name, evalErr.Backtrace())
+		return fmt.Errorf("%s: %s", name, evalErr.Msg)
+	}
+	return fmt.Errorf("%s: %w", name, err)
+}
+
+// loadFile runs a script's top level and returns the commands it registered.
+func loadFile(path string) ([]*command, error) {
+	file := filepath.Base(path)
+	var commands []*command
+	register := func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var name, label string
+		var fn starlark.Callable
+		if err := starlark.UnpackArgs(b.Name(), args, kwargs, "name", &name, "fn", &fn, "label?", &label); err != nil {
+			return nil, err
+		}
+		if !commandNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("%s: invalid name %q: use lower-case letters, digits, - and _", b.Name(), name)
+		}
+		for _, c := range commands {
+			if c.Name == name {
+				return nil, fmt.Errorf("%s: %q is defined twice", b.Name(), name)
+			}
+		}
+		if label == "" {
+			label = name
+		}
+		commands = append(commands, &command{Command: Command{Name: name, Label: label, File: file}, fn: fn})
+		return starlark.None, nil
+	}
+
+	predeclared := builtins()
+	predeclared["command"] = starlark.NewBuiltin("command", register)
+
+	thread := &starlark.Thread{Name: file, Print: printer(file)}
+	timer := time.AfterFunc(loadTimeout, func() { thread.Cancel("took too long to load") })
+	defer timer.Stop()
+	if _, err := starlark.ExecFileOptions(fileOptions, thread, path, nil, predeclared); err != nil {
+		var evalErr *starlark.EvalError
+		if errors.As(err, &evalErr) {
+			return nil, errors.New(evalErr.Backtrace())
+		}
+		return nil, err
+	}
+	// Commands may be lambdas the file's globals don't reach.
+	for _, c := range commands {
+		c.fn.Freeze()
+	}
+	return commands, nil
+}
+
+// printer sends a script's print output to the log.
+func printer(file string) func(*starlark.Thread, string) {
+	return func(_ *starlark.Thread, msg string) {
+		log.Printf("[%s] %s", file, msg)
+	}
+}
@@ -0,0 +1,155 @@
+package script
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeHost records what commands do.
+type fakeHost struct {
+	log       []string
+	clipboard string
+}
+
+func (h *fakeHost) Type(text string, submit bool) error {
+	if submit {
+		text += "⏎"
+	}
+	h.log = append(h.log, "type:"+text)
+	return nil
+}
+
+func (h *fakeHost) Key(name string) error {
+	if name == "bogus" {
+		return errors.New("unknown key")
+	}
+	h.log = append(h.log, "key:"+name)
+	return nil
+}
+
+func (h *fakeHost) AI(text, mode string) (string, error) {
+	return strings.ToUpper(text) + "/" + mode, nil
+}
+
+func (h *fakeHost) Clipboard() (string, error) { return h.clipboard, nil }
+
+func (h *fakeHost) SetClipboard(text string) error {
+	h.clipboard = text
+	return nil
+}
+
+func (h *fakeHost) App() string { return "notepad.exe" }
+
+// newEngine writes files into a scripts directory and loads them.
+func newEngine(t *testing.T, timeout time.Duration, files map[string]string) *Engine {
+	t.Helper()
+	dir := t.TempDir()
+	for name, src := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e := New(dir, timeout)
+	e.Load()
+	return e
+}
+
+func TestRunCommand(t *testing.T) {
+	e := newEngine(t, 0, map[string]string{"a.star": `
+def shout():
+    text = clipboard.get()
+    clipboard.set(ai(text, mode="formal"))
+    keys("ctrl_v", "enter")
+    type(app(), submit=True)
+
+command("shout", shout, label="Shout")
+command("plain", lambda: type("hi"))
+`})
+	cmds := e.Commands()
+	if len(cmds) != 2 || cmds[0].Name != "shout" || cmds[0].Label != "Shout" || cmds[1].Label != "plain" || cmds[0].File != "a.star" {
+		t.Fatalf("Commands = %+v", cmds)
+	}
+
+	host := &fakeHost{clipboard: "hello"}
+	if err := e.Run(context.Background(), "shout", host); err != nil {
+		t.Fatal(err)
+	}
+	if host.clipboard != "HELLO/formal" {
+		t.Errorf("clipboard = %q", host.clipboard)
+	}
+	if got := strings.Join(host.log, " "); got != "key:ctrl_v key:enter type:notepad.exe⏎" {
+		t.Errorf("log = %s", got)
+	}
+
+	if err := e.Run(context.Background(), "missing", host); !errors.Is(err, ErrUnknownCommand) {
+		t.Errorf("missing command: error %v, want %v", err, ErrUnknownCommand)
+	}
+}
+
+func TestLoadSkipsBadScripts(t *testing.T) {
+	e := newEngine(t, 0, map[string]string{
+		"a.star":      `command("one", lambda: None)`,
+		"b.star":      `command("one", lambda: None)` + "\n" + `command("two", lambda: None)`,
+		"broken.star": `command(`,
+		"bad.star":    `command("Bad Name", lambda: None)`,
+		"load.star":   `type("at load time")`,
+		"notes.txt":   `command("ignored", lambda: None)`,
+	})
+	var names []string
+	for _, c := range e.Commands() {
+		names = append(names, c.Name)
+	}
+	// b.star's duplicate "one" is skipped, but its other command stays.
+	if got := strings.Join(names, ","); got != "one,two" {
+		t.Errorf("commands = %s, want one,two", got)
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	e := newEngine(t, 100*time.Millisecond, map[string]string{"a.star": `
+def spin():
+    while True:
+        pass
+
+command("spin", spin)
+command("nap", lambda: sleep(10))
+command("fail", lambda: keys("bogus"))
+command("crash", lambda: 1 // 0)
+`})
+	host := &fakeHost{}
+	for name, want := range map[string]string{
+		"spin":  "stopped after",
+		"nap":   "stopped after",
+		"fail":  "unknown key",
+		"crash": "division by zero",
+	} {
+		err := e.Run(context.Background(), name, host)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: error %v, want %q", name, err, want)
+		}
+	}
+}
+
+func TestWatchReloads(t *testing.T) {
+	e := newEngine(t, 0, nil)
+	defer e.Close()
+	changed := make(chan struct{}, 1)
+	e.Watch(func() { changed <- struct{}{} })
+
+	if err := os.WriteFile(filepath.Join(e.Dir(), "new.star"), []byte(`command("new", lambda: None)`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-changed:
+	case <-time.After(3 * watchInterval):
+		t.Fatal("new script not picked up")
+	}
+	if cmds := e.Commands(); len(cmds) != 1 || cmds[0].Name != "new" {
+		t.Errorf("Commands = %+v", cmds)
+	}
+}
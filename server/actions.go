@@ -0,0 +1,370 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gold16/ginkgo-talk/config"
+)
+
+const (
+	defaultActionTimeout = 30 * time.Second
+
+	// actionMaxOutput is how much of a run action's output is returned, in bytes.
+	actionMaxOutput = 4096
+
+	// codeConfirmationRequired answers an action that must be confirmed
+	// but wasn't.
+	codeConfirmationRequired = "confirmation_required"
+)
+
+var actionNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+var (
+	errUnknownAction      = errors.New("unknown action")
+	errActionNotConfirmed = errors.New("this action has to be confirmed")
+)
+
+// desktopAction is an action from the config's whitelist.
+type desktopAction struct {
+	name        string
+	label       string
+	url         string
+	launch      []string
+	run         []string
+	timeout     time.Duration
+	confirm     bool
+	permissions []Scope // needed on top of ScopeAction
+}
+
+// ActionInfo describes an action for the phone's buttons.
+type ActionInfo struct {
+	Name    string `json:"name"`
+	Label   string `json:"label"`
+	Kind    string `json:"kind"` // "url", "launch" or "run"
+	Confirm bool   `json:"confirm"`
+}
+
+// ActionResult reports what an action did.
+type ActionResult struct {
+	Name      string `json:"name"`
+	Status    string `json:"status"`             // "opened", "launched" or "finished"
+	ExitCode  *int   `json:"exitCode,omitempty"` // run actions only
+	Output    string `json:"output,omitempty"`   // run actions: stdout and stderr
+	Truncated bool   `json:"truncated,omitempty"`
+}
+
+// ActionRequest is the body of POST /api/actions/run.
+type ActionRequest struct {
+	Name      string `json:"name"`
+	Confirmed bool   `json:"confirmed,omitempty"` // required for actions with confirm set
+}
+
+func (a desktopAction) kind() string {
+	switch {
+	case a.url != "":
+		return "url"
+	case len(a.launch) > 0:
+		return "launch"
+	}
+	return "run"
+}
+
+// allowed checks that p may run the action.
+func (a desktopAction) allowed(p principal) error {
+	if err := p.check(ScopeAction); err != nil {
+		return err
+	}
+	for _, scope := range a.permissions {
+		if err := p.check(scope); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// actionStore holds the whitelist of actions from gtalk_config.json.
+type actionStore struct {
+	mu      sync.RWMutex
+	actions []desktopAction
+}
+
+func newActionStore(cfg config.Config) *actionStore {
+	as := &actionStore{}
+	as.load(cfg)
+	return as
+}
+
+// load replaces the actions with those in cfg. Invalid entries are logged
+// and skipped.
+func (as *actionStore) load(cfg config.Config) {
+	var actions []desktopAction
+	seen := make(map[string]bool)
+	for i, acfg := range cfg.Actions {
+		a, err := parseAction(acfg)
+		if err == nil && seen[a.name] {
+			err = errors.New("defined twice")
+		}
+		if err != nil {
+			log.Printf("Skipping action %d (%s): %v", i+1, acfg.Name, err)
+			continue
+		}
+		seen[a.name] = true
+		actions = append(actions, a)
+	}
+
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	as.actions = actions
+}
+
+func parseAction(cfg config.Action) (desktopAction, error) {
+	a := desktopAction{
+		name:    cfg.Name,
+		label:   cfg.Label,
+		url:     cfg.URL,
+		launch:  cfg.Launch,
+		run:     cfg.Run,
+		timeout: time.Duration(cfg.Timeout) * time.Second,
+		confirm: cfg.Confirm,
+	}
+	if !actionNamePattern.MatchString(a.name) {
+		return a, fmt.Errorf("invalid name %q: use lower-case letters, digits, - and _", a.name)
+	}
+	if a.label == "" {
+		a.label = a.name
+	}
+	if a.timeout <= 0 {
+		a.timeout = defaultActionTimeout
+	}
+
+	kinds := 0
+	if a.url != "" {
+		kinds++
+		u, err := url.Parse(a.url)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return a, fmt.Errorf("invalid url %q: use http:// or https://", a.url)
+		}
+	}
+	for _, argv := range [][]string{a.launch, a.run} {
+		if argv == nil {
+			continue
+		}
+		kinds++
+		if len(argv) == 0 || argv[0] == "" {
+			return a, errors.New("no program given")
+		}
+	}
+	if kinds != 1 {
+		return a, errors.New("set exactly one of url, launch and run")
+	}
+
+	scopes, err := parseDevicePermissions(cfg.Permissions)
+	if err != nil {
+		return a, err
+	}
+	a.permissions = scopes
+	return a, nil
+}
+
+func (as *actionStore) get(name string) (desktopAction, bool) {
+	as.mu.RLock()
+	defer as.mu.RUnlock()
+	for _, a := range as.actions {
+		if a.name == name {
+			return a, true
+		}
+	}
+	return desktopAction{}, false
+}
+
+// forPrincipal lists the actions p may run.
+func (as *actionStore) forPrincipal(p principal) []ActionInfo {
+	as.mu.RLock()
+	defer as.mu.RUnlock()
+	var infos []ActionInfo
+	for _, a := range as.actions {
+		if a.allowed(p) == nil {
+			infos = append(infos, ActionInfo{Name: a.name, Label: a.label, Kind: a.kind(), Confirm: a.confirm})
+		}
+	}
+	return infos
+}
+
+// runAction runs the named action for p, if p may run it and, when the
+// action asks for it, has confirmed it.
+func (s *Server) runAction(p principal, source, name string, confirmed bool) (ActionResult, error) {
+	a, ok := s.actions.get(name)
+	if !ok {
+		return ActionResult{}, fmt.Errorf("%w %q", errUnknownAction, name)
+	}
+	if err := a.allowed(p); err != nil {
+		return ActionResult{}, err
+	}
+	if a.confirm && !confirmed {
+		return ActionResult{}, errActionNotConfirmed
+	}
+
+	log.Printf("Running action %s for %s", name, p)
+	o := p.origin(source)
+	res, err := a.do()
+	if err != nil {
+		err = fmt.Errorf("action %s: %w", name, err)
+		log.Printf("%v", err)
+		s.publishBackendError("action", err, o.deviceID)
+		return res, err
+	}
+	data := o.data(map[string]interface{}{"name": name, "status": res.Status})
+	if res.ExitCode != nil {
+		data["exitCode"] = *res.ExitCode
+	}
+	s.events.publish(Event{Type: EventActionRun, Data: data, from: o.deviceID})
+	return res, nil
+}
+
+func (a desktopAction) do() (ActionResult, error) {
+	res := ActionResult{Name: a.name}
+	switch a.kind() {
+	case "url":
+		res.Status = "opened"
+		return res, OpenURL(a.url)
+	case "launch":
+		cmd := exec.Command(a.launch[0], a.launch[1:]...)
+		if err := cmd.Start(); err != nil {
+			return res, err
+		}
+		go cmd.Wait()
+		res.Status = "launched"
+		return res, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), a.timeout)
+	defer cancel()
+	out := &cappedBuffer{max: actionMaxOutput}
+	cmd := exec.CommandContext(ctx, a.run[0], a.run[1:]...)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	cmd.WaitDelay = time.Second // don't wait on children still holding the pipes
+	hideWindow(cmd)
+
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return res, fmt.Errorf("timed out after %s", a.timeout)
+	}
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return res, err
+	}
+	code := cmd.ProcessState.ExitCode()
+	res.Status = "finished"
+	res.ExitCode = &code
+	res.Output = strings.ToValidUTF8(out.buf.String(), "")
+	res.Truncated = out.truncated
+	return res, nil
+}
+
+// errOutputFull ends the copy into a cappedBuffer that stops when full,
+// which closes the pipe on the command writing to it.
+var errOutputFull = errors.New("output limit reached")
+
+// cappedBuffer keeps the first max bytes written to it. With stop set, a
+// write that reaches max fails instead of discarding the rest.
+type cappedBuffer struct {
+	buf       bytes.Buffer
+	max       int
+	stop      bool
+	truncated bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	room := b.max - b.buf.Len()
+	if b.stop && len(p) >= room {
+		b.buf.Write(p[:max(room, 0)])
+		b.truncated = true
+		return max(room, 0), errOutputFull
+	}
+	if len(p) > room {
+		p = p[:max(room, 0)]
+		b.truncated = true
+	}
+	b.buf.Write(p)
+	return n, nil
+}
+
+// actionErrorMessage is the WebSocket form of a failed action.
+func actionErrorMessage(err error) map[string]string {
+	var denied *permissionError
+	switch {
+	case errors.As(err, &denied):
+		return deniedMessage(err)
+	case errors.Is(err, errActionNotConfirmed):
+		return map[string]string{"type": "error", "code": codeConfirmationRequired, "error": err.Error()}
+	}
+	return map[string]string{"type": "error", "error": err.Error()}
+}
+
+// handleAPIActions lists the actions the caller may run.
+func (s *Server) handleAPIActions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	p, ok := s.authorize(w, r, ScopeAction)
+	if !ok {
+		return
+	}
+	actions := s.actions.forPrincipal(p)
+	if actions == nil {
+		actions = []ActionInfo{}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"actions": actions})
+}
+
+// handleAPIRunAction runs an action and answers with its result.
+func (s *Server) handleAPIRunAction(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	p, ok := s.apiRequest(w, r, ScopeAction)
+	if !ok {
+		return
+	}
+	var req ActionRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAPIBody)).Decode(&req); err != nil || req.Name == "" {
+		writeAPIError(w, http.StatusBadRequest, "name is required")
+		return
+	}
+
+	if !s.jobs.start() {
+		writeAPIError(w, http.StatusServiceUnavailable, errShuttingDown.Error())
+		return
+	}
+	defer s.jobs.done()
+
+	res, err := s.runAction(p, "api", req.Name, req.Confirmed)
+	var denied *permissionError
+	switch {
+	case errors.Is(err, errUnknownAction):
+		writeAPIError(w, http.StatusNotFound, err.Error())
+	case errors.As(err, &denied):
+		writeDenied(w, err)
+	case errors.Is(err, errActionNotConfirmed):
+		w.WriteHeader(http.StatusPreconditionRequired)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error(), "code": codeConfirmationRequired})
+	case err != nil:
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+	default:
+		json.NewEncoder(w).Encode(res)
+	}
+}
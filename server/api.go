@@ -0,0 +1,265 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/gold16/ginkgo-talk/ai"
+	"github.com/gold16/ginkgo-talk/input"
+)
+
+// maxAPIBody bounds request bodies on the REST endpoints.
+const maxAPIBody = 64 << 10
+
+var (
+	errAINotConfigured = errors.New("AI is not configured, set an API key first")
+	errUnknownCommand  = errors.New("unknown command")
+)
+
+// keyCommand is a key press the phone's buttons and /api/command can send.
+type keyCommand struct {
+	label  string // for the log
+	status string // reported back on success
+	press  func(input.Backend) error
+}
+
+var keyCommands = map[string]keyCommand{
+	"clear":       {"Clear PC input field", "cleared", input.Backend.SelectAllAndDelete},
+	"enter":       {"Enter", "enter", input.Backend.PressEnter},
+	"shift_enter": {"Shift+Enter", "shift_enter", input.Backend.PressShiftEnter},
+	"ctrl_z":      {"Ctrl+Z (undo)", "ctrl_z", input.Backend.PressCtrlZ},
+	"ctrl_v":      {"Ctrl+V (paste)", "ctrl_v", input.Backend.PressCtrlV},
+	"tab":         {"Tab", "tab", input.Backend.PressTab},
+	"escape":      {"Escape", "escape", input.Backend.PressEscape},
+}
+
+// runKeyCommand presses the keys for a named command and returns its status.
+func (s *Server) runKeyCommand(name string) (string, error) {
+	cmd, ok := keyCommands[name]
+	if !ok {
+		return "", fmt.Errorf("%w %q", errUnknownCommand, name)
+	}
+	log.Printf("%s", cmd.label)
+	s.typing.Lock()
+	err := cmd.press(s.input)
+	s.typing.Unlock()
+	if err != nil {
+		log.Printf("%s error: %v", cmd.label, err)
+		return "", err
+	}
+	return cmd.status, nil
+}
+
+// typeText types text without pressing Enter.
+func (s *Server) typeText(text string) error {
+	s.typing.Lock()
+	defer s.typing.Unlock()
+	return s.input.TypeText(text)
+}
+
+// typeAndSubmit types text and presses Enter, like sending from the phone.
+// No other typing or key press can come between the two.
+func (s *Server) typeAndSubmit(text string) error {
+	s.typing.Lock()
+	defer s.typing.Unlock()
+	if err := s.input.TypeText(text); err != nil {
+		log.Printf("SendInput error: %v", err)
+		return err
+	}
+	if err := s.input.PressEnter(); err != nil {
+		log.Printf("PressEnter error: %v", err)
+		return err
+	}
+	return nil
+}
+
+// resolveMode checks a requested AI mode; "" means raw. AI modes need a
+// configured API key.
+func (s *Server) resolveMode(mode ai.Mode) (ai.Mode, error) {
+	switch mode {
+	case "", ai.ModeRaw:
+		return ai.ModeRaw, nil
+	case ai.ModeTidy, ai.ModeFormal, ai.ModeTranslate:
+		if !s.ai.IsAvailable() {
+			return "", errAINotConfigured
+		}
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown mode %q (raw, tidy, formal or translate)", mode)
+}
+
+// TypeRequest is the body of POST /api/type.
+type TypeRequest struct {
+	Text    string `json:"text"`
+	Mode    string `json:"mode,omitempty"`    // "raw" (default), "tidy", "formal", "translate"
+	Submit  *bool  `json:"submit,omitempty"`  // press Enter after typing; default true
+	Preview bool   `json:"preview,omitempty"` // only return the AI result, type nothing
+}
+
+// TypeResponse reports what POST /api/type did.
+type TypeResponse struct {
+	Status   string  `json:"status"` // "sent", "typed" or "preview"
+	Text     string  `json:"text"`   // the text typed, after AI processing and filters
+	Original string  `json:"original"`
+	Mode     ai.Mode `json:"mode"`
+}
+
+// CommandRequest is the body of POST /api/command.
+type CommandRequest struct {
+	Command string `json:"command"` // one of keyCommands
+}
+
+// handleAPIType types text like a message from the phone, for scripts and
+// automations. AI modes are processed before the response is sent.
+func (s *Server) handleAPIType(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	p, ok := s.apiRequest(w, r, ScopeType)
+	if !ok {
+		return
+	}
+	var req TypeRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAPIBody)).Decode(&req); err != nil || req.Text == "" {
+		writeAPIError(w, http.StatusBadRequest, "text is required")
+		return
+	}
+	mode, err := s.resolveMode(ai.Mode(req.Mode))
+	if errors.Is(err, errAINotConfigured) {
+		writeAPIError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	} else if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if mode != ai.ModeRaw {
+		if err := p.check(ScopeAI); err != nil {
+			writeDenied(w, err)
+			return
+		}
+	}
+	if req.Preview && mode == ai.ModeRaw {
+		writeAPIError(w, http.StatusBadRequest, "preview needs an AI mode")
+		return
+	}
+
+	if !s.jobs.start() {
+		writeAPIError(w, http.StatusServiceUnavailable, errShuttingDown.Error())
+		return
+	}
+	defer s.jobs.done()
+
+	resp := TypeResponse{Text: req.Text, Original: req.Text, Mode: mode}
+	if mode != ai.ModeRaw {
+		log.Printf("AI processing [%s] for %s: %s", mode, p, req.Text)
+		processed, err := s.ai.Process(req.Text, mode)
+		if err != nil {
+			log.Printf("AI error: %v", err)
+			s.publishBackendError("ai", err, p.deviceID())
+			writeAPIError(w, http.StatusBadGateway, err.Error())
+			return
+		}
+		resp.Text = processed
+		s.publishProcessed(p.origin("api"), req.Text, processed, mode)
+	}
+
+	// A preview shows what would be typed, so it goes through the filters too.
+	filtered, err := s.filterText(p.origin("api"), resp.Text, mode)
+	if err != nil {
+		writeAPIError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	resp.Text = filtered
+	if req.Preview {
+		resp.Status = "preview"
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	if req.Submit == nil || *req.Submit {
+		log.Printf("Typing and sending for %s: %s", p, resp.Text)
+		err = s.typeAndSubmit(resp.Text)
+		resp.Status = "sent"
+	} else {
+		log.Printf("Typing for %s: %s", p, resp.Text)
+		err = s.typeText(resp.Text)
+		resp.Status = "typed"
+	}
+	if err != nil {
+		s.publishBackendError("keyboard", err, p.deviceID())
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	s.publishTyped(p.origin("api"), resp.Text, mode, resp.Status == "sent")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleAPICommand presses one of the phone's command keys.
+func (s *Server) handleAPICommand(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	p, ok := s.apiRequest(w, r, ScopeCommand)
+	if !ok {
+		return
+	}
+	var req CommandRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAPIBody)).Decode(&req); err != nil || req.Command == "" {
+		writeAPIError(w, http.StatusBadRequest, "command is required")
+		return
+	}
+	if _, ok := keyCommands[req.Command]; !ok {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("unknown command %q", req.Command))
+		return
+	}
+
+	if !s.jobs.start() {
+		writeAPIError(w, http.StatusServiceUnavailable, errShuttingDown.Error())
+		return
+	}
+	defer s.jobs.done()
+
+	status, err := s.runKeyCommand(req.Command)
+	if err != nil {
+		s.publishBackendError("keyboard", err, p.deviceID())
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"status": status})
+}
+
+// apiRequest checks the method of a REST call and that its token has
+// scope, answering the request itself if not. Devices paired with
+// end-to-end encryption must use the WebSocket: their access token alone,
+// taken from a connection whose certificate warning was clicked through,
+// must not be enough to type.
+func (s *Server) apiRequest(w http.ResponseWriter, r *http.Request, scope Scope) (principal, bool) {
+	if r.Method != http.MethodPost {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return principal{}, false
+	}
+	p, ok := s.authorize(w, r, scope)
+	if ok && refuseE2EDevice(w, r, p) {
+		return principal{}, false
+	}
+	return p, ok
+}
+
+// refuseE2EDevice answers 403 to a REST request from a device paired with
+// end-to-end encryption, and reports whether it did.
+func refuseE2EDevice(w http.ResponseWriter, r *http.Request, p principal) bool {
+	if p.token != nil || len(p.session.e2eKey) == 0 {
+		return false
+	}
+	log.Printf("Refusing REST %s from end-to-end encrypted device %s", r.URL.Path, p.deviceID())
+	w.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error": "this device's requests must be end-to-end encrypted; use the WebSocket or an API token",
+		"code":  codeE2ERequired,
+	})
+	return true
+}
+
+func writeAPIError(w http.ResponseWriter, code int, msg string) {
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
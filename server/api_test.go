@@ -0,0 +1,109 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gold16/ginkgo-talk/config"
+)
+
+func TestAPIRefusesE2EDevices(t *testing.T) {
+	s := newTestServer(t, config.Config{})
+	plain, err := s.sessions.issue("plain-device", "192.0.2.1:1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e2e, err := s.sessions.issue("e2e-device", "192.0.2.2:1", make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	post := func(token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/api/command", strings.NewReader(`{"command":"nope"}`))
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		s.handleAPICommand(w, r)
+		return w
+	}
+
+	// The plain device gets past authorization to the unknown command.
+	if w := post(plain.AccessToken); w.Code != http.StatusBadRequest {
+		t.Errorf("plain device: status %d, want 400", w.Code)
+	}
+	w := post(e2e.AccessToken)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("e2e device: status %d, want 403", w.Code)
+	}
+	var resp map[string]string
+	json.NewDecoder(w.Body).Decode(&resp)
+	if resp["code"] != codeE2ERequired {
+		t.Errorf("e2e device: code %q, want %q", resp["code"], codeE2ERequired)
+	}
+}
+
+// keyLog records typing and key presses in order.
+type keyLog struct {
+	recordingInput
+	mu   sync.Mutex
+	keys []string
+}
+
+func (l *keyLog) record(key string) {
+	l.mu.Lock()
+	l.keys = append(l.keys, key)
+	l.mu.Unlock()
+}
+
+func (l *keyLog) TypeText(text string) error {
+	for _, r := range text {
+		l.record(string(r))
+		time.Sleep(100 * time.Microsecond)
+	}
+	return nil
+}
+
+func (l *keyLog) PressEnter() error { l.record("Enter"); return nil }
+func (l *keyLog) PressTab() error   { l.record("Tab"); return nil }
+
+func TestTypingNotInterleaved(t *testing.T) {
+	s := newTestServer(t, config.Config{})
+	keys := &keyLog{}
+	s.input = keys
+	secret, _, err := s.tokens.Create("ci", []Scope{ScopeType, ScopeCommand}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	post := func(path, body string, handler http.HandlerFunc) {
+		r := httptest.NewRequest("POST", path, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+secret)
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: status %d %s", path, w.Code, w.Body)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			post("/api/type", `{"text":"abc"}`, s.handleAPIType)
+		}()
+		go func() {
+			defer wg.Done()
+			post("/api/command", `{"command":"tab"}`, s.handleAPICommand)
+		}()
+	}
+	wg.Wait()
+
+	got := strings.Join(keys.keys, " ")
+	if strings.Count(got, "a b c Enter") != 10 || strings.Count(got, "Tab") != 10 {
+		t.Errorf("keys interleaved: %s", got)
+	}
+}
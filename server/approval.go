@@ -0,0 +1,230 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// pendingPairTTL is how long a pairing request waits for desktop approval.
+const pendingPairTTL = 2 * time.Minute
+
+// Limits on requests waiting for approval at once, so nobody on the network
+// can bury the desktop in prompts.
+const (
+	maxPendingPairsPerAddress = 3
+	maxPendingPairs           = 20
+)
+
+// PairMode selects what a device needs to pair without a QR link.
+type PairMode string
+
+const (
+	PairModeCode           PairMode = "code"         // 4-digit pair code only
+	PairModeApprove        PairMode = "approve"      // approval on the desktop only
+	PairModeCodeAndApprove PairMode = "code+approve" // pair code, then desktop approval
+)
+
+// parsePairMode normalizes a configured pair mode, defaulting to PairModeCode.
+func parsePairMode(s string) (PairMode, bool) {
+	switch PairMode(strings.ToLower(strings.TrimSpace(s))) {
+	case "", PairModeCode:
+		return PairModeCode, true
+	case PairModeApprove:
+		return PairModeApprove, true
+	case PairModeCodeAndApprove:
+		return PairModeCodeAndApprove, true
+	}
+	return PairModeCode, false
+}
+
+// needsApproval reports whether pairing requests wait for the desktop.
+func (m PairMode) needsApproval() bool {
+	return m == PairModeApprove || m == PairModeCodeAndApprove
+}
+
+// needsCode reports whether pairing requests must carry the pair code.
+func (m PairMode) needsCode() bool {
+	return m == PairModeCode || m == PairModeCodeAndApprove
+}
+
+// Pending pairing request states reported to the waiting device.
+const (
+	pairStatusPending  = "pending"
+	pairStatusApproved = "approved"
+	pairStatusDenied   = "denied"
+	pairStatusExpired  = "expired"
+)
+
+var (
+	errUnknownPairRequest  = errors.New("unknown or expired pairing request")
+	errTooManyPairRequests = errors.New("too many pairing requests waiting for approval")
+)
+
+// PendingPair describes a pairing request waiting for approval on the desktop.
+type PendingPair struct {
+	ID          string `json:"id"`
+	DeviceID    string `json:"deviceId"`
+	DeviceName  string `json:"deviceName,omitempty"`
+	RemoteAddr  string `json:"remoteAddr"`
+	UserAgent   string `json:"userAgent,omitempty"`
+	RequestedAt string `json:"requestedAt"`
+	ExpiresAt   string `json:"expiresAt"`
+	// Replaces is set when another device already uses this ID, being
+	// paired or having its own policy. Approving gives the new device that
+	// device's policy and ends its pairing.
+	Replaces bool `json:"replaces,omitempty"`
+
+	e2eKey []byte // set when the device paired through SPAKE2
+}
+
+type pendingPair struct {
+	info       PendingPair
+	ip         string // the requesting address, without the port
+	ticketHash [32]byte // secret the requesting device polls with
+	expiresAt  time.Time
+	status     string
+	creds      DeviceCredentials
+}
+
+// pendingPairStore holds pairing requests until the desktop decides on them.
+// The ID is shown on the desktop; only the requesting device knows the ticket.
+type pendingPairStore struct {
+	mu   sync.Mutex
+	reqs map[string]*pendingPair
+}
+
+func newPendingPairStore() *pendingPairStore {
+	return &pendingPairStore{reqs: make(map[string]*pendingPair)}
+}
+
+// add queues a new request from ip and returns it together with the
+// device's ticket. It fails with errTooManyPairRequests once ip, or all
+// addresses together, have too many requests waiting.
+func (st *pendingPairStore) add(info PendingPair, ip string) (PendingPair, string, error) {
+	ticket, err := generateAuthToken()
+	if err != nil {
+		return PendingPair{}, "", err
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	now := time.Now()
+	st.pruneLocked(now)
+	waiting, fromIP := 0, 0
+	for _, req := range st.reqs {
+		if req.status == pairStatusPending && now.Before(req.expiresAt) {
+			waiting++
+			if req.ip == ip {
+				fromIP++
+			}
+		}
+	}
+	if waiting >= maxPendingPairs || fromIP >= maxPendingPairsPerAddress {
+		return PendingPair{}, "", errTooManyPairRequests
+	}
+
+	// The ID is shortened for the desktop, so make sure it is unused.
+	for info.ID == "" || st.reqs[info.ID] != nil {
+		id, err := generateAuthToken()
+		if err != nil {
+			return PendingPair{}, "", err
+		}
+		info.ID = id[:8]
+	}
+	info.RequestedAt = now.Format(time.RFC3339)
+	info.ExpiresAt = now.Add(pendingPairTTL).Format(time.RFC3339)
+	st.reqs[info.ID] = &pendingPair{
+		info:       info,
+		ip:         ip,
+		ticketHash: sha256.Sum256([]byte(ticket)),
+		expiresAt:  now.Add(pendingPairTTL),
+		status:     pairStatusPending,
+	}
+	return info, ticket, nil
+}
+
+// list returns the requests still waiting for a decision, oldest first.
+func (st *pendingPairStore) list() []PendingPair {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	now := time.Now()
+	st.pruneLocked(now)
+
+	var out []PendingPair
+	for _, req := range st.reqs {
+		if req.status == pairStatusPending && now.Before(req.expiresAt) {
+			out = append(out, req.info)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].RequestedAt < out[j].RequestedAt
+	})
+	return out
+}
+
+// decide records the desktop's decision. issue is called only on approval
+// and produces the credentials handed to the device on its next poll.
+func (st *pendingPairStore) decide(id string, approve bool, issue func(PendingPair) (DeviceCredentials, error)) (PendingPair, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	req, ok := st.reqs[id]
+	if !ok || req.status != pairStatusPending || time.Now().After(req.expiresAt) {
+		return PendingPair{}, errUnknownPairRequest
+	}
+	if !approve {
+		req.status = pairStatusDenied
+		return req.info, nil
+	}
+	creds, err := issue(req.info)
+	if err != nil {
+		return PendingPair{}, err
+	}
+	req.status = pairStatusApproved
+	req.creds = creds
+	return req.info, nil
+}
+
+// poll returns the state of the request owning ticket. Approved credentials
+// are handed out once; the request is dropped after any final answer.
+func (st *pendingPairStore) poll(ticket string) (string, DeviceCredentials) {
+	hash := sha256.Sum256([]byte(ticket))
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for id, req := range st.reqs {
+		if subtle.ConstantTimeCompare(hash[:], req.ticketHash[:]) != 1 {
+			continue
+		}
+		if req.status == pairStatusPending {
+			if time.Now().Before(req.expiresAt) {
+				return pairStatusPending, DeviceCredentials{}
+			}
+			req.status = pairStatusExpired
+		}
+		delete(st.reqs, id)
+		return req.status, req.creds
+	}
+	return pairStatusExpired, DeviceCredentials{}
+}
+
+// pruneLocked forgets requests nobody has polled for well after they ended.
+func (st *pendingPairStore) pruneLocked(now time.Time) {
+	for id, req := range st.reqs {
+		if now.After(req.expiresAt.Add(pendingPairTTL)) {
+			delete(st.reqs, id)
+		}
+	}
+}
+
+// DisplayName returns a short human-readable label for a pairing request.
+func (req PendingPair) DisplayName() string {
+	if req.DeviceName != "" {
+		return req.DeviceName
+	}
+	return "unnamed device"
+}
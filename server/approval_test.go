@@ -0,0 +1,102 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gold16/ginkgo-talk/config"
+)
+
+// requestPairing asks to pair by approval alone from remoteAddr.
+func requestPairing(t *testing.T, s *Server, remoteAddr, deviceID string) (int, map[string]string) {
+	t.Helper()
+	r := httptest.NewRequest("POST", "/api/pair", strings.NewReader(`{"deviceId":"`+deviceID+`"}`))
+	r.RemoteAddr = remoteAddr
+	w := httptest.NewRecorder()
+	s.handlePair(w, r)
+	var resp map[string]string
+	json.NewDecoder(w.Body).Decode(&resp)
+	return w.Code, resp
+}
+
+// pollPairing asks once for the state of the request owning ticket.
+func pollPairing(t *testing.T, s *Server, ticket string) map[string]string {
+	t.Helper()
+	r := httptest.NewRequest("POST", "/api/pair/wait", strings.NewReader(`{"ticket":"`+ticket+`"}`))
+	w := httptest.NewRecorder()
+	s.handlePairWait(w, r)
+	var resp map[string]string
+	json.NewDecoder(w.Body).Decode(&resp)
+	return resp
+}
+
+func TestPairApproval(t *testing.T) {
+	s := newTestServer(t, config.Config{PairMode: string(PairModeApprove)})
+	status, approved := requestPairing(t, s, "192.0.2.1:1", "phone")
+	if status != http.StatusAccepted {
+		t.Fatalf("status %d, want 202", status)
+	}
+	_, denied := requestPairing(t, s, "192.0.2.2:1", "tablet")
+	if pending := s.PendingPairs(); len(pending) != 2 {
+		t.Fatalf("%d pending requests, want 2", len(pending))
+	}
+	if resp := pollPairing(t, s, approved["ticket"]); resp["status"] != pairStatusPending {
+		t.Errorf("before deciding: %v, want pending", resp)
+	}
+
+	if err := s.ApprovePair(approved["requestId"]); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DenyPair(denied["requestId"]); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ApprovePair(denied["requestId"]); err == nil {
+		t.Error("a denied request was approved")
+	}
+
+	if resp := pollPairing(t, s, approved["ticket"]); resp["status"] != pairStatusApproved || resp["accessToken"] == "" {
+		t.Errorf("approved: %v, want credentials", resp)
+	}
+	if resp := pollPairing(t, s, denied["ticket"]); resp["status"] != pairStatusDenied || resp["accessToken"] != "" {
+		t.Errorf("denied: %v", resp)
+	}
+	// The answer is handed out once.
+	if resp := pollPairing(t, s, approved["ticket"]); resp["status"] != pairStatusExpired {
+		t.Errorf("second poll: %v, want expired", resp)
+	}
+}
+
+func TestPairApprovalLimits(t *testing.T) {
+	s := newTestServer(t, config.Config{PairMode: string(PairModeApprove)})
+	for i := 0; i < maxPendingPairsPerAddress; i++ {
+		if status, _ := requestPairing(t, s, "192.0.2.1:1", fmt.Sprint("phone", i)); status != http.StatusAccepted {
+			t.Fatalf("request %d: status %d, want 202", i, status)
+		}
+	}
+	if status, _ := requestPairing(t, s, "192.0.2.1:2", "one-more"); status != http.StatusTooManyRequests {
+		t.Errorf("past the per-address limit: status %d, want 429", status)
+	}
+
+	// Other addresses still get through, up to the overall limit.
+	for i := maxPendingPairsPerAddress; i < maxPendingPairs; i++ {
+		addr := fmt.Sprintf("192.0.2.%d:1", 10+i)
+		if status, _ := requestPairing(t, s, addr, fmt.Sprint("phone", i)); status != http.StatusAccepted {
+			t.Fatalf("request %d: status %d, want 202", i, status)
+		}
+	}
+	if status, _ := requestPairing(t, s, "198.51.100.1:1", "late"); status != http.StatusTooManyRequests {
+		t.Errorf("past the overall limit: status %d, want 429", status)
+	}
+
+	// A decision frees a place.
+	if err := s.DenyPair(s.PendingPairs()[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := requestPairing(t, s, "198.51.100.1:1", "late"); status != http.StatusAccepted {
+		t.Errorf("after a decision: status %d, want 202", status)
+	}
+}
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// scopeAny lets any paired device or API token through.
+	scopeAny Scope = ""
+	// scopePaired is for endpoints only the phone app uses. API tokens
+	// can't be granted it.
+	scopePaired Scope = "paired"
+)
+
+// principal is who a request acts for: a paired device or an API token.
+type principal struct {
+	session deviceSession // zero for API tokens
+	token   *apiToken     // nil for paired devices
+	policy  string        // the device's policy, "" for API tokens
+	scopes  []Scope       // what it may do
+}
+
+// devicePrincipal looks up the current permissions of a paired device.
+func (s *Server) devicePrincipal(sess deviceSession) principal {
+	policy, scopes := s.policies.forDevice(sess.deviceID)
+	return principal{session: sess, policy: policy, scopes: scopes}
+}
+
+// deviceID is the paired device behind the request, or "" for an API token.
+func (p principal) deviceID() string {
+	return p.session.deviceID
+}
+
+// can reports whether p has scope.
+func (p principal) can(scope Scope) bool {
+	switch scope {
+	case scopeAny:
+		return true
+	case scopePaired:
+		return p.token == nil
+	}
+	for _, s := range p.scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// check is can as an error, for reporting to the client.
+func (p principal) check(scope Scope) error {
+	if !p.can(scope) {
+		return &permissionError{who: p, permission: scope}
+	}
+	return nil
+}
+
+func (p principal) String() string {
+	if p.token != nil {
+		return "token " + p.token.Name
+	}
+	return "device " + p.session.deviceID
+}
+
+// identify resolves the request's bearer token to a paired device or an
+// API token.
+func (s *Server) identify(r *http.Request) (principal, bool) {
+	token := tokenFromRequest(r)
+	if strings.HasPrefix(token, apiTokenPrefix) {
+		t, ok := s.tokens.authenticate(token)
+		if !ok {
+			return principal{}, false
+		}
+		return principal{token: &t, scopes: t.Scopes}, true
+	}
+	sess, ok := s.sessions.authenticate(token)
+	if !ok {
+		return principal{}, false
+	}
+	return s.devicePrincipal(sess), true
+}
+
+// authorize checks that the request may act with scope. If not, it answers
+// with 401 or 403 itself and returns false.
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request, scope Scope) (principal, bool) {
+	p, ok := s.identify(r)
+	if !ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "unauthorized", "code": codeUnauthorized})
+		return principal{}, false
+	}
+	if err := p.check(scope); err != nil {
+		writeDenied(w, err)
+		return principal{}, false
+	}
+	return p, true
+}
+
+// writeDenied answers 403 with the permission that was missing.
+func writeDenied(w http.ResponseWriter, err error) {
+	resp := map[string]string{"error": err.Error(), "code": codePermissionDenied}
+	var denied *permissionError
+	if errors.As(err, &denied) {
+		resp["permission"] = string(denied.permission)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleTokens lists API tokens (GET) or creates one (POST). Like the QR
+// page, it only answers requests from this computer.
+func (s *Server) handleTokens(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !isLocalRequest(r) {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": "forbidden"})
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		json.NewEncoder(w).Encode(map[string]interface{}{"tokens": s.tokens.List()})
+
+	case http.MethodPost:
+		var body struct {
+			Name      string   `json:"name"`
+			Scopes    []string `json:"scopes"`
+			ExpiresIn string   `json:"expiresIn"` // e.g. "90d"; empty for no expiry
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+			return
+		}
+		scopes, err := ParseScopes(strings.Join(body.Scopes, ","))
+		var ttl time.Duration
+		if err == nil {
+			ttl, err = ParseTokenTTL(body.ExpiresIn)
+		}
+		var secret string
+		var info APITokenInfo
+		if err == nil {
+			secret, info, err = s.tokens.Create(body.Name, scopes, ttl)
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		log.Printf("API token %q created with scopes %v", info.Name, info.Scopes)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{"token": secret, "info": info})
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "method not allowed"})
+	}
+}
+
+// handleRevokeToken deletes an API token. Local requests only.
+func (s *Server) handleRevokeToken(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !isLocalRequest(r) {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": "forbidden"})
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "method not allowed"})
+		return
+	}
+
+	var body struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+		return
+	}
+	name := strings.TrimSpace(body.Name)
+	if err := s.tokens.Revoke(name); errors.Is(err, errUnknownToken) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	log.Printf("API token %q revoked", name)
+	json.NewEncoder(w).Encode(map[string]interface{}{"ok": true})
+}
@@ -0,0 +1,248 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	caCertFileName = "ca.pem"
+	caKeyFileName  = "ca-key.pem"
+
+	caValidity   = 10 * 365 * 24 * time.Hour
+	leafValidity = 7 * 24 * time.Hour
+)
+
+// localCA is a per-installation certificate authority. Phones trust its
+// root once, after which every leaf it issues is accepted without warnings.
+type localCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// loadOrCreateCA loads the CA from dir, or creates and saves a new one.
+func loadOrCreateCA(dir string) (*localCA, error) {
+	certFile := filepath.Join(dir, caCertFileName)
+	keyFile := filepath.Join(dir, caKeyFileName)
+
+	if pair, err := tls.LoadX509KeyPair(certFile, keyFile); err == nil {
+		cert, err := x509.ParseCertificate(pair.Certificate[0])
+		key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+		if err == nil && ok && cert.IsCA && time.Now().Before(cert.NotAfter) {
+			log.Printf("Loaded local CA (valid until %s)", cert.NotAfter.Format("2006-01-02"))
+			return &localCA{cert: cert, key: key}, nil
+		}
+		log.Printf("Local CA is invalid or expired, creating a new one...")
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+	hostname, _ := os.Hostname()
+
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"Ginkgo Talk"},
+			CommonName:   fmt.Sprintf("Ginkgo Talk Local CA (%s)", hostname),
+		},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter:  time.Now().Add(caValidity),
+
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+
+		// Phones install this root as trusted, so limit it to names and
+		// addresses that can only be local.
+		PermittedDNSDomains: []string{"localhost", "local"},
+		PermittedIPRanges:   localIPRanges(),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		log.Printf("Could not save %s: %v", caCertFileName, err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		log.Printf("Could not save %s: %v", caKeyFileName, err)
+	}
+	log.Printf("Created new local CA, saved to %s", dir)
+
+	return &localCA{cert: cert, key: key}, nil
+}
+
+// localIPRanges lists the address ranges the CA may issue certificates for.
+func localIPRanges() []*net.IPNet {
+	var ranges []*net.IPNet
+	for _, cidr := range []string{
+		"127.0.0.0/8", "10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16",
+		"169.254.0.0/16", "100.64.0.0/10",
+		"::1/128", "fc00::/7", "fe80::/10",
+	} {
+		_, n, _ := net.ParseCIDR(cidr)
+		ranges = append(ranges, n)
+	}
+	return ranges
+}
+
+// IssueLeaf issues a short-lived server certificate for the given addresses.
+// The CA certificate is included in the chain.
+func (ca *localCA) IssueLeaf(ips []net.IP, dnsNames []string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"Ginkgo Talk"},
+			CommonName:   "Ginkgo Talk Local Server",
+		},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter:  time.Now().Add(leafValidity),
+
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IPAddresses:           ips,
+		DNSNames:              dnsNames,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{der, ca.cert.Raw},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+// Fingerprint returns the SHA-256 fingerprint of the root certificate in the
+// colon-separated form phones show in their certificate details.
+func (ca *localCA) Fingerprint() string {
+	sum := sha256.Sum256(ca.cert.Raw)
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
+
+// DER returns the root certificate in DER form.
+func (ca *localCA) DER() []byte {
+	return ca.cert.Raw
+}
+
+// MobileConfig returns an iOS configuration profile that installs the root.
+// Identifiers are derived from the fingerprint so reinstalling replaces the
+// old profile instead of adding a second one.
+func (ca *localCA) MobileConfig() []byte {
+	sum := sha256.Sum256(ca.cert.Raw)
+	profileUUID := uuidFromBytes(sum[:16])
+	payloadUUID := uuidFromBytes(sum[16:])
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>PayloadContent</key>
+	<array>
+		<dict>
+			<key>PayloadCertificateFileName</key>
+			<string>ginkgo-talk-ca.crt</string>
+			<key>PayloadContent</key>
+			<data>%s</data>
+			<key>PayloadDisplayName</key>
+			<string>%s</string>
+			<key>PayloadIdentifier</key>
+			<string>com.ginkgotalk.ca.%s</string>
+			<key>PayloadType</key>
+			<string>com.apple.security.root</string>
+			<key>PayloadUUID</key>
+			<string>%s</string>
+			<key>PayloadVersion</key>
+			<integer>1</integer>
+		</dict>
+	</array>
+	<key>PayloadDisplayName</key>
+	<string>Ginkgo Talk Local CA</string>
+	<key>PayloadDescription</key>
+	<string>Trusts the Ginkgo Talk server on your computer. Fingerprint (SHA-256): %s</string>
+	<key>PayloadIdentifier</key>
+	<string>com.ginkgotalk.profile.%s</string>
+	<key>PayloadType</key>
+	<string>Configuration</string>
+	<key>PayloadUUID</key>
+	<string>%s</string>
+	<key>PayloadVersion</key>
+	<integer>1</integer>
+</dict>
+</plist>
+`, base64.StdEncoding.EncodeToString(ca.cert.Raw), xmlEscape(ca.cert.Subject.CommonName),
+		payloadUUID, payloadUUID, ca.Fingerprint(), profileUUID, profileUUID)
+	return buf.Bytes()
+}
+
+func uuidFromBytes(b []byte) string {
+	h := hex.EncodeToString(b[:16])
+	return strings.ToUpper(h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:32])
+}
+
+func xmlEscape(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+// randomSerial returns a random 128-bit certificate serial number.
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
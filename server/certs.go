@@ -0,0 +1,186 @@
+package server
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// certRenewBefore reissues the leaf this long before it expires.
+	certRenewBefore = 24 * time.Hour
+
+	// interfaceScanInterval limits how often handshakes rescan interfaces.
+	interfaceScanInterval = 10 * time.Second
+)
+
+// certManager serves leaf certificates from the local CA through
+// tls.Config.GetCertificate. The leaf is reissued whenever the set of
+// addresses it must cover changes, so a new LAN IP works without a restart.
+type certManager struct {
+	ca         *localCA
+	overrideIP func() string
+	mdnsHost   func() string
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	sanKey   string
+	ifaceIPs []net.IP
+	scanned  time.Time
+}
+
+func newCertManager(ca *localCA, overrideIP, mdnsHost func() string) *certManager {
+	return &certManager{ca: ca, overrideIP: overrideIP, mdnsHost: mdnsHost}
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (m *certManager) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if m.scanned.IsZero() || now.Sub(m.scanned) > interfaceScanInterval {
+		m.ifaceIPs = interfaceIPs()
+		m.scanned = now
+	}
+
+	ips, dnsNames, skipped := m.subjectAltNames()
+	key := sanKey(ips, dnsNames)
+	if m.cert != nil && key == m.sanKey && now.Before(m.cert.Leaf.NotAfter.Add(-certRenewBefore)) {
+		return m.cert, nil
+	}
+
+	cert, err := m.ca.IssueLeaf(ips, dnsNames)
+	if err != nil {
+		if m.cert != nil {
+			log.Printf("Could not reissue TLS cert, keeping the previous one: %v", err)
+			return m.cert, nil
+		}
+		return nil, err
+	}
+	if m.cert != nil {
+		log.Printf("Reissued TLS cert for %s", key)
+	}
+	for _, ip := range skipped {
+		log.Printf("Left %s out of the TLS cert: not a private address", ip)
+	}
+	m.cert = &cert
+	m.sanKey = key
+	return m.cert, nil
+}
+
+// subjectAltNames lists the loopback addresses, every interface address,
+// the LAN IP override, the computer's .local name and the advertised one. Addresses outside the CA's
+// name constraints are left out, since one of them would make phones
+// reject the whole certificate.
+func (m *certManager) subjectAltNames() (ips []net.IP, dnsNames []string, skipped []net.IP) {
+	candidates := []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+	candidates = append(candidates, m.ifaceIPs...)
+	if override := net.ParseIP(m.overrideIP()); override != nil {
+		candidates = append(candidates, override)
+	}
+
+	ranges := localIPRanges()
+	seen := make(map[string]bool)
+	for _, ip := range candidates {
+		if seen[ip.String()] {
+			continue
+		}
+		seen[ip.String()] = true
+		if !ipInRanges(ip, ranges) {
+			skipped = append(skipped, ip)
+			continue
+		}
+		ips = append(ips, ip)
+	}
+
+	dnsNames = []string{"localhost"}
+	for _, host := range []string{localHostname(), m.mdnsHost()} {
+		if host != "" && !slices.Contains(dnsNames, host) {
+			dnsNames = append(dnsNames, host)
+		}
+	}
+	return ips, dnsNames, skipped
+}
+
+// interfaceIPs returns the addresses of every interface that is up.
+// IPv6 link-local addresses are skipped: browsers can't use them without a zone.
+func interfaceIPs() []net.IP {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	var ips []net.IP
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.IsLoopback() {
+				continue
+			}
+			if ipNet.IP.To4() == nil && ipNet.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			ips = append(ips, ipNet.IP)
+		}
+	}
+	return ips
+}
+
+// localHostname returns this computer's name in the .local domain, or "" if
+// the hostname can't be turned into a valid DNS label. The system's own
+// mDNS responder, if any, answers for it.
+func localHostname() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return ""
+	}
+	hostname, _, _ = strings.Cut(hostname, ".")
+
+	var b strings.Builder
+	for _, r := range strings.ToLower(hostname) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			b.WriteRune(r)
+		case r == '-' || r == '_' || r == ' ':
+			b.WriteByte('-')
+		}
+	}
+	label := strings.Trim(b.String(), "-")
+	if label == "" || len(label) > 63 {
+		return ""
+	}
+	return label + ".local"
+}
+
+func ipInRanges(ip net.IP, ranges []*net.IPNet) bool {
+	for _, n := range ranges {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// sanKey is a stable description of a SAN set, used to detect changes.
+func sanKey(ips []net.IP, dnsNames []string) string {
+	parts := make([]string, 0, len(ips)+len(dnsNames))
+	for _, ip := range ips {
+		parts = append(parts, ip.String())
+	}
+	parts = append(parts, dnsNames...)
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"net"
+	"testing"
+
+	"github.com/gold16/ginkgo-talk/config"
+)
+
+func TestAddressesCoveredByCertificate(t *testing.T) {
+	s := newTestServer(t, config.Config{Bind: []string{}})
+	if _, err := s.tlsConfig(); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := s.certs.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Whatever interfaces this machine has, no address is offered that
+	// phones would get a certificate error on.
+	for _, a := range s.Addresses() {
+		if err := cert.Leaf.VerifyHostname(a.Host); err != nil {
+			t.Errorf("%s is offered but not in the certificate: %v", a.Host, err)
+		}
+	}
+	if err := cert.Leaf.VerifyHostname(s.LanIP()); err != nil && s.LanIP() != "localhost" {
+		t.Errorf("LanIP %s is not in the certificate: %v", s.LanIP(), err)
+	}
+}
+
+func TestLocalIPRanges(t *testing.T) {
+	ranges := localIPRanges()
+	for ip, want := range map[string]bool{
+		"192.168.1.20": true,
+		"fd12:3456::1": true,
+		"8.8.8.8":      false,
+		"2001:db8::1":  false, // global IPv6, which the local CA can't issue for
+	} {
+		if got := ipInRanges(net.ParseIP(ip), ranges); got != want {
+			t.Errorf("%s in local ranges = %v, want %v", ip, got, want)
+		}
+	}
+}
+
+func TestLanIPOverrideMustBePrivate(t *testing.T) {
+	s := newTestServer(t, config.Config{LanIP: "203.0.113.5"})
+	if ip := s.GetLanIPOverride(); ip != "" {
+		t.Errorf("public override %s taken from the config", ip)
+	}
+	for _, ip := range []string{"192.168.1.9", "fd00::9", "fe80::9"} {
+		if err := s.SetLanIPOverride(ip); err != nil {
+			t.Errorf("%s: %v", ip, err)
+		}
+	}
+	for _, ip := range []string{"203.0.113.5", "2001:db8::5", "nonsense"} {
+		if err := s.SetLanIPOverride(ip); err == nil {
+			t.Errorf("%s accepted", ip)
+		}
+	}
+	if ip := s.GetLanIPOverride(); ip != "fe80::9" {
+		t.Errorf("override = %s after refused changes, want fe80::9", ip)
+	}
+
+	// A configured certificate may cover any address.
+	if _, err := CheckLanIP(config.Config{TLSCertFile: "own.crt"}, "203.0.113.5"); err != nil {
+		t.Errorf("with own certificate: %v", err)
+	}
+}
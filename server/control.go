@@ -0,0 +1,159 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/gold16/ginkgo-talk/ai"
+	"github.com/gold16/ginkgo-talk/config"
+)
+
+// Status summarizes the running server for the desktop side, such as the
+// ginkgo-talk status command.
+type Status struct {
+	Name          string           `json:"name"`
+	Version       string           `json:"version"`
+	URL           string           `json:"url"`
+	PairMode      PairMode         `json:"pairMode"`
+	AIAvailable   bool             `json:"aiAvailable"`
+	Model         string           `json:"model,omitempty"`
+	Devices       int              `json:"devices"`
+	ClientAddr    string           `json:"clientAddr,omitempty"`
+	Connection    ConnectionStatus `json:"connection"`
+	CAFingerprint string           `json:"caFingerprint,omitempty"`
+}
+
+// Status returns the server's current status.
+func (s *Server) Status() Status {
+	s.mu.RLock()
+	clientAddr := s.clientAddr
+	s.mu.RUnlock()
+	st := Status{
+		Name:        s.name,
+		Version:     s.version,
+		URL:         s.BaseURL(),
+		PairMode:    s.pairMode,
+		AIAvailable: s.ai.IsAvailable(),
+		Devices:     len(s.sessions.list()),
+		ClientAddr:  clientAddr,
+		Connection:  s.connectionStatus(),
+	}
+	if st.AIAvailable {
+		st.Model = s.ai.Model()
+	}
+	if s.ca != nil {
+		st.CAFingerprint = s.ca.Fingerprint()
+	}
+	return st
+}
+
+// PairCode returns the pair code, if the pair mode uses one.
+func (s *Server) PairCode() (string, error) {
+	if !s.pairMode.needsCode() {
+		return "", fmt.Errorf("pair mode %s doesn't use a pair code", s.pairMode)
+	}
+	return s.pairCodes.current(), nil
+}
+
+// PairLink returns the one-time pairing link the QR code currently carries.
+func (s *Server) PairLink() (string, error) {
+	link, err := s.pairLinks.Current()
+	if err != nil {
+		return "", err
+	}
+	return s.defaultPairURL() + "/#pair=" + link.nonce, nil
+}
+
+// ConnectedDevice returns the ID of the device holding the WebSocket, or
+// "" if none is connected.
+func (s *Server) ConnectedDevice() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.connDeviceID
+}
+
+// Tokens returns the server's API tokens.
+func (s *Server) Tokens() *TokenStore {
+	return s.tokens
+}
+
+// Type types text on this computer, after the AI if mode asks for it and
+// the configured filters, and returns what was typed. Unlike text from the phone, nothing
+// is submitted with Enter.
+func (s *Server) Type(text string, mode ai.Mode) (string, error) {
+	if text == "" {
+		return "", errors.New("nothing to type")
+	}
+	mode, err := s.resolveMode(mode)
+	if err != nil {
+		return "", err
+	}
+
+	if !s.jobs.start() {
+		return "", errShuttingDown
+	}
+	defer s.jobs.done()
+
+	if mode != ai.ModeRaw {
+		processed, err := s.ai.Process(text, mode)
+		if err != nil {
+			s.publishBackendError("ai", err, "")
+			return "", fmt.Errorf("AI processing: %w", err)
+		}
+		s.publishProcessed(eventOrigin{source: "cli"}, text, processed, mode)
+		text = processed
+	}
+	text, err = s.filterText(eventOrigin{source: "cli"}, text, mode)
+	if err != nil {
+		return "", err
+	}
+	log.Printf("Typing text from the command line")
+	if err := s.typeText(text); err != nil {
+		s.publishBackendError("keyboard", err, "")
+		return "", err
+	}
+	s.publishTyped(eventOrigin{source: "cli"}, text, mode, false)
+	return text, nil
+}
+
+// ApplyConfig applies a changed setting to the running server, and reports
+// whether it could. Other settings take effect on the next start.
+func (s *Server) ApplyConfig(key string, cfg config.Config) bool {
+	switch key {
+	case "apiKey":
+		s.ai.SetAPIKey(cfg.APIKey)
+	case "baseUrl":
+		if !s.ai.SetBaseURL(cfg.BaseURL) {
+			return false
+		}
+	case "model":
+		if !s.ai.SetModel(cfg.Model) {
+			return false
+		}
+	case "lanIp":
+		if err := s.SetLanIPOverride(cfg.LanIP); err != nil {
+			log.Printf("LAN IP not changed: %v", err)
+			return false
+		}
+		return true
+	case "policies", "devicePolicies", "defaultPolicy":
+		s.policies.load(cfg)
+		return true
+	case "filters":
+		s.filters.load(cfg)
+		return true
+	case "actions":
+		s.actions.load(cfg)
+		s.events.publish(Event{Type: EventActionsChanged})
+		return true
+	default:
+		return false
+	}
+	log.Printf("AI setting %s changed from the command line", key)
+	s.events.publish(Event{
+		Type: EventAIConfigChanged,
+		Data: map[string]interface{}{"aiAvailable": s.ai.IsAvailable(), "model": s.ai.Model()},
+	})
+	return true
+}
@@ -0,0 +1,24 @@
+//go:build !windows
+
+package server
+
+import (
+	"os/exec"
+	"runtime"
+)
+
+func hideWindow(*exec.Cmd) {}
+
+// OpenURL opens rawURL with the desktop's default handler.
+func OpenURL(rawURL string) error {
+	opener := "xdg-open"
+	if runtime.GOOS == "darwin" {
+		opener = "open"
+	}
+	cmd := exec.Command(opener, rawURL)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go cmd.Wait()
+	return nil
+}
@@ -0,0 +1,26 @@
+//go:build windows
+
+package server
+
+import (
+	"fmt"
+	"net/url"
+	"os/exec"
+	"syscall"
+)
+
+// createNoWindow keeps console programs from flashing a window, as the
+// app itself has no console.
+const createNoWindow = 0x08000000
+
+func hideWindow(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true, CreationFlags: createNoWindow}
+}
+
+// OpenURL opens rawURL in the default browser.
+func OpenURL(rawURL string) error {
+	if _, err := url.ParseRequestURI(rawURL); err != nil {
+		return fmt.Errorf("invalid URL: %s", rawURL)
+	}
+	return exec.Command("rundll32", "url.dll,FileProtocolHandler", rawURL).Start()
+}
@@ -0,0 +1,275 @@
+package server
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gold16/ginkgo-talk/config"
+)
+
+const (
+	discoveryTimeout  = 1500 * time.Millisecond
+	discoveryCacheTTL = 10 * time.Second
+)
+
+// DiscoveredServer is a Ginkgo Talk server found on the LAN.
+type DiscoveredServer struct {
+	Name    string `json:"name"`
+	URL     string `json:"url"`
+	Version string `json:"version,omitempty"`
+	Self    bool   `json:"self,omitempty"`
+}
+
+// discoveryCache keeps the last browse result, so a phone opening its
+// desktop list doesn't trigger a burst of multicast queries.
+type discoveryCache struct {
+	mu      sync.Mutex
+	at      time.Time
+	servers []DiscoveredServer
+}
+
+// defaultName is the server's name when it has neither a configured name
+// nor a hostname.
+const defaultName = "Ginkgo Talk"
+
+// serverName is the human-readable name phones list this computer under:
+// the configured name, or else the hostname.
+func serverName(cfg config.Config) string {
+	if name := strings.TrimSpace(cfg.Name); name != "" {
+		return name
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		if label, _, _ := strings.Cut(hostname, "."); label != "" {
+			return label
+		}
+	}
+	return defaultName
+}
+
+// handleDiscover lists the Ginkgo Talk servers on the LAN, including this
+// one. Browsers can't send multicast themselves, so any paired server
+// browses on the phone's behalf; credentials for each server stay with
+// that server's origin on the phone.
+func (s *Server) handleDiscover(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if _, ok := s.authorize(w, r, scopeAny); !ok {
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"servers": s.discoverServers(r),
+	})
+}
+
+func (s *Server) discoverServers(r *http.Request) []DiscoveredServer {
+	s.discovery.mu.Lock()
+	defer s.discovery.mu.Unlock()
+	if time.Since(s.discovery.at) > discoveryCacheTTL {
+		s.discovery.servers = browseMDNS(discoveryTimeout)
+		s.discovery.at = time.Now()
+	}
+
+	self := DiscoveredServer{Name: s.name, URL: s.externalURL(r), Version: s.version, Self: true}
+	servers := []DiscoveredServer{self}
+	for _, srv := range s.discovery.servers {
+		if s.mdns != nil && srv.Name == s.mdns.instance {
+			continue // ourselves, answered by our own responder
+		}
+		servers = append(servers, srv)
+	}
+	sort.SliceStable(servers[1:], func(i, j int) bool {
+		return strings.ToLower(servers[1+i].Name) < strings.ToLower(servers[1+j].Name)
+	})
+	return servers
+}
+
+// browseMDNS asks the LAN for _ginkgotalk._tcp instances. The query goes
+// out from an ephemeral port, so responders reply directly to us
+// (RFC 6762 section 6.7) and no shared port 5353 socket is needed.
+func browseMDNS(timeout time.Duration) []DiscoveredServer {
+	query := make([]byte, 12)
+	binary.BigEndian.PutUint16(query[4:], 1)
+	query = appendDNSName(query, mdnsServiceType)
+	query = binary.BigEndian.AppendUint16(query, dnsTypePTR)
+	query = binary.BigEndian.AppendUint16(query, dnsClassIN)
+
+	var (
+		mu      sync.Mutex
+		records []dnsAnswer
+		wg      sync.WaitGroup
+	)
+	for _, group := range []*net.UDPAddr{mdnsGroupV4, mdnsGroupV6} {
+		network := "udp4"
+		if group.IP.To4() == nil {
+			network = "udp6"
+		}
+		conn, err := net.ListenUDP(network, nil)
+		if err != nil {
+			continue
+		}
+		if _, err := conn.WriteToUDP(query, group); err != nil {
+			conn.Close()
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+			conn.SetReadDeadline(time.Now().Add(timeout))
+			buf := make([]byte, 9000)
+			for {
+				n, _, err := conn.ReadFromUDP(buf)
+				if err != nil {
+					return
+				}
+				answers, err := parseDNSAnswers(buf[:n])
+				if err != nil {
+					continue
+				}
+				mu.Lock()
+				records = append(records, answers...)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return assembleServers(records)
+}
+
+// dnsAnswer is a decoded resource record of one of the types browsing uses.
+type dnsAnswer struct {
+	name   string
+	typ    uint16
+	target string   // PTR, SRV
+	port   int      // SRV
+	txt    []string // TXT
+	ip     net.IP   // A, AAAA
+}
+
+// parseDNSAnswers decodes the answer and additional sections of a response.
+func parseDNSAnswers(msg []byte) ([]dnsAnswer, error) {
+	if len(msg) < 12 || binary.BigEndian.Uint16(msg[2:])&0x8000 == 0 {
+		return nil, errDNSMalformed
+	}
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	rrcount := int(binary.BigEndian.Uint16(msg[6:])) + int(binary.BigEndian.Uint16(msg[8:])) + int(binary.BigEndian.Uint16(msg[10:]))
+
+	off := 12
+	for i := 0; i < qdcount; i++ {
+		_, next, err := readDNSName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		off = next + 4
+	}
+
+	var answers []dnsAnswer
+	for i := 0; i < rrcount; i++ {
+		name, next, err := readDNSName(msg, off)
+		if err != nil || next+10 > len(msg) {
+			return nil, errDNSMalformed
+		}
+		typ := binary.BigEndian.Uint16(msg[next:])
+		rdlen := int(binary.BigEndian.Uint16(msg[next+8:]))
+		rdata := next + 10
+		if rdata+rdlen > len(msg) {
+			return nil, errDNSMalformed
+		}
+		off = rdata + rdlen
+
+		ans := dnsAnswer{name: name, typ: typ}
+		switch typ {
+		case dnsTypePTR:
+			if ans.target, _, err = readDNSName(msg, rdata); err != nil {
+				continue
+			}
+		case dnsTypeSRV:
+			if rdlen < 7 {
+				continue
+			}
+			ans.port = int(binary.BigEndian.Uint16(msg[rdata+4:]))
+			if ans.target, _, err = readDNSName(msg, rdata+6); err != nil {
+				continue
+			}
+		case dnsTypeTXT:
+			for p := rdata; p < off; {
+				n := int(msg[p])
+				if p+1+n > off {
+					break
+				}
+				ans.txt = append(ans.txt, string(msg[p+1:p+1+n]))
+				p += 1 + n
+			}
+		case dnsTypeA, dnsTypeAAAA:
+			if rdlen != net.IPv4len && rdlen != net.IPv6len {
+				continue
+			}
+			ans.ip = net.IP(append([]byte(nil), msg[rdata:off]...))
+		default:
+			continue
+		}
+		answers = append(answers, ans)
+	}
+	return answers, nil
+}
+
+// assembleServers joins PTR, SRV, TXT and address records into servers.
+func assembleServers(records []dnsAnswer) []DiscoveredServer {
+	find := func(name string, typ uint16) []dnsAnswer {
+		var out []dnsAnswer
+		for _, rec := range records {
+			if rec.typ == typ && strings.EqualFold(rec.name, name) {
+				out = append(out, rec)
+			}
+		}
+		return out
+	}
+
+	seen := make(map[string]bool)
+	var servers []DiscoveredServer
+	for _, ptr := range find(mdnsServiceType, dnsTypePTR) {
+		instance := ptr.target
+		if seen[strings.ToLower(instance)] {
+			continue
+		}
+		srvs := find(instance, dnsTypeSRV)
+		if len(srvs) == 0 {
+			continue
+		}
+		seen[strings.ToLower(instance)] = true
+		srv := srvs[0]
+
+		// Prefer an IPv4 address: not every phone resolves .local names.
+		host := strings.TrimSuffix(srv.target, ".")
+		for _, typ := range []uint16{dnsTypeAAAA, dnsTypeA} {
+			if addrs := find(srv.target, typ); len(addrs) > 0 {
+				host = addrs[0].ip.String()
+			}
+		}
+
+		server := DiscoveredServer{Name: strings.TrimSuffix(instance, "."+mdnsServiceType)}
+		path := "/"
+		for _, txt := range find(instance, dnsTypeTXT) {
+			for _, kv := range txt.txt {
+				key, value, _ := strings.Cut(kv, "=")
+				switch key {
+				case "path":
+					path = value
+				case "version":
+					server.Version = value
+				}
+			}
+		}
+		server.URL = "https://" + net.JoinHostPort(host, strconv.Itoa(srv.port)) + strings.TrimSuffix(path, "/")
+		servers = append(servers, server)
+	}
+	return servers
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gold16/ginkgo-talk/config"
+)
+
+func TestAssembleServers(t *testing.T) {
+	instance := func(name string) string { return name + "." + mdnsServiceType }
+	records := []dnsAnswer{
+		{name: mdnsServiceType, typ: dnsTypePTR, target: instance("Laptop")},
+		{name: instance("Laptop"), typ: dnsTypeSRV, target: "gtalk-laptop.local", port: 9600},
+		{name: instance("Laptop"), typ: dnsTypeTXT, txt: []string{"path=/gtalk/", "version=1.2"}},
+		{name: "gtalk-laptop.local", typ: dnsTypeAAAA, ip: net.ParseIP("fd00::5")},
+		{name: "gtalk-laptop.local", typ: dnsTypeA, ip: net.ParseIP("192.168.1.5")},
+		// Announced twice, by two responders on different interfaces.
+		{name: mdnsServiceType, typ: dnsTypePTR, target: instance("LAPTOP")},
+		// Only an IPv6 address: used as is.
+		{name: mdnsServiceType, typ: dnsTypePTR, target: instance("Desk")},
+		{name: instance("Desk"), typ: dnsTypeSRV, target: "gtalk-desk.local", port: 9527},
+		{name: "gtalk-desk.local", typ: dnsTypeAAAA, ip: net.ParseIP("fd00::20")},
+		// No address at all: the host name.
+		{name: mdnsServiceType, typ: dnsTypePTR, target: instance("Den")},
+		{name: instance("Den"), typ: dnsTypeSRV, target: "gtalk-den.local.", port: 9527},
+		// No SRV record: skipped.
+		{name: mdnsServiceType, typ: dnsTypePTR, target: instance("Gone")},
+	}
+	want := []DiscoveredServer{
+		{Name: "Laptop", URL: "https://192.168.1.5:9600/gtalk", Version: "1.2"},
+		{Name: "Desk", URL: "https://[fd00::20]:9527"},
+		{Name: "Den", URL: "https://gtalk-den.local:9527"},
+	}
+	got := assembleServers(records)
+	if len(got) != len(want) {
+		t.Fatalf("servers = %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("server %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestParseDNSAnswersMalformed(t *testing.T) {
+	resp, _ := testResponder().respond(dnsQuery(0, mdnsServiceType, dnsTypePTR, dnsClassIN), false)
+	if resp == nil {
+		t.Fatal("no response")
+	}
+	for name, msg := range map[string][]byte{
+		"short":     resp[:8],
+		"truncated": resp[:len(resp)-3],
+		"query":     dnsQuery(0, mdnsServiceType, dnsTypePTR, dnsClassIN),
+	} {
+		if _, err := parseDNSAnswers(msg); err == nil {
+			t.Errorf("%s message parsed", name)
+		}
+	}
+}
+
+func TestDiscoverServers(t *testing.T) {
+	s := newTestServer(t, config.Config{Name: "Office"})
+	s.mdns = &mdnsResponder{instance: "Office"}
+	s.discovery.at = time.Now()
+	s.discovery.servers = []DiscoveredServer{
+		{Name: "laptop", URL: "https://192.168.1.5:9527"},
+		{Name: "Office", URL: "https://192.168.1.20:9527"}, // ourselves
+		{Name: "Attic", URL: "https://192.168.1.7:9527"},
+	}
+
+	r := httptest.NewRequest("GET", "/api/discover", nil)
+	servers := s.discoverServers(r)
+	var names []string
+	for _, srv := range servers {
+		names = append(names, srv.Name)
+	}
+	if len(servers) != 3 || !servers[0].Self || servers[0].Name != "Office" || names[1] != "Attic" || names[2] != "laptop" {
+		t.Errorf("servers = %+v, want Office (self), Attic, laptop", servers)
+	}
+}
+
+func TestHandleDiscoverNeedsAuth(t *testing.T) {
+	s := newTestServer(t, config.Config{})
+	w := httptest.NewRecorder()
+	s.handleDiscover(w, httptest.NewRequest("GET", "/api/discover", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("status %d, want 401", w.Code)
+	}
+}
+
+func TestServerName(t *testing.T) {
+	if got := serverName(config.Config{Name: "  Office  "}); got != "Office" {
+		t.Errorf("configured name: %q", got)
+	}
+	if got := serverName(config.Config{}); got == "" {
+		t.Error("no name without a configured one")
+	}
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Devices paired through SPAKE2 share an AES-256-GCM key with the server.
+// Every WebSocket payload to and from such a device is wrapped in an
+// envelope, so a MITM on a clicked-through certificate sees only ciphertext.
+//
+// The additional data binds each frame to its direction, the connection and
+// a sequence number, which stops reordering and replay across connections.
+
+// Envelope is an encrypted WebSocket payload.
+type Envelope struct {
+	Type string `json:"type"` // always "enc"
+	Seq  uint64 `json:"seq"`
+	IV   string `json:"iv"`
+	Data string `json:"data"`
+}
+
+var errPlaintextRejected = errors.New("plaintext message from end-to-end encrypted device")
+
+// wsClient wraps a phone's WebSocket connection and encrypts traffic when
+// the device has an end-to-end key.
+type wsClient struct {
+	conn     *websocket.Conn
+	deviceID string
+	connID   string
+	aead     cipher.AEAD // nil for devices paired without SPAKE2
+
+	writeMu sync.Mutex
+	sendSeq uint64
+	recvSeq uint64
+}
+
+func newWSClient(conn *websocket.Conn, deviceID string, e2eKey []byte) (*wsClient, error) {
+	connID, err := generateAuthToken()
+	if err != nil {
+		return nil, err
+	}
+	c := &wsClient{conn: conn, deviceID: deviceID, connID: connID}
+	if len(e2eKey) > 0 {
+		block, err := aes.NewCipher(e2eKey)
+		if err != nil {
+			return nil, err
+		}
+		if c.aead, err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// hello announces the connection ID the client must bind its frames to.
+// It is the only message sent in plaintext on an encrypted connection.
+func (c *wsClient) hello() error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	return c.conn.WriteJSON(map[string]interface{}{
+		"type": "hello",
+		"conn": c.connID,
+		"e2e":  c.aead != nil,
+	})
+}
+
+// send writes v as JSON, encrypting it for end-to-end devices.
+func (c *wsClient) send(v interface{}) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	if c.aead == nil {
+		return c.conn.WriteJSON(v)
+	}
+
+	plaintext, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	c.sendSeq++
+	iv := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(iv); err != nil {
+		return err
+	}
+	sealed := c.aead.Seal(nil, iv, plaintext, c.additionalData("s2c", c.sendSeq))
+	return c.conn.WriteJSON(Envelope{
+		Type: "enc",
+		Seq:  c.sendSeq,
+		IV:   base64.StdEncoding.EncodeToString(iv),
+		Data: base64.StdEncoding.EncodeToString(sealed),
+	})
+}
+
+// open unwraps an incoming frame. Encrypted devices must send envelopes
+// with strictly increasing sequence numbers.
+func (c *wsClient) open(raw []byte) ([]byte, error) {
+	if c.aead == nil {
+		return raw, nil
+	}
+
+	var env Envelope
+	if err := json.Unmarshal(raw, &env); err != nil {
+		return nil, err
+	}
+	if env.Type != "enc" {
+		return nil, errPlaintextRejected
+	}
+	if env.Seq <= c.recvSeq {
+		return nil, fmt.Errorf("replayed frame (seq %d)", env.Seq)
+	}
+	iv, err := base64.StdEncoding.DecodeString(env.IV)
+	if err != nil || len(iv) != c.aead.NonceSize() {
+		return nil, fmt.Errorf("invalid iv")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(env.Data)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := c.aead.Open(nil, iv, sealed, c.additionalData("c2s", env.Seq))
+	if err != nil {
+		return nil, fmt.Errorf("decrypt frame: %w", err)
+	}
+	c.recvSeq = env.Seq
+	return plaintext, nil
+}
+
+func (c *wsClient) additionalData(dir string, seq uint64) []byte {
+	return []byte(fmt.Sprintf("gtalk-e2e|%s|%s|%d", dir, c.connID, seq))
+}
+
+func (c *wsClient) close() error {
+	return c.conn.Close()
+}
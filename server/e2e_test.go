@@ -0,0 +1,279 @@
+package server
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gold16/ginkgo-talk/config"
+	"github.com/gorilla/websocket"
+)
+
+// e2ePeer is the phone's end of an encrypted connection.
+type e2ePeer struct {
+	t      *testing.T
+	aead   cipher.AEAD
+	connID string
+}
+
+func newE2EPeer(t *testing.T, key []byte, connID string) *e2ePeer {
+	t.Helper()
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &e2ePeer{t: t, aead: aead, connID: connID}
+}
+
+func (p *e2ePeer) ad(dir string, seq uint64) []byte {
+	return []byte(fmt.Sprintf("gtalk-e2e|%s|%s|%d", dir, p.connID, seq))
+}
+
+// seal encrypts plaintext as the phone does, for direction dir.
+func (p *e2ePeer) seal(dir string, seq uint64, plaintext string) []byte {
+	p.t.Helper()
+	iv := make([]byte, p.aead.NonceSize())
+	if _, err := rand.Read(iv); err != nil {
+		p.t.Fatal(err)
+	}
+	raw, err := json.Marshal(Envelope{
+		Type: "enc",
+		Seq:  seq,
+		IV:   base64.StdEncoding.EncodeToString(iv),
+		Data: base64.StdEncoding.EncodeToString(p.aead.Seal(nil, iv, []byte(plaintext), p.ad(dir, seq))),
+	})
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	return raw
+}
+
+func newE2EClient(t *testing.T, conn *websocket.Conn) (*wsClient, []byte) {
+	t.Helper()
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	c, err := newWSClient(conn, "phone", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, key
+}
+
+func TestE2EOpen(t *testing.T) {
+	c, key := newE2EClient(t, nil)
+	phone := newE2EPeer(t, key, c.connID)
+	msg := `{"type":"text","text":"hi"}`
+
+	got, err := c.open(phone.seal("c2s", 1, msg))
+	if err != nil || string(got) != msg {
+		t.Fatalf("open = %q, %v; want %q", got, err, msg)
+	}
+
+	// Skipping ahead is fine; going back is not.
+	if _, err := c.open(phone.seal("c2s", 5, msg)); err != nil {
+		t.Fatalf("seq 5 after 1: %v", err)
+	}
+	for _, seq := range []uint64{5, 3} {
+		if _, err := c.open(phone.seal("c2s", seq, msg)); err == nil {
+			t.Errorf("seq %d after 5 accepted", seq)
+		}
+	}
+
+	other := newE2EPeer(t, key, "another-connection")
+	wrongKey := make([]byte, 32)
+	for name, raw := range map[string][]byte{
+		"server direction": phone.seal("s2c", 6, msg),
+		"other connection": other.seal("c2s", 6, msg),
+		"wrong key":        newE2EPeer(t, wrongKey, c.connID).seal("c2s", 6, msg),
+		"plaintext":        []byte(msg),
+		"bad seq in AD":    relabel(t, phone.seal("c2s", 7, msg), 6),
+	} {
+		if _, err := c.open(raw); err == nil {
+			t.Errorf("%s accepted", name)
+		}
+	}
+	if _, err := c.open([]byte(msg)); err != errPlaintextRejected {
+		t.Errorf("plaintext: error %v, want %v", err, errPlaintextRejected)
+	}
+
+	// Nothing above moved the sequence on.
+	if got, err := c.open(phone.seal("c2s", 6, msg)); err != nil || string(got) != msg {
+		t.Errorf("seq 6 after rejected frames: %q, %v", got, err)
+	}
+}
+
+// relabel changes the sequence number of a sealed envelope without
+// re-encrypting it.
+func relabel(t *testing.T, raw []byte, seq uint64) []byte {
+	t.Helper()
+	var env Envelope
+	if err := json.Unmarshal(raw, &env); err != nil {
+		t.Fatal(err)
+	}
+	env.Seq = seq
+	out, err := json.Marshal(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestE2EOpenTampered(t *testing.T) {
+	c, key := newE2EClient(t, nil)
+	phone := newE2EPeer(t, key, c.connID)
+
+	var env Envelope
+	json.Unmarshal(phone.seal("c2s", 1, `{"type":"text","text":"hi"}`), &env)
+	data, _ := base64.StdEncoding.DecodeString(env.Data)
+	data[0] ^= 1
+	env.Data = base64.StdEncoding.EncodeToString(data)
+	raw, _ := json.Marshal(env)
+	if _, err := c.open(raw); err == nil {
+		t.Error("tampered frame accepted")
+	}
+}
+
+func TestE2ESend(t *testing.T) {
+	serverConn := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		serverConn <- conn
+	}))
+	defer srv.Close()
+
+	phoneConn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer phoneConn.Close()
+	c, key := newE2EClient(t, <-serverConn)
+	defer c.close()
+	phone := newE2EPeer(t, key, c.connID)
+
+	if err := c.hello(); err != nil {
+		t.Fatal(err)
+	}
+	var hello map[string]interface{}
+	if err := phoneConn.ReadJSON(&hello); err != nil {
+		t.Fatal(err)
+	}
+	if hello["type"] != "hello" || hello["conn"] != c.connID || hello["e2e"] != true {
+		t.Fatalf("hello = %v", hello)
+	}
+
+	for seq := uint64(1); seq <= 2; seq++ {
+		if err := c.send(map[string]string{"type": "status", "n": fmt.Sprint(seq)}); err != nil {
+			t.Fatal(err)
+		}
+		var env Envelope
+		if err := phoneConn.ReadJSON(&env); err != nil {
+			t.Fatal(err)
+		}
+		if env.Type != "enc" || env.Seq != seq {
+			t.Fatalf("envelope %d: type %q seq %d", seq, env.Type, env.Seq)
+		}
+		iv, _ := base64.StdEncoding.DecodeString(env.IV)
+		sealed, _ := base64.StdEncoding.DecodeString(env.Data)
+		plaintext, err := phone.aead.Open(nil, iv, sealed, phone.ad("s2c", seq))
+		if err != nil {
+			t.Fatalf("envelope %d doesn't open with the s2c additional data: %v", seq, err)
+		}
+		if want := fmt.Sprintf(`{"n":"%d","type":"status"}`, seq); string(plaintext) != want {
+			t.Errorf("envelope %d = %s, want %s", seq, plaintext, want)
+		}
+		if strings.Contains(env.Data, "status") {
+			t.Error("plaintext visible in the envelope")
+		}
+	}
+}
+
+func TestPlainClientPassesThrough(t *testing.T) {
+	c, err := newWSClient(nil, "phone", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := []byte(`{"type":"text","text":"hi"}`)
+	if got, err := c.open(msg); err != nil || string(got) != string(msg) {
+		t.Errorf("open = %q, %v; want the frame unchanged", got, err)
+	}
+}
+
+func TestConfigOverEncryptedWebSocket(t *testing.T) {
+	s := newTestServer(t, config.Config{})
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	creds, err := s.sessions.issue("phone", "192.0.2.1:1", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The access token alone can't change settings over REST.
+	status, resp := postConfig(t, s, creds.AccessToken, `{"baseUrl":"https://evil.example.com"}`)
+	if status != http.StatusForbidden || resp["code"] != codeE2ERequired {
+		t.Fatalf("REST config from e2e device: status %d %v, want 403 %s", status, resp, codeE2ERequired)
+	}
+	if s.ai.BaseURL() == "https://evil.example.com" {
+		t.Fatal("REST config applied")
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(s.handleWebSocket))
+	defer srv.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"),
+		http.Header{"Authorization": {"Bearer " + creds.AccessToken}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var hello map[string]interface{}
+	if err := conn.ReadJSON(&hello); err != nil {
+		t.Fatal(err)
+	}
+	phone := newE2EPeer(t, key, hello["conn"].(string))
+
+	raw := phone.seal("c2s", 1, `{"type":"config","config":{"apiKey":"sk-new","model":"m2"}}`)
+	if err := conn.WriteMessage(websocket.TextMessage, raw); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		var env Envelope
+		if err := conn.ReadJSON(&env); err != nil {
+			t.Fatal(err)
+		}
+		iv, _ := base64.StdEncoding.DecodeString(env.IV)
+		sealed, _ := base64.StdEncoding.DecodeString(env.Data)
+		plaintext, err := phone.aead.Open(nil, iv, sealed, phone.ad("s2c", env.Seq))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var msg map[string]interface{}
+		json.Unmarshal(plaintext, &msg)
+		if msg["type"] == "event" {
+			continue
+		}
+		if msg["type"] != "config_saved" || msg["model"] != "m2" {
+			t.Fatalf("reply = %v, want config_saved", msg)
+		}
+		break
+	}
+	if s.ai.APIKey() != "sk-new" {
+		t.Error("API key not applied")
+	}
+}
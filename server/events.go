@@ -0,0 +1,372 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gold16/ginkgo-talk/ai"
+)
+
+// Event types pushed to the phone over its WebSocket and to desktop
+// integrations over /api/events, webhooks and MQTT.
+const (
+	EventAIConfigChanged    = "ai_config_changed"   // data: aiAvailable, model
+	EventPairExpiring       = "pair_expiring"       // data: deviceId, expiresAt
+	EventDeviceConnected    = "device_connected"    // data: deviceId, clientAddr
+	EventDeviceDisconnected = "device_disconnected" // data: deviceId, clientAddr
+	EventDevicePaired       = "device_paired"       // data: deviceId, remoteAddr
+	EventPairDenied         = "pair_denied"         // data: deviceId, remoteAddr
+	EventDeviceRevoked      = "device_revoked"      // data: deviceId
+	EventScriptsChanged     = "scripts_changed"     // data: scripts
+	EventActionsChanged     = "actions_changed"     // no data; phones fetch /api/status
+	EventActionRun          = "action_run"          // data: source, deviceId or token, name, status, exitCode
+	EventBackendError       = "backend_error"       // data: source ("action", "ai", "filter", "keyboard" or "script"), error
+	EventShutdown           = "server_shutdown"     // no data
+
+	// Text events carry what was typed, so they only go to desktop
+	// integrations: local /api/events streams, webhooks and MQTT.
+	EventTextTyped   = "text_typed"   // data: source, deviceId or token, mode, chars, submitted, text
+	EventAIProcessed = "ai_processed" // data: source, deviceId or token, mode, original, text
+)
+
+const (
+	// pairExpiryWarning is how long before a pairing session ends the
+	// phone is told to expect a new pairing.
+	pairExpiryWarning = 10 * time.Minute
+
+	// sseKeepAlive keeps idle event streams from being cut by proxies.
+	sseKeepAlive = 30 * time.Second
+
+	// eventQueueSize is how many events a slow subscriber may fall behind
+	// before it starts missing them.
+	eventQueueSize = 32
+)
+
+// Event is something that happened on the server.
+type Event struct {
+	ID   uint64      `json:"id"`
+	Type string      `json:"event"`
+	Time string      `json:"time"`
+	Data interface{} `json:"data,omitempty"`
+
+	to    string // only for this device, "" for everyone
+	from  string // caused by this device, which already knows about it
+	local bool   // only for desktop integrations, never for devices or API tokens
+}
+
+// forDevice reports whether a phone with deviceID should be sent ev.
+func (ev Event) forDevice(deviceID string) bool {
+	return !ev.local && (ev.to == "" || ev.to == deviceID) && ev.from != deviceID
+}
+
+// eventOrigin says where typed text came from.
+type eventOrigin struct {
+	source   string // "phone", "api" or "cli"
+	deviceID string
+	token    string // API token name
+}
+
+// origin describes text sent by p through source.
+func (p principal) origin(source string) eventOrigin {
+	o := eventOrigin{source: source, deviceID: p.deviceID()}
+	if p.token != nil {
+		o.token = p.token.Name
+	}
+	return o
+}
+
+func (o eventOrigin) data(fields map[string]interface{}) map[string]interface{} {
+	fields["source"] = o.source
+	if o.deviceID != "" {
+		fields["deviceId"] = o.deviceID
+	}
+	if o.token != "" {
+		fields["token"] = o.token
+	}
+	return fields
+}
+
+// textFields are the event data fields holding typed text, which
+// integrations can ask to have left out.
+var textFields = []string{"text", "original"}
+
+// withoutText returns ev with the typed text removed from its data.
+func (ev Event) withoutText() Event {
+	data, ok := ev.Data.(map[string]interface{})
+	if !ok {
+		return ev
+	}
+	redacted := make(map[string]interface{}, len(data))
+	for k, v := range data {
+		redacted[k] = v
+	}
+	for _, k := range textFields {
+		delete(redacted, k)
+	}
+	ev.Data = redacted
+	return ev
+}
+
+// eventSub is one subscriber. The subscriber closes done once it has
+// stopped reading ch, which lets shutdown wait for events to go out.
+type eventSub struct {
+	ch   chan Event
+	done chan struct{}
+}
+
+// eventBus fans events out to the phone's WebSocket and to SSE streams.
+// Publishing never blocks: a subscriber whose queue is full misses events.
+type eventBus struct {
+	mu     sync.Mutex
+	nextID uint64
+	subs   map[*eventSub]struct{}
+	closed bool
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{subs: make(map[*eventSub]struct{})}
+}
+
+func (b *eventBus) subscribe() *eventSub {
+	sub := &eventSub{ch: make(chan Event, eventQueueSize), done: make(chan struct{})}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		close(sub.ch)
+		return sub
+	}
+	b.subs[sub] = struct{}{}
+	return sub
+}
+
+// unsubscribe stops delivery to sub and closes its channel.
+func (b *eventBus) unsubscribe(sub *eventSub) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subs[sub]; ok {
+		delete(b.subs, sub)
+		close(sub.ch)
+	}
+}
+
+// stamp gives ev its ID and time, for events that are sent to someone
+// directly before they are published.
+func (b *eventBus) stamp(ev Event) Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.stampLocked(ev)
+}
+
+func (b *eventBus) stampLocked(ev Event) Event {
+	if ev.ID == 0 {
+		b.nextID++
+		ev.ID = b.nextID
+		ev.Time = time.Now().UTC().Format(time.RFC3339)
+	}
+	return ev
+}
+
+func (b *eventBus) publish(ev Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+	ev = b.stampLocked(ev)
+	for sub := range b.subs {
+		select {
+		case sub.ch <- ev:
+		default:
+			log.Printf("Event subscriber is falling behind, dropped %s", ev.Type)
+		}
+	}
+}
+
+// close ends every subscription and waits up to timeout for subscribers
+// to finish sending what they have queued.
+func (b *eventBus) close(timeout time.Duration) {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return
+	}
+	b.closed = true
+	subs := make([]*eventSub, 0, len(b.subs))
+	for sub := range b.subs {
+		subs = append(subs, sub)
+		close(sub.ch)
+	}
+	b.subs = make(map[*eventSub]struct{})
+	b.mu.Unlock()
+
+	deadline := time.After(timeout)
+	for _, sub := range subs {
+		select {
+		case <-sub.done:
+		case <-deadline:
+			return
+		}
+	}
+}
+
+// publishBackendError reports a failure the desktop couldn't handle.
+// deviceID is the phone whose request failed; it already got the error.
+func (s *Server) publishBackendError(source string, err error, deviceID string) {
+	s.events.publish(Event{
+		Type: EventBackendError,
+		Data: map[string]string{"source": source, "error": err.Error()},
+		from: deviceID,
+	})
+}
+
+// publishPairing reports a device paired, or a pairing request denied.
+func (s *Server) publishPairing(eventType, deviceID, remoteAddr string) {
+	s.events.publish(Event{
+		Type: eventType,
+		Data: map[string]string{"deviceId": deviceID, "remoteAddr": remoteAddr},
+	})
+}
+
+// publishTyped reports text typed on the desktop.
+func (s *Server) publishTyped(o eventOrigin, text string, mode ai.Mode, submitted bool) {
+	s.events.publish(Event{
+		Type: EventTextTyped,
+		Data: o.data(map[string]interface{}{
+			"mode":      mode,
+			"chars":     len([]rune(text)),
+			"submitted": submitted,
+			"text":      text,
+		}),
+		local: true,
+	})
+}
+
+// publishProcessed reports text the AI rewrote.
+func (s *Server) publishProcessed(o eventOrigin, original, processed string, mode ai.Mode) {
+	s.events.publish(Event{
+		Type: EventAIProcessed,
+		Data: o.data(map[string]interface{}{
+			"mode":     mode,
+			"original": original,
+			"text":     processed,
+		}),
+		local: true,
+	})
+}
+
+// forwardEvents sends bus events meant for the phone over its WebSocket
+// until sub is closed.
+func (s *Server) forwardEvents(client *wsClient, sub *eventSub) {
+	defer close(sub.done)
+	for ev := range sub.ch {
+		if !ev.forDevice(client.deviceID) {
+			continue
+		}
+		client.send(ev.message()) // a broken connection ends the read loop
+	}
+}
+
+// warnPairExpiry publishes EventPairExpiring for the device shortly before
+// its pairing session ends. Stop the returned timer to cancel the warning.
+func (s *Server) warnPairExpiry(deviceID string, expiresAt time.Time) *time.Timer {
+	return time.AfterFunc(time.Until(expiresAt.Add(-pairExpiryWarning)), func() {
+		s.events.publish(Event{
+			Type: EventPairExpiring,
+			Data: map[string]string{"deviceId": deviceID, "expiresAt": expiresAt.Format(time.RFC3339)},
+			to:   deviceID,
+		})
+	})
+}
+
+// message is the WebSocket form of ev.
+func (ev Event) message() map[string]interface{} {
+	return map[string]interface{}{
+		"type":  "event",
+		"id":    ev.ID,
+		"event": ev.Type,
+		"time":  ev.Time,
+		"data":  ev.Data,
+	}
+}
+
+// handleEvents streams events as Server-Sent Events. It is meant for
+// scripts on the desktop, which may connect without a token; paired
+// devices and API tokens can use it with theirs, and see only events for
+// everyone or for themselves. What was typed only goes to API tokens with
+// ScopeEventsText: local streams without a token get the text events
+// without the text, and devices and other tokens don't get them at all.
+// ?types=a,b limits the stream to those event types.
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	p, authed := s.identify(r)
+	if !authed && !isLocalRequest(r) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "unauthorized"})
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	var types map[string]bool
+	if q := strings.TrimSpace(r.URL.Query().Get("types")); q != "" {
+		types = make(map[string]bool)
+		for _, t := range strings.Split(q, ",") {
+			types[strings.TrimSpace(t)] = true
+		}
+	}
+
+	sub := s.events.subscribe()
+	defer close(sub.done)
+	defer s.events.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case ev, ok := <-sub.ch:
+			if !ok {
+				return
+			}
+			if authed && ev.to != "" && ev.to != p.deviceID() {
+				continue
+			}
+			if ev.local {
+				switch {
+				case !authed:
+					ev = ev.withoutText()
+				case p.token == nil || !p.can(ScopeEventsText):
+					continue
+				}
+			}
+			if types != nil && !types[ev.Type] {
+				continue
+			}
+			data, err := json.Marshal(ev)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.ID, ev.Type, data)
+			flusher.Flush()
+		}
+	}
+}
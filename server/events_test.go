@@ -0,0 +1,98 @@
+package server
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gold16/ginkgo-talk/ai"
+	"github.com/gold16/ginkgo-talk/config"
+)
+
+// readEvents opens /api/events with token, publishes a typed text and a
+// marker event, and returns the stream's data lines up to the marker.
+func readEvents(t *testing.T, s *Server, url, token string) []string {
+	t.Helper()
+	req, _ := http.NewRequest("GET", url+"/api/events", nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+	lines := bufio.NewScanner(resp.Body)
+	lines.Scan() // ": connected", sent once subscribed
+
+	s.publishTyped(eventOrigin{source: "phone", deviceID: "d1"}, "my secret", ai.ModeRaw, true)
+	s.events.publish(Event{Type: EventScriptsChanged})
+
+	var data []string
+	done := time.AfterFunc(5*time.Second, func() { resp.Body.Close() })
+	defer done.Stop()
+	for lines.Scan() {
+		line := lines.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		if strings.Contains(line, EventScriptsChanged) {
+			return data
+		}
+		data = append(data, line)
+	}
+	t.Fatal("stream ended before the marker event")
+	return nil
+}
+
+func TestEventsTextNeedsScope(t *testing.T) {
+	s := newTestServer(t, config.Config{})
+	srv := httptest.NewServer(http.HandlerFunc(s.handleEvents))
+	defer srv.Close()
+
+	withText, _, err := s.tokens.Create("reader", []Scope{ScopeEventsText}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	without, _, err := s.tokens.Create("typist", []Scope{ScopeType}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Local, without a token: the event, but not the text.
+	data := readEvents(t, s, srv.URL, "")
+	if len(data) != 1 || !strings.Contains(data[0], EventTextTyped) || strings.Contains(data[0], "my secret") {
+		t.Errorf("local stream got %q, want text_typed without the text", data)
+	}
+	// A token with events:text gets the text.
+	data = readEvents(t, s, srv.URL, withText)
+	if len(data) != 1 || !strings.Contains(data[0], "my secret") {
+		t.Errorf("events:text token got %q, want the text", data)
+	}
+	// Other tokens don't get text events.
+	if data := readEvents(t, s, srv.URL, without); len(data) != 0 {
+		t.Errorf("token without events:text got %q", data)
+	}
+}
+
+func TestParseScopesAllExcludesEventsText(t *testing.T) {
+	scopes, err := ParseScopes("all")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sc := range scopes {
+		if sc == ScopeEventsText {
+			t.Error("all includes events:text")
+		}
+	}
+	scopes, err = ParseScopes("all,events:text")
+	if err != nil || len(scopes) != len(allScopes)+1 {
+		t.Errorf("all,events:text = %v, %v", scopes, err)
+	}
+}
@@ -0,0 +1,215 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gold16/ginkgo-talk/ai"
+	"github.com/gold16/ginkgo-talk/config"
+	"github.com/gold16/ginkgo-talk/input"
+)
+
+const (
+	defaultFilterTimeout = 5 * time.Second
+
+	// filterMaxOutput caps what a filter may print, in bytes.
+	filterMaxOutput = 1 << 20
+)
+
+// textFilter is an external command that rewrites text before it is typed.
+type textFilter struct {
+	name    string
+	command []string
+	timeout time.Duration
+	modes   map[ai.Mode]bool // nil for every mode
+	block   bool             // type nothing when the filter fails
+}
+
+// filterMeta tells a filter about the text, as JSON in GTALK_FILTER_META.
+type filterMeta struct {
+	Filter    string  `json:"filter"`
+	Mode      ai.Mode `json:"mode"`
+	Source    string  `json:"source"` // "phone", "api" or "cli"
+	DeviceID  string  `json:"deviceId,omitempty"`
+	Token     string  `json:"token,omitempty"`
+	TargetApp string  `json:"targetApp,omitempty"`
+}
+
+// filterChain holds the filters from gtalk_config.json, in order.
+type filterChain struct {
+	mu      sync.RWMutex
+	filters []textFilter
+}
+
+func newFilterChain(cfg config.Config) *filterChain {
+	fc := &filterChain{}
+	fc.load(cfg)
+	return fc
+}
+
+// load replaces the filters with those in cfg. Invalid entries are logged
+// and skipped.
+func (fc *filterChain) load(cfg config.Config) {
+	var filters []textFilter
+	for i, fcfg := range cfg.Filters {
+		if len(fcfg.Command) == 0 || fcfg.Command[0] == "" {
+			log.Printf("Skipping filter %d: no command", i+1)
+			continue
+		}
+		f := textFilter{
+			name:    fcfg.Name,
+			command: fcfg.Command,
+			timeout: time.Duration(fcfg.Timeout) * time.Second,
+		}
+		if f.name == "" {
+			f.name = filepath.Base(fcfg.Command[0])
+		}
+		if f.timeout <= 0 {
+			f.timeout = defaultFilterTimeout
+		}
+		switch fcfg.OnError {
+		case "", "pass":
+		case "block":
+			f.block = true
+		default:
+			log.Printf("Skipping filter %s: onError is %q, not pass or block", f.name, fcfg.OnError)
+			continue
+		}
+		if len(fcfg.Modes) > 0 {
+			f.modes = make(map[ai.Mode]bool, len(fcfg.Modes))
+			for _, m := range fcfg.Modes {
+				f.modes[ai.Mode(m)] = true
+			}
+		}
+		filters = append(filters, f)
+	}
+
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.filters = filters
+}
+
+func (fc *filterChain) list() []textFilter {
+	fc.mu.RLock()
+	defer fc.mu.RUnlock()
+	return fc.filters
+}
+
+// filterText runs text through the filters for mode, in order. A filter
+// that fails or times out is passed over, unless it is set to block, in
+// which case an error is returned and nothing should be typed.
+func (s *Server) filterText(o eventOrigin, text string, mode ai.Mode) (string, error) {
+	filters := s.filters.list()
+	if len(filters) == 0 {
+		return text, nil
+	}
+	meta := filterMeta{Mode: mode, Source: o.source, DeviceID: o.deviceID, Token: o.token, TargetApp: s.targetApp()}
+	for _, f := range filters {
+		if f.modes != nil && !f.modes[mode] {
+			continue
+		}
+		meta.Filter = f.name
+		out, err := f.run(text, meta)
+		if err != nil {
+			err = fmt.Errorf("filter %s: %w", f.name, err)
+			s.publishBackendError("filter", err, o.deviceID)
+			if f.block {
+				log.Printf("Not typing: %v", err)
+				return "", err
+			}
+			log.Printf("Passing text on unchanged: %v", err)
+			continue
+		}
+		text = out
+	}
+	return text, nil
+}
+
+// targetApp names the application that will receive the typing, if the
+// input backend can tell.
+func (s *Server) targetApp() string {
+	r, ok := s.input.(input.AppReporter)
+	if !ok {
+		return ""
+	}
+	app, err := r.ForegroundApp()
+	if err != nil {
+		return ""
+	}
+	return app
+}
+
+func (f textFilter) run(text string, meta filterMeta) (string, error) {
+	metaJSON, err := json.Marshal(meta)
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), f.timeout)
+	defer cancel()
+
+	// A filter printing without end is stopped rather than buffered.
+	stdout := &cappedBuffer{max: filterMaxOutput + 1, stop: true}
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, f.command[0], f.command[1:]...)
+	cmd.Env = append(os.Environ(), "GTALK_FILTER_META="+string(metaJSON))
+	cmd.Stdin = strings.NewReader(text)
+	cmd.Stdout = stdout
+	cmd.Stderr = &stderr
+	cmd.WaitDelay = time.Second // don't wait on children still holding the pipes
+	hideWindow(cmd)
+
+	err = cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", fmt.Errorf("timed out after %s", f.timeout)
+	}
+	if stdout.truncated {
+		return "", fmt.Errorf("printed more than %d bytes", filterMaxOutput)
+	}
+	if err != nil {
+		if msg := firstLine(stderr.String()); msg != "" {
+			return "", fmt.Errorf("%w: %s", err, msg)
+		}
+		return "", err
+	}
+
+	out := stdout.buf.String()
+	// Most tools end their output with a newline the text didn't have.
+	if !strings.HasSuffix(text, "\n") {
+		if trimmed, ok := strings.CutSuffix(out, "\n"); ok {
+			out = strings.TrimSuffix(trimmed, "\r")
+		}
+	}
+	switch {
+	case out == "":
+		return "", errors.New("printed nothing")
+	case len(out) > filterMaxOutput:
+		return "", fmt.Errorf("printed more than %d bytes", filterMaxOutput)
+	case !utf8.ValidString(out):
+		return "", errors.New("printed invalid UTF-8")
+	}
+	return out, nil
+}
+
+// firstLine returns the first non-empty line of s, shortened for the log.
+func firstLine(s string) string {
+	for _, line := range strings.Split(s, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			if len(line) > 200 {
+				line = line[:200] + "..."
+			}
+			return line
+		}
+	}
+	return ""
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/gold16/ginkgo-talk/ai"
+	"github.com/gold16/ginkgo-talk/config"
+)
+
+// fakeAI answers every chat completion with content.
+func fakeAI(t *testing.T, content string) *ai.Processor {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"` + content + `"}}]}`))
+	}))
+	t.Cleanup(srv.Close)
+	return ai.New(ai.Options{APIKey: "test", BaseURL: srv.URL})
+}
+
+func TestAIPreviewIsFiltered(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("needs sh")
+	}
+	// The filter isn't idempotent, so running it twice would show.
+	s := newTestServerWith(t, Options{
+		Config: config.Config{Filters: []config.Filter{
+			{Name: "tag", Command: []string{"sh", "-c", "cat; printf ' +f'"}, Modes: []string{"tidy"}},
+		}},
+		AI: fakeAI(t, "AI TEXT"),
+	})
+	creds, err := s.sessions.issue("phone", "192.0.2.1:1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(s.handleWebSocket))
+	defer srv.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"),
+		http.Header{"Authorization": {"Bearer " + creds.AccessToken}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// reply sends msg and returns the first answer other than progress.
+	reply := func(msg Message) map[string]interface{} {
+		t.Helper()
+		if err := conn.WriteJSON(msg); err != nil {
+			t.Fatal(err)
+		}
+		for {
+			var resp map[string]interface{}
+			if err := conn.ReadJSON(&resp); err != nil {
+				t.Fatal(err)
+			}
+			switch resp["type"] {
+			case "hello", "processing", "event":
+				continue
+			}
+			return resp
+		}
+	}
+
+	resp := reply(Message{Type: "text", Text: "hi", Mode: "tidy"})
+	if resp["type"] != "ai_preview" || resp["text"] != "AI TEXT +f" {
+		t.Fatalf("preview = %v, want the filtered AI text", resp)
+	}
+	// Confirmed unedited, the preview is typed as shown.
+	resp = reply(Message{Type: "text", Text: "AI TEXT +f", Mode: "tidy", Confirmed: true})
+	if resp["type"] != "ack" || resp["text"] != "AI TEXT +f" {
+		t.Errorf("confirmed preview: %v", resp)
+	}
+	// Edited, it goes through the tidy filters again, without more AI.
+	resp = reply(Message{Type: "text", Text: "edited", Mode: "tidy", Confirmed: true})
+	if resp["type"] != "ack" || resp["text"] != "edited +f" {
+		t.Errorf("edited preview: %v", resp)
+	}
+	// Raw text skips filters limited to tidy.
+	resp = reply(Message{Type: "text", Text: "plain", Mode: "raw"})
+	if resp["type"] != "ack" || resp["text"] != "plain" {
+		t.Errorf("raw text: %v", resp)
+	}
+
+	typed := s.input.(*recordingInput).Typed()
+	want := []string{"AI TEXT +f", "edited +f", "plain"}
+	if strings.Join(typed, "|") != strings.Join(want, "|") {
+		t.Errorf("typed %q, want %q", typed, want)
+	}
+}
+
+func TestFilterOutputIsCapped(t *testing.T) {
+	if _, err := exec.LookPath("yes"); err != nil {
+		t.Skip("needs yes")
+	}
+	f := textFilter{name: "endless", command: []string{"yes"}, timeout: time.Minute}
+	start := time.Now()
+	_, err := f.run("hi", filterMeta{})
+	if err == nil || !strings.Contains(err.Error(), "printed more than") {
+		t.Errorf("endless filter: %v, want the output limit error", err)
+	}
+	if time.Since(start) > 30*time.Second {
+		t.Error("endless filter ran until its timeout")
+	}
+}
@@ -0,0 +1,208 @@
+package server
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gold16/ginkgo-talk/config"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	defaultPingInterval   = 20 * time.Second
+	defaultPongTimeout    = 45 * time.Second
+	defaultIdleTimeout    = 2 * time.Minute
+	defaultMaxMessageSize = 64 << 10
+
+	// wsWriteWait bounds every write, so a phone that stopped reading
+	// can't block the server.
+	wsWriteWait = 10 * time.Second
+)
+
+// heartbeatConfig controls WebSocket keepalive and dead-connection detection.
+type heartbeatConfig struct {
+	pingInterval   time.Duration // how often the server pings the phone
+	pongTimeout    time.Duration // the connection is dropped after this long without a frame
+	idleTimeout    time.Duration // no messages for this long counts as idle
+	maxMessageSize int64         // largest message the phone may send, in bytes
+}
+
+// heartbeatConfigFrom reads the heartbeat settings from cfg. Out-of-range
+// values fall back to the defaults; the pong timeout must leave room for
+// at least one ping.
+func heartbeatConfigFrom(cfg config.Config) heartbeatConfig {
+	hb := heartbeatConfig{
+		pingInterval:   time.Duration(cfg.PingInterval) * time.Second,
+		pongTimeout:    time.Duration(cfg.PongTimeout) * time.Second,
+		idleTimeout:    time.Duration(cfg.IdleTimeout) * time.Second,
+		maxMessageSize: cfg.MaxMessageSize,
+	}
+	if hb.pingInterval <= 0 {
+		hb.pingInterval = defaultPingInterval
+	}
+	if hb.pongTimeout <= 0 {
+		hb.pongTimeout = defaultPongTimeout
+	}
+	if hb.pongTimeout <= hb.pingInterval {
+		log.Printf("pongTimeout must be longer than pingInterval, using %s", 2*hb.pingInterval+hb.pingInterval/4)
+		hb.pongTimeout = 2*hb.pingInterval + hb.pingInterval/4
+	}
+	if hb.idleTimeout <= 0 {
+		hb.idleTimeout = defaultIdleTimeout
+	}
+	if hb.maxMessageSize <= 0 {
+		hb.maxMessageSize = defaultMaxMessageSize
+	}
+	return hb
+}
+
+// staleAfter is how long after the last frame a connection counts as
+// stale: a pong is overdue, but the connection hasn't been dropped yet.
+func (hb heartbeatConfig) staleAfter() time.Duration {
+	return hb.pingInterval + hb.pingInterval/2
+}
+
+// ConnState describes the phone's WebSocket connection.
+type ConnState string
+
+const (
+	ConnConnected    ConnState = "connected"    // the phone recently sent a message
+	ConnIdle         ConnState = "idle"         // answering pings, but no messages lately
+	ConnStale        ConnState = "stale"        // pongs are overdue; probably off the network
+	ConnDisconnected ConnState = "disconnected" // no connection
+)
+
+// ConnectionStatus is the connection part of StatusResponse. Timestamps are RFC 3339.
+type ConnectionStatus struct {
+	State          ConnState `json:"state"`
+	Since          string    `json:"since,omitempty"`
+	ConnectedAt    string    `json:"connectedAt,omitempty"`
+	LastSeenAt     string    `json:"lastSeenAt,omitempty"`
+	LastMessageAt  string    `json:"lastMessageAt,omitempty"`
+	DisconnectedAt string    `json:"disconnectedAt,omitempty"`
+}
+
+// connTracker follows one WebSocket connection through its states. States
+// that depend on elapsed time are worked out when the status is read.
+type connTracker struct {
+	hb heartbeatConfig
+
+	mu          sync.Mutex
+	connectedAt time.Time
+	lastSeen    time.Time // any frame, including pongs
+	lastMessage time.Time // data messages only
+	state       ConnState
+	since       time.Time
+}
+
+func newConnTracker(hb heartbeatConfig) *connTracker {
+	now := time.Now()
+	return &connTracker{
+		hb:          hb,
+		connectedAt: now,
+		lastSeen:    now,
+		lastMessage: now,
+		state:       ConnConnected,
+		since:       now,
+	}
+}
+
+// pong records a pong from the phone.
+func (t *connTracker) pong() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	t.advance(now)
+	t.lastSeen = now
+	t.advance(now)
+}
+
+// message records a data message from the phone.
+func (t *connTracker) message() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	t.advance(now)
+	t.lastSeen = now
+	t.lastMessage = now
+	t.advance(now)
+}
+
+// advance moves the state machine to now. A timeout transition is dated
+// when the timeout passed, not when it was noticed.
+func (t *connTracker) advance(now time.Time) {
+	next, at := ConnConnected, now
+	switch {
+	case now.Sub(t.lastSeen) > t.hb.staleAfter():
+		next, at = ConnStale, t.lastSeen.Add(t.hb.staleAfter())
+	case now.Sub(t.lastMessage) > t.hb.idleTimeout:
+		next, at = ConnIdle, t.lastMessage.Add(t.hb.idleTimeout)
+	}
+	if next == t.state {
+		return
+	}
+	if next == ConnStale {
+		log.Printf("Phone connection stale: no pong for %s", now.Sub(t.lastSeen).Round(time.Second))
+	}
+	t.state, t.since = next, at
+}
+
+func (t *connTracker) status() ConnectionStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.advance(time.Now())
+	return ConnectionStatus{
+		State:         t.state,
+		Since:         t.since.Format(time.RFC3339),
+		ConnectedAt:   t.connectedAt.Format(time.RFC3339),
+		LastSeenAt:    t.lastSeen.Format(time.RFC3339),
+		LastMessageAt: t.lastMessage.Format(time.RFC3339),
+	}
+}
+
+// connectionStatus reports the state of the phone's connection.
+func (s *Server) connectionStatus() ConnectionStatus {
+	s.mu.RLock()
+	tracker := s.connTrack
+	disconnectAt := s.disconnectAt
+	s.mu.RUnlock()
+
+	if tracker != nil {
+		return tracker.status()
+	}
+	status := ConnectionStatus{State: ConnDisconnected}
+	if !disconnectAt.IsZero() {
+		status.Since = disconnectAt.Format(time.RFC3339)
+		status.DisconnectedAt = status.Since
+	}
+	return status
+}
+
+// startHeartbeat arms the read deadline and message size limit on conn and
+// pings it every pingInterval until stop is closed. Browsers answer pings
+// on their own, so the phone needs no code for this. A phone that stops
+// answering hits the read deadline, which ends the read loop.
+func startHeartbeat(conn *websocket.Conn, hb heartbeatConfig, tracker *connTracker, stop <-chan struct{}) {
+	conn.SetReadLimit(hb.maxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(hb.pongTimeout))
+	conn.SetPongHandler(func(string) error {
+		tracker.pong()
+		return conn.SetReadDeadline(time.Now().Add(hb.pongTimeout))
+	})
+
+	go func() {
+		ticker := time.NewTicker(hb.pingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+					return
+				}
+			}
+		}
+	}()
+}
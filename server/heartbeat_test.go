@@ -0,0 +1,68 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/gold16/ginkgo-talk/ai"
+	"github.com/gold16/ginkgo-talk/config"
+)
+
+func TestLongJobKeepsConnection(t *testing.T) {
+	// The AI answers after the pong timeout has passed.
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(3 * time.Second)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"done"}}]}`))
+	}))
+	defer slow.Close()
+
+	s := newTestServerWith(t, Options{
+		Config: config.Config{PingInterval: 1, PongTimeout: 2},
+		AI:     ai.New(ai.Options{APIKey: "test", BaseURL: slow.URL}),
+	})
+	creds, err := s.sessions.issue("phone", "192.0.2.1:1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(s.handleWebSocket))
+	defer srv.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"),
+		http.Header{"Authorization": {"Bearer " + creds.AccessToken}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := conn.WriteJSON(Message{Type: "text", Text: "hi", Mode: "tidy"}); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for {
+		var resp map[string]interface{}
+		if err := conn.ReadJSON(&resp); err != nil {
+			t.Fatalf("connection dropped during the AI request: %v", err)
+		}
+		if resp["type"] == "ai_preview" {
+			break
+		}
+	}
+	// Answering pings, the phone stays connected after the job too.
+	if err := conn.WriteJSON(Message{Type: "text", Text: "plain"}); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		var resp map[string]interface{}
+		if err := conn.ReadJSON(&resp); err != nil {
+			t.Fatalf("connection dropped after the AI request: %v", err)
+		}
+		if resp["type"] == "ack" {
+			return
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gold16/ginkgo-talk/config"
+)
+
+const (
+	// hookQueueSize is how many events may wait for one webhook or broker
+	// before new ones are dropped.
+	hookQueueSize = 256
+
+	// hookAttempts is how often an event is tried before it is dropped.
+	// The wait between tries doubles from hookMinBackoff to hookMaxBackoff.
+	hookAttempts   = 6
+	hookMinBackoff = time.Second
+	hookMaxBackoff = time.Minute
+
+	// hookTimeout bounds one delivery attempt.
+	hookTimeout = 10 * time.Second
+)
+
+// hookTarget is somewhere events are delivered: a webhook or an MQTT broker.
+type hookTarget interface {
+	String() string
+	// deliver makes one attempt at delivering ev, whose JSON form is body.
+	// Errors wrapped in permanentError are not retried.
+	deliver(ctx context.Context, ev Event, body []byte) error
+	close()
+}
+
+// idleTarget is a target that needs to hear from the server now and then,
+// like an MQTT broker expecting pings on an otherwise quiet connection.
+type idleTarget interface {
+	hookTarget
+	idleEvery() time.Duration
+	idle(ctx context.Context)
+}
+
+// permanentError is a delivery failure that trying again won't fix.
+type permanentError struct{ err error }
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// hook delivers events to one target from its own queue, so a slow or
+// unreachable target doesn't hold up the others.
+type hook struct {
+	target     hookTarget
+	types      map[string]bool // nil for every event
+	redactText bool
+	queue      chan Event
+}
+
+func newHook(target hookTarget, types []string, redactText bool) *hook {
+	h := &hook{target: target, redactText: redactText, queue: make(chan Event, hookQueueSize)}
+	if len(types) > 0 {
+		h.types = make(map[string]bool, len(types))
+		for _, t := range types {
+			h.types[t] = true
+		}
+	}
+	return h
+}
+
+// hookDispatcher fans events out from the bus to the configured webhooks
+// and MQTT broker. Delivery retries with backoff; while the server stops,
+// queued events get one more try each.
+type hookDispatcher struct {
+	hooks    []*hook
+	wg       sync.WaitGroup
+	draining chan struct{} // closed when the server stops: no more retries
+	ctx      context.Context
+	cancel   context.CancelFunc // abandons deliveries in flight
+}
+
+// newHookDispatcher sets up the targets in cfg. Invalid ones are logged
+// and skipped.
+func newHookDispatcher(cfg config.Config, version string) *hookDispatcher {
+	d := &hookDispatcher{draining: make(chan struct{})}
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+	for i, wh := range cfg.Webhooks {
+		target, err := newWebhookTarget(wh, version)
+		if err != nil {
+			log.Printf("Skipping webhook %d: %v", i+1, err)
+			continue
+		}
+		d.hooks = append(d.hooks, newHook(target, wh.Events, wh.RedactText))
+	}
+	if cfg.MQTT != nil {
+		target, err := newMQTTTarget(*cfg.MQTT)
+		if err != nil {
+			log.Printf("Skipping MQTT: %v", err)
+		} else {
+			d.hooks = append(d.hooks, newHook(target, cfg.MQTT.Events, cfg.MQTT.RedactText))
+		}
+	}
+	return d
+}
+
+// start delivers events published on bus from now on.
+func (d *hookDispatcher) start(bus *eventBus) {
+	if len(d.hooks) == 0 {
+		return
+	}
+	for _, h := range d.hooks {
+		log.Printf("Publishing events to %s", h.target)
+		d.wg.Add(1)
+		go d.run(h)
+	}
+	sub := bus.subscribe()
+	go func() {
+		defer close(sub.done)
+		for ev := range sub.ch {
+			for _, h := range d.hooks {
+				if h.types != nil && !h.types[ev.Type] {
+					continue
+				}
+				out := ev
+				if h.redactText {
+					out = ev.withoutText()
+				}
+				select {
+				case h.queue <- out:
+				default:
+					log.Printf("Queue for %s is full, dropped %s", h.target, ev.Type)
+				}
+			}
+		}
+		for _, h := range d.hooks {
+			close(h.queue)
+		}
+	}()
+}
+
+// shutdown waits until the queued events are delivered or ctx ends. The
+// event bus must be closed first.
+func (d *hookDispatcher) shutdown(ctx context.Context) error {
+	close(d.draining)
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		d.cancel()
+		return fmt.Errorf("event delivery: %w", ctx.Err())
+	}
+}
+
+func (d *hookDispatcher) run(h *hook) {
+	defer d.wg.Done()
+	defer h.target.close()
+
+	var idle <-chan time.Time
+	if it, ok := h.target.(idleTarget); ok {
+		ticker := time.NewTicker(it.idleEvery())
+		defer ticker.Stop()
+		idle = ticker.C
+	}
+	lastSent := time.Now()
+	for {
+		select {
+		case ev, ok := <-h.queue:
+			if !ok {
+				return
+			}
+			d.send(h, ev)
+			lastSent = time.Now()
+		case <-idle:
+			it := h.target.(idleTarget)
+			if time.Since(lastSent) >= it.idleEvery() {
+				ctx, cancel := context.WithTimeout(d.ctx, hookTimeout)
+				it.idle(ctx)
+				cancel()
+			}
+		}
+	}
+}
+
+// send delivers ev, retrying with backoff until it succeeds, fails for
+// good or the server stops.
+func (d *hookDispatcher) send(h *hook, ev Event) {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		log.Printf("Event %d for %s: %v", ev.ID, h.target, err)
+		return
+	}
+	backoff := hookMinBackoff
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(d.ctx, hookTimeout)
+		err := h.target.deliver(ctx, ev, body)
+		cancel()
+		if err == nil {
+			return
+		}
+		var permanent *permanentError
+		if errors.As(err, &permanent) || attempt == hookAttempts {
+			log.Printf("Dropped %s event %d for %s: %v", ev.Type, ev.ID, h.target, err)
+			return
+		}
+		select {
+		case <-d.draining:
+			log.Printf("Dropped %s event %d for %s while stopping: %v", ev.Type, ev.ID, h.target, err)
+			return
+		default:
+		}
+		log.Printf("Delivering %s event %d to %s failed, retrying in %s: %v", ev.Type, ev.ID, h.target, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-d.draining:
+		}
+		backoff = min(backoff*2, hookMaxBackoff)
+	}
+}
+
+// webhookTarget posts events as JSON. With a secret, the body is signed
+// with HMAC-SHA256 in X-Gtalk-Signature-256, like GitHub's webhooks.
+type webhookTarget struct {
+	url       string
+	display   string // url without credentials or query, for the log
+	secret    []byte
+	userAgent string
+	client    *http.Client
+}
+
+func newWebhookTarget(cfg config.Webhook, version string) (*webhookTarget, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid URL %q: use http:// or https://", cfg.URL)
+	}
+	display := *u
+	display.User, display.RawQuery = nil, ""
+	return &webhookTarget{
+		url:       cfg.URL,
+		display:   display.String(),
+		secret:    []byte(cfg.Secret),
+		userAgent: "ginkgo-talk/" + version,
+		client:    &http.Client{},
+	}, nil
+}
+
+func (t *webhookTarget) String() string {
+	return "webhook " + t.display
+}
+
+func (t *webhookTarget) deliver(ctx context.Context, ev Event, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url, bytes.NewReader(body))
+	if err != nil {
+		return &permanentError{err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", t.userAgent)
+	req.Header.Set("X-Gtalk-Event", ev.Type)
+	req.Header.Set("X-Gtalk-Delivery", strconv.FormatUint(ev.ID, 10))
+	if len(t.secret) > 0 {
+		mac := hmac.New(sha256.New, t.secret)
+		mac.Write(body)
+		req.Header.Set("X-Gtalk-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return fmt.Errorf("status %s", resp.Status)
+	default:
+		return &permanentError{fmt.Errorf("status %s", resp.Status)}
+	}
+}
+
+func (t *webhookTarget) close() {
+	t.client.CloseIdleConnections()
+}
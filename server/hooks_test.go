@@ -0,0 +1,239 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gold16/ginkgo-talk/config"
+)
+
+// webhookRequest is what a test webhook received.
+type webhookRequest struct {
+	header http.Header
+	body   []byte
+}
+
+// webhookServer answers with the given statuses in turn, then 200.
+func webhookServer(t *testing.T, statuses ...int) (*httptest.Server, func() []webhookRequest) {
+	var mu sync.Mutex
+	var got []webhookRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		got = append(got, webhookRequest{r.Header.Clone(), body})
+		status := http.StatusOK
+		if len(got) <= len(statuses) {
+			status = statuses[len(got)-1]
+		}
+		mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, func() []webhookRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]webhookRequest(nil), got...)
+	}
+}
+
+func TestWebhookSignedAndRetried(t *testing.T) {
+	srv, requests := webhookServer(t, http.StatusServiceUnavailable)
+	d := newHookDispatcher(config.Config{Webhooks: []config.Webhook{{URL: srv.URL, Secret: "s3cret"}}}, "test")
+	ev := Event{ID: 7, Type: EventTextTyped, Time: "2026-01-02T03:04:05Z", Data: map[string]string{"text": "hi"}}
+	d.send(d.hooks[0], ev)
+
+	got := requests()
+	if len(got) != 2 {
+		t.Fatalf("%d requests, want a failed one and a retry", len(got))
+	}
+	want, _ := json.Marshal(ev)
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(want)
+	signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	for i, req := range got {
+		if string(req.body) != string(want) {
+			t.Errorf("request %d: body %s, want %s", i, req.body, want)
+		}
+		if h := req.header.Get("X-Gtalk-Signature-256"); h != signature {
+			t.Errorf("request %d: signature %q, want %q", i, h, signature)
+		}
+		if req.header.Get("X-Gtalk-Event") != EventTextTyped || req.header.Get("X-Gtalk-Delivery") != "7" {
+			t.Errorf("request %d: headers %v", i, req.header)
+		}
+	}
+}
+
+func TestWebhookClientErrorNotRetried(t *testing.T) {
+	srv, requests := webhookServer(t, http.StatusBadRequest)
+	d := newHookDispatcher(config.Config{Webhooks: []config.Webhook{{URL: srv.URL}}}, "test")
+	d.send(d.hooks[0], Event{ID: 1, Type: EventTextTyped})
+
+	got := requests()
+	if len(got) != 1 {
+		t.Fatalf("%d requests, want one", len(got))
+	}
+	if h := got[0].header.Get("X-Gtalk-Signature-256"); h != "" {
+		t.Errorf("signed without a secret: %q", h)
+	}
+}
+
+// mqttPacket reads one packet: its first byte and body.
+func mqttPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, mult := 0, 1
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		n += int(b&0x7f) * mult
+		mult *= 128
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	body := make([]byte, n)
+	_, err = io.ReadFull(r, body)
+	return header, body, err
+}
+
+// mqttReadString reads a length-prefixed string from the front of b. A
+// string running past the end of b reads as "".
+func mqttReadString(b []byte) (string, []byte) {
+	if len(b) < 2 || len(b) < 2+int(binary.BigEndian.Uint16(b)) {
+		return "", nil
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	return string(b[2 : 2+n]), b[2+n:]
+}
+
+// fakeBroker accepts one connection and runs broker on it. The broker
+// runs on its own goroutine, so it reports with t.Error and returns.
+func fakeBroker(t *testing.T, broker func(net.Conn, *bufio.Reader)) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		ln.Close()
+		<-done
+	})
+	go func() {
+		defer close(done)
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		broker(conn, bufio.NewReader(conn))
+	}()
+	return "tcp://" + ln.Addr().String()
+}
+
+func TestMQTTConnectAndPublish(t *testing.T) {
+	body := []byte(`{"id":3,"event":"text_typed"}`)
+	disconnected := make(chan bool, 1)
+	broker := fakeBroker(t, func(conn net.Conn, r *bufio.Reader) {
+		header, p, err := mqttPacket(r)
+		if err != nil || header != mqttConnect<<4 {
+			t.Errorf("first packet %#x, %v; want CONNECT", header, err)
+			return
+		}
+		proto, p := mqttReadString(p)
+		if proto != "MQTT" || len(p) < 4 || p[0] != 4 {
+			t.Errorf("CONNECT protocol %q, rest %x; want MQTT level 4", proto, p)
+			return
+		}
+		// Clean session, user name and password.
+		if flags := p[1]; flags != 0x02|0x80|0x40 {
+			t.Errorf("CONNECT flags %#x", flags)
+		}
+		if keepAlive := binary.BigEndian.Uint16(p[2:]); keepAlive != mqttKeepAlive {
+			t.Errorf("keep alive %d", keepAlive)
+		}
+		clientID, p := mqttReadString(p[4:])
+		user, p := mqttReadString(p)
+		pass, _ := mqttReadString(p)
+		if clientID != "desk" || user != "me" || pass != "pw" {
+			t.Errorf("CONNECT payload %q %q %q", clientID, user, pass)
+		}
+		conn.Write([]byte{mqttConnack << 4, 2, 0, 0})
+
+		header, p, err = mqttPacket(r)
+		if err != nil || header != mqttPublish<<4|1<<1 {
+			t.Errorf("PUBLISH header %#x, %v; want QoS 1", header, err)
+			return
+		}
+		topic, p := mqttReadString(p)
+		if topic != "home/talk/text_typed" || len(p) < 2 {
+			t.Errorf("topic %q, rest %x", topic, p)
+			return
+		}
+		id := binary.BigEndian.Uint16(p)
+		if string(p[2:]) != string(body) {
+			t.Errorf("payload %s, want %s", p[2:], body)
+		}
+		// An unrelated packet first, which the client must skip.
+		conn.Write([]byte{mqttPingresp << 4, 0})
+		conn.Write([]byte{mqttPuback << 4, 2, byte(id >> 8), byte(id)})
+
+		header, _, err = mqttPacket(r)
+		disconnected <- err == nil && header == mqttDisconnect<<4
+	})
+
+	target, err := newMQTTTarget(config.MQTT{Broker: broker, Topic: "/home/talk/", ClientID: "desk", Username: "me", Password: "pw"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := target.deliver(ctx, Event{Type: EventTextTyped}, body); err != nil {
+		t.Fatal(err)
+	}
+	target.close()
+	select {
+	case ok := <-disconnected:
+		if !ok {
+			t.Error("no DISCONNECT on close")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("broker didn't see the connection close")
+	}
+}
+
+func TestMQTTConnectRefused(t *testing.T) {
+	broker := fakeBroker(t, func(conn net.Conn, r *bufio.Reader) {
+		mqttPacket(r)
+		conn.Write([]byte{mqttConnack << 4, 2, 0, 5})
+	})
+	target, err := newMQTTTarget(config.MQTT{Broker: broker})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = target.deliver(ctx, Event{Type: EventTextTyped}, []byte("{}"))
+	if err == nil || err.Error() != "broker refused connection: not authorized" {
+		t.Errorf("deliver = %v, want the refusal", err)
+	}
+	if target.conn != nil {
+		t.Error("connection kept after refusal")
+	}
+}
@@ -0,0 +1,368 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gold16/ginkgo-talk/config"
+)
+
+// DefaultPort is the HTTPS port used when the config doesn't set one.
+const DefaultPort = 9527
+
+// listenConfig describes how the server is reached. Everything except the
+// HTTPS port is optional.
+type listenConfig struct {
+	port         int    // HTTPS port
+	tlsCertFile  string // user-supplied certificate, replaces the local CA
+	tlsKeyFile   string
+	httpListen   string   // plain-HTTP listener for a reverse proxy: loopback host:port or "unix:/path"
+	redirectPort int      // redirects plain HTTP on this port to HTTPS
+	basePath     string   // URL prefix, "" or e.g. "/gtalk"
+	allowedHosts []string // extra Host names accepted besides IPs, localhost and the mDNS name
+	bind         []string // interface names or IP addresses to listen on, empty for all
+	mdns         bool     // advertise over multicast DNS
+}
+
+// listenConfigFrom reads the listener settings from cfg.
+func listenConfigFrom(cfg config.Config) listenConfig {
+	lc := listenConfig{
+		port:         cfg.Port,
+		tlsCertFile:  strings.TrimSpace(cfg.TLSCertFile),
+		tlsKeyFile:   strings.TrimSpace(cfg.TLSKeyFile),
+		httpListen:   strings.TrimSpace(cfg.HTTPListen),
+		redirectPort: cfg.RedirectPort,
+		basePath:     normalizeBasePath(cfg.BasePath),
+		allowedHosts: cfg.AllowedHosts,
+		bind:         cfg.Bind,
+		mdns:         cfg.MDNS == nil || *cfg.MDNS,
+	}
+	if lc.port <= 0 || lc.port > 65535 {
+		if lc.port != 0 {
+			log.Printf("invalid port: %d, falling back to %d", lc.port, DefaultPort)
+		}
+		lc.port = DefaultPort
+	}
+	return lc
+}
+
+// normalizeBasePath turns "gtalk/", "/gtalk" and "/gtalk/" into "/gtalk",
+// and "" or "/" into "".
+func normalizeBasePath(p string) string {
+	p = strings.Trim(strings.TrimSpace(p), "/")
+	if p == "" {
+		return ""
+	}
+	return "/" + p
+}
+
+// bindIPs resolves the bind setting to IP addresses. Interface names expand
+// to all of the interface's usable addresses. A nil result means every interface.
+func (lc listenConfig) bindIPs() ([]net.IP, error) {
+	var ips []net.IP
+	for _, entry := range lc.bind {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if ip := net.ParseIP(strings.Trim(entry, "[]")); ip != nil {
+			ips = append(ips, ip)
+			continue
+		}
+		iface, err := net.InterfaceByName(entry)
+		if err != nil {
+			return nil, fmt.Errorf("bind %q: not an IP address or interface name", entry)
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, fmt.Errorf("bind %q: %w", entry, err)
+		}
+		found := false
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && !(ipNet.IP.To4() == nil && ipNet.IP.IsLinkLocalUnicast()) {
+				ips = append(ips, ipNet.IP)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("bind %q: interface has no usable address", entry)
+		}
+	}
+	return ips, nil
+}
+
+// listenAll opens a TCP listener on port for each bound address, or a
+// single dual-stack listener when no binding is configured.
+func (lc listenConfig) listenAll(port int) ([]net.Listener, error) {
+	ips, err := lc.bindIPs()
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		ln, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{ln}, nil
+	}
+
+	var listeners []net.Listener
+	for _, ip := range ips {
+		ln, err := net.Listen("tcp", net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, ln)
+	}
+	return listeners, nil
+}
+
+// Addresses lists the LAN addresses phones can reach the server on, best
+// first, with the URL for each. Only bound addresses are listed when the
+// server is bound to specific interfaces, and only private ones when the
+// certificate comes from the local CA, which can't cover public addresses.
+func (s *Server) Addresses() []LanAddress {
+	addrs := lanAddresses()
+	if s.certs != nil {
+		ranges := localIPRanges()
+		filtered := addrs[:0]
+		for _, a := range addrs {
+			if ipInRanges(net.ParseIP(a.Host), ranges) {
+				filtered = append(filtered, a)
+			}
+		}
+		addrs = filtered
+	}
+	if bound, err := s.listen.bindIPs(); err == nil && len(bound) > 0 {
+		filtered := addrs[:0]
+		for _, a := range addrs {
+			for _, ip := range bound {
+				if ip.Equal(net.ParseIP(a.Host)) {
+					filtered = append(filtered, a)
+					break
+				}
+			}
+		}
+		addrs = filtered
+	}
+	for i := range addrs {
+		addrs[i].URL = s.urlForHost(addrs[i].Host)
+	}
+	return addrs
+}
+
+var errLanIPNotLocal = errors.New("not a private address: the local certificate can only cover private, link-local and unique local addresses")
+
+// parseLanIP checks a LAN IP override. With certificates from the local CA
+// it must be an address they can cover, or phones would get a certificate
+// error; a configured certificate is trusted to cover what it needs.
+func (lc listenConfig) parseLanIP(s string) (string, error) {
+	ip := net.ParseIP(strings.TrimSpace(s))
+	if ip == nil {
+		return "", fmt.Errorf("invalid IP address %q", s)
+	}
+	if lc.tlsCertFile == "" && !ipInRanges(ip, localIPRanges()) {
+		return "", fmt.Errorf("%s: %w", ip, errLanIPNotLocal)
+	}
+	return ip.String(), nil
+}
+
+// CheckLanIP checks a LAN IP override against the settings in cfg, for
+// when no server is running; see SetLanIPOverride.
+func CheckLanIP(cfg config.Config, ip string) (string, error) {
+	return listenConfigFrom(cfg).parseLanIP(ip)
+}
+
+// pairAddresses lists the addresses offered on the QR page: the mDNS name
+// first when it is advertised, since it survives IP changes, then every IP.
+func (s *Server) pairAddresses() []LanAddress {
+	addrs := s.Addresses()
+	if s.mdns != nil {
+		mdns := LanAddress{Interface: "mDNS", Host: s.mdns.host, URL: s.urlForHost(s.mdns.host)}
+		addrs = append([]LanAddress{mdns}, addrs...)
+	}
+	return addrs
+}
+
+// pairURL is the base URL the QR code points to by default.
+func (s *Server) pairURL(r *http.Request) string {
+	if isProxied(r) {
+		return s.externalURL(r)
+	}
+	return s.defaultPairURL()
+}
+
+// defaultPairURL is the pairing base URL for phones on the LAN.
+func (s *Server) defaultPairURL() string {
+	if s.mdns != nil && s.GetLanIPOverride() == "" {
+		return s.urlForHost(s.mdns.host)
+	}
+	return s.BaseURL()
+}
+
+// Port returns the HTTPS port.
+func (s *Server) Port() int {
+	return s.listen.port
+}
+
+// BaseURL returns the address phones on the LAN use to reach the server.
+func (s *Server) BaseURL() string {
+	return s.urlForHost(s.LanIP())
+}
+
+func (s *Server) urlForHost(host string) string {
+	return "https://" + net.JoinHostPort(host, strconv.Itoa(s.listen.port)) + s.listen.basePath
+}
+
+// externalURL returns the base URL as seen by the client of r. Requests that
+// came through the reverse proxy listener use the forwarded scheme and host.
+func (s *Server) externalURL(r *http.Request) string {
+	if fwd, ok := r.Context().Value(forwardedKey{}).(forwardedInfo); ok && fwd.host != "" {
+		return fwd.proto + "://" + fwd.host + s.listen.basePath
+	}
+	return s.BaseURL()
+}
+
+// withBasePath mounts h under the configured base path.
+func (s *Server) withBasePath(h http.Handler) http.Handler {
+	base := s.listen.basePath
+	if base == "" {
+		return h
+	}
+	root := http.NewServeMux()
+	root.Handle(base+"/", http.StripPrefix(base, h))
+	root.HandleFunc(base, func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, base+"/", http.StatusMovedPermanently)
+	})
+	return root
+}
+
+// tlsConfig uses the configured certificate if there is one, and otherwise
+// serves certificates from the local CA.
+func (s *Server) tlsConfig() (*tls.Config, error) {
+	certFile, keyFile := s.listen.tlsCertFile, s.listen.tlsKeyFile
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, fmt.Errorf("tlsCertFile and tlsKeyFile must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load TLS cert: %w", err)
+		}
+		log.Printf("Using TLS cert from %s", certFile)
+		if cert.Leaf != nil {
+			s.listen.allowedHosts = append(s.listen.allowedHosts, cert.Leaf.DNSNames...)
+		}
+		return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+	}
+
+	ca, err := loadOrCreateCA(s.dataDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load local CA: %w", err)
+	}
+	s.ca = ca
+
+	// Serve TLS certs from the local CA for HTTPS (required for Web Speech API).
+	// They are reissued whenever the LAN addresses change.
+	s.certs = newCertManager(ca, s.GetLanIPOverride, s.mdnsHost)
+	if _, err := s.certs.GetCertificate(nil); err != nil {
+		return nil, fmt.Errorf("failed to generate TLS cert: %w", err)
+	}
+	return &tls.Config{GetCertificate: s.certs.GetCertificate}, nil
+}
+
+// listenPlainHTTP opens the reverse proxy listener. Plain HTTP carries
+// tokens in the clear, so only loopback addresses and Unix sockets are allowed.
+func listenPlainHTTP(addr string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(path) // stale socket from a previous run
+		}
+		return net.Listen("unix", path)
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid httpListen %q: %w", addr, err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("httpListen %q must be a loopback address or a unix: socket", addr)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// redirectHandler sends plain-HTTP visitors to the HTTPS port on the same
+// host, if it is one of the server's own names; anyone else goes to the LAN
+// address, so the redirect can't be pointed at another site.
+func (s *Server) redirectHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := s.LanIP()
+		if s.allowedHost(r.Host) {
+			host = r.Host
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			}
+			host = strings.Trim(host, "[]")
+		}
+		target := "https://" + net.JoinHostPort(host, strconv.Itoa(s.listen.port)) + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusTemporaryRedirect)
+	})
+}
+
+type forwardedKey struct{}
+
+// forwardedInfo is the scheme and host the reverse proxy was reached on.
+type forwardedInfo struct {
+	proto string
+	host  string
+}
+
+// trustForwarded applies X-Forwarded-For, X-Forwarded-Proto and
+// X-Forwarded-Host. It is only used on the plain-HTTP listener, which only
+// a local reverse proxy can reach; the HTTPS listener ignores these headers.
+// Requests without a client address are refused: the proxy's own address
+// would otherwise pass for the desktop.
+func trustForwarded(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The proxy appends the address it saw, so the last entry is the one to trust.
+		parts := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+		ip := net.ParseIP(strings.TrimSpace(parts[len(parts)-1]))
+		if ip == nil {
+			log.Printf("Refusing proxied request without X-Forwarded-For: %s %s", r.Method, r.URL.Path)
+			http.Error(w, "missing X-Forwarded-For", http.StatusBadRequest)
+			return
+		}
+		r.RemoteAddr = net.JoinHostPort(ip.String(), "0")
+
+		fwd := forwardedInfo{proto: "http", host: r.Host}
+		if proto := firstHeaderValue(r, "X-Forwarded-Proto"); strings.EqualFold(proto, "https") {
+			fwd.proto = "https"
+		}
+		if host := firstHeaderValue(r, "X-Forwarded-Host"); host != "" {
+			fwd.host = host
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), forwardedKey{}, fwd)))
+	})
+}
+
+// isProxied reports whether r came through the reverse proxy listener.
+func isProxied(r *http.Request) bool {
+	_, ok := r.Context().Value(forwardedKey{}).(forwardedInfo)
+	return ok
+}
+
+func firstHeaderValue(r *http.Request, name string) string {
+	v, _, _ := strings.Cut(r.Header.Get(name), ",")
+	return strings.TrimSpace(v)
+}
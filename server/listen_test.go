@@ -0,0 +1,65 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gold16/ginkgo-talk/config"
+)
+
+func TestTrustForwardedNeverLocal(t *testing.T) {
+	var local, reached bool
+	h := trustForwarded(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+		local = isLocalRequest(r)
+	}))
+
+	for _, tc := range []struct {
+		name, xff string
+		want      int
+	}{
+		{"no header", "", http.StatusBadRequest},
+		{"garbage", "not-an-ip", http.StatusBadRequest},
+		{"loopback client", "127.0.0.1", http.StatusOK},
+		{"remote client", "203.0.113.7", http.StatusOK},
+		{"spoofed first entry", "127.0.0.1, 203.0.113.7", http.StatusOK},
+	} {
+		reached, local = false, false
+		r := httptest.NewRequest("GET", "/api/pending", nil)
+		r.RemoteAddr = "@" // a unix socket peer
+		if tc.xff != "" {
+			r.Header.Set("X-Forwarded-For", tc.xff)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tc.want {
+			t.Errorf("%s: status %d, want %d", tc.name, w.Code, tc.want)
+		}
+		if reached != (tc.want == http.StatusOK) {
+			t.Errorf("%s: handler reached = %v", tc.name, reached)
+		}
+		if local {
+			t.Errorf("%s: proxied request counted as local", tc.name)
+		}
+	}
+}
+
+func TestRedirectStaysOnOwnHost(t *testing.T) {
+	s := newTestServer(t, config.Config{Port: 9527})
+	h := s.redirectHandler()
+	for host, want := range map[string]string{
+		"localhost:8080":        "https://localhost:9527/qrcode?x=1",
+		"[fe80::1]:8080":        "https://[fe80::1]:9527/qrcode?x=1",
+		"evil.example.com":      "https://" + net.JoinHostPort(s.LanIP(), "9527") + "/qrcode?x=1",
+		"evil.example.com:8080": "https://" + net.JoinHostPort(s.LanIP(), "9527") + "/qrcode?x=1",
+	} {
+		r := httptest.NewRequest("GET", "http://"+host+"/qrcode?x=1", nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if got := w.Header().Get("Location"); w.Code != http.StatusTemporaryRedirect || got != want {
+			t.Errorf("Host %s: %d %s, want %s", host, w.Code, got, want)
+		}
+	}
+}
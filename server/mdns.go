@@ -0,0 +1,637 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A small multicast DNS responder (RFC 6762) that advertises the server as
+// a DNS-SD service (RFC 6763). Phones find it as _ginkgotalk._tcp and reach
+// it as gtalk-<hostname>.local, so a DHCP address change doesn't break
+// pairing.
+//
+// It only answers questions about its own names, which keeps it small enough
+// to live without a DNS library. It shares port 5353 with the system
+// responder (Bonjour, Avahi) through SO_REUSEADDR. The computer's own
+// <hostname>.local belongs to that responder, hence the separate host name.
+// Both names are probed before they are announced (RFC 6762 section 8.1),
+// and numbered if another device already uses them.
+
+const (
+	mdnsPort         = 5353
+	mdnsServiceType  = "_ginkgotalk._tcp.local"
+	mdnsServicesEnum = "_services._dns-sd._udp.local"
+
+	mdnsHostTTL    = 120  // seconds, for records that change with the network
+	mdnsServiceTTL = 4500 // seconds, for the service pointer records
+	mdnsLegacyTTL  = 10   // cap for answers to one-shot (non-5353) queries
+
+	mdnsWatchInterval = 30 * time.Second
+
+	mdnsProbeInterval = 250 * time.Millisecond
+	mdnsMaxRenames    = 10
+)
+
+const (
+	dnsTypeA    = 1
+	dnsTypePTR  = 12
+	dnsTypeTXT  = 16
+	dnsTypeAAAA = 28
+	dnsTypeSRV  = 33
+	dnsTypeANY  = 255
+
+	dnsClassIN         = 1
+	dnsClassANY        = 255
+	dnsClassCacheFlush = 0x8000 // in answers: replace cached records
+	dnsClassUnicast    = 0x8000 // in questions: the QU bit
+)
+
+var (
+	mdnsGroupV4 = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: mdnsPort}
+	mdnsGroupV6 = &net.UDPAddr{IP: net.ParseIP("ff02::fb"), Port: mdnsPort}
+
+	errDNSMalformed = errors.New("malformed DNS message")
+	errMDNSClosed   = errors.New("mDNS responder closed")
+)
+
+// mdnsResponder advertises one service instance and its host name. The
+// names only change while probing, before start returns.
+type mdnsResponder struct {
+	instance string // service instance label, e.g. "Ginkgo Talk on desk-pc"
+	host     string // e.g. "gtalk-desk-pc.local"
+	port     int
+	txt      []string
+	addrs    func() []net.IP
+
+	baseInstance, baseHost string // the names before numbering
+
+	mu       sync.Mutex
+	conns    []mdnsConn
+	probing  bool
+	conflict chan struct{} // signalled when a response claims our names
+	closed   bool
+	done     chan struct{}
+}
+
+type mdnsConn struct {
+	conn  *net.UDPConn
+	group *net.UDPAddr
+}
+
+// dnsRecord is a resource record with its RDATA already encoded.
+type dnsRecord struct {
+	name   string
+	typ    uint16
+	ttl    uint32
+	unique bool // sets the cache-flush bit in multicast answers
+	data   []byte
+}
+
+func newMDNSResponder(instance, host string, port int, txt []string, addrs func() []net.IP) *mdnsResponder {
+	instance = strings.ReplaceAll(instance, ".", " ")
+	if len(instance) > 63 {
+		instance = instance[:63]
+	}
+	return &mdnsResponder{
+		instance:     instance,
+		host:         host,
+		port:         port,
+		txt:          txt,
+		addrs:        addrs,
+		baseInstance: instance,
+		baseHost:     host,
+		done:         make(chan struct{}),
+	}
+}
+
+// start joins the mDNS groups on every multicast-capable interface in
+// ifaces, probes for its names and announces the service. Loopback
+// interfaces are accepted too, which lets tests run without a network.
+func (m *mdnsResponder) start(ifaces []net.Interface) error {
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&(net.FlagMulticast|net.FlagLoopback) == 0 {
+			continue
+		}
+		for _, group := range []*net.UDPAddr{mdnsGroupV4, mdnsGroupV6} {
+			network := "udp4"
+			if group.IP.To4() == nil {
+				network = "udp6"
+			}
+			conn, err := net.ListenMulticastUDP(network, &iface, group)
+			if err != nil {
+				continue // e.g. no IPv6 on this interface
+			}
+			m.conns = append(m.conns, mdnsConn{conn: conn, group: group})
+		}
+	}
+	if len(m.conns) == 0 {
+		return errors.New("could not join the mDNS group on any interface")
+	}
+
+	m.probing = true
+	for _, c := range m.conns {
+		go m.serve(c)
+	}
+	if err := m.probe(); err != nil {
+		m.mu.Lock()
+		for _, c := range m.conns {
+			c.conn.Close()
+		}
+		m.mu.Unlock()
+		return err
+	}
+	go m.watch()
+	return nil
+}
+
+// probe makes sure no one else answers for the host or instance name,
+// numbering both until a free pair is found (RFC 6762 section 8.1).
+func (m *mdnsResponder) probe() error {
+	// Devices powered on together shouldn't probe in lockstep.
+	time.Sleep(rand.N(mdnsProbeInterval))
+	for n := 1; ; n++ {
+		conflict := make(chan struct{}, 1)
+		m.mu.Lock()
+		m.conflict = conflict
+		query := m.probeQuery()
+		m.mu.Unlock()
+
+		free := true
+		for i := 0; i < 3 && free; i++ {
+			m.send(query)
+			select {
+			case <-conflict:
+				free = false
+			case <-time.After(mdnsProbeInterval):
+			case <-m.done:
+				return errMDNSClosed
+			}
+		}
+		if free {
+			m.mu.Lock()
+			m.probing = false
+			m.conflict = nil
+			m.mu.Unlock()
+			return nil
+		}
+		if n > mdnsMaxRenames {
+			return fmt.Errorf("%s and %d numbered names are taken", m.baseHost, mdnsMaxRenames)
+		}
+		m.mu.Lock()
+		taken := m.host
+		m.rename(n + 1)
+		log.Printf("mDNS name %s is taken, trying %s", taken, m.host)
+		m.mu.Unlock()
+	}
+}
+
+// probeQuery asks for any record under our names, with the records we
+// want to claim in the authority section.
+func (m *mdnsResponder) probeQuery() []byte {
+	services := m.serviceRecords()
+	claimed := append(services[1:3:3], m.addressRecords()...)
+	return buildDNSProbe([]string{m.host, m.instance + "." + mdnsServiceType}, claimed)
+}
+
+// rename numbers the names, as "gtalk-desk-pc-2.local" and
+// "Ginkgo Talk on desk-pc (2)".
+func (m *mdnsResponder) rename(n int) {
+	suffix := fmt.Sprintf(" (%d)", n)
+	m.instance = m.baseInstance[:min(len(m.baseInstance), 63-len(suffix))] + suffix
+	label := strings.TrimSuffix(m.baseHost, ".local")
+	suffix = fmt.Sprintf("-%d", n)
+	m.host = label[:min(len(label), 63-len(suffix))] + suffix + ".local"
+}
+
+// checkConflict signals the running probe if msg is a response with
+// records under one of our names.
+func (m *mdnsResponder) checkConflict(msg []byte) {
+	answers, err := parseDNSAnswers(msg)
+	if err != nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	instanceName := m.instance + "." + mdnsServiceType
+	for _, a := range answers {
+		if strings.EqualFold(a.name, m.host) || strings.EqualFold(a.name, instanceName) {
+			select {
+			case m.conflict <- struct{}{}:
+			default:
+			}
+			return
+		}
+	}
+}
+
+func (m *mdnsResponder) serve(c mdnsConn) {
+	buf := make([]byte, 9000)
+	for {
+		n, src, err := c.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		m.mu.Lock()
+		probing := m.probing
+		m.mu.Unlock()
+		if probing {
+			// The names aren't ours yet, so nothing is answered.
+			m.checkConflict(buf[:n])
+			continue
+		}
+		resp, unicast := m.respond(buf[:n], src.Port != mdnsPort)
+		if resp == nil {
+			continue
+		}
+		dst := c.group
+		if unicast {
+			dst = src
+		}
+		c.conn.WriteToUDP(resp, dst)
+	}
+}
+
+// watch announces the service at startup, and again whenever the host's
+// addresses change, so caches pick up a new DHCP lease right away.
+func (m *mdnsResponder) watch() {
+	last := ""
+	ticker := time.NewTicker(mdnsWatchInterval)
+	defer ticker.Stop()
+	for {
+		key := ipsKey(m.addrs())
+		if key != last {
+			last = key
+			// RFC 6762 section 8.3: announce at least twice, one second apart.
+			m.announce(mdnsHostTTL)
+			select {
+			case <-time.After(time.Second):
+			case <-m.done:
+				return
+			}
+			m.announce(mdnsHostTTL)
+		}
+		select {
+		case <-ticker.C:
+		case <-m.done:
+			return
+		}
+	}
+}
+
+// announce multicasts every record. A TTL of 0 says goodbye.
+func (m *mdnsResponder) announce(hostTTL uint32) {
+	var answers []dnsRecord
+	answers = append(answers, m.serviceRecords()...)
+	answers = append(answers, m.addressRecords()...)
+	if hostTTL == 0 {
+		for i := range answers {
+			answers[i].ttl = 0
+		}
+	}
+	m.send(buildDNSResponse(0, 0, nil, answers, nil, true))
+}
+
+// send multicasts msg on every interface.
+func (m *mdnsResponder) send(msg []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, c := range m.conns {
+		c.conn.WriteToUDP(msg, c.group)
+	}
+}
+
+// Close sends goodbye packets and stops the responder.
+func (m *mdnsResponder) Close() {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return
+	}
+	m.closed = true
+	close(m.done)
+	m.mu.Unlock()
+
+	m.announce(0)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, c := range m.conns {
+		c.conn.Close()
+	}
+}
+
+// respond answers a query. legacy marks a one-shot query from a port other
+// than 5353 (RFC 6762 section 6.7): it gets a conventional unicast reply.
+// It returns nil if none of the questions are about this responder.
+func (m *mdnsResponder) respond(query []byte, legacy bool) (resp []byte, unicast bool) {
+	if len(query) < 12 {
+		return nil, false
+	}
+	id := binary.BigEndian.Uint16(query[0:2])
+	flags := binary.BigEndian.Uint16(query[2:4])
+	if flags&0x8000 != 0 || flags&0x7800 != 0 {
+		return nil, false // a response, or not a standard query
+	}
+	qdcount := int(binary.BigEndian.Uint16(query[4:6]))
+
+	type question struct {
+		name  string
+		typ   uint16
+		class uint16
+	}
+	var questions []question
+	off := 12
+	for i := 0; i < qdcount; i++ {
+		name, next, err := readDNSName(query, off)
+		if err != nil || next+4 > len(query) {
+			return nil, false
+		}
+		questions = append(questions, question{
+			name:  name,
+			typ:   binary.BigEndian.Uint16(query[next:]),
+			class: binary.BigEndian.Uint16(query[next+2:]),
+		})
+		off = next + 4
+	}
+
+	var answers, additional []dnsRecord
+	unicast = legacy
+	instanceName := m.instance + "." + mdnsServiceType
+	for _, q := range questions {
+		if class := q.class &^ dnsClassUnicast; class != dnsClassIN && class != dnsClassANY {
+			continue
+		}
+		matched := true
+		switch {
+		case strings.EqualFold(q.name, mdnsServiceType) && (q.typ == dnsTypePTR || q.typ == dnsTypeANY):
+			services := m.serviceRecords()
+			answers = append(answers, services[0])
+			additional = append(additional, services[1:3]...)
+			additional = append(additional, m.addressRecords()...)
+		case strings.EqualFold(q.name, mdnsServicesEnum) && (q.typ == dnsTypePTR || q.typ == dnsTypeANY):
+			answers = append(answers, m.serviceRecords()[3])
+		case strings.EqualFold(q.name, instanceName):
+			services := m.serviceRecords()
+			if q.typ == dnsTypeSRV || q.typ == dnsTypeANY {
+				answers = append(answers, services[1])
+			}
+			if q.typ == dnsTypeTXT || q.typ == dnsTypeANY {
+				answers = append(answers, services[2])
+			}
+			additional = append(additional, m.addressRecords()...)
+		case strings.EqualFold(q.name, m.host):
+			for _, rec := range m.addressRecords() {
+				if q.typ == rec.typ || q.typ == dnsTypeANY {
+					answers = append(answers, rec)
+				}
+			}
+		default:
+			matched = false
+		}
+		if matched && q.class&dnsClassUnicast != 0 {
+			unicast = true
+		}
+	}
+	if len(answers) == 0 {
+		return nil, false
+	}
+
+	if !legacy {
+		return buildDNSResponse(0, 0, nil, answers, additional, true), unicast
+	}
+	// Legacy queries get the ID and questions echoed back and short TTLs.
+	for _, recs := range [][]dnsRecord{answers, additional} {
+		for i := range recs {
+			recs[i].ttl = min(recs[i].ttl, mdnsLegacyTTL)
+		}
+	}
+	return buildDNSResponse(id, qdcount, query[12:off], answers, additional, false), true
+}
+
+// serviceRecords returns the service PTR, SRV, TXT and enumeration PTR records, in that order.
+func (m *mdnsResponder) serviceRecords() []dnsRecord {
+	instanceName := m.instance + "." + mdnsServiceType
+
+	srv := make([]byte, 6)
+	binary.BigEndian.PutUint16(srv[4:], uint16(m.port))
+	srv = appendDNSName(srv, m.host)
+
+	var txt []byte
+	for _, s := range m.txt {
+		if len(s) > 255 {
+			s = s[:255]
+		}
+		txt = append(txt, byte(len(s)))
+		txt = append(txt, s...)
+	}
+	if len(txt) == 0 {
+		txt = []byte{0}
+	}
+
+	return []dnsRecord{
+		{name: mdnsServiceType, typ: dnsTypePTR, ttl: mdnsServiceTTL, data: appendDNSName(nil, instanceName)},
+		{name: instanceName, typ: dnsTypeSRV, ttl: mdnsHostTTL, unique: true, data: srv},
+		{name: instanceName, typ: dnsTypeTXT, ttl: mdnsServiceTTL, unique: true, data: txt},
+		{name: mdnsServicesEnum, typ: dnsTypePTR, ttl: mdnsServiceTTL, data: appendDNSName(nil, mdnsServiceType)},
+	}
+}
+
+func (m *mdnsResponder) addressRecords() []dnsRecord {
+	var recs []dnsRecord
+	for _, ip := range m.addrs() {
+		if ip4 := ip.To4(); ip4 != nil {
+			recs = append(recs, dnsRecord{name: m.host, typ: dnsTypeA, ttl: mdnsHostTTL, unique: true, data: ip4})
+		} else {
+			recs = append(recs, dnsRecord{name: m.host, typ: dnsTypeAAAA, ttl: mdnsHostTTL, unique: true, data: ip.To16()})
+		}
+	}
+	return recs
+}
+
+// buildDNSResponse encodes an authoritative response. Names are written
+// without compression, which keeps the encoder trivial at a small size cost.
+func buildDNSResponse(id uint16, qdcount int, questions []byte, answers, additional []dnsRecord, multicast bool) []byte {
+	msg := make([]byte, 12)
+	binary.BigEndian.PutUint16(msg[0:], id)
+	binary.BigEndian.PutUint16(msg[2:], 0x8400) // QR + AA
+	binary.BigEndian.PutUint16(msg[4:], uint16(qdcount))
+	msg = append(msg, questions...)
+	binary.BigEndian.PutUint16(msg[6:], uint16(len(answers)))
+	binary.BigEndian.PutUint16(msg[10:], uint16(len(additional)))
+	return appendDNSRecords(msg, slices.Concat(answers, additional), multicast)
+}
+
+// buildDNSProbe encodes a probe: a query of type ANY for each name, with
+// the records to be claimed in the authority section.
+func buildDNSProbe(names []string, authority []dnsRecord) []byte {
+	msg := make([]byte, 12)
+	binary.BigEndian.PutUint16(msg[4:], uint16(len(names)))
+	binary.BigEndian.PutUint16(msg[8:], uint16(len(authority)))
+	for _, name := range names {
+		msg = appendDNSName(msg, name)
+		msg = binary.BigEndian.AppendUint16(msg, dnsTypeANY)
+		msg = binary.BigEndian.AppendUint16(msg, dnsClassIN)
+	}
+	return appendDNSRecords(msg, authority, false)
+}
+
+// appendDNSRecords encodes records. In multicast messages, unique records
+// get the cache-flush bit.
+func appendDNSRecords(msg []byte, records []dnsRecord, multicast bool) []byte {
+	for _, rec := range records {
+		msg = appendDNSName(msg, rec.name)
+		class := uint16(dnsClassIN)
+		if multicast && rec.unique {
+			class |= dnsClassCacheFlush
+		}
+		msg = binary.BigEndian.AppendUint16(msg, rec.typ)
+		msg = binary.BigEndian.AppendUint16(msg, class)
+		msg = binary.BigEndian.AppendUint32(msg, rec.ttl)
+		msg = binary.BigEndian.AppendUint16(msg, uint16(len(rec.data)))
+		msg = append(msg, rec.data...)
+	}
+	return msg
+}
+
+// appendDNSName encodes a dotted name as DNS labels.
+func appendDNSName(b []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" {
+			continue
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+// readDNSName decodes the name at off, following compression pointers. It
+// returns the dotted name and the offset just past it.
+func readDNSName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errDNSMalformed
+		}
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.Join(labels, "."), next, nil
+		case n&0xC0 == 0xC0:
+			if off+1 >= len(msg) || jumps > 16 {
+				return "", 0, errDNSMalformed
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3FFF)
+			jumps++
+		case n&0xC0 != 0:
+			return "", 0, errDNSMalformed
+		default:
+			if off+1+n > len(msg) {
+				return "", 0, errDNSMalformed
+			}
+			labels = append(labels, string(msg[off+1:off+1+n]))
+			off += 1 + n
+		}
+	}
+}
+
+func ipsKey(ips []net.IP) string {
+	parts := make([]string, len(ips))
+	for i, ip := range ips {
+		parts[i] = ip.String()
+	}
+	slices.Sort(parts)
+	return strings.Join(parts, ",")
+}
+
+// startMDNS advertises the server unless it is disabled in the config.
+// Failing to advertise is not fatal: phones can still use the IP address.
+func (s *Server) startMDNS() {
+	if !s.listen.mdns {
+		return
+	}
+	host := mdnsHostname()
+	if host == "" {
+		log.Printf("mDNS disabled: hostname is not a valid DNS label")
+		return
+	}
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		log.Printf("mDNS disabled: %v", err)
+		return
+	}
+	if bound, err := s.listen.bindIPs(); err == nil && len(bound) > 0 {
+		ifaces = slices.DeleteFunc(ifaces, func(iface net.Interface) bool {
+			return !interfaceHasIP(iface, bound)
+		})
+	}
+
+	addrs := func() []net.IP {
+		var ips []net.IP
+		for _, a := range s.Addresses() {
+			if ip := net.ParseIP(a.Host); ip != nil {
+				ips = append(ips, ip)
+			}
+		}
+		return ips
+	}
+	txt := []string{"path=" + s.listen.basePath + "/", "version=" + s.version}
+	m := newMDNSResponder(s.name, host, s.listen.port, txt, addrs)
+	if err := m.start(ifaces); err != nil {
+		log.Printf("mDNS disabled: %v", err)
+		return
+	}
+	s.mdns = m
+	log.Printf("Advertising %s as %s.%s", m.host, m.instance, mdnsServiceType)
+}
+
+// mdnsHostname is the host name the server advertises: the computer's
+// .local name with a gtalk- prefix, or "" if there is none.
+func mdnsHostname() string {
+	host := localHostname()
+	if host == "" {
+		return ""
+	}
+	label := "gtalk-" + strings.TrimSuffix(host, ".local")
+	return strings.TrimRight(label[:min(len(label), 63)], "-") + ".local"
+}
+
+// mdnsHost returns the name the server is advertised as, or "" if mDNS is off.
+func (s *Server) mdnsHost() string {
+	if s.mdns == nil {
+		return ""
+	}
+	return s.mdns.host
+}
+
+func interfaceHasIP(iface net.Interface, ips []net.IP) bool {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			for _, ip := range ips {
+				if ipNet.IP.Equal(ip) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
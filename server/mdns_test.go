@@ -0,0 +1,200 @@
+package server
+
+import (
+	"encoding/binary"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+func testResponder() *mdnsResponder {
+	addrs := []net.IP{net.ParseIP("192.168.1.20"), net.ParseIP("fd00::20")}
+	return newMDNSResponder("Ginkgo Talk on desk", "gtalk-desk.local", 9527,
+		[]string{"path=/", "version=test"}, func() []net.IP { return addrs })
+}
+
+// dnsQuery encodes a query with one question.
+func dnsQuery(id uint16, name string, typ, class uint16) []byte {
+	msg := make([]byte, 12)
+	binary.BigEndian.PutUint16(msg[0:], id)
+	binary.BigEndian.PutUint16(msg[4:], 1)
+	msg = appendDNSName(msg, name)
+	msg = binary.BigEndian.AppendUint16(msg, typ)
+	return binary.BigEndian.AppendUint16(msg, class)
+}
+
+func TestMDNSRespondBrowse(t *testing.T) {
+	m := testResponder()
+	resp, unicast := m.respond(dnsQuery(0, mdnsServiceType, dnsTypePTR, dnsClassIN), false)
+	if resp == nil || unicast {
+		t.Fatalf("browse: resp %v, unicast %v; want a multicast answer", resp != nil, unicast)
+	}
+	if id := binary.BigEndian.Uint16(resp); id != 0 {
+		t.Errorf("multicast response ID %d, want 0", id)
+	}
+	if ancount := binary.BigEndian.Uint16(resp[6:]); ancount != 1 {
+		t.Errorf("%d answers, want the PTR record only", ancount)
+	}
+
+	records, err := parseDNSAnswers(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	servers := assembleServers(records)
+	if len(servers) != 1 {
+		t.Fatalf("servers = %+v, want one", servers)
+	}
+	// The IPv4 address is preferred, not the host name.
+	if got := servers[0]; got.Name != "Ginkgo Talk on desk" || got.URL != "https://192.168.1.20:9527" || got.Version != "test" {
+		t.Errorf("server = %+v", got)
+	}
+}
+
+func TestMDNSRespondHost(t *testing.T) {
+	m := testResponder()
+	resp, unicast := m.respond(dnsQuery(0, "GTALK-desk.local", dnsTypeA, dnsClassIN|dnsClassUnicast), false)
+	if resp == nil || !unicast {
+		t.Fatalf("QU query for A: resp %v, unicast %v; want a unicast answer", resp != nil, unicast)
+	}
+	records, err := parseDNSAnswers(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].typ != dnsTypeA || !records[0].ip.Equal(net.ParseIP("192.168.1.20")) {
+		t.Errorf("records = %+v, want the A record only", records)
+	}
+	// Host records are unique, so multicast answers carry cache-flush.
+	if class := binary.BigEndian.Uint16(resp[len(resp)-4-2-4-2:]); class != dnsClassIN|dnsClassCacheFlush {
+		t.Errorf("class %#x, want IN with cache-flush", class)
+	}
+
+	if resp, _ := m.respond(dnsQuery(0, "desk.local", dnsTypeA, dnsClassIN), false); resp != nil {
+		t.Error("answered for the computer's own .local name")
+	}
+}
+
+func TestMDNSRespondLegacy(t *testing.T) {
+	m := testResponder()
+	query := dnsQuery(0x1234, "gtalk-desk.local", dnsTypeANY, dnsClassIN)
+	resp, unicast := m.respond(query, true)
+	if resp == nil || !unicast {
+		t.Fatal("legacy query not answered by unicast")
+	}
+	if id := binary.BigEndian.Uint16(resp); id != 0x1234 {
+		t.Errorf("ID %#x, want the query's", id)
+	}
+	if qdcount := binary.BigEndian.Uint16(resp[4:]); qdcount != 1 || !slices.Equal(resp[12:len(query)], query[12:]) {
+		t.Error("question not echoed")
+	}
+	// A and AAAA, with TTLs capped and no cache-flush bit.
+	off := len(query)
+	for i := 0; i < 2; i++ {
+		_, next, err := readDNSName(resp, off)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if class := binary.BigEndian.Uint16(resp[next+2:]); class != dnsClassIN {
+			t.Errorf("record %d: class %#x, want IN", i, class)
+		}
+		if ttl := binary.BigEndian.Uint32(resp[next+4:]); ttl > mdnsLegacyTTL {
+			t.Errorf("record %d: TTL %d, want at most %d", i, ttl, mdnsLegacyTTL)
+		}
+		off = next + 10 + int(binary.BigEndian.Uint16(resp[next+8:]))
+	}
+}
+
+func TestMDNSRespondIgnores(t *testing.T) {
+	m := testResponder()
+	response := dnsQuery(0, "gtalk-desk.local", dnsTypeA, dnsClassIN)
+	binary.BigEndian.PutUint16(response[2:], 0x8400)
+	// One question whose name points at itself.
+	loop := make([]byte, 12)
+	binary.BigEndian.PutUint16(loop[4:], 1)
+	loop = append(binary.BigEndian.AppendUint16(loop, 0xC00C), 0, 1, 0, 1)
+
+	for name, msg := range map[string][]byte{
+		"short":       {0, 0, 0},
+		"response":    response,
+		"other name":  dnsQuery(0, "printer.local", dnsTypeA, dnsClassIN),
+		"other class": dnsQuery(0, "gtalk-desk.local", dnsTypeA, 3),
+		"truncated":   dnsQuery(0, "gtalk-desk.local", dnsTypeA, dnsClassIN)[:20],
+		"loop":        loop,
+	} {
+		if resp, _ := m.respond(msg, false); resp != nil {
+			t.Errorf("%s: answered", name)
+		}
+	}
+}
+
+func TestReadDNSNameCompression(t *testing.T) {
+	msg := make([]byte, 12)
+	msg = appendDNSName(msg, "gtalk-desk.local")
+	ptr := len(msg)
+	msg = append(msg, 3, 'w', 'w', 'w', 0xC0, 12+11) // "www" + pointer to "local"
+	name, next, err := readDNSName(msg, ptr)
+	if err != nil || name != "www.local" || next != len(msg) {
+		t.Errorf("readDNSName = %q, %d, %v; want www.local, %d", name, next, err, len(msg))
+	}
+}
+
+func TestMDNSHostname(t *testing.T) {
+	host := mdnsHostname()
+	if host == "" {
+		t.Skip("hostname is not a valid DNS label")
+	}
+	if host == localHostname() || host != "gtalk-"+localHostname() {
+		t.Errorf("mdnsHostname = %q for %q", host, localHostname())
+	}
+}
+
+func TestMDNSRename(t *testing.T) {
+	m := testResponder()
+	m.rename(2)
+	if m.host != "gtalk-desk-2.local" || m.instance != "Ginkgo Talk on desk (2)" {
+		t.Errorf("renamed to %q, %q", m.host, m.instance)
+	}
+}
+
+// loopback returns the loopback interface, or skips the test.
+func loopback(t *testing.T) net.Interface {
+	t.Helper()
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Skip(err)
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 && iface.Flags&net.FlagUp != 0 {
+			return iface
+		}
+	}
+	t.Skip("no loopback interface")
+	return net.Interface{}
+}
+
+func TestMDNSProbeConflict(t *testing.T) {
+	lo := loopback(t)
+	first := testResponder()
+	if err := first.start([]net.Interface{lo}); err != nil {
+		t.Skipf("mDNS on loopback: %v", err)
+	}
+	defer first.Close()
+	if first.host != "gtalk-desk.local" {
+		t.Fatalf("first responder took %q", first.host)
+	}
+
+	// The first responder answers the second's probes, so the second
+	// numbers its names.
+	second := testResponder()
+	start := time.Now()
+	if err := second.start([]net.Interface{lo}); err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	if second.host != "gtalk-desk-2.local" || second.instance != "Ginkgo Talk on desk (2)" {
+		t.Errorf("second responder took %q, %q", second.host, second.instance)
+	}
+	if elapsed := time.Since(start); elapsed < 3*mdnsProbeInterval {
+		t.Errorf("started after %s, too soon to have probed", elapsed)
+	}
+}
@@ -0,0 +1,318 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gold16/ginkgo-talk/config"
+)
+
+// A minimal MQTT 3.1.1 publisher, just enough to send events to a broker:
+// CONNECT, PUBLISH at QoS 0 or 1, and PINGREQ to keep the connection open.
+
+const (
+	mqttDefaultTopic = "ginkgo-talk"
+	mqttKeepAlive    = 60 // seconds
+
+	mqttConnect    = 1
+	mqttConnack    = 2
+	mqttPublish    = 3
+	mqttPuback     = 4
+	mqttPingreq    = 12
+	mqttPingresp   = 13
+	mqttDisconnect = 14
+)
+
+// mqttConnackErrors are the broker's reasons for refusing a connection.
+var mqttConnackErrors = map[byte]string{
+	1: "unacceptable protocol version",
+	2: "client ID rejected",
+	3: "server unavailable",
+	4: "bad user name or password",
+	5: "not authorized",
+}
+
+type mqttTarget struct {
+	addr     string // host:port
+	useTLS   bool
+	host     string
+	topic    string
+	clientID string
+	username string
+	password string
+	qos      byte
+
+	// The connection is opened on the first event and again after an
+	// error. Only the hook's worker goroutine touches it.
+	conn     net.Conn
+	r        *bufio.Reader
+	packetID uint16
+}
+
+func newMQTTTarget(cfg config.MQTT) (*mqttTarget, error) {
+	u, err := url.Parse(cfg.Broker)
+	if err != nil {
+		return nil, err
+	}
+	t := &mqttTarget{
+		host:     u.Hostname(),
+		topic:    strings.Trim(cfg.Topic, "/"),
+		clientID: cfg.ClientID,
+		username: cfg.Username,
+		password: cfg.Password,
+		qos:      1,
+	}
+	port := u.Port()
+	switch u.Scheme {
+	case "tcp", "mqtt":
+		if port == "" {
+			port = "1883"
+		}
+	case "tls", "ssl", "mqtts":
+		t.useTLS = true
+		if port == "" {
+			port = "8883"
+		}
+	default:
+		return nil, fmt.Errorf("invalid broker %q: use tcp://host:1883 or tls://host:8883", cfg.Broker)
+	}
+	if t.host == "" {
+		return nil, fmt.Errorf("invalid broker %q: missing host", cfg.Broker)
+	}
+	t.addr = net.JoinHostPort(t.host, port)
+	if t.topic == "" {
+		t.topic = mqttDefaultTopic
+	}
+	if strings.ContainsAny(t.topic, "+#") {
+		return nil, fmt.Errorf("invalid topic %q: wildcards are for subscribing", cfg.Topic)
+	}
+	if cfg.QoS != nil {
+		if *cfg.QoS != 0 && *cfg.QoS != 1 {
+			return nil, fmt.Errorf("invalid qos %d: use 0 or 1", *cfg.QoS)
+		}
+		t.qos = byte(*cfg.QoS)
+	}
+	if t.clientID == "" {
+		b := make([]byte, 4)
+		rand.Read(b)
+		t.clientID = "ginkgo-talk-" + hex.EncodeToString(b)
+	}
+	return t, nil
+}
+
+func (t *mqttTarget) String() string {
+	scheme := "tcp"
+	if t.useTLS {
+		scheme = "tls"
+	}
+	return fmt.Sprintf("MQTT %s://%s/%s", scheme, t.addr, t.topic)
+}
+
+func (t *mqttTarget) deliver(ctx context.Context, ev Event, body []byte) error {
+	if err := t.connect(ctx); err != nil {
+		return err
+	}
+	err := t.publish(ctx, t.topic+"/"+ev.Type, body)
+	if err != nil {
+		t.drop()
+	}
+	return err
+}
+
+func (t *mqttTarget) idleEvery() time.Duration {
+	return mqttKeepAlive * time.Second / 2
+}
+
+// idle pings the broker so it doesn't drop a quiet connection.
+func (t *mqttTarget) idle(ctx context.Context) {
+	if t.conn == nil {
+		return
+	}
+	t.deadline(ctx)
+	err := t.write(mqttPingreq<<4, nil)
+	if err == nil {
+		err = t.expect(mqttPingresp, nil)
+	}
+	if err != nil {
+		t.drop()
+	}
+}
+
+func (t *mqttTarget) close() {
+	if t.conn == nil {
+		return
+	}
+	t.conn.SetDeadline(time.Now().Add(time.Second))
+	t.write(mqttDisconnect<<4, nil)
+	t.drop()
+}
+
+func (t *mqttTarget) drop() {
+	if t.conn != nil {
+		t.conn.Close()
+		t.conn, t.r = nil, nil
+	}
+}
+
+// deadline makes reads and writes give up when ctx does.
+func (t *mqttTarget) deadline(ctx context.Context) {
+	if d, ok := ctx.Deadline(); ok {
+		t.conn.SetDeadline(d)
+	} else {
+		t.conn.SetDeadline(time.Time{})
+	}
+}
+
+func (t *mqttTarget) connect(ctx context.Context) error {
+	if t.conn != nil {
+		return nil
+	}
+	var conn net.Conn
+	var err error
+	if t.useTLS {
+		d := tls.Dialer{Config: &tls.Config{ServerName: t.host}}
+		conn, err = d.DialContext(ctx, "tcp", t.addr)
+	} else {
+		var d net.Dialer
+		conn, err = d.DialContext(ctx, "tcp", t.addr)
+	}
+	if err != nil {
+		return err
+	}
+	t.conn, t.r = conn, bufio.NewReader(conn)
+	t.deadline(ctx)
+
+	flags := byte(0x02) // clean session
+	payload := mqttString(nil, t.clientID)
+	if t.username != "" {
+		flags |= 0x80
+		payload = mqttString(payload, t.username)
+		if t.password != "" {
+			flags |= 0x40
+			payload = mqttString(payload, t.password)
+		}
+	}
+	var p []byte
+	p = mqttString(p, "MQTT")
+	p = append(p, 4, flags) // protocol level 4 is MQTT 3.1.1
+	p = binary.BigEndian.AppendUint16(p, mqttKeepAlive)
+	p = append(p, payload...)
+
+	if err := t.write(mqttConnect<<4, p); err != nil {
+		t.drop()
+		return err
+	}
+	var ack [2]byte
+	if err := t.expect(mqttConnack, ack[:]); err != nil {
+		t.drop()
+		return err
+	}
+	if ack[1] != 0 {
+		t.drop()
+		reason, ok := mqttConnackErrors[ack[1]]
+		if !ok {
+			reason = fmt.Sprintf("code %d", ack[1])
+		}
+		return fmt.Errorf("broker refused connection: %s", reason)
+	}
+	return nil
+}
+
+func (t *mqttTarget) publish(ctx context.Context, topic string, body []byte) error {
+	t.deadline(ctx)
+	p := mqttString(nil, topic)
+	if t.qos == 0 {
+		return t.write(mqttPublish<<4, append(p, body...))
+	}
+
+	t.packetID++
+	if t.packetID == 0 {
+		t.packetID = 1
+	}
+	p = binary.BigEndian.AppendUint16(p, t.packetID)
+	if err := t.write(mqttPublish<<4|1<<1, append(p, body...)); err != nil {
+		return err
+	}
+	for {
+		var ack [2]byte
+		if err := t.expect(mqttPuback, ack[:]); err != nil {
+			return err
+		}
+		if binary.BigEndian.Uint16(ack[:]) == t.packetID {
+			return nil
+		}
+	}
+}
+
+// write sends one packet with the given first byte and body.
+func (t *mqttTarget) write(header byte, body []byte) error {
+	packet := []byte{header}
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if n == 0 {
+			break
+		}
+	}
+	_, err := t.conn.Write(append(packet, body...))
+	return err
+}
+
+// expect reads the next packet, which must be of the given type, into
+// body. Other packets are skipped, as only acknowledgements matter here.
+func (t *mqttTarget) expect(packetType byte, body []byte) error {
+	for {
+		header, err := t.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		n, mult := 0, 1
+		for i := 0; ; i++ {
+			b, err := t.r.ReadByte()
+			if err != nil {
+				return err
+			}
+			if i == 4 {
+				return errors.New("malformed packet from broker")
+			}
+			n += int(b&0x7f) * mult
+			mult *= 128
+			if b&0x80 == 0 {
+				break
+			}
+		}
+		if header>>4 != packetType {
+			if _, err := t.r.Discard(n); err != nil {
+				return err
+			}
+			continue
+		}
+		if n != len(body) {
+			return fmt.Errorf("unexpected packet length %d from broker", n)
+		}
+		_, err = io.ReadFull(t.r, body)
+		return err
+	}
+}
+
+// mqttString appends s with its two-byte length prefix.
+func mqttString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
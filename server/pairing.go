@@ -0,0 +1,109 @@
+package server
+
+import (
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// pairLinkTTL is how long a QR pairing link stays valid if nobody scans it.
+const pairLinkTTL = 2 * time.Minute
+
+// pairLink is a single-use pairing nonce embedded in the QR code.
+type pairLink struct {
+	nonce      string
+	expiresAt  time.Time
+	generation int
+}
+
+// pairLinkIssuer hands out one pairing link at a time. The link is replaced
+// as soon as it is redeemed or expires, so a photo of the QR code is useless
+// once the phone it was meant for has paired.
+type pairLinkIssuer struct {
+	mu         sync.Mutex
+	current    pairLink
+	generation int
+}
+
+func newPairLinkIssuer() *pairLinkIssuer {
+	return &pairLinkIssuer{}
+}
+
+// Current returns the active pairing link, generating a new one if needed.
+func (p *pairLinkIssuer) Current() (pairLink, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.current.nonce == "" || time.Now().After(p.current.expiresAt) {
+		if err := p.regenerateLocked(); err != nil {
+			return pairLink{}, err
+		}
+	}
+	return p.current, nil
+}
+
+// Redeem consumes nonce. It succeeds at most once per link.
+func (p *pairLinkIssuer) Redeem(nonce string) bool {
+	if nonce == "" {
+		return false
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.current.nonce == "" || time.Now().After(p.current.expiresAt) {
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(nonce), []byte(p.current.nonce)) != 1 {
+		return false
+	}
+	// Invalidate right away; the next Current call issues a fresh link.
+	p.current = pairLink{}
+	return true
+}
+
+func (p *pairLinkIssuer) regenerateLocked() error {
+	nonce, err := generateAuthToken()
+	if err != nil {
+		return err
+	}
+	p.generation++
+	p.current = pairLink{
+		nonce:      nonce,
+		expiresAt:  time.Now().Add(pairLinkTTL),
+		generation: p.generation,
+	}
+	return nil
+}
+
+// isLocalRequest reports whether r was made from the desktop itself, either
+// over loopback or to one of this machine's own addresses. Requests through
+// the reverse proxy never are, whatever address the proxy forwarded.
+func isLocalRequest(r *http.Request) bool {
+	if isProxied(r) {
+		return false
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	remote := net.ParseIP(host)
+	if remote == nil {
+		return false
+	}
+	if remote.IsLoopback() {
+		return true
+	}
+	if local, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		if tcpAddr, ok := local.(*net.TCPAddr); ok && tcpAddr.IP.Equal(remote) {
+			return true
+		}
+	}
+	// The desktop's browser may use any of this machine's addresses.
+	for _, ip := range interfaceIPs() {
+		if ip.Equal(remote) {
+			return true
+		}
+	}
+	return false
+}
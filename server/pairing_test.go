@@ -0,0 +1,183 @@
+package server
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gold16/ginkgo-talk/config"
+)
+
+// pairWithCode posts the pair code for deviceID, with an access token if
+// one is given, and returns the status and response body.
+func pairWithCode(t *testing.T, s *Server, deviceID, accessToken string) (int, map[string]interface{}) {
+	t.Helper()
+	return postPairCode(t, s, "192.0.2.10:4000", s.pairCodes.current(), deviceID, accessToken)
+}
+
+// postPairCode pairs deviceID through SPAKE2 with code, from remoteAddr and
+// with an access token if one is given. It returns the status and body of
+// the step that ended the exchange.
+func postPairCode(t *testing.T, s *Server, remoteAddr, code, deviceID, accessToken string) (int, map[string]interface{}) {
+	t.Helper()
+	c := newPakeClient(t, deviceID, code)
+	status, resp := postJSON(t, s.handlePairPake, "/api/pair/pake", remoteAddr, accessToken, map[string]string{
+		"method":   "code",
+		"deviceId": deviceID,
+		"share":    encodePakeElement(c.X),
+	})
+	if status != http.StatusOK {
+		return status, resp
+	}
+	Y, err := parsePakeElement(resp["share"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return postJSON(t, s.handlePairPakeConfirm, "/api/pair/pake/confirm", remoteAddr, accessToken, map[string]string{
+		"session": resp["session"].(string),
+		"confirm": hex.EncodeToString(c.finish(t, Y).clientConfirm),
+	})
+}
+
+func TestPairingKnownDeviceIDNeedsApproval(t *testing.T) {
+	s := newTestServer(t, config.Config{
+		DefaultPolicy:  PolicyGuest,
+		DevicePolicies: map[string]string{"laptop": PolicyFull},
+	})
+
+	// A new ID pairs with the code alone.
+	code, resp := pairWithCode(t, s, "phone", "")
+	if code != http.StatusOK {
+		t.Fatalf("new device: status %d, want 200", code)
+	}
+	phoneToken, _ := resp["accessToken"].(string)
+
+	// An ID with its own policy can't be claimed without approval.
+	code, resp = pairWithCode(t, s, "laptop", "")
+	if code != http.StatusAccepted || resp["status"] != pairStatusPending {
+		t.Fatalf("policy ID: status %d %v, want 202 pending", code, resp)
+	}
+	pending := s.PendingPairs()
+	if len(pending) != 1 || !pending[0].Replaces {
+		t.Fatalf("pending = %+v, want one request marked Replaces", pending)
+	}
+
+	// Nor can a paired device's ID, by anyone but that device.
+	code, resp = pairWithCode(t, s, "phone", phoneToken)
+	if code != http.StatusOK {
+		t.Fatalf("paired device pairing again: status %d, want 200", code)
+	}
+	phoneToken, _ = resp["accessToken"].(string)
+	code, resp = pairWithCode(t, s, "phone", "")
+	if code != http.StatusAccepted {
+		t.Fatalf("paired ID from another device: status %d, want 202", code)
+	}
+
+	// Approving the takeover ends the old pairing.
+	if err := s.ApprovePair(resp["requestId"].(string)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.sessions.authenticate(phoneToken); ok {
+		t.Error("the replaced device's access token still works")
+	}
+}
+
+// wrongCode returns a pair code other than the current one.
+func wrongCode(s *Server) string {
+	if s.pairCodes.current() == "0000" {
+		return "0001"
+	}
+	return "0000"
+}
+
+func TestPairCodeRotates(t *testing.T) {
+	s := newTestServer(t, config.Config{})
+
+	// A new code may come out the same by chance, so rotation is checked
+	// by whether the old code still works.
+	code := s.pairCodes.current()
+	if status, _ := postPairCode(t, s, "192.0.2.1:1", code, "phone", ""); status != http.StatusOK {
+		t.Fatalf("pairing: status %d", status)
+	}
+	if s.pairCodes.current() == code {
+		t.Skip("the new pair code equals the old one")
+	}
+	if status, _ := postPairCode(t, s, "192.0.2.2:1", code, "tablet", ""); status != http.StatusForbidden {
+		t.Errorf("used pair code: status %d, want 403", status)
+	}
+
+	// Failed attempts from different addresses add up on one code.
+	for i := 2; i < pairMaxAttempts; i++ {
+		postPairCode(t, s, "192.0.2."+strconv.Itoa(10+i)+":1", wrongCode(s), "guess", "")
+	}
+	if s.pairCodes.uses != pairMaxAttempts-1 {
+		t.Fatalf("%d uses counted, want %d", s.pairCodes.uses, pairMaxAttempts-1)
+	}
+	postPairCode(t, s, "192.0.2.30:1", wrongCode(s), "guess", "")
+	if s.pairCodes.uses != 0 {
+		t.Errorf("code not replaced after %d attempts", pairMaxAttempts)
+	}
+}
+
+func TestPairCodeLimitsPerAddress(t *testing.T) {
+	s := newTestServer(t, config.Config{})
+
+	guesser := "198.51.100.7:5000"
+	for i := 0; i < pairMaxAttempts; i++ {
+		if status, _ := postPairCode(t, s, guesser, wrongCode(s), "guess", ""); status != http.StatusForbidden {
+			t.Fatalf("attempt %d: status %d, want 403", i+1, status)
+		}
+	}
+	// The guesser waits, even with the right code, from another port.
+	if status, _ := postPairCode(t, s, "198.51.100.7:5001", s.pairCodes.current(), "guess", ""); status != http.StatusTooManyRequests {
+		t.Errorf("locked out address: status %d, want 429", status)
+	}
+	// Everyone else can still pair.
+	if status, _ := postPairCode(t, s, "192.0.2.1:1", s.pairCodes.current(), "phone", ""); status != http.StatusOK {
+		t.Errorf("other address: status %d, want 200", status)
+	}
+}
+
+func TestPairCodeLimitsAllAddresses(t *testing.T) {
+	s := newTestServer(t, config.Config{})
+	for i := 0; i < pairMaxTotalAttempts; i++ {
+		addr := "198.51.100." + strconv.Itoa(i) + ":1"
+		if status, _ := postPairCode(t, s, addr, wrongCode(s), "guess", ""); status != http.StatusForbidden {
+			t.Fatalf("attempt %d: status %d, want 403", i+1, status)
+		}
+	}
+	if status, _ := postPairCode(t, s, "192.0.2.1:1", s.pairCodes.current(), "phone", ""); status != http.StatusTooManyRequests {
+		t.Errorf("after %d attempts from all over: status %d, want 429", pairMaxTotalAttempts, status)
+	}
+}
+
+func TestPairingWithSecretNeedsPake(t *testing.T) {
+	s := newTestServer(t, config.Config{})
+	for _, body := range []string{
+		`{"code":"` + s.pairCodes.current() + `","deviceId":"phone"}`,
+		`{"nonce":"abc","deviceId":"phone"}`,
+		`{"deviceId":"phone"}`,
+	} {
+		r := httptest.NewRequest("POST", "/api/pair", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		s.handlePair(w, r)
+		var resp map[string]string
+		json.NewDecoder(w.Body).Decode(&resp)
+		if w.Code != http.StatusForbidden || resp["code"] != codePakeRequired {
+			t.Errorf("%s: status %d %v, want 403 %s", body, w.Code, resp, codePakeRequired)
+		}
+	}
+
+	// With approval only there is no secret, and the desktop decides.
+	s = newTestServer(t, config.Config{PairMode: string(PairModeApprove)})
+	r := httptest.NewRequest("POST", "/api/pair", strings.NewReader(`{"deviceId":"phone"}`))
+	w := httptest.NewRecorder()
+	s.handlePair(w, r)
+	if w.Code != http.StatusAccepted {
+		t.Errorf("approval only: status %d, want 202", w.Code)
+	}
+}
@@ -0,0 +1,356 @@
+package server
+
+import (
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// SPAKE2 (RFC 9382) over the 2048-bit MODP group from RFC 3526. A finite
+// field group is used instead of an elliptic curve so the phone can run the
+// exchange with plain BigInt arithmetic and WebCrypto; see web/pake.js.
+//
+// The password is the 4-digit pair code or the one-time QR nonce. It never
+// crosses the wire, and each failed exchange costs an attacker one guess.
+
+const (
+	pakeGroupSize  = 256 // bytes per encoded group element
+	pakeServerID   = "ginkgo-talk"
+	pakeSessionTTL = time.Minute
+)
+
+const rfc3526Group14 = "FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD1" +
+	"29024E088A67CC74020BBEA63B139B22514A08798E3404DD" +
+	"EF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245" +
+	"E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7ED" +
+	"EE386BFB5A899FA5AE9F24117C4B1FE649286651ECE45B3D" +
+	"C2007CB8A163BF0598DA48361C55D39A69163FA8FD24CF5F" +
+	"83655D23DCA3AD961C62F356208552BB9ED529077096966D" +
+	"670C354E4ABC9804F1746C08CA18217C32905E462E36CE3B" +
+	"E39E772C180E86039B2783A2EC07A28FB5C55DF06F4C52C9" +
+	"DE2BCBF6955817183995497CEA956AE515D2261898FA0510" +
+	"15728E5A8AACAA68FFFFFFFFFFFFFFFF"
+
+var (
+	pakeP, pakeQ, pakeG, pakeM, pakeN *big.Int
+
+	errPakeBadShare   = errors.New("invalid key share")
+	errPakeBadConfirm = errors.New("key confirmation failed")
+)
+
+func init() {
+	pakeP, _ = new(big.Int).SetString(rfc3526Group14, 16)
+	pakeQ = new(big.Int).Rsh(new(big.Int).Sub(pakeP, big.NewInt(1)), 1)
+	pakeG = big.NewInt(2)
+	pakeM = pakeHashToGroup("gtalk-spake2-M")
+	pakeN = pakeHashToGroup("gtalk-spake2-N")
+}
+
+// pakeHashToGroup derives a group element with no known discrete log by
+// hashing label to a field element and squaring it into the order-q subgroup.
+func pakeHashToGroup(label string) *big.Int {
+	var buf []byte
+	for i := byte(0); len(buf) < pakeGroupSize+32; i++ {
+		h := sha256.Sum256(append([]byte(label), i))
+		buf = append(buf, h[:]...)
+	}
+	x := new(big.Int).SetBytes(buf)
+	x.Mod(x, pakeP)
+	return x.Exp(x, big.NewInt(2), pakeP)
+}
+
+// pakePassword maps a pair secret to the SPAKE2 password scalar w.
+// The device ID is mixed in so a transcript can't be replayed for another device.
+func pakePassword(deviceID, secret string) *big.Int {
+	h := sha256.Sum256([]byte("gtalk-spake2-w\x00" + deviceID + "\x00" + secret))
+	return new(big.Int).SetBytes(h[:])
+}
+
+// pakeKeys are the keys derived from a completed exchange.
+type pakeKeys struct {
+	e2eKey        []byte // AES-256-GCM key for WebSocket payloads
+	clientConfirm []byte // expected client key confirmation MAC
+	serverConfirm []byte // server key confirmation MAC
+}
+
+// pakeRespond runs the server side of SPAKE2 for the client share X.
+// It returns the server share Y and the derived keys.
+func pakeRespond(deviceID string, w, X *big.Int) (*big.Int, pakeKeys, error) {
+	if !pakeValidElement(X) {
+		return nil, pakeKeys{}, errPakeBadShare
+	}
+
+	yBytes := make([]byte, 32)
+	if _, err := rand.Read(yBytes); err != nil {
+		return nil, pakeKeys{}, err
+	}
+	y := new(big.Int).SetBytes(yBytes)
+	if y.Sign() == 0 {
+		y.SetInt64(1)
+	}
+
+	// Y = g^y * N^w
+	Y := new(big.Int).Exp(pakeG, y, pakeP)
+	Y.Mul(Y, new(big.Int).Exp(pakeN, w, pakeP)).Mod(Y, pakeP)
+
+	// K = (X / M^w)^y
+	mw := new(big.Int).Exp(pakeM, w, pakeP)
+	K := new(big.Int).Mul(X, new(big.Int).ModInverse(mw, pakeP))
+	K.Mod(K, pakeP).Exp(K, y, pakeP)
+
+	keys, err := pakeDeriveKeys(deviceID, X, Y, K, w)
+	if err != nil {
+		return nil, pakeKeys{}, err
+	}
+	return Y, keys, nil
+}
+
+// pakeValidElement checks that v is a non-trivial member of the order-q subgroup.
+func pakeValidElement(v *big.Int) bool {
+	if v == nil || v.Cmp(big.NewInt(1)) <= 0 || v.Cmp(new(big.Int).Sub(pakeP, big.NewInt(1))) >= 0 {
+		return false
+	}
+	return new(big.Int).Exp(v, pakeQ, pakeP).Cmp(big.NewInt(1)) == 0
+}
+
+func pakeDeriveKeys(deviceID string, X, Y, K, w *big.Int) (pakeKeys, error) {
+	// Transcript layout follows RFC 9382: each field is prefixed with its
+	// length as a little-endian uint64.
+	var tt []byte
+	appendField := func(b []byte) {
+		tt = binary.LittleEndian.AppendUint64(tt, uint64(len(b)))
+		tt = append(tt, b...)
+	}
+	appendField([]byte(deviceID))
+	appendField([]byte(pakeServerID))
+	appendField(X.FillBytes(make([]byte, pakeGroupSize)))
+	appendField(Y.FillBytes(make([]byte, pakeGroupSize)))
+	appendField(K.FillBytes(make([]byte, pakeGroupSize)))
+	appendField(w.FillBytes(make([]byte, 32)))
+	hash := sha256.Sum256(tt)
+
+	e2eKey, err := hkdf.Key(sha256.New, hash[:], nil, "gtalk e2e key", 32)
+	if err != nil {
+		return pakeKeys{}, err
+	}
+	kcA, err := hkdf.Key(sha256.New, hash[:], nil, "gtalk confirm client", 32)
+	if err != nil {
+		return pakeKeys{}, err
+	}
+	kcB, err := hkdf.Key(sha256.New, hash[:], nil, "gtalk confirm server", 32)
+	if err != nil {
+		return pakeKeys{}, err
+	}
+	return pakeKeys{
+		e2eKey:        e2eKey,
+		clientConfirm: pakeMAC(kcA, hash[:]),
+		serverConfirm: pakeMAC(kcB, hash[:]),
+	}, nil
+}
+
+func pakeMAC(key, msg []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(msg)
+	return mac.Sum(nil)
+}
+
+func parsePakeElement(s string) (*big.Int, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != pakeGroupSize {
+		return nil, errPakeBadShare
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func encodePakeElement(v *big.Int) string {
+	return hex.EncodeToString(v.FillBytes(make([]byte, pakeGroupSize)))
+}
+
+// pakeSession is a SPAKE2 exchange waiting for the client's key confirmation.
+type pakeSession struct {
+	deviceID   string
+	deviceName string
+	method     string // "code" or "nonce"
+	secret     string
+	keys       pakeKeys
+	expiresAt  time.Time
+}
+
+// pakeSessionStore holds half-finished exchanges between the two pairing requests.
+type pakeSessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*pakeSession
+}
+
+func newPakeSessionStore() *pakeSessionStore {
+	return &pakeSessionStore{sessions: make(map[string]*pakeSession)}
+}
+
+func (st *pakeSessionStore) add(sess *pakeSession) (string, error) {
+	id, err := generateAuthToken()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	sess.expiresAt = now.Add(pakeSessionTTL)
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for k, s := range st.sessions {
+		if now.After(s.expiresAt) {
+			delete(st.sessions, k)
+		}
+	}
+	st.sessions[id] = sess
+	return id, nil
+}
+
+// confirm checks the client's key confirmation. The session is consumed
+// whatever the outcome, so each exchange allows exactly one guess.
+func (st *pakeSessionStore) confirm(id string, clientConfirm []byte) (*pakeSession, error) {
+	st.mu.Lock()
+	sess, ok := st.sessions[id]
+	delete(st.sessions, id)
+	st.mu.Unlock()
+
+	if !ok || time.Now().After(sess.expiresAt) {
+		return nil, fmt.Errorf("unknown or expired key exchange")
+	}
+	if !hmac.Equal(clientConfirm, sess.keys.clientConfirm) {
+		return sess, errPakeBadConfirm
+	}
+	return sess, nil
+}
+
+// pairCodes holds the 4-digit pair code and slows down online guessing of
+// it. Every attempt counts until it succeeds, including key exchanges the
+// client abandons after seeing the server's confirmation.
+//
+// A client that keeps failing is locked out on its own, so it can't lock
+// out everyone else; only many failing clients together lock out all. The
+// code changes after pairMaxAttempts attempts from anyone and after every
+// pairing, so guesses don't pile up against one code.
+type pairCodes struct {
+	mu          sync.Mutex
+	code        string
+	uses        int // attempts on the current code
+	failures    int // attempts from all clients since the last success
+	lockedUntil time.Time
+	clients     map[string]*pairClient // by IP address
+	onChange    func(code string)
+}
+
+// pairClient counts the attempts from one address.
+type pairClient struct {
+	attempts    int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+const (
+	pairMaxAttempts      = 5  // per client, and per code
+	pairMaxTotalAttempts = 20 // from all clients
+	pairLockout          = time.Minute
+	pairClientMemory     = 10 * time.Minute
+)
+
+func newPairCodes() *pairCodes {
+	p := &pairCodes{clients: make(map[string]*pairClient)}
+	p.code = newPairCode()
+	return p
+}
+
+func newPairCode() string {
+	code, err := generatePairCode()
+	if err != nil {
+		log.Printf("failed to generate pair code, falling back to 0000: %v", err)
+		return "0000"
+	}
+	return code
+}
+
+// current returns the pair code to show on the desktop.
+func (p *pairCodes) current() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.code
+}
+
+// attempt counts an attempt from the client at addr and returns the code
+// to check it against, or false if the client must wait.
+func (p *pairCodes) attempt(addr string) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	for key, c := range p.clients {
+		if now.Sub(c.last) > pairClientMemory && now.After(c.lockedUntil) {
+			delete(p.clients, key)
+		}
+	}
+	c := p.clients[addr]
+	if c == nil {
+		c = &pairClient{}
+		p.clients[addr] = c
+	}
+	if now.Before(p.lockedUntil) || now.Before(c.lockedUntil) {
+		return "", false
+	}
+
+	code := p.code
+	c.attempts++
+	c.last = now
+	if c.attempts >= pairMaxAttempts {
+		log.Printf("Too many pair code attempts from %s, ignoring it for %s", addr, pairLockout)
+		c.attempts = 0
+		c.lockedUntil = now.Add(pairLockout)
+	}
+	p.failures++
+	if p.failures >= pairMaxTotalAttempts {
+		log.Printf("Too many pair code attempts, refusing all for %s", pairLockout)
+		p.failures = 0
+		p.lockedUntil = now.Add(pairLockout)
+	}
+	p.uses++
+	if p.uses >= pairMaxAttempts {
+		p.rotate()
+	}
+	return code, true
+}
+
+// succeed records that the client at addr paired with the code, which
+// is then replaced.
+func (p *pairCodes) succeed(addr string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.clients, addr)
+	p.failures = 0
+	p.rotate()
+}
+
+func (p *pairCodes) rotate() {
+	p.code = newPairCode()
+	p.uses = 0
+	log.Printf("New pair code: %s", p.code)
+	if p.onChange != nil {
+		go p.onChange(p.code)
+	}
+}
+
+// remoteIP returns the client address of r without the port.
+func remoteIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
@@ -0,0 +1,210 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gold16/ginkgo-talk/config"
+)
+
+// pakeClient is the device side of SPAKE2, as web/pake.js runs it.
+type pakeClient struct {
+	deviceID string
+	w, x, X  *big.Int
+}
+
+func newPakeClient(t *testing.T, deviceID, secret string) *pakeClient {
+	t.Helper()
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	c := &pakeClient{deviceID: deviceID, w: pakePassword(deviceID, secret), x: new(big.Int).SetBytes(b)}
+	// X = g^x * M^w
+	c.X = new(big.Int).Exp(pakeG, c.x, pakeP)
+	c.X.Mul(c.X, new(big.Int).Exp(pakeM, c.w, pakeP)).Mod(c.X, pakeP)
+	return c
+}
+
+// finish derives the client's keys from the server share Y.
+func (c *pakeClient) finish(t *testing.T, Y *big.Int) pakeKeys {
+	t.Helper()
+	// K = (Y / N^w)^x
+	nw := new(big.Int).Exp(pakeN, c.w, pakeP)
+	K := new(big.Int).Mul(Y, new(big.Int).ModInverse(nw, pakeP))
+	K.Mod(K, pakeP).Exp(K, c.x, pakeP)
+	keys, err := pakeDeriveKeys(c.deviceID, c.X, Y, K, c.w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func TestPakeExchange(t *testing.T) {
+	c := newPakeClient(t, "phone", "1234")
+	Y, server, err := pakeRespond("phone", pakePassword("phone", "1234"), c.X)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pakeValidElement(Y) {
+		t.Fatal("server share is not a group element")
+	}
+	client := c.finish(t, Y)
+	if !bytes.Equal(client.e2eKey, server.e2eKey) {
+		t.Error("both sides derived different keys from the same password")
+	}
+	if !bytes.Equal(client.serverConfirm, server.serverConfirm) || !bytes.Equal(client.clientConfirm, server.clientConfirm) {
+		t.Error("key confirmations differ")
+	}
+	if bytes.Equal(server.clientConfirm, server.serverConfirm) {
+		t.Error("client and server confirmations are the same")
+	}
+	if len(server.e2eKey) != 32 {
+		t.Errorf("e2e key is %d bytes, want 32", len(server.e2eKey))
+	}
+}
+
+func TestPakeWrongPassword(t *testing.T) {
+	for _, tc := range []struct{ name, deviceID, secret string }{
+		{"wrong code", "phone", "1235"},
+		{"other device", "tablet", "1234"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newPakeClient(t, tc.deviceID, tc.secret)
+			Y, server, err := pakeRespond("phone", pakePassword("phone", "1234"), c.X)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client := c.finish(t, Y)
+			if bytes.Equal(client.e2eKey, server.e2eKey) {
+				t.Error("keys match without the password")
+			}
+			if bytes.Equal(client.clientConfirm, server.clientConfirm) || bytes.Equal(client.serverConfirm, server.serverConfirm) {
+				t.Error("confirmation matches without the password")
+			}
+		})
+	}
+}
+
+func TestPakeRejectsInvalidShares(t *testing.T) {
+	pMinus1 := new(big.Int).Sub(pakeP, big.NewInt(1))
+	// p ≡ 7 (mod 8), so 2 is a square and -2 is not: p-2 lies outside the
+	// order-q subgroup.
+	for name, v := range map[string]*big.Int{
+		"zero":       big.NewInt(0),
+		"one":        big.NewInt(1),
+		"p-1":        pMinus1,
+		"p":          new(big.Int).Set(pakeP),
+		"non-member": new(big.Int).Sub(pakeP, big.NewInt(2)),
+	} {
+		if pakeValidElement(v) {
+			t.Errorf("%s accepted as a group element", name)
+		}
+		if _, _, err := pakeRespond("phone", pakePassword("phone", "1234"), v); err != errPakeBadShare {
+			t.Errorf("%s: pakeRespond error %v, want %v", name, err, errPakeBadShare)
+		}
+	}
+	if !pakeValidElement(pakeM) || !pakeValidElement(pakeN) {
+		t.Error("M or N is not in the subgroup")
+	}
+	for _, s := range []string{"", "zz", hex.EncodeToString(make([]byte, pakeGroupSize-1))} {
+		if _, err := parsePakeElement(s); err == nil {
+			t.Errorf("parsePakeElement(%q) succeeded", s)
+		}
+	}
+}
+
+// postJSON posts body to handler, with an access token if one is given,
+// and decodes the JSON response.
+func postJSON(t *testing.T, handler http.HandlerFunc, path, remoteAddr, accessToken string, body interface{}) (int, map[string]interface{}) {
+	t.Helper()
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("POST", path, bytes.NewReader(data))
+	r.RemoteAddr = remoteAddr
+	if accessToken != "" {
+		r.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+	w := httptest.NewRecorder()
+	handler(w, r)
+	var resp map[string]interface{}
+	json.NewDecoder(w.Body).Decode(&resp)
+	return w.Code, resp
+}
+
+// pakePair runs the exchange through the pairing handlers and returns the
+// confirm status, the response and the client's keys.
+func pakePair(t *testing.T, s *Server, deviceID, code string) (int, map[string]interface{}, pakeKeys) {
+	t.Helper()
+	c := newPakeClient(t, deviceID, code)
+	status, resp := postJSON(t, s.handlePairPake, "/api/pair/pake", "192.0.2.5:1", "", map[string]string{
+		"method":   "code",
+		"deviceId": deviceID,
+		"share":    encodePakeElement(c.X),
+	})
+	if status != http.StatusOK {
+		t.Fatalf("key exchange: status %d %v", status, resp)
+	}
+	Y, err := parsePakeElement(resp["share"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := c.finish(t, Y)
+	session := resp["session"].(string)
+	status, resp = postJSON(t, s.handlePairPakeConfirm, "/api/pair/pake/confirm", "192.0.2.5:1", "", map[string]string{
+		"session": session,
+		"confirm": hex.EncodeToString(keys.clientConfirm),
+	})
+
+	// A session allows one confirmation, right or wrong.
+	again, _ := postJSON(t, s.handlePairPakeConfirm, "/api/pair/pake/confirm", "192.0.2.5:1", "", map[string]string{
+		"session": session,
+		"confirm": hex.EncodeToString(keys.clientConfirm),
+	})
+	if again != http.StatusForbidden {
+		t.Errorf("confirming a session twice: status %d, want 403", again)
+	}
+	return status, resp, keys
+}
+
+func TestPakePairing(t *testing.T) {
+	s := newTestServer(t, config.Config{})
+
+	status, resp, _ := pakePair(t, s, "phone", wrongCode(s))
+	if status != http.StatusForbidden {
+		t.Fatalf("wrong code: status %d %v, want 403", status, resp)
+	}
+
+	status, resp, keys := pakePair(t, s, "phone", s.pairCodes.current())
+	if status != http.StatusOK {
+		t.Fatalf("right code: status %d %v, want 200", status, resp)
+	}
+	token, _ := resp["accessToken"].(string)
+	sess, ok := s.sessions.authenticate(token)
+	if !ok {
+		t.Fatal("the issued access token doesn't work")
+	}
+	if !bytes.Equal(sess.e2eKey, keys.e2eKey) {
+		t.Error("the session doesn't hold the exchanged key")
+	}
+}
+
+func TestPakeConfirmUnknownSession(t *testing.T) {
+	s := newTestServer(t, config.Config{})
+	status, _ := postJSON(t, s.handlePairPakeConfirm, "/api/pair/pake/confirm", "192.0.2.5:1", "", map[string]string{
+		"session": strings.Repeat("a", 43),
+		"confirm": hex.EncodeToString(make([]byte, 32)),
+	})
+	if status != http.StatusForbidden {
+		t.Errorf("unknown session: status %d, want 403", status)
+	}
+}
@@ -0,0 +1,246 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gold16/ginkgo-talk/ai"
+	"github.com/gold16/ginkgo-talk/config"
+)
+
+// ScopeDevices lets a paired device see and revoke the other devices. It
+// can't be granted to API tokens.
+const ScopeDevices Scope = "devices"
+
+// Built-in device policies.
+const (
+	PolicyFull  = "full"  // everything, as before policies existed
+	PolicyGuest = "guest" // type text, nothing else
+)
+
+// Machine-readable error codes for denied requests, sent as "code" in JSON
+// errors and WebSocket error messages.
+const (
+	codeUnauthorized     = "unauthorized"
+	codePermissionDenied = "permission_denied"
+	// codeE2ERequired refuses plain REST calls from devices that paired
+	// with end-to-end encryption.
+	codeE2ERequired = "e2e_required"
+	// codePakeRequired refuses pairing with the pair code or QR nonce
+	// outside SPAKE2.
+	codePakeRequired = "pake_required"
+)
+
+// devicePermissions is everything a paired device can be allowed to do.
+var devicePermissions = append(append([]Scope(nil), allScopes...), ScopeDevices)
+
+var builtinPolicies = map[string][]Scope{
+	PolicyFull:  devicePermissions,
+	PolicyGuest: {ScopeType},
+}
+
+// permissionError is returned when a device or token tries something its
+// policy or scopes don't allow.
+type permissionError struct {
+	who        principal
+	permission Scope
+}
+
+func (e *permissionError) Error() string {
+	if e.permission == scopePaired {
+		return "only paired devices can do this"
+	}
+	return fmt.Sprintf("%s lacks the %s permission", e.who, e.permission)
+}
+
+// policyStore maps paired devices to permission sets. Policies are set in
+// gtalk_config.json: "policies" defines custom ones, "devicePolicies" maps
+// device IDs to a policy and "defaultPolicy" covers every other device.
+type policyStore struct {
+	mu            sync.RWMutex
+	policies      map[string][]Scope
+	defaultPolicy string
+	devices       map[string]string
+}
+
+func newPolicyStore(cfg config.Config) *policyStore {
+	ps := &policyStore{}
+	ps.load(cfg)
+	return ps
+}
+
+// load replaces the policies with those in cfg. Invalid entries are logged
+// and skipped; an unknown default falls back to full access.
+func (ps *policyStore) load(cfg config.Config) {
+	policies := make(map[string][]Scope, len(builtinPolicies)+len(cfg.Policies))
+	for name, scopes := range builtinPolicies {
+		policies[name] = scopes
+	}
+	for name, list := range cfg.Policies {
+		if _, builtin := builtinPolicies[name]; builtin {
+			log.Printf("Policy %q is built in and can't be redefined", name)
+			continue
+		}
+		scopes, err := parseDevicePermissions(list)
+		if err != nil {
+			log.Printf("Skipping policy %q: %v", name, err)
+			continue
+		}
+		policies[name] = scopes
+	}
+
+	defaultPolicy := cfg.DefaultPolicy
+	if defaultPolicy == "" {
+		defaultPolicy = PolicyFull
+	} else if _, ok := policies[defaultPolicy]; !ok {
+		log.Printf("Unknown defaultPolicy %q, using %s", defaultPolicy, PolicyFull)
+		defaultPolicy = PolicyFull
+	}
+
+	devices := make(map[string]string, len(cfg.DevicePolicies))
+	for deviceID, name := range cfg.DevicePolicies {
+		if _, ok := policies[name]; !ok {
+			log.Printf("Device %s has unknown policy %q, using %s", deviceID, name, defaultPolicy)
+			continue
+		}
+		devices[deviceID] = name
+	}
+
+	ps.mu.Lock()
+	ps.policies, ps.defaultPolicy, ps.devices = policies, defaultPolicy, devices
+	ps.mu.Unlock()
+}
+
+// forDevice returns the name and permissions of the device's policy.
+func (ps *policyStore) forDevice(deviceID string) (string, []Scope) {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	name, ok := ps.devices[deviceID]
+	if !ok {
+		name = ps.defaultPolicy
+	}
+	return name, ps.policies[name]
+}
+
+// assigned reports whether deviceID has a policy of its own rather than
+// the default.
+func (ps *policyStore) assigned(deviceID string) bool {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	_, ok := ps.devices[deviceID]
+	return ok
+}
+
+func (ps *policyStore) exists(name string) bool {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	_, ok := ps.policies[name]
+	return ok
+}
+
+// names lists the policies, built-in ones first.
+func (ps *policyStore) names() []string {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	var custom []string
+	for name := range ps.policies {
+		if _, builtin := builtinPolicies[name]; !builtin {
+			custom = append(custom, name)
+		}
+	}
+	sort.Strings(custom)
+	return append([]string{PolicyFull, PolicyGuest}, custom...)
+}
+
+// checkMessage checks that the device may act on a WebSocket message.
+// Text needs ScopeType, and ScopeAI too for an AI mode; commands need
+// ScopeCommand. Actions may need more; runAction checks those.
+func (s *Server) checkMessage(sess deviceSession, msg Message) error {
+	p := s.devicePrincipal(sess)
+	switch msg.Type {
+	case "text":
+		if err := p.check(ScopeType); err != nil {
+			return err
+		}
+		if msg.Mode != "" && ai.Mode(msg.Mode) != ai.ModeRaw {
+			return p.check(ScopeAI)
+		}
+	case "command":
+		return p.check(ScopeCommand)
+	case "script":
+		return p.check(ScopeScript)
+	case "action":
+		return p.check(ScopeAction)
+	case "config":
+		return p.check(ScopeConfigWrite)
+	}
+	return nil
+}
+
+// deniedMessage is the WebSocket form of a permission error. AI requests
+// are answered as ai_error so the phone leaves its processing state, and
+// settings changes as config_error.
+func deniedMessage(err error) map[string]string {
+	reply := map[string]string{"type": "error", "code": codePermissionDenied, "error": err.Error()}
+	var denied *permissionError
+	if errors.As(err, &denied) {
+		reply["permission"] = string(denied.permission)
+		switch denied.permission {
+		case ScopeAI:
+			reply["type"] = "ai_error"
+		case ScopeConfigWrite:
+			reply["type"] = "config_error"
+		}
+	}
+	return reply
+}
+
+// Devices lists the paired devices with their policies.
+func (s *Server) Devices() []DeviceInfo {
+	devices := s.sessions.list()
+	for i := range devices {
+		devices[i].Policy, _ = s.policies.forDevice(devices[i].DeviceID)
+	}
+	return devices
+}
+
+// SetDevicePolicy assigns a policy to a device and saves it to the config.
+func (s *Server) SetDevicePolicy(deviceID, policy string) error {
+	if !s.policies.exists(policy) {
+		return fmt.Errorf("unknown policy %q (one of %s)", policy, strings.Join(s.policies.names(), ", "))
+	}
+	cfg := s.loadConfig()
+	devicePolicies := make(map[string]string, len(cfg.DevicePolicies)+1)
+	for id, name := range cfg.DevicePolicies {
+		devicePolicies[id] = name
+	}
+	devicePolicies[deviceID] = policy
+	cfg.DevicePolicies = devicePolicies
+	if err := s.saveConfig(cfg); err != nil {
+		return err
+	}
+	s.policies.load(cfg)
+	log.Printf("Device %s now has the %s policy", deviceID, policy)
+	return nil
+}
+
+// parseDevicePermissions checks a custom policy's permission list.
+func parseDevicePermissions(list []string) ([]Scope, error) {
+	scopes := make([]Scope, 0, len(list))
+	for _, name := range list {
+		scope := Scope(strings.TrimSpace(name))
+		found := false
+		for _, p := range devicePermissions {
+			found = found || p == scope
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown permission %q", name)
+		}
+		scopes = append(scopes, scope)
+	}
+	return scopes, nil
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/gold16/ginkgo-talk/ai"
+	"github.com/gold16/ginkgo-talk/input"
+	"github.com/gold16/ginkgo-talk/script"
+)
+
+var errNoClipboard = errors.New("the clipboard is not supported on this platform")
+
+// scriptHost carries out a script command's calls on this computer, as
+// the device or token that ran it.
+type scriptHost struct {
+	s      *Server
+	origin eventOrigin
+}
+
+func (h scriptHost) Type(text string, submit bool) error {
+	text, err := h.s.filterText(h.origin, text, ai.ModeRaw)
+	if err != nil {
+		return err
+	}
+	if submit {
+		err = h.s.typeAndSubmit(text)
+	} else {
+		err = h.s.typeText(text)
+	}
+	if err != nil {
+		return err
+	}
+	h.s.publishTyped(h.origin, text, ai.ModeRaw, submit)
+	return nil
+}
+
+func (h scriptHost) Key(name string) error {
+	_, err := h.s.runKeyCommand(name)
+	return err
+}
+
+func (h scriptHost) AI(text, mode string) (string, error) {
+	m, err := h.s.resolveMode(ai.Mode(mode))
+	if err != nil {
+		return "", err
+	}
+	if m == ai.ModeRaw {
+		return text, nil
+	}
+	processed, err := h.s.ai.Process(text, m)
+	if err != nil {
+		return "", err
+	}
+	h.s.publishProcessed(h.origin, text, processed, m)
+	return processed, nil
+}
+
+func (h scriptHost) Clipboard() (string, error) {
+	cb, ok := h.s.input.(input.Clipboard)
+	if !ok {
+		return "", errNoClipboard
+	}
+	return cb.ClipboardText()
+}
+
+func (h scriptHost) SetClipboard(text string) error {
+	cb, ok := h.s.input.(input.Clipboard)
+	if !ok {
+		return errNoClipboard
+	}
+	return cb.SetClipboardText(text)
+}
+
+func (h scriptHost) App() string {
+	return h.s.targetApp()
+}
+
+// runScript runs a script command for o. Failures other than an unknown
+// command are reported to event subscribers.
+func (s *Server) runScript(o eventOrigin, name string) error {
+	log.Printf("Running script command %s", name)
+	err := s.scripts.Run(context.Background(), name, scriptHost{s: s, origin: o})
+	if errors.Is(err, script.ErrUnknownCommand) {
+		log.Printf("Unknown script command: %s", name)
+	} else if err != nil {
+		log.Printf("Script error: %v", err)
+		s.publishBackendError("script", err, o.deviceID)
+	}
+	return err
+}
+
+// publishScripts tells phones the script commands changed.
+func (s *Server) publishScripts() {
+	s.events.publish(Event{
+		Type: EventScriptsChanged,
+		Data: map[string]interface{}{"scripts": s.scripts.Commands()},
+	})
+}
+
+// ScriptRequest is the body of POST /api/scripts/run.
+type ScriptRequest struct {
+	Name string `json:"name"`
+}
+
+// handleAPIScripts lists the script commands.
+func (s *Server) handleAPIScripts(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if _, ok := s.authorize(w, r, ScopeScript); !ok {
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"scripts": s.scripts.Commands()})
+}
+
+// handleAPIRunScript runs a script command and answers once it is done.
+func (s *Server) handleAPIRunScript(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	p, ok := s.apiRequest(w, r, ScopeScript)
+	if !ok {
+		return
+	}
+	var req ScriptRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAPIBody)).Decode(&req); err != nil || req.Name == "" {
+		writeAPIError(w, http.StatusBadRequest, "name is required")
+		return
+	}
+
+	if !s.jobs.start() {
+		writeAPIError(w, http.StatusServiceUnavailable, errShuttingDown.Error())
+		return
+	}
+	defer s.jobs.done()
+
+	if err := s.runScript(p.origin("api"), req.Name); errors.Is(err, script.ErrUnknownCommand) {
+		writeAPIError(w, http.StatusNotFound, fmt.Sprintf("unknown script command %q", req.Name))
+		return
+	} else if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"status": "done"})
+}
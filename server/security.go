@@ -0,0 +1,157 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	csrfCookieName = "gtalk_csrf"
+	csrfHeaderName = "X-CSRF-Token"
+)
+
+// protect wraps every route with the checks browsers need against
+// DNS rebinding, cross-site WebSocket hijacking and CSRF:
+//
+//   - the Host header must name this server (an IP literal, localhost,
+//     the mDNS hostname or a configured allowed host);
+//   - a request with an Origin header must come from that same host;
+//   - browser POSTs must echo the CSRF cookie in the X-CSRF-Token header.
+//
+// Requests with neither an Origin nor a Cookie header come from scripts,
+// not browsers, and skip the CSRF check since they carry no ambient credentials.
+func (s *Server) protect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := requestHost(r)
+		if !s.allowedHost(host) {
+			forbidden(w, r, "host not allowed")
+			return
+		}
+		setSecurityHeaders(w, r, host)
+		if !sameOrigin(r, host) {
+			forbidden(w, r, "cross-origin request")
+			return
+		}
+
+		csrfCookie := ""
+		if c, err := r.Cookie(csrfCookieName); err == nil {
+			csrfCookie = c.Value
+		}
+		if csrfCookie == "" {
+			if token, err := generateAuthToken(); err == nil {
+				http.SetCookie(w, &http.Cookie{
+					Name:     csrfCookieName,
+					Value:    token,
+					Path:     "/",
+					Secure:   true,
+					SameSite: http.SameSiteStrictMode,
+				})
+			}
+		}
+
+		if isUnsafeMethod(r.Method) && isBrowserRequest(r) {
+			sent := r.Header.Get(csrfHeaderName)
+			if csrfCookie == "" || subtle.ConstantTimeCompare([]byte(sent), []byte(csrfCookie)) != 1 {
+				forbidden(w, r, "missing or invalid CSRF token")
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// setSecurityHeaders applies the content security policy and related headers.
+// The app only loads its own scripts; Google Fonts is the one outside source.
+func setSecurityHeaders(w http.ResponseWriter, r *http.Request, host string) {
+	wsScheme := "wss"
+	if fwd, ok := r.Context().Value(forwardedKey{}).(forwardedInfo); ok && fwd.proto == "http" {
+		wsScheme = "ws"
+	}
+	h := w.Header()
+	h.Set("Content-Security-Policy", "default-src 'self'; "+
+		"script-src 'self'; "+
+		"style-src 'self' https://fonts.googleapis.com; "+
+		"font-src https://fonts.gstatic.com; "+
+		"img-src 'self' data:; "+
+		"connect-src 'self' "+wsScheme+"://"+host+"; "+
+		"object-src 'none'; base-uri 'none'; form-action 'self'; frame-ancestors 'none'")
+	h.Set("X-Frame-Options", "DENY")
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("Referrer-Policy", "no-referrer")
+}
+
+// requestHost returns the host the client addressed, taking the reverse
+// proxy's X-Forwarded-Host into account.
+func requestHost(r *http.Request) string {
+	if fwd, ok := r.Context().Value(forwardedKey{}).(forwardedInfo); ok && fwd.host != "" {
+		return fwd.host
+	}
+	return r.Host
+}
+
+// allowedHost reports whether host (with or without port) names this server.
+// IP literals are always fine: DNS rebinding needs a hostname.
+func (s *Server) allowedHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.Trim(host, "[]"))
+	if host == "" {
+		return false
+	}
+	if net.ParseIP(host) != nil || host == "localhost" || host == localHostname() || host == s.mdnsHost() {
+		return true
+	}
+	for _, allowed := range s.listen.allowedHosts {
+		if strings.EqualFold(host, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameOrigin reports whether the Origin header, if any, matches host.
+func sameOrigin(r *http.Request, host string) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false // includes "null"
+	}
+	return strings.EqualFold(u.Host, host)
+}
+
+// checkOrigin is the WebSocket upgrader's origin check. Browsers always
+// send Origin on WebSocket handshakes, so it must match the host.
+func (s *Server) checkOrigin(r *http.Request) bool {
+	return sameOrigin(r, requestHost(r))
+}
+
+func isUnsafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	return true
+}
+
+func isBrowserRequest(r *http.Request) bool {
+	return r.Header.Get("Origin") != "" || r.Header.Get("Cookie") != ""
+}
+
+func forbidden(w http.ResponseWriter, r *http.Request, msg string) {
+	if strings.Contains(r.URL.Path, "/api/") {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": msg})
+		return
+	}
+	http.Error(w, msg, http.StatusForbidden)
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gold16/ginkgo-talk/config"
+)
+
+func TestAllowedHost(t *testing.T) {
+	s := newTestServer(t, config.Config{AllowedHosts: []string{"talk.example.com"}})
+	if s.allowedHost("gtalk-desk.local") {
+		t.Error("mDNS name allowed with mDNS off")
+	}
+	s.mdns = &mdnsResponder{host: "gtalk-desk.local"}
+	allowed := []string{
+		"192.168.1.20", "192.168.1.20:8443", "[fe80::1]:8443", "localhost:8443",
+		"gtalk-desk.local:8443", "TALK.example.com",
+	}
+	if name := localHostname(); name != "" {
+		allowed = append(allowed, name)
+	}
+	for _, host := range allowed {
+		if !s.allowedHost(host) {
+			t.Errorf("%q refused", host)
+		}
+	}
+	for _, host := range []string{"", "evil.example.com", "evil.example.com:8443", "talk.example.com.evil.net"} {
+		if s.allowedHost(host) {
+			t.Errorf("%q allowed", host)
+		}
+	}
+}
+
+func TestSameOrigin(t *testing.T) {
+	for _, tc := range []struct {
+		origin string
+		want   bool
+	}{
+		{"", true},
+		{"https://192.168.1.20:8443", true},
+		{"https://192.168.1.20", false},
+		{"https://evil.example.com", false},
+		{"null", false},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		if tc.origin != "" {
+			r.Header.Set("Origin", tc.origin)
+		}
+		if got := sameOrigin(r, "192.168.1.20:8443"); got != tc.want {
+			t.Errorf("origin %q: %v, want %v", tc.origin, got, tc.want)
+		}
+	}
+}
+
+func TestProtect(t *testing.T) {
+	s := newTestServer(t, config.Config{})
+	h := s.protect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	const host = "192.168.1.20:8443"
+	serve := func(method, host string, header map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "https://"+host+"/api/type", nil)
+		for k, v := range header {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	// A first visit gets a CSRF cookie and the security headers.
+	w := serve("GET", host, nil)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("GET: status %d", w.Code)
+	}
+	var csrf string
+	for _, c := range w.Result().Cookies() {
+		if c.Name == csrfCookieName {
+			csrf = c.Value
+		}
+	}
+	if csrf == "" {
+		t.Fatal("no CSRF cookie set")
+	}
+	if w.Header().Get("Content-Security-Policy") == "" || w.Header().Get("X-Frame-Options") != "DENY" {
+		t.Error("security headers missing")
+	}
+
+	cookie := csrfCookieName + "=" + csrf
+	origin := "https://" + host
+	for _, tc := range []struct {
+		name   string
+		method string
+		host   string
+		header map[string]string
+		want   int
+	}{
+		{"rebound host", "GET", "evil.example.com", nil, http.StatusForbidden},
+		{"cross-origin", "GET", host, map[string]string{"Origin": "https://evil.example.com"}, http.StatusForbidden},
+		{"browser POST without token", "POST", host, map[string]string{"Origin": origin, "Cookie": cookie}, http.StatusForbidden},
+		{"browser POST with wrong token", "POST", host, map[string]string{"Origin": origin, "Cookie": cookie, csrfHeaderName: csrf + "x"}, http.StatusForbidden},
+		{"browser POST without cookie", "POST", host, map[string]string{"Origin": origin, csrfHeaderName: csrf}, http.StatusForbidden},
+		{"browser POST with token", "POST", host, map[string]string{"Origin": origin, "Cookie": cookie, csrfHeaderName: csrf}, http.StatusNoContent},
+		{"script POST", "POST", host, map[string]string{"Authorization": "Bearer abc"}, http.StatusNoContent},
+	} {
+		if w := serve(tc.method, tc.host, tc.header); w.Code != tc.want {
+			t.Errorf("%s: status %d, want %d", tc.name, w.Code, tc.want)
+		}
+	}
+}
@@ -0,0 +1,1620 @@
+﻿package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gold16/ginkgo-talk/ai"
+	"github.com/gold16/ginkgo-talk/config"
+	"github.com/gold16/ginkgo-talk/input"
+	"github.com/gold16/ginkgo-talk/script"
+	"github.com/gorilla/websocket"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// tlsErrorFilter is an io.Writer that suppresses TLS handshake errors.
+// These are expected with self-signed certificates and just clutter the log.
+type tlsErrorFilter struct{}
+
+func (t *tlsErrorFilter) Write(p []byte) (n int, err error) {
+	msg := string(p)
+	if strings.Contains(msg, "TLS handshake error") {
+		return len(p), nil // silently discard
+	}
+	// Pass through any non-TLS errors
+	return fmt.Fprint(log.Writer(), msg)
+}
+
+const pairSessionTTL = 24 * time.Hour
+
+// Message represents a WebSocket message from the phone.
+type Message struct {
+	Type      string        `json:"type"` // "text", "command", "script", "action", "config"
+	Text      string        `json:"text"`
+	Mode      string        `json:"mode,omitempty"`      // "raw", "tidy", "formal", "translate"
+	Confirmed bool          `json:"confirmed,omitempty"` // the user confirmed an action, or AI text from ai_preview
+	Config    *configUpdate `json:"config,omitempty"`    // for "config"
+}
+
+// StatusResponse represents the server status.
+type StatusResponse struct {
+	Connected     bool             `json:"connected"`
+	ClientAddr    string           `json:"clientAddr,omitempty"`
+	ServerAddr    string           `json:"serverAddr"`
+	ServerName    string           `json:"serverName"`
+	StartedAt     string           `json:"startedAt"`
+	AIAvailable   bool             `json:"aiAvailable"`
+	Paired        bool             `json:"paired"`
+	PairRequired  bool             `json:"pairRequired"`
+	PairExpiresAt string           `json:"pairExpiresAt,omitempty"`
+	Connection    ConnectionStatus `json:"connection"`
+	Policy        string           `json:"policy,omitempty"` // the device's policy, for paired devices
+	Permissions   []Scope          `json:"permissions"`
+	// Scripts lists the script commands, for devices and tokens that may run them.
+	Scripts []script.Command `json:"scripts,omitempty"`
+	// Actions lists the desktop actions the device or token may run.
+	Actions []ActionInfo `json:"actions,omitempty"`
+}
+
+// Server holds the HTTP/WebSocket server state.
+type Server struct {
+	mu            sync.RWMutex
+	typing        sync.Mutex // held while typing or pressing keys, so sources don't interleave
+	conn          *websocket.Conn
+	client        *wsClient
+	clientAddr    string
+	connDeviceID  string
+	connTrack     *connTracker
+	disconnectAt  time.Time
+	startedAt     time.Time
+	name          string
+	listen        listenConfig
+	heartbeat     heartbeatConfig
+	lanIPOverride string
+	pairCodes     *pairCodes
+	pairMode      PairMode
+	pairLinks     *pairLinkIssuer
+	pendingPairs  *pendingPairStore
+	pakeSessions  *pakeSessionStore
+	onPairRequest func(PendingPair)
+	sessions      *sessionStore
+	tokens        *TokenStore
+	policies      *policyStore
+	filters       *filterChain
+	scripts       *script.Engine
+	actions       *actionStore
+	ca            *localCA
+	mdns          *mdnsResponder
+	discovery     discoveryCache
+	events        *eventBus
+	hooks         *hookDispatcher
+	jobs          jobTracker
+	httpServers   []*http.Server
+	certs         *certManager
+	upgrader      websocket.Upgrader
+	ai            *ai.Processor
+	input         input.Backend
+	web           fs.FS
+	version       string
+	dataDir       string
+	configPath    string
+	cfg           config.Config // the settings, when there is no config file
+}
+
+// Options configure a Server. The zero value is a working server on the
+// default port that keeps its files in the current directory and types
+// with input.Default.
+type Options struct {
+	// Config holds the settings. Changes made while the server runs, from
+	// the phone or the command line, are saved to ConfigPath, or only kept
+	// in memory if ConfigPath is empty.
+	Config     config.Config
+	ConfigPath string
+
+	// DataDir holds the local CA, certificates and API tokens.
+	DataDir string
+
+	// Web is the phone app, served at the root. Without it the server only
+	// answers the API.
+	Web fs.FS
+
+	// Input types on the desktop (default input.Default()).
+	Input input.Backend
+	// AI processes text (default: built from the AI settings in Config).
+	AI *ai.Processor
+
+	// Version is reported to phones and over mDNS.
+	Version string
+}
+
+// New creates a Server. It doesn't listen until Start is called.
+func New(opts Options) *Server {
+	cfg := opts.Config
+	processor := opts.AI
+	if processor == nil {
+		processor = ai.New(ai.Options{APIKey: cfg.APIKey, BaseURL: cfg.BaseURL, Model: cfg.Model})
+	}
+	if processor.IsAvailable() {
+		log.Printf("AI processing enabled (model: %s)", processor.Model())
+	} else {
+		log.Printf("AI processing disabled (set DEEPSEEK_API_KEY to enable)")
+	}
+	backend := opts.Input
+	if backend == nil {
+		backend = input.Default()
+	}
+
+	pairModeSetting := strings.TrimSpace(cfg.PairMode)
+	pairMode, ok := parsePairMode(pairModeSetting)
+	if !ok {
+		log.Printf("invalid pair mode: %s, falling back to %s", pairModeSetting, pairMode)
+	}
+	listen := listenConfigFrom(cfg)
+	var lanIPOverride string
+	if strings.TrimSpace(cfg.LanIP) != "" {
+		ip, err := listen.parseLanIP(cfg.LanIP)
+		if err != nil {
+			log.Printf("invalid LAN IP override: %v, falling back to auto-detect", err)
+		} else {
+			lanIPOverride = ip
+			log.Printf("using configured LAN IP: %s", lanIPOverride)
+		}
+	}
+
+	scripts := script.New(filepath.Join(opts.DataDir, script.DirName), time.Duration(cfg.ScriptTimeout)*time.Second)
+	scripts.Load()
+
+	tokens, err := LoadTokenStore(filepath.Join(opts.DataDir, TokensFileName))
+	if err != nil {
+		log.Printf("⚠️  API tokens unavailable: %v", err)
+	}
+
+	s := &Server{
+		listen:        listen,
+		startedAt:     time.Now(),
+		name:          serverName(cfg),
+		heartbeat:     heartbeatConfigFrom(cfg),
+		lanIPOverride: lanIPOverride,
+		pairCodes:     newPairCodes(),
+		pairMode:      pairMode,
+		pairLinks:     newPairLinkIssuer(),
+		pendingPairs:  newPendingPairStore(),
+		pakeSessions:  newPakeSessionStore(),
+		sessions:      newSessionStore(),
+		tokens:        tokens,
+		policies:      newPolicyStore(cfg),
+		filters:       newFilterChain(cfg),
+		scripts:       scripts,
+		actions:       newActionStore(cfg),
+		events:        newEventBus(),
+		hooks:         newHookDispatcher(cfg, opts.Version),
+		ai:            processor,
+		input:         backend,
+		web:           opts.Web,
+		version:       opts.Version,
+		dataDir:       opts.DataDir,
+		configPath:    opts.ConfigPath,
+		cfg:           cfg,
+	}
+	s.upgrader.CheckOrigin = s.checkOrigin
+	return s
+}
+
+// loadConfig returns the saved settings. Reading them again picks up
+// changes made by other means, such as editing the file.
+func (s *Server) loadConfig() config.Config {
+	if s.configPath == "" {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		return s.cfg
+	}
+	return config.Load(s.configPath)
+}
+
+func (s *Server) saveConfig(cfg config.Config) error {
+	if s.configPath == "" {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.cfg = cfg
+		return nil
+	}
+	return config.Save(s.configPath, cfg)
+}
+
+func (s *Server) LanIP() string {
+	if ip := s.GetLanIPOverride(); ip != "" {
+		return ip
+	}
+	if addrs := s.Addresses(); len(addrs) > 0 {
+		return addrs[0].Host
+	}
+	return "localhost"
+}
+
+// SetLanIPOverride sets the LAN IP override, or clears it if ip is "".
+// Unless the server has its own certificate, ip must be a private address.
+func (s *Server) SetLanIPOverride(ip string) error {
+	if ip != "" {
+		var err error
+		if ip, err = s.listen.parseLanIP(ip); err != nil {
+			return err
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lanIPOverride = ip
+	return nil
+}
+
+// GetLanIPOverride returns the current LAN IP override value.
+func (s *Server) GetLanIPOverride() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.lanIPOverride
+}
+
+// Start launches the HTTPS server, plus the optional plain-HTTP and
+// redirect listeners. It returns when any of them fails.
+func (s *Server) Start() error {
+	tlsConfig, err := s.tlsConfig()
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+
+	// Serve the PWA files
+	if s.web != nil {
+		mux.Handle("/", http.FileServer(http.FS(s.web)))
+	}
+
+	// API endpoints
+	mux.HandleFunc("/ws", s.handleWebSocket)
+	mux.HandleFunc("/qrcode", s.handleQRCode)
+	mux.HandleFunc("/qrcode.png", s.handleQRCodeImage)
+	mux.HandleFunc("/api/pairlink", s.handlePairLink)
+	mux.HandleFunc("/api/pair", s.handlePair)
+	mux.HandleFunc("/api/pair/wait", s.handlePairWait)
+	mux.HandleFunc("/api/pair/pake", s.handlePairPake)
+	mux.HandleFunc("/api/pair/pake/confirm", s.handlePairPakeConfirm)
+	mux.HandleFunc("/api/pending", s.handlePending)
+	mux.HandleFunc("/api/token/refresh", s.handleTokenRefresh)
+	mux.HandleFunc("/api/devices", s.handleDevices)
+	mux.HandleFunc("/api/devices/revoke", s.handleRevokeDevice)
+	mux.HandleFunc("/ca.crt", s.handleCACert)
+	mux.HandleFunc("/ca.mobileconfig", s.handleCAMobileConfig)
+	mux.HandleFunc("/api/status", s.handleStatus)
+	mux.HandleFunc("/api/discover", s.handleDiscover)
+	mux.HandleFunc("/api/events", s.handleEvents)
+	mux.HandleFunc("/api/config", s.handleConfig)
+	mux.HandleFunc("/api/type", s.handleAPIType)
+	mux.HandleFunc("/api/command", s.handleAPICommand)
+	mux.HandleFunc("/api/scripts", s.handleAPIScripts)
+	mux.HandleFunc("/api/scripts/run", s.handleAPIRunScript)
+	mux.HandleFunc("/api/actions", s.handleAPIActions)
+	mux.HandleFunc("/api/actions/run", s.handleAPIRunAction)
+	mux.HandleFunc("/api/tokens", s.handleTokens)
+	mux.HandleFunc("/api/tokens/revoke", s.handleRevokeToken)
+	handler := s.protect(s.withBasePath(mux))
+
+	// Open every listener before serving on any, so a failure leaves
+	// nothing behind.
+	tlsListeners, err := s.listen.listenAll(s.listen.port)
+	if err != nil {
+		return err
+	}
+	opened := tlsListeners
+	closeOpened := func() {
+		for _, ln := range opened {
+			ln.Close()
+		}
+	}
+	var redirectListeners []net.Listener
+	if s.listen.redirectPort != 0 {
+		if redirectListeners, err = s.listen.listenAll(s.listen.redirectPort); err != nil {
+			closeOpened()
+			return fmt.Errorf("redirect listener: %w", err)
+		}
+		opened = append(opened, redirectListeners...)
+	}
+	var plainListener net.Listener
+	if s.listen.httpListen != "" {
+		if plainListener, err = listenPlainHTTP(s.listen.httpListen); err != nil {
+			closeOpened()
+			return err
+		}
+	}
+
+	// Handlers read s.mdns, so it is set before anything is served.
+	s.startMDNS()
+	s.hooks.start(s.events)
+	s.scripts.Watch(s.publishScripts)
+	errCh := make(chan error, len(tlsListeners)+len(redirectListeners)+1)
+
+	if plainListener != nil {
+		ln := plainListener
+		plain := &http.Server{Handler: trustForwarded(handler)}
+		s.trackHTTPServer(plain)
+		log.Printf("Plain HTTP listener for reverse proxy on %s", s.listen.httpListen)
+		go func() {
+			errCh <- fmt.Errorf("http listener: %w", plain.Serve(ln))
+		}()
+	}
+
+	if len(redirectListeners) > 0 {
+		redirect := &http.Server{Handler: s.redirectHandler()}
+		s.trackHTTPServer(redirect)
+		log.Printf("Redirecting http://:%d to HTTPS", s.listen.redirectPort)
+		for _, ln := range redirectListeners {
+			go func() {
+				errCh <- fmt.Errorf("redirect listener: %w", redirect.Serve(ln))
+			}()
+		}
+	}
+
+	server := &http.Server{
+		Handler:   handler,
+		TLSConfig: tlsConfig,
+		ErrorLog:  log.New(&tlsErrorFilter{}, "", 0),
+	}
+	s.trackHTTPServer(server)
+
+	log.Printf("Ginkgo Talk server starting on %s", s.BaseURL())
+	for _, ln := range tlsListeners {
+		log.Printf("Listening on %s", ln.Addr())
+	}
+	if s.ca != nil {
+		log.Printf("Local CA fingerprint (SHA-256): %s", s.ca.Fingerprint())
+	}
+	log.Printf("Scan the QR code to connect your phone")
+	if s.pairMode.needsCode() {
+		log.Printf("Pair code: %s", s.pairCodes.current())
+	}
+	if s.pairMode.needsApproval() {
+		log.Printf("New devices need approval on this desktop (pair mode: %s)", s.pairMode)
+	}
+
+	for _, ln := range tlsListeners {
+		go func() {
+			// ServeTLS with empty filenames uses the TLS config certs
+			errCh <- server.ServeTLS(ln, "", "")
+		}()
+	}
+	if err := <-errCh; !errors.Is(err, http.ErrServerClosed) {
+		// Don't leave the other listeners serving.
+		s.mu.RLock()
+		servers := s.httpServers
+		s.mu.RUnlock()
+		for _, srv := range servers {
+			srv.Close()
+		}
+		return err
+	}
+	return nil
+}
+
+// handleWebSocket handles WebSocket connections from the phone.
+func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	sess, ok := s.authenticate(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		log.Printf("Unauthorized WebSocket attempt from %s", r.RemoteAddr)
+		return
+	}
+
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("WebSocket upgrade error: %v", err)
+		return
+	}
+	client, err := newWSClient(conn, sess.deviceID, sess.e2eKey)
+	if err != nil {
+		log.Printf("WebSocket setup error: %v", err)
+		conn.Close()
+		return
+	}
+	if err := client.hello(); err != nil {
+		log.Printf("WebSocket hello error: %v", err)
+		conn.Close()
+		return
+	}
+
+	// Extract base IP (without port) to detect same-client reconnects
+	clientIP := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		clientIP = host
+	}
+
+	tracker := newConnTracker(s.heartbeat)
+	stopHeartbeat := make(chan struct{})
+	startHeartbeat(conn, s.heartbeat, tracker, stopHeartbeat)
+
+	connected := s.events.stamp(Event{
+		Type: EventDeviceConnected,
+		Data: map[string]string{"deviceId": sess.deviceID, "clientAddr": r.RemoteAddr},
+		from: sess.deviceID,
+	})
+
+	// Store connection
+	s.mu.Lock()
+	prevConn, prevClient, prevDeviceID := s.conn, s.client, s.connDeviceID
+	s.conn = conn
+	s.client = client
+	s.clientAddr = r.RemoteAddr
+	s.connDeviceID = sess.deviceID
+	s.connTrack = tracker
+	s.mu.Unlock()
+	if prevConn != nil {
+		if prevDeviceID != sess.deviceID {
+			// Tell the phone being replaced why, so it doesn't reconnect and
+			// take the connection back.
+			prevClient.send(connected.message())
+		}
+		prevConn.Close() // Close previous connection
+	}
+	s.events.publish(connected)
+
+	sub := s.events.subscribe()
+	go s.forwardEvents(client, sub)
+	expiryWarning := s.warnPairExpiry(sess.deviceID, sess.expiresAt)
+
+	if client.aead != nil {
+		log.Printf("Phone connected from %s (end-to-end encrypted)", r.RemoteAddr)
+	} else {
+		log.Printf("Phone connected from %s", r.RemoteAddr)
+	}
+	_ = clientIP
+
+	defer func() {
+		close(stopHeartbeat)
+		expiryWarning.Stop()
+		s.events.unsubscribe(sub)
+		s.mu.Lock()
+		if s.conn == conn {
+			s.conn = nil
+			s.client = nil
+			s.clientAddr = ""
+			s.connDeviceID = ""
+			s.connTrack = nil
+			s.disconnectAt = time.Now()
+		}
+		s.mu.Unlock()
+		conn.Close()
+		log.Printf("Phone disconnected from %s", r.RemoteAddr)
+		s.events.publish(Event{
+			Type: EventDeviceDisconnected,
+			Data: map[string]string{"deviceId": sess.deviceID, "clientAddr": r.RemoteAddr},
+			from: sess.deviceID,
+		})
+	}()
+	origin := eventOrigin{source: "phone", deviceID: sess.deviceID}
+	// preview is the last AI result sent for confirming, after the filters.
+	var preview string
+
+	for {
+		_, msgBytes, err := conn.ReadMessage()
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				log.Printf("Phone at %s stopped answering pings", r.RemoteAddr)
+			} else if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				log.Printf("WebSocket error: %v", err)
+			}
+			break
+		}
+		conn.SetReadDeadline(time.Now().Add(s.heartbeat.pongTimeout))
+		tracker.message()
+
+		payload, err := client.open(msgBytes)
+		if err != nil {
+			log.Printf("Rejected message from %s: %v", r.RemoteAddr, err)
+			continue
+		}
+
+		var msg Message
+		if err := json.Unmarshal(payload, &msg); err != nil {
+			log.Printf("Invalid message: %v", err)
+			continue
+		}
+		if err := s.checkMessage(sess, msg); err != nil {
+			log.Printf("Denied %s from %s: %v", msg.Type, r.RemoteAddr, err)
+			client.send(deniedMessage(err))
+			continue
+		}
+
+		// Typing runs to completion even if the app is quitting meanwhile.
+		if !s.jobs.start() {
+			client.send(map[string]string{"type": "error", "error": errShuttingDown.Error()})
+			continue
+		}
+		// Pongs aren't read while the job runs, so an AI request or long
+		// typing mustn't run into the read deadline. It starts over after.
+		conn.SetReadDeadline(time.Time{})
+
+		switch msg.Type {
+		case "text":
+			if msg.Text != "" {
+				outputText := msg.Text
+				mode := ai.Mode(msg.Mode)
+				if mode == "" {
+					mode = ai.ModeRaw
+				}
+
+				// AI processing, unless this confirms a preview
+				if mode != ai.ModeRaw && !msg.Confirmed && s.ai.IsAvailable() {
+					log.Printf("AI processing [%s]: %s", mode, msg.Text)
+					client.send(map[string]string{
+						"type":   "processing",
+						"text":   msg.Text,
+						"status": "ai_processing",
+					})
+					processed, err := s.ai.Process(msg.Text, mode)
+					if err != nil {
+						log.Printf("AI error: %v", err)
+						client.send(map[string]string{
+							"type":  "ai_error",
+							"error": err.Error(),
+						})
+						s.publishBackendError("ai", err, client.deviceID)
+					} else {
+						log.Printf("AI result: %s", processed)
+						s.publishProcessed(origin, msg.Text, processed, mode)
+						// The preview shows what will be typed, so the filters run now.
+						filtered, err := s.filterText(origin, processed, mode)
+						if err != nil {
+							client.send(map[string]string{"type": "ai_error", "error": err.Error()})
+							break
+						}
+						preview = filtered
+						// Return to client for preview, don't type yet
+						client.send(map[string]interface{}{
+							"type":     "ai_preview",
+							"text":     filtered,
+							"original": msg.Text,
+							"mode":     string(mode),
+						})
+					}
+				} else {
+					// Raw mode or a confirmed preview: filter, type, then submit
+					// (equivalent to pressing Enter on PC). A preview sent back
+					// unedited has been through the filters already.
+					if !msg.Confirmed || preview == "" || msg.Text != preview {
+						filtered, err := s.filterText(origin, outputText, mode)
+						if err != nil {
+							client.send(map[string]string{"type": "error", "error": err.Error()})
+							break
+						}
+						outputText = filtered
+					}
+					preview = ""
+					log.Printf("Typing and sending: %s", outputText)
+					if err := s.typeAndSubmit(outputText); err != nil {
+						s.keyboardError(client, err)
+					} else {
+						s.publishTyped(origin, outputText, mode, true)
+						client.send(map[string]interface{}{
+							"type":     "ack",
+							"text":     outputText,
+							"original": msg.Text,
+							"mode":     string(mode),
+							"status":   "sent",
+						})
+					}
+				}
+			}
+		case "script":
+			if err := s.runScript(origin, msg.Text); err != nil {
+				client.send(map[string]string{"type": "error", "error": err.Error()})
+			} else {
+				client.send(map[string]string{"type": "ack", "status": "script"})
+			}
+		case "action":
+			res, err := s.runAction(s.devicePrincipal(sess), "phone", msg.Text, msg.Confirmed)
+			if err != nil {
+				client.send(actionErrorMessage(err))
+			} else {
+				client.send(map[string]interface{}{"type": "action_result", "data": res})
+			}
+		case "config":
+			if msg.Config == nil {
+				client.send(map[string]string{"type": "config_error", "error": "missing config"})
+			} else if err := s.updateConfig(s.devicePrincipal(sess), *msg.Config); err != nil {
+				log.Printf("Config change from %s failed: %v", r.RemoteAddr, err)
+				client.send(map[string]string{"type": "config_error", "error": err.Error()})
+			} else {
+				client.send(s.configSaved())
+			}
+		case "command":
+			status, err := s.runKeyCommand(msg.Text)
+			if errors.Is(err, errUnknownCommand) {
+				log.Printf("Unknown command: %s", msg.Text)
+			} else if err != nil {
+				s.keyboardError(client, err)
+			} else {
+				client.send(map[string]string{"type": "ack", "status": status})
+			}
+		default:
+			log.Printf("Unknown message type: %s", msg.Type)
+		}
+		s.jobs.done()
+		conn.SetReadDeadline(time.Now().Add(s.heartbeat.pongTimeout))
+	}
+}
+
+// keyboardError reports a failed key press to the phone and to event subscribers.
+func (s *Server) keyboardError(client *wsClient, err error) {
+	client.send(map[string]string{"type": "error", "error": err.Error()})
+	s.publishBackendError("keyboard", err, client.deviceID)
+}
+
+// handleQRCode serves the desktop QR page. It only answers local requests,
+// since the QR code it shows is enough to pair a phone.
+func (s *Server) handleQRCode(w http.ResponseWriter, r *http.Request) {
+	if !isLocalRequest(r) {
+		http.Error(w, "QR code is only available on the desktop", http.StatusForbidden)
+		return
+	}
+	if s.web == nil {
+		http.NotFound(w, r)
+		return
+	}
+	page, err := fs.ReadFile(s.web, "qrcode.html")
+	if err != nil {
+		http.Error(w, "QR page not found", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(page)
+}
+
+// handleQRCodeImage generates a QR code PNG carrying the current one-time pairing link.
+func (s *Server) handleQRCodeImage(w http.ResponseWriter, r *http.Request) {
+	if !isLocalRequest(r) {
+		http.Error(w, "QR code is only available on the desktop", http.StatusForbidden)
+		return
+	}
+	link, err := s.pairLinks.Current()
+	if err != nil {
+		http.Error(w, "Failed to generate pairing link", http.StatusInternalServerError)
+		return
+	}
+
+	base := s.pairURL(r)
+	if host := r.URL.Query().Get("host"); host != "" {
+		// The QR page lets the user pick another of the listed addresses.
+		for _, addr := range s.pairAddresses() {
+			if addr.Host == host {
+				base = addr.URL
+				break
+			}
+		}
+	}
+	url := fmt.Sprintf("%s/#pair=%s", base, link.nonce)
+
+	png, err := qrcode.Encode(url, qrcode.Medium, 512)
+	if err != nil {
+		http.Error(w, "Failed to generate QR code", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(png)
+}
+
+// handleCACert serves the local CA root so phones can install it.
+// It is unauthenticated on purpose: the root is public, and users verify
+// it against the fingerprint shown on the desktop.
+func (s *Server) handleCACert(w http.ResponseWriter, r *http.Request) {
+	if s.ca == nil {
+		http.NotFound(w, r) // using a configured certificate
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-x509-ca-cert")
+	w.Header().Set("Content-Disposition", `attachment; filename="ginkgo-talk-ca.crt"`)
+	w.Write(s.ca.DER())
+}
+
+// handleCAMobileConfig serves the local CA root as an iOS configuration profile.
+func (s *Server) handleCAMobileConfig(w http.ResponseWriter, r *http.Request) {
+	if s.ca == nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-apple-aspen-config")
+	w.Header().Set("Content-Disposition", `attachment; filename="ginkgo-talk-ca.mobileconfig"`)
+	w.Write(s.ca.MobileConfig())
+}
+
+// handlePairLink reports which pairing link the QR code currently carries,
+// so the desktop QR page can refresh itself after a scan or on expiry.
+func (s *Server) handlePairLink(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !isLocalRequest(r) {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": "forbidden"})
+		return
+	}
+	link, err := s.pairLinks.Current()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to generate pairing link"})
+		return
+	}
+	pairCode := ""
+	if s.pairMode.needsCode() {
+		pairCode = s.pairCodes.current()
+	}
+	caFingerprint := ""
+	if s.ca != nil {
+		caFingerprint = s.ca.Fingerprint()
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"generation":    link.generation,
+		"expiresAt":     link.expiresAt.Format(time.RFC3339),
+		"pairCode":      pairCode,
+		"caFingerprint": caFingerprint,
+		"url":           s.pairURL(r),
+		"addresses":     s.pairAddresses(),
+	})
+}
+
+// handleStatus returns the current server status.
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	p, ok := s.authorize(w, r, scopeAny)
+	if !ok {
+		return
+	}
+
+	s.mu.RLock()
+	connected := s.conn != nil
+	clientAddr := s.clientAddr
+	s.mu.RUnlock()
+
+	resp := StatusResponse{
+		Connected:    connected,
+		ClientAddr:   clientAddr,
+		ServerAddr:   s.externalURL(r),
+		ServerName:   s.name,
+		StartedAt:    s.startedAt.Format(time.RFC3339),
+		AIAvailable:  s.ai.IsAvailable(),
+		Paired:       p.token == nil,
+		PairRequired: false,
+		Connection:   s.connectionStatus(),
+		Policy:       p.policy,
+		Permissions:  p.scopes,
+	}
+	if p.token == nil {
+		resp.PairExpiresAt = p.session.expiresAt.Format(time.RFC3339)
+	}
+	if p.can(ScopeScript) {
+		resp.Scripts = s.scripts.Commands()
+	}
+	resp.Actions = s.actions.forPrincipal(p)
+
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleConfig handles API key configuration.
+func (s *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	scope := ScopeConfigRead
+	if r.Method == http.MethodPost {
+		scope = ScopeConfigWrite
+	}
+	p, ok := s.authorize(w, r, scope)
+	if !ok {
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		// The phone sends settings over the WebSocket, where they are end-to-end
+		// encrypted: a captured access token mustn't be enough to point
+		// baseUrl somewhere else and collect the API key.
+		if refuseE2EDevice(w, r, p) {
+			return
+		}
+		var body configUpdate
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAPIBody)).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+			return
+		}
+		if err := s.updateConfig(p, body); errors.Is(err, errInvalidConfig) {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		} else if err != nil {
+			log.Printf("Config save error: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+
+		json.NewEncoder(w).Encode(s.configSaved())
+		return
+	}
+
+	// GET: return current config (mask key)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"apiKey":      config.MaskAPIKey(s.ai.APIKey()),
+		"baseUrl":     s.ai.BaseURL(),
+		"model":       s.ai.Model(),
+		"lanIp":       s.GetLanIPOverride(),
+		"aiAvailable": s.ai.IsAvailable(),
+	})
+}
+
+// configUpdate is a settings change from the phone. Empty fields are left
+// as they are; a lanIp of "auto" clears the override.
+type configUpdate struct {
+	APIKey  string `json:"apiKey"`
+	BaseURL string `json:"baseUrl"`
+	Model   string `json:"model"`
+	LanIP   string `json:"lanIp"`
+}
+
+var errInvalidConfig = errors.New("invalid config")
+
+// configSaved reports the settings after a change, over REST or as the
+// WebSocket's config_saved message.
+func (s *Server) configSaved() map[string]interface{} {
+	return map[string]interface{}{
+		"type":        "config_saved",
+		"ok":          true,
+		"aiAvailable": s.ai.IsAvailable(),
+		"model":       s.ai.Model(),
+		"baseUrl":     s.ai.BaseURL(),
+		"lanIp":       s.GetLanIPOverride(),
+	}
+}
+
+// updateConfig checks every field of u before changing anything, then
+// applies the change and saves it.
+func (s *Server) updateConfig(p principal, u configUpdate) error {
+	if baseURL := strings.TrimSpace(u.BaseURL); baseURL != "" {
+		parsed, err := url.Parse(baseURL)
+		if err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") || parsed.Host == "" {
+			return fmt.Errorf("%w: baseUrl must be an http or https URL", errInvalidConfig)
+		}
+	}
+	lanIP := strings.TrimSpace(u.LanIP)
+	if strings.EqualFold(lanIP, "auto") {
+		lanIP = "auto"
+	} else if lanIP != "" {
+		ip, err := s.listen.parseLanIP(lanIP)
+		if err != nil {
+			return fmt.Errorf("%w: lanIp: %v", errInvalidConfig, err)
+		}
+		lanIP = ip
+	}
+
+	if u.APIKey != "" {
+		s.ai.SetAPIKey(u.APIKey)
+		log.Printf("API key updated by %s", p)
+	}
+	if s.ai.SetBaseURL(u.BaseURL) {
+		log.Printf("API base URL: %s", s.ai.BaseURL())
+	}
+	if s.ai.SetModel(u.Model) {
+		log.Printf("Model: %s", s.ai.Model())
+	}
+	switch lanIP {
+	case "":
+	case "auto":
+		s.SetLanIPOverride("")
+		log.Printf("LAN IP override cleared, back to auto-detect")
+	default:
+		s.SetLanIPOverride(lanIP) // checked above
+		log.Printf("LAN IP override updated: %s", lanIP)
+	}
+	if u.APIKey != "" || u.BaseURL != "" || u.Model != "" {
+		s.events.publish(Event{
+			Type: EventAIConfigChanged,
+			Data: map[string]interface{}{"aiAvailable": s.ai.IsAvailable(), "model": s.ai.Model()},
+			from: p.deviceID(),
+		})
+	}
+
+	// Persist config to disk, keeping settings this endpoint doesn't manage
+	cfg := s.loadConfig()
+	cfg.APIKey = s.ai.APIKey()
+	cfg.BaseURL = s.ai.BaseURL()
+	cfg.Model = s.ai.Model()
+	cfg.LanIP = s.GetLanIPOverride()
+	if err := s.saveConfig(cfg); err != nil {
+		return fmt.Errorf("settings changed but not saved: %w", err)
+	}
+	return nil
+}
+
+func generateAuthToken() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func generatePairCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(10000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%04d", n.Int64()), nil
+}
+
+func (s *Server) handlePair(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == http.MethodGet {
+		sess, paired := s.authenticate(r)
+		pairExpiresText := ""
+		if paired {
+			pairExpiresText = sess.expiresAt.Format(time.RFC3339)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"paired":        paired,
+			"pairRequired":  !paired,
+			"pairExpiresAt": pairExpiresText,
+			"pairMode":      s.pairMode,
+		})
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "method not allowed"})
+		return
+	}
+
+	var body struct {
+		Code       string `json:"code,omitempty"`
+		Nonce      string `json:"nonce,omitempty"`
+		DeviceID   string `json:"deviceId,omitempty"`
+		DeviceName string `json:"deviceName,omitempty"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+		return
+	}
+	deviceID := deviceIDFromRequest(r)
+	if deviceID == "" {
+		deviceID = strings.TrimSpace(body.DeviceID)
+	}
+	if deviceID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "missing device id"})
+		return
+	}
+
+	// The pair code and QR nonce are shared secrets, so they are only
+	// accepted through SPAKE2: pairing with them here would leave the device
+	// without an end-to-end key. What remains is approval on the desktop,
+	// which has no secret to run SPAKE2 with.
+	if strings.TrimSpace(body.Code) != "" || strings.TrimSpace(body.Nonce) != "" || s.pairMode.needsCode() {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "pair through /api/pair/pake with the pair code or QR nonce",
+			"code":  codePakeRequired,
+		})
+		return
+	}
+	s.requestPairApproval(w, r, deviceID, body.DeviceName, nil, s.claimsPairedDevice(r, deviceID))
+}
+
+// completePairing issues credentials to a device that has passed pairing.
+func (s *Server) completePairing(w http.ResponseWriter, r *http.Request, deviceID string, e2eKey []byte) {
+	creds, err := s.sessions.issue(deviceID, r.RemoteAddr, e2eKey)
+	if err != nil {
+		log.Printf("Failed to issue device credentials: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to issue credentials"})
+		return
+	}
+	log.Printf("Paired device: %s (expires: %s)", deviceID, creds.PairExpiresAt)
+	s.publishPairing(EventDevicePaired, deviceID, r.RemoteAddr)
+
+	setSessionCookie(w, creds)
+	json.NewEncoder(w).Encode(pairedResponse(creds))
+}
+
+// pairedResponse is the JSON body returned to a device once it is paired.
+func pairedResponse(creds DeviceCredentials) map[string]interface{} {
+	return map[string]interface{}{
+		"ok":              true,
+		"paired":          true,
+		"pairRequired":    false,
+		"pairExpiresAt":   creds.PairExpiresAt,
+		"deviceId":        creds.DeviceID,
+		"accessToken":     creds.AccessToken,
+		"accessExpiresAt": creds.AccessExpiresAt,
+		"refreshToken":    creds.RefreshToken,
+	}
+}
+
+// handlePairPake runs the first step of SPAKE2 pairing. The device proves
+// knowledge of the pair code or QR nonce without sending it.
+func (s *Server) handlePairPake(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "method not allowed"})
+		return
+	}
+
+	var body struct {
+		DeviceID   string `json:"deviceId"`
+		DeviceName string `json:"deviceName,omitempty"`
+		Method     string `json:"method"` // "code" or "nonce"
+		Share      string `json:"share"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+		return
+	}
+	deviceID := strings.TrimSpace(body.DeviceID)
+	if deviceID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "missing device id"})
+		return
+	}
+
+	var secret string
+	switch body.Method {
+	case "nonce":
+		link, err := s.pairLinks.Current()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "failed to generate pairing link"})
+			return
+		}
+		secret = link.nonce
+	case "code":
+		if !s.pairMode.needsCode() {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]string{"error": "pair code disabled"})
+			return
+		}
+		code, ok := s.pairCodes.attempt(remoteIP(r))
+		if !ok {
+			w.WriteHeader(http.StatusTooManyRequests)
+			json.NewEncoder(w).Encode(map[string]string{"error": "too many attempts"})
+			return
+		}
+		secret = code
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid method"})
+		return
+	}
+
+	X, err := parsePakeElement(body.Share)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid key share"})
+		return
+	}
+	Y, keys, err := pakeRespond(deviceID, pakePassword(deviceID, secret), X)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid key share"})
+		return
+	}
+
+	sessionID, err := s.pakeSessions.add(&pakeSession{
+		deviceID:   deviceID,
+		deviceName: body.DeviceName,
+		method:     body.Method,
+		secret:     secret,
+		keys:       keys,
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "key exchange failed"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"session": sessionID,
+		"share":   encodePakeElement(Y),
+		"confirm": hex.EncodeToString(keys.serverConfirm),
+	})
+}
+
+// handlePairPakeConfirm finishes SPAKE2 pairing once the device has shown it
+// derived the same key. The key then protects the device's WebSocket traffic.
+func (s *Server) handlePairPakeConfirm(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "method not allowed"})
+		return
+	}
+
+	var body struct {
+		Session string `json:"session"`
+		Confirm string `json:"confirm"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+		return
+	}
+	confirm, err := hex.DecodeString(body.Confirm)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+		return
+	}
+
+	sess, err := s.pakeSessions.confirm(body.Session, confirm)
+	if err != nil {
+		log.Printf("Key exchange from %s failed: %v", r.RemoteAddr, err)
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": "key confirmation failed"})
+		return
+	}
+
+	if sess.method == "nonce" {
+		if !s.pairLinks.Redeem(sess.secret) {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]string{"error": "pairing link expired"})
+			return
+		}
+	} else {
+		s.pairCodes.succeed(remoteIP(r))
+	}
+	if replaces := s.claimsPairedDevice(r, sess.deviceID); replaces || (sess.method != "nonce" && s.pairMode.needsApproval()) {
+		s.requestPairApproval(w, r, sess.deviceID, sess.deviceName, sess.keys.e2eKey, replaces)
+		return
+	}
+	s.completePairing(w, r, sess.deviceID, sess.keys.e2eKey)
+}
+
+// claimsPairedDevice reports whether pairing as deviceID would take over a
+// device the desktop already knows, one that is still paired or has a
+// policy of its own. Device IDs are chosen by the device and are no secret,
+// so only the device itself, still holding a valid access token, may pair
+// again without the desktop's approval.
+func (s *Server) claimsPairedDevice(r *http.Request, deviceID string) bool {
+	if sess, ok := s.authenticate(r); ok && sess.deviceID == deviceID {
+		return false
+	}
+	return s.sessions.has(deviceID) || s.policies.assigned(deviceID)
+}
+
+// requestPairApproval queues a pairing request for the desktop to approve and
+// hands the device a ticket to poll /api/pair/wait with. replaces marks a
+// request for the ID of a device that is already known.
+func (s *Server) requestPairApproval(w http.ResponseWriter, r *http.Request, deviceID, deviceName string, e2eKey []byte, replaces bool) {
+	req, ticket, err := s.pendingPairs.add(PendingPair{
+		DeviceID:   deviceID,
+		DeviceName: strings.TrimSpace(deviceName),
+		RemoteAddr: r.RemoteAddr,
+		UserAgent:  r.UserAgent(),
+		Replaces:   replaces,
+		e2eKey:     e2eKey,
+	}, remoteIP(r))
+	if errors.Is(err, errTooManyPairRequests) {
+		log.Printf("Pairing request from %s refused: %v", r.RemoteAddr, err)
+		w.WriteHeader(http.StatusTooManyRequests)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to queue pairing request: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to queue pairing request"})
+		return
+	}
+	if replaces {
+		log.Printf("Pairing request %s from %s claims the ID of known device %s; waiting for approval", req.ID, req.RemoteAddr, deviceID)
+	} else {
+		log.Printf("Pairing request %s from %s (%s) is waiting for approval", req.ID, req.RemoteAddr, req.DeviceName)
+	}
+	if s.onPairRequest != nil {
+		go s.onPairRequest(req)
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":    pairStatusPending,
+		"requestId": req.ID,
+		"ticket":    ticket,
+		"expiresAt": req.ExpiresAt,
+	})
+}
+
+// handleTokenRefresh rotates a device's access and refresh tokens.
+func (s *Server) handleTokenRefresh(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "method not allowed"})
+		return
+	}
+
+	var body struct {
+		RefreshToken string `json:"refreshToken"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+		return
+	}
+
+	creds, err := s.sessions.refresh(strings.TrimSpace(body.RefreshToken))
+	if err != nil {
+		clearSessionCookie(w)
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "pair required"})
+		return
+	}
+
+	setSessionCookie(w, creds)
+	json.NewEncoder(w).Encode(creds)
+}
+
+// handleDevices lists the currently paired devices.
+func (s *Server) handleDevices(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	p, ok := s.authorize(w, r, scopePaired)
+	if !ok {
+		return
+	}
+
+	devices := s.Devices()
+	if !p.can(ScopeDevices) {
+		// Without the devices permission a phone only sees itself.
+		own := devices[:0]
+		for _, d := range devices {
+			if d.DeviceID == p.deviceID() {
+				own = append(own, d)
+			}
+		}
+		devices = own
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"self":    p.deviceID(),
+		"devices": devices,
+	})
+}
+
+// handleRevokeDevice revokes the credentials of a single device.
+func (s *Server) handleRevokeDevice(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	p, ok := s.authorize(w, r, scopePaired)
+	if !ok {
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "method not allowed"})
+		return
+	}
+
+	var body struct {
+		DeviceID string `json:"deviceId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+		return
+	}
+	deviceID := strings.TrimSpace(body.DeviceID)
+	if deviceID == "" {
+		deviceID = p.deviceID()
+	}
+	if deviceID != p.deviceID() {
+		if err := p.check(ScopeDevices); err != nil {
+			writeDenied(w, err)
+			return
+		}
+	}
+
+	if !s.RevokeDevice(deviceID) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "unknown device"})
+		return
+	}
+	if deviceID == p.deviceID() {
+		clearSessionCookie(w)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"ok": true})
+}
+
+// handlePairWait lets a device poll for the desktop's decision on its
+// pairing request. Approved devices receive their credentials here.
+func (s *Server) handlePairWait(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "method not allowed"})
+		return
+	}
+
+	var body struct {
+		Ticket string `json:"ticket"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || strings.TrimSpace(body.Ticket) == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+		return
+	}
+
+	status, creds := s.pendingPairs.poll(strings.TrimSpace(body.Ticket))
+	if status != pairStatusApproved {
+		json.NewEncoder(w).Encode(map[string]interface{}{"status": status})
+		return
+	}
+
+	setSessionCookie(w, creds)
+	resp := pairedResponse(creds)
+	resp["status"] = status
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handlePending lists pending pairing requests and accepts decisions on them.
+// Only the desktop itself may call it.
+func (s *Server) handlePending(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !isLocalRequest(r) {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": "forbidden"})
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"pairMode": s.pairMode,
+			"pending":  s.PendingPairs(),
+		})
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "method not allowed"})
+		return
+	}
+
+	var body struct {
+		ID      string `json:"id"`
+		Approve bool   `json:"approve"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+		return
+	}
+
+	var err error
+	if body.Approve {
+		err = s.ApprovePair(body.ID)
+	} else {
+		err = s.DenyPair(body.ID)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"ok": true})
+}
+
+// SetPairCodeHandler registers fn to be called with the new pair code
+// whenever it changes. It must be set before Start.
+func (s *Server) SetPairCodeHandler(fn func(code string)) {
+	s.pairCodes.onChange = fn
+}
+
+// SetPairRequestHandler registers fn to be called for every pairing request
+// that needs desktop approval. It must be set before Start.
+func (s *Server) SetPairRequestHandler(fn func(PendingPair)) {
+	s.onPairRequest = fn
+}
+
+// PendingPairs returns the pairing requests waiting for approval.
+func (s *Server) PendingPairs() []PendingPair {
+	return s.pendingPairs.list()
+}
+
+// ApprovePair approves a pending pairing request and issues the device's credentials.
+func (s *Server) ApprovePair(id string) error {
+	info, err := s.pendingPairs.decide(id, true, func(p PendingPair) (DeviceCredentials, error) {
+		if p.Replaces {
+			// Disconnect the device whose ID is being taken over.
+			s.RevokeDevice(p.DeviceID)
+		}
+		return s.sessions.issue(p.DeviceID, p.RemoteAddr, p.e2eKey)
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Approved pairing request %s from %s", info.ID, info.RemoteAddr)
+	s.publishPairing(EventDevicePaired, info.DeviceID, info.RemoteAddr)
+	return nil
+}
+
+// DenyPair rejects a pending pairing request.
+func (s *Server) DenyPair(id string) error {
+	info, err := s.pendingPairs.decide(id, false, nil)
+	if err != nil {
+		return err
+	}
+	log.Printf("Denied pairing request %s from %s", info.ID, info.RemoteAddr)
+	s.publishPairing(EventPairDenied, info.DeviceID, info.RemoteAddr)
+	return nil
+}
+
+// RevokeDevice drops a device's credentials and closes its WebSocket, if open.
+// Other paired devices are not affected.
+func (s *Server) RevokeDevice(deviceID string) bool {
+	if !s.sessions.revoke(deviceID) {
+		return false
+	}
+	s.mu.Lock()
+	if s.conn != nil && s.connDeviceID == deviceID {
+		s.conn.Close()
+	}
+	s.mu.Unlock()
+	log.Printf("Revoked device: %s", deviceID)
+	s.events.publish(Event{Type: EventDeviceRevoked, Data: map[string]string{"deviceId": deviceID}})
+	return true
+}
+
+// authenticate resolves the device session behind the request's access
+// token. Handlers other than the phone's own use authorize instead.
+func (s *Server) authenticate(r *http.Request) (deviceSession, bool) {
+	return s.sessions.authenticate(tokenFromRequest(r))
+}
+
+func deviceIDFromRequest(r *http.Request) string {
+	deviceID := strings.TrimSpace(r.URL.Query().Get("device_id"))
+	if deviceID == "" {
+		deviceID = strings.TrimSpace(r.Header.Get("X-GTalk-Device"))
+	}
+	return deviceID
+}
+
+// LanAddress is one address phones on the LAN may reach the server on.
+type LanAddress struct {
+	Interface string `json:"interface"`
+	Host      string `json:"host"` // IP address, or the mDNS name
+	URL       string `json:"url,omitempty"`
+}
+
+// lanAddresses lists the LAN addresses of every interface that is up, best
+// first. The address the OS would use for its default route wins; after that,
+// interface names prioritize real physical adapters (WiFi/Ethernet) over
+// virtual adapters (VMware, VPN, Docker, Hyper-V, etc), and IPv4 goes before IPv6.
+func lanAddresses() []LanAddress {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	routeIPs := defaultRouteIPs()
+
+	type candidate struct {
+		addr     LanAddress
+		priority int // lower is better
+	}
+	var candidates []candidate
+
+	for _, iface := range ifaces {
+		// Skip down or loopback interfaces
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+
+		prio := classifyInterface(strings.ToLower(iface.Name))
+
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.IsLoopback() {
+				continue
+			}
+			ip := ipNet.IP
+			// Skip link-local 169.254.x.x and fe80::, phones can't use them in a URL
+			if ip.IsLinkLocalUnicast() {
+				continue
+			}
+			p := prio
+			if ip.To4() == nil {
+				p += 5
+			}
+			for _, r := range routeIPs {
+				if r.Equal(ip) {
+					p = 0
+				}
+			}
+			candidates = append(candidates, candidate{
+				addr:     LanAddress{Interface: iface.Name, Host: ip.String()},
+				priority: p,
+			})
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].priority < candidates[j].priority
+	})
+	result := make([]LanAddress, len(candidates))
+	for i, c := range candidates {
+		result[i] = c.addr
+	}
+	return result
+}
+
+// defaultRouteIPs returns the source addresses the OS picks for its IPv4 and
+// IPv6 default routes. Connecting a UDP socket sends no packets.
+func defaultRouteIPs() []net.IP {
+	var ips []net.IP
+	for _, target := range []string{"192.0.2.1:9", "[2001:db8::1]:9"} {
+		conn, err := net.Dial("udp", target)
+		if err != nil {
+			continue
+		}
+		if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+			ips = append(ips, addr.IP)
+		}
+		conn.Close()
+	}
+	return ips
+}
+
+// classifyInterface assigns a priority to a network interface by name.
+// Lower number = higher priority (more likely to be the real LAN adapter).
+func classifyInterface(name string) int {
+	// Virtual / VPN adapters — deprioritize
+	virtualKeywords := []string{
+		"vmware", "vmnet", "virtualbox", "vbox",
+		"hyper-v", "vethernet",
+		"docker", "veth", "br-",
+		"vpn", "starvpn", "tap", "tun", "wireguard", "wg",
+		"蓝牙", "bluetooth",
+		"loopback",
+		"nodebabylink",
+	}
+	for _, kw := range virtualKeywords {
+		if strings.Contains(name, kw) {
+			return 90
+		}
+	}
+
+	// Real physical adapters — high priority
+	physicalKeywords := []string{
+		"wlan", "wi-fi", "wifi", "无线",
+		"以太网", "ethernet", "eth",
+		"en0", "en1",
+	}
+	for _, kw := range physicalKeywords {
+		if strings.Contains(name, kw) {
+			return 10
+		}
+	}
+
+	// Unknown interface — middle priority
+	return 50
+}
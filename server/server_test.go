@@ -0,0 +1,189 @@
+package server
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gold16/ginkgo-talk/config"
+	"github.com/gorilla/websocket"
+)
+
+// newTestServer returns a server on loopback with its data in a temporary
+// directory, mDNS off and a recordingInput for typing.
+func newTestServer(t *testing.T, cfg config.Config) *Server {
+	t.Helper()
+	return newTestServerWith(t, Options{Config: cfg})
+}
+
+func newTestServerWith(t *testing.T, opts Options) *Server {
+	t.Helper()
+	off := false
+	opts.Config.MDNS = &off
+	if opts.Config.Bind == nil {
+		opts.Config.Bind = []string{"127.0.0.1"}
+	}
+	opts.DataDir = t.TempDir()
+	opts.Input = &recordingInput{}
+	opts.Version = "test"
+	return New(opts)
+}
+
+// recordingInput remembers what was typed instead of typing it.
+type recordingInput struct {
+	mu    sync.Mutex
+	typed []string
+}
+
+func (in *recordingInput) TypeText(text string) error {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.typed = append(in.typed, text)
+	return nil
+}
+
+func (in *recordingInput) Typed() []string {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return append([]string(nil), in.typed...)
+}
+
+func (*recordingInput) SelectAllAndDelete() error { return nil }
+func (*recordingInput) PressEnter() error         { return nil }
+func (*recordingInput) PressShiftEnter() error    { return nil }
+func (*recordingInput) PressCtrlZ() error         { return nil }
+func (*recordingInput) PressCtrlV() error         { return nil }
+func (*recordingInput) PressTab() error           { return nil }
+func (*recordingInput) PressEscape() error        { return nil }
+func (*recordingInput) ReleaseModifiers() error   { return nil }
+
+// freePort returns a loopback port nothing listens on.
+func freePort(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func TestStartClosesListenersOnError(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+
+	port := freePort(t)
+	s := newTestServer(t, config.Config{Port: port, RedirectPort: busy.Addr().(*net.TCPAddr).Port})
+	if err := s.Start(); err == nil {
+		t.Fatal("Start succeeded with the redirect port taken")
+	}
+
+	// The HTTPS listener opened before the failure must be closed again.
+	ln, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatalf("HTTPS port still in use after Start failed: %v", err)
+	}
+	ln.Close()
+}
+
+// postConfig sends a settings change as the device with accessToken.
+func postConfig(t *testing.T, s *Server, accessToken, body string) (int, map[string]interface{}) {
+	t.Helper()
+	r := httptest.NewRequest("POST", "/api/config", strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+accessToken)
+	w := httptest.NewRecorder()
+	s.handleConfig(w, r)
+	var resp map[string]interface{}
+	json.NewDecoder(w.Body).Decode(&resp)
+	return w.Code, resp
+}
+
+func TestConfigValidatedBeforeApplying(t *testing.T) {
+	s := newTestServerWith(t, Options{ConfigPath: filepath.Join(t.TempDir(), "config.json")})
+	creds, err := s.sessions.issue("phone", "192.0.2.1:1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, body := range []string{
+		`{"apiKey":"sk-new","lanIp":"not-an-ip"}`,
+		`{"apiKey":"sk-new","baseUrl":"ftp://example.com"}`,
+		`{"apiKey":"` + strings.Repeat("x", maxAPIBody) + `"}`,
+	} {
+		if status, _ := postConfig(t, s, creds.AccessToken, body); status != http.StatusBadRequest {
+			t.Errorf("%.40s: status %d, want 400", body, status)
+		}
+		if s.ai.APIKey() != "" {
+			t.Fatalf("%.40s: API key applied from an invalid request", body)
+		}
+	}
+
+	status, _ := postConfig(t, s, creds.AccessToken, `{"apiKey":"sk-new","lanIp":"192.168.1.9"}`)
+	if status != http.StatusOK {
+		t.Fatalf("valid change: status %d", status)
+	}
+	if cfg := config.Load(s.configPath); cfg.APIKey != "sk-new" || cfg.LanIP != "192.168.1.9" {
+		t.Errorf("saved config = %+v", cfg)
+	}
+
+	s.configPath = filepath.Join(t.TempDir(), "missing", "config.json")
+	if status, resp := postConfig(t, s, creds.AccessToken, `{"model":"other"}`); status != http.StatusInternalServerError {
+		t.Errorf("unsaved change: status %d %v, want 500", status, resp)
+	}
+}
+
+func TestWebSocketTakeoverTellsReplacedDevice(t *testing.T) {
+	s := newTestServer(t, config.Config{})
+	srv := httptest.NewServer(http.HandlerFunc(s.handleWebSocket))
+	defer srv.Close()
+	dial := func(deviceID string) *websocket.Conn {
+		t.Helper()
+		creds, err := s.sessions.issue(deviceID, "192.0.2.1:1", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"),
+			http.Header{"Authorization": {"Bearer " + creds.AccessToken}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var hello map[string]interface{}
+		if err := conn.ReadJSON(&hello); err != nil || hello["type"] != "hello" {
+			t.Fatalf("hello = %v, %v", hello, err)
+		}
+		return conn
+	}
+
+	phone := dial("phone")
+	defer phone.Close()
+	tablet := dial("tablet")
+	defer tablet.Close()
+
+	phone.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var msg struct {
+			Type  string            `json:"type"`
+			Event string            `json:"event"`
+			Data  map[string]string `json:"data"`
+		}
+		if err := phone.ReadJSON(&msg); err != nil {
+			t.Fatalf("replaced phone closed without being told: %v", err)
+		}
+		if msg.Type == "event" && msg.Event == EventDeviceConnected && msg.Data["deviceId"] == "tablet" {
+			break
+		}
+	}
+	if s.ConnectedDevice() != "tablet" {
+		t.Errorf("connected device %q, want tablet", s.ConnectedDevice())
+	}
+}
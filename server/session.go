@@ -0,0 +1,249 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// accessTokenTTL bounds how long a leaked access token stays useful.
+	// Devices rotate it with their refresh token before it runs out.
+	accessTokenTTL = 15 * time.Minute
+
+	sessionCookieName = "gtalk_token"
+)
+
+var errInvalidRefreshToken = errors.New("invalid or expired refresh token")
+
+// deviceSession holds the credentials issued to one paired device.
+// Only SHA-256 hashes of the tokens are kept in memory.
+type deviceSession struct {
+	deviceID        string
+	remoteAddr      string
+	pairedAt        time.Time
+	expiresAt       time.Time // end of the pairing session, refresh stops working after this
+	accessExpiresAt time.Time
+	accessHash      [32]byte
+	refreshHash     [32]byte
+	e2eKey          []byte // SPAKE2 session key, nil for devices paired without it
+}
+
+// DeviceCredentials is returned to a device after pairing or a token refresh.
+type DeviceCredentials struct {
+	DeviceID        string `json:"deviceId"`
+	AccessToken     string `json:"accessToken"`
+	AccessExpiresAt string `json:"accessExpiresAt"`
+	RefreshToken    string `json:"refreshToken"`
+	PairExpiresAt   string `json:"pairExpiresAt"`
+}
+
+// DeviceInfo describes a paired device without exposing its tokens.
+type DeviceInfo struct {
+	DeviceID      string `json:"deviceId"`
+	RemoteAddr    string `json:"remoteAddr,omitempty"`
+	PairedAt      string `json:"pairedAt"`
+	PairExpiresAt string `json:"pairExpiresAt"`
+	Policy        string `json:"policy,omitempty"`
+}
+
+// sessionStore tracks the credentials of every paired device.
+// Each device has its own tokens, so revoking one leaves the others intact.
+type sessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*deviceSession
+}
+
+func newSessionStore() *sessionStore {
+	return &sessionStore{sessions: make(map[string]*deviceSession)}
+}
+
+// issue starts a new pairing session for deviceID, replacing any previous one.
+// e2eKey is the SPAKE2 session key, or nil if the device paired without it.
+func (st *sessionStore) issue(deviceID, remoteAddr string, e2eKey []byte) (DeviceCredentials, error) {
+	now := time.Now()
+	sess := &deviceSession{
+		deviceID:   deviceID,
+		remoteAddr: remoteAddr,
+		pairedAt:   now,
+		expiresAt:  now.Add(pairSessionTTL),
+		e2eKey:     e2eKey,
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	creds, err := sess.rotate(now)
+	if err != nil {
+		return DeviceCredentials{}, err
+	}
+	st.sessions[deviceID] = sess
+	return creds, nil
+}
+
+// has reports whether deviceID is paired.
+func (st *sessionStore) has(deviceID string) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.pruneLocked(time.Now())
+	_, ok := st.sessions[deviceID]
+	return ok
+}
+
+// refresh exchanges a refresh token for a new access/refresh token pair.
+// The old refresh token stops working as soon as it has been used once.
+func (st *sessionStore) refresh(refreshToken string) (DeviceCredentials, error) {
+	if refreshToken == "" {
+		return DeviceCredentials{}, errInvalidRefreshToken
+	}
+	hash := sha256.Sum256([]byte(refreshToken))
+	now := time.Now()
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.pruneLocked(now)
+	for _, sess := range st.sessions {
+		if subtle.ConstantTimeCompare(hash[:], sess.refreshHash[:]) == 1 {
+			return sess.rotate(now)
+		}
+	}
+	return DeviceCredentials{}, errInvalidRefreshToken
+}
+
+// authenticate returns the session that owns accessToken, if it is still valid.
+func (st *sessionStore) authenticate(accessToken string) (deviceSession, bool) {
+	if accessToken == "" {
+		return deviceSession{}, false
+	}
+	hash := sha256.Sum256([]byte(accessToken))
+	now := time.Now()
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.pruneLocked(now)
+	for _, sess := range st.sessions {
+		if subtle.ConstantTimeCompare(hash[:], sess.accessHash[:]) != 1 {
+			continue
+		}
+		if now.After(sess.accessExpiresAt) {
+			return deviceSession{}, false
+		}
+		return *sess, true
+	}
+	return deviceSession{}, false
+}
+
+// revoke drops the session of a single device.
+func (st *sessionStore) revoke(deviceID string) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if _, ok := st.sessions[deviceID]; !ok {
+		return false
+	}
+	delete(st.sessions, deviceID)
+	return true
+}
+
+// list returns the paired devices, oldest pairing first.
+func (st *sessionStore) list() []DeviceInfo {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.pruneLocked(time.Now())
+
+	devices := make([]DeviceInfo, 0, len(st.sessions))
+	for _, sess := range st.sessions {
+		devices = append(devices, DeviceInfo{
+			DeviceID:      sess.deviceID,
+			RemoteAddr:    sess.remoteAddr,
+			PairedAt:      sess.pairedAt.Format(time.RFC3339),
+			PairExpiresAt: sess.expiresAt.Format(time.RFC3339),
+		})
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].PairedAt < devices[j].PairedAt
+	})
+	return devices
+}
+
+func (st *sessionStore) pruneLocked(now time.Time) {
+	for id, sess := range st.sessions {
+		if now.After(sess.expiresAt) {
+			delete(st.sessions, id)
+		}
+	}
+}
+
+// rotate replaces both tokens of the session. The caller must hold the store lock.
+func (sess *deviceSession) rotate(now time.Time) (DeviceCredentials, error) {
+	accessToken, err := generateAuthToken()
+	if err != nil {
+		return DeviceCredentials{}, err
+	}
+	refreshToken, err := generateAuthToken()
+	if err != nil {
+		return DeviceCredentials{}, err
+	}
+
+	sess.accessHash = sha256.Sum256([]byte(accessToken))
+	sess.refreshHash = sha256.Sum256([]byte(refreshToken))
+	sess.accessExpiresAt = now.Add(accessTokenTTL)
+	if sess.accessExpiresAt.After(sess.expiresAt) {
+		sess.accessExpiresAt = sess.expiresAt
+	}
+
+	return DeviceCredentials{
+		DeviceID:        sess.deviceID,
+		AccessToken:     accessToken,
+		AccessExpiresAt: sess.accessExpiresAt.Format(time.RFC3339),
+		RefreshToken:    refreshToken,
+		PairExpiresAt:   sess.expiresAt.Format(time.RFC3339),
+	}, nil
+}
+
+// tokenFromRequest extracts the access token from the Authorization header,
+// the X-GTalk-Token header or the session cookie. Tokens in the query string
+// are ignored on purpose: they end up in browser history and proxy logs.
+func tokenFromRequest(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		if token, ok := strings.CutPrefix(auth, "Bearer "); ok {
+			return strings.TrimSpace(token)
+		}
+	}
+	if token := strings.TrimSpace(r.Header.Get("X-GTalk-Token")); token != "" {
+		return token
+	}
+	if cookie, err := r.Cookie(sessionCookieName); err == nil {
+		return strings.TrimSpace(cookie.Value)
+	}
+	return ""
+}
+
+// setSessionCookie stores the access token in a cookie so the browser can
+// authenticate the WebSocket handshake, which cannot carry custom headers.
+func setSessionCookie(w http.ResponseWriter, creds DeviceCredentials) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    creds.AccessToken,
+		Path:     "/",
+		MaxAge:   int(accessTokenTTL / time.Second),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+func clearSessionCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSessionIssueAndAuthenticate(t *testing.T) {
+	st := newSessionStore()
+	creds, err := st.issue("phone", "192.0.2.1:1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess, ok := st.authenticate(creds.AccessToken)
+	if !ok || sess.deviceID != "phone" {
+		t.Fatalf("authenticate = %+v, %v", sess, ok)
+	}
+	for _, token := range []string{"", creds.RefreshToken, creds.AccessToken + "x"} {
+		if _, ok := st.authenticate(token); ok {
+			t.Errorf("authenticate(%q) succeeded", token)
+		}
+	}
+
+	// Pairing again replaces the old tokens.
+	again, err := st.issue("phone", "192.0.2.1:1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := st.authenticate(creds.AccessToken); ok {
+		t.Error("access token from the previous pairing still works")
+	}
+	if _, ok := st.authenticate(again.AccessToken); !ok {
+		t.Error("new access token doesn't work")
+	}
+}
+
+func TestSessionRefreshIsSingleUse(t *testing.T) {
+	st := newSessionStore()
+	creds, err := st.issue("phone", "192.0.2.1:1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, err := st.refresh(creds.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.AccessToken == creds.AccessToken || next.RefreshToken == creds.RefreshToken {
+		t.Error("refresh returned the same tokens")
+	}
+	if next.PairExpiresAt != creds.PairExpiresAt {
+		t.Error("refresh extended the pairing")
+	}
+	if _, err := st.refresh(creds.RefreshToken); err != errInvalidRefreshToken {
+		t.Errorf("reused refresh token: error %v, want %v", err, errInvalidRefreshToken)
+	}
+	if _, ok := st.authenticate(creds.AccessToken); ok {
+		t.Error("old access token still works after a refresh")
+	}
+	if _, ok := st.authenticate(next.AccessToken); !ok {
+		t.Error("refreshed access token doesn't work")
+	}
+	for _, token := range []string{"", next.AccessToken} {
+		if _, err := st.refresh(token); err == nil {
+			t.Errorf("refresh(%q) succeeded", token)
+		}
+	}
+}
+
+func TestSessionRevoke(t *testing.T) {
+	st := newSessionStore()
+	phone, _ := st.issue("phone", "192.0.2.1:1", nil)
+	tablet, _ := st.issue("tablet", "192.0.2.2:1", nil)
+	if !st.revoke("phone") {
+		t.Fatal("revoke returned false for a paired device")
+	}
+	if st.revoke("phone") {
+		t.Error("revoking twice returned true")
+	}
+	if _, ok := st.authenticate(phone.AccessToken); ok {
+		t.Error("revoked access token still works")
+	}
+	if _, err := st.refresh(phone.RefreshToken); err == nil {
+		t.Error("revoked refresh token still works")
+	}
+	if _, ok := st.authenticate(tablet.AccessToken); !ok {
+		t.Error("revoking one device logged out another")
+	}
+	if devices := st.list(); len(devices) != 1 || devices[0].DeviceID != "tablet" {
+		t.Errorf("list = %+v, want only tablet", devices)
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	st := newSessionStore()
+	creds, _ := st.issue("phone", "192.0.2.1:1", nil)
+
+	// Near the end of the pairing, the access token lasts no longer than it.
+	now := time.Now()
+	st.mu.Lock()
+	sess := st.sessions["phone"]
+	sess.expiresAt = now.Add(time.Minute)
+	st.mu.Unlock()
+	creds, err := st.refresh(creds.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.mu.Lock()
+	capped := !sess.accessExpiresAt.After(sess.expiresAt)
+	st.mu.Unlock()
+	if !capped {
+		t.Error("access token outlives the pairing")
+	}
+
+	// An expired access token is refused while the refresh token still works.
+	st.mu.Lock()
+	sess.accessExpiresAt = now.Add(-time.Second)
+	st.mu.Unlock()
+	if _, ok := st.authenticate(creds.AccessToken); ok {
+		t.Error("expired access token accepted")
+	}
+
+	// Once the pairing ends, nothing works and the device is gone.
+	st.mu.Lock()
+	sess.expiresAt = now.Add(-time.Second)
+	st.mu.Unlock()
+	if _, err := st.refresh(creds.RefreshToken); err == nil {
+		t.Error("refresh works after the pairing expired")
+	}
+	if st.has("phone") {
+		t.Error("expired device still listed as paired")
+	}
+}
+
+func TestTokenFromRequest(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		header map[string]string
+		query  string
+		want   string
+	}{
+		{"bearer", map[string]string{"Authorization": "Bearer abc"}, "", "abc"},
+		{"custom header", map[string]string{"X-GTalk-Token": "abc"}, "", "abc"},
+		{"cookie", map[string]string{"Cookie": sessionCookieName + "=abc"}, "", "abc"},
+		{"bearer first", map[string]string{"Authorization": "Bearer abc", "X-GTalk-Token": "def"}, "", "abc"},
+		{"not bearer", map[string]string{"Authorization": "Basic abc"}, "", ""},
+		{"query ignored", nil, "?token=abc", ""},
+	} {
+		r := httptest.NewRequest("GET", "/ws"+tc.query, nil)
+		for k, v := range tc.header {
+			r.Header.Set(k, v)
+		}
+		if got := tokenFromRequest(r); got != tc.want {
+			t.Errorf("%s: token %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
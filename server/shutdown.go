@@ -0,0 +1,113 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var errShuttingDown = errors.New("server is shutting down")
+
+// jobTracker counts keyboard and AI jobs in flight, so shutdown can let
+// them finish instead of cutting TypeText off with keys still held.
+type jobTracker struct {
+	mu      sync.Mutex
+	closing bool
+	wg      sync.WaitGroup
+}
+
+// start registers a job. It returns false once shutdown has begun.
+func (t *jobTracker) start() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closing {
+		return false
+	}
+	t.wg.Add(1)
+	return true
+}
+
+func (t *jobTracker) done() {
+	t.wg.Done()
+}
+
+// drain refuses new jobs and waits for the running ones, or for ctx.
+func (t *jobTracker) drain(ctx context.Context) error {
+	t.mu.Lock()
+	t.closing = true
+	t.mu.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *Server) trackHTTPServer(srv *http.Server) {
+	s.mu.Lock()
+	s.httpServers = append(s.httpServers, srv)
+	s.mu.Unlock()
+}
+
+// Shutdown stops the server gracefully: phones and event streams are told
+// first, running typing jobs finish and any held modifier keys are
+// released, then the WebSocket, mDNS and HTTP listeners are closed and
+// events still queued for webhooks and MQTT go out.
+// Start returns nil once Shutdown has been called.
+func (s *Server) Shutdown(ctx context.Context) error {
+	log.Printf("Shutting down...")
+	s.events.publish(Event{Type: EventShutdown})
+
+	err := s.jobs.drain(ctx)
+	if err != nil {
+		log.Printf("Typing still in progress, stopping anyway: %v", err)
+	}
+	if relErr := s.input.ReleaseModifiers(); relErr != nil {
+		log.Printf("Could not release modifier keys: %v", relErr)
+	}
+
+	// Closing the bus ends SSE streams, which http.Server.Shutdown would
+	// otherwise wait on, after the shutdown event has gone out.
+	s.events.close(time.Second)
+
+	s.mu.Lock()
+	conn := s.conn
+	servers := s.httpServers
+	s.mu.Unlock()
+	if conn != nil {
+		msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+		conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(wsWriteWait))
+		conn.Close()
+	}
+	if s.mdns != nil {
+		s.mdns.Close()
+	}
+	s.scripts.Close()
+
+	for _, srv := range servers {
+		if shutErr := srv.Shutdown(ctx); shutErr != nil && err == nil {
+			err = shutErr
+		}
+	}
+	if hookErr := s.hooks.shutdown(ctx); hookErr != nil && err == nil {
+		err = hookErr
+	}
+	if err != nil {
+		return fmt.Errorf("shutdown: %w", err)
+	}
+	log.Printf("Stopped")
+	return nil
+}
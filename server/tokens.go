@@ -0,0 +1,322 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TokensFileName is the API token file in the server's data directory.
+const TokensFileName = "gtalk_tokens.json"
+
+const (
+	// apiTokenPrefix marks API tokens, so they are easy to tell from device
+	// access tokens and to find in leaked logs.
+	apiTokenPrefix = "gtk_"
+
+	// lastUsedPersistEvery limits how often using a token rewrites the file.
+	lastUsedPersistEvery = time.Minute
+)
+
+// Scope is a permission. API tokens are granted scopes directly; paired
+// devices get them from their policy.
+type Scope string
+
+const (
+	ScopeType        Scope = "type"         // POST /api/type in raw mode
+	ScopeCommand     Scope = "command"      // POST /api/command
+	ScopeAI          Scope = "ai"           // AI modes in POST /api/type
+	ScopeConfigRead  Scope = "config:read"  // GET /api/config
+	ScopeConfigWrite Scope = "config:write" // POST /api/config
+	ScopeScript      Scope = "script"       // POST /api/scripts/run
+	ScopeAction      Scope = "action"       // POST /api/actions/run
+)
+
+var allScopes = []Scope{ScopeType, ScopeCommand, ScopeAI, ScopeConfigRead, ScopeConfigWrite, ScopeScript, ScopeAction}
+
+// ScopeEventsText lets an API token read the text events, with what was
+// typed, from /api/events. It is left out of "all" and can't be given to
+// devices, so it is only granted when asked for by name.
+const ScopeEventsText Scope = "events:text"
+
+// tokenScopes are the scopes API tokens can be granted.
+var tokenScopes = append(append([]Scope(nil), allScopes...), ScopeEventsText)
+
+var tokenNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+var errUnknownToken = errors.New("unknown token")
+
+// apiToken is a named token for scripts and integrations. Only the SHA-256
+// hash of the secret is stored.
+type apiToken struct {
+	Name       string     `json:"name"`
+	Hash       string     `json:"hash"`
+	Scopes     []Scope    `json:"scopes"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+}
+
+// APITokenInfo describes an API token without its hash.
+type APITokenInfo struct {
+	Name       string  `json:"name"`
+	Scopes     []Scope `json:"scopes"`
+	CreatedAt  string  `json:"createdAt"`
+	ExpiresAt  string  `json:"expiresAt,omitempty"`
+	LastUsedAt string  `json:"lastUsedAt,omitempty"`
+	Expired    bool    `json:"expired,omitempty"`
+}
+
+// TokenStore holds the API tokens, persisted in gtalk_tokens.json.
+type TokenStore struct {
+	path string
+
+	mu        sync.Mutex
+	tokens    map[string]*apiToken
+	persisted map[string]time.Time // last-used time as last written to disk
+	loadErr   error                // why the file couldn't be read; it is then never written
+}
+
+// LoadTokenStore reads the API tokens from path. A missing file is an empty
+// store. If the file can't be read, the store is returned with the error
+// and refuses changes, so the tokens in the file aren't overwritten.
+func LoadTokenStore(path string) (*TokenStore, error) {
+	st := &TokenStore{
+		path:      path,
+		tokens:    make(map[string]*apiToken),
+		persisted: make(map[string]time.Time),
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return st, nil
+	} else if err != nil {
+		st.loadErr = err
+		return st, err
+	}
+	var tokens []*apiToken
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		st.loadErr = fmt.Errorf("parse %s: %w", path, err)
+		return st, st.loadErr
+	}
+	for _, t := range tokens {
+		st.tokens[t.Name] = t
+		if t.LastUsedAt != nil {
+			st.persisted[t.Name] = *t.LastUsedAt
+		}
+	}
+	return st, nil
+}
+
+// Create adds a token and returns its secret, which is shown only once.
+// ttl of 0 means the token doesn't expire.
+func (st *TokenStore) Create(name string, scopes []Scope, ttl time.Duration) (string, APITokenInfo, error) {
+	if !tokenNamePattern.MatchString(name) {
+		return "", APITokenInfo{}, fmt.Errorf("invalid token name %q: use letters, digits, '.', '_' or '-'", name)
+	}
+	if len(scopes) == 0 {
+		return "", APITokenInfo{}, errors.New("a token needs at least one scope")
+	}
+	raw, err := generateAuthToken()
+	if err != nil {
+		return "", APITokenInfo{}, err
+	}
+	secret := apiTokenPrefix + raw
+	hash := sha256.Sum256([]byte(secret))
+	t := &apiToken{
+		Name:      name,
+		Hash:      hex.EncodeToString(hash[:]),
+		Scopes:    scopes,
+		CreatedAt: time.Now().UTC().Truncate(time.Second),
+	}
+	if ttl > 0 {
+		expires := t.CreatedAt.Add(ttl)
+		t.ExpiresAt = &expires
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if _, exists := st.tokens[name]; exists {
+		return "", APITokenInfo{}, fmt.Errorf("a token named %q already exists", name)
+	}
+	st.tokens[name] = t
+	if err := st.saveLocked(); err != nil {
+		delete(st.tokens, name)
+		return "", APITokenInfo{}, err
+	}
+	return secret, t.info(time.Now()), nil
+}
+
+// authenticate returns the token behind secret if it hasn't expired, and
+// records that it was used.
+func (st *TokenStore) authenticate(secret string) (apiToken, bool) {
+	if !strings.HasPrefix(secret, apiTokenPrefix) {
+		return apiToken{}, false
+	}
+	sum := sha256.Sum256([]byte(secret))
+	hash := hex.EncodeToString(sum[:])
+	now := time.Now().UTC()
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for _, t := range st.tokens {
+		if subtle.ConstantTimeCompare([]byte(hash), []byte(t.Hash)) != 1 {
+			continue
+		}
+		if t.ExpiresAt != nil && now.After(*t.ExpiresAt) {
+			return apiToken{}, false
+		}
+		used := now.Truncate(time.Second)
+		t.LastUsedAt = &used
+		if now.Sub(st.persisted[t.Name]) >= lastUsedPersistEvery {
+			st.persisted[t.Name] = used
+			if err := st.saveLocked(); err != nil {
+				log.Printf("Could not save API tokens: %v", err)
+			}
+		}
+		return *t, true
+	}
+	return apiToken{}, false
+}
+
+// Revoke deletes the token called name.
+func (st *TokenStore) Revoke(name string) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	t, ok := st.tokens[name]
+	if !ok {
+		return fmt.Errorf("%w %q", errUnknownToken, name)
+	}
+	delete(st.tokens, name)
+	if err := st.saveLocked(); err != nil {
+		st.tokens[name] = t
+		return err
+	}
+	return nil
+}
+
+// List returns every token, oldest first. Expired tokens are kept until
+// they are revoked, so their owner can see why a script stopped working.
+func (st *TokenStore) List() []APITokenInfo {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	now := time.Now()
+	infos := make([]APITokenInfo, 0, len(st.tokens))
+	for _, t := range st.tokens {
+		infos = append(infos, t.info(now))
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].CreatedAt != infos[j].CreatedAt {
+			return infos[i].CreatedAt < infos[j].CreatedAt
+		}
+		return infos[i].Name < infos[j].Name
+	})
+	return infos
+}
+
+func (st *TokenStore) saveLocked() error {
+	if st.loadErr != nil {
+		return fmt.Errorf("API tokens are read-only until the file is fixed: %w", st.loadErr)
+	}
+	tokens := make([]*apiToken, 0, len(st.tokens))
+	for _, t := range st.tokens {
+		tokens = append(tokens, t)
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].Name < tokens[j].Name })
+	data, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(st.path, data, 0600)
+}
+
+func (t *apiToken) info(now time.Time) APITokenInfo {
+	info := APITokenInfo{
+		Name:      t.Name,
+		Scopes:    t.Scopes,
+		CreatedAt: t.CreatedAt.Format(time.RFC3339),
+	}
+	if t.ExpiresAt != nil {
+		info.ExpiresAt = t.ExpiresAt.Format(time.RFC3339)
+		info.Expired = now.After(*t.ExpiresAt)
+	}
+	if t.LastUsedAt != nil {
+		info.LastUsedAt = t.LastUsedAt.Format(time.RFC3339)
+	}
+	return info
+}
+
+// ParseScopes reads a comma-separated scope list; "all" grants every scope
+// but ScopeEventsText.
+func ParseScopes(list string) ([]Scope, error) {
+	var scopes []Scope
+	seen := make(map[Scope]bool)
+	for _, part := range strings.Split(list, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		add := []Scope{Scope(part)}
+		if part == "all" {
+			add = allScopes
+		} else if !validScope(add[0]) {
+			return nil, fmt.Errorf("unknown scope %q (one of %s)", part, scopeNames())
+		}
+		for _, scope := range add {
+			if !seen[scope] {
+				seen[scope] = true
+				scopes = append(scopes, scope)
+			}
+		}
+	}
+	return scopes, nil
+}
+
+func validScope(scope Scope) bool {
+	for _, s := range tokenScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func scopeNames() string {
+	names := make([]string, len(tokenScopes))
+	for i, s := range tokenScopes {
+		names[i] = string(s)
+	}
+	return strings.Join(names, ", ")
+}
+
+// ParseTokenTTL reads a token lifetime such as "90d", "12h" or "30m".
+// "" and "never" mean no expiry.
+func ParseTokenTTL(s string) (time.Duration, error) {
+	switch s {
+	case "", "never":
+		return 0, nil
+	}
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid expiry %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid expiry %q (e.g. 90d, 12h or never)", s)
+	}
+	return d, nil
+}
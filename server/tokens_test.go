@@ -0,0 +1,150 @@
+package server
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), TokensFileName)
+	st, err := LoadTokenStore(path)
+	if err != nil {
+		t.Fatalf("missing file: %v", err)
+	}
+	secret, info, err := st.Create("ci", []Scope{ScopeType}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(secret, apiTokenPrefix) || info.Name != "ci" || info.ExpiresAt != "" {
+		t.Errorf("Create = %q, %+v", secret, info)
+	}
+	if _, _, err := st.Create("ci", []Scope{ScopeType}, 0); err == nil {
+		t.Error("a second token with the same name was created")
+	}
+
+	tok, ok := st.authenticate(secret)
+	if !ok || tok.Name != "ci" || len(tok.Scopes) != 1 || tok.Scopes[0] != ScopeType {
+		t.Fatalf("authenticate = %+v, %v", tok, ok)
+	}
+	for _, bad := range []string{"", strings.TrimPrefix(secret, apiTokenPrefix), secret + "x"} {
+		if _, ok := st.authenticate(bad); ok {
+			t.Errorf("authenticate(%q) succeeded", bad)
+		}
+	}
+
+	// Only the hash is written to disk.
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), strings.TrimPrefix(secret, apiTokenPrefix)) {
+		t.Error("the token secret is stored in plaintext")
+	}
+
+	reloaded, err := LoadTokenStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := reloaded.authenticate(secret); !ok {
+		t.Error("token doesn't work after reloading")
+	}
+	if list := reloaded.List(); len(list) != 1 || list[0].LastUsedAt == "" {
+		t.Errorf("List after reload = %+v, want ci with a last use", list)
+	}
+
+	if err := reloaded.Revoke("ci"); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloaded.Revoke("ci"); !errors.Is(err, errUnknownToken) {
+		t.Errorf("revoking twice: error %v, want %v", err, errUnknownToken)
+	}
+	if _, ok := reloaded.authenticate(secret); ok {
+		t.Error("revoked token still works")
+	}
+	if again, _ := LoadTokenStore(path); len(again.List()) != 0 {
+		t.Error("revoked token is still on disk")
+	}
+}
+
+func TestTokenExpiry(t *testing.T) {
+	st, _ := LoadTokenStore(filepath.Join(t.TempDir(), TokensFileName))
+	secret, info, err := st.Create("short", []Scope{ScopeType}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ExpiresAt == "" || info.Expired {
+		t.Fatalf("info = %+v, want an expiry in the future", info)
+	}
+	if _, ok := st.authenticate(secret); !ok {
+		t.Fatal("unexpired token refused")
+	}
+
+	st.mu.Lock()
+	past := time.Now().Add(-time.Second)
+	st.tokens["short"].ExpiresAt = &past
+	st.mu.Unlock()
+	if _, ok := st.authenticate(secret); ok {
+		t.Error("expired token accepted")
+	}
+	// Expired tokens stay listed until revoked.
+	if list := st.List(); len(list) != 1 || !list[0].Expired {
+		t.Errorf("List = %+v, want the token marked expired", list)
+	}
+}
+
+func TestTokenCreateInvalid(t *testing.T) {
+	st, _ := LoadTokenStore(filepath.Join(t.TempDir(), TokensFileName))
+	for _, name := range []string{"", "-lead", "has space", "a/b", strings.Repeat("a", 65)} {
+		if _, _, err := st.Create(name, []Scope{ScopeType}, 0); err == nil {
+			t.Errorf("Create(%q) succeeded", name)
+		}
+	}
+	if _, _, err := st.Create("none", nil, 0); err == nil {
+		t.Error("token without scopes created")
+	}
+}
+
+func TestLoadTokenStoreCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), TokensFileName)
+	if err := os.WriteFile(path, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	st, err := LoadTokenStore(path)
+	if err == nil {
+		t.Error("corrupt token file loaded without error")
+	}
+
+	// The tokens in the file may still be recoverable, so it isn't replaced.
+	if _, _, err := st.Create("ci", []Scope{ScopeType}, 0); err == nil {
+		t.Error("token created over a corrupt file")
+	}
+	if len(st.List()) != 0 {
+		t.Error("refused token is listed")
+	}
+	if data, _ := os.ReadFile(path); string(data) != "{" {
+		t.Errorf("corrupt file overwritten with %q", data)
+	}
+}
+
+func TestParseTokenTTL(t *testing.T) {
+	for in, want := range map[string]time.Duration{
+		"":      0,
+		"never": 0,
+		"90d":   90 * 24 * time.Hour,
+		"12h":   12 * time.Hour,
+		"30m":   30 * time.Minute,
+	} {
+		if got, err := ParseTokenTTL(in); err != nil || got != want {
+			t.Errorf("ParseTokenTTL(%q) = %v, %v; want %v", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"0d", "-1d", "xd", "0s", "-5m", "soon"} {
+		if _, err := ParseTokenTTL(in); err == nil {
+			t.Errorf("ParseTokenTTL(%q) succeeded", in)
+		}
+	}
+}
@@ -20,6 +20,10 @@
     const tabBtn = document.getElementById('tabBtn');
     const ctrlVBtn = document.getElementById('ctrlVBtn');
     const escBtn = document.getElementById('escBtn');
+    const scriptsSection = document.getElementById('scriptsSection');
+    const scriptButtons = document.getElementById('scriptButtons');
+    const actionsSection = document.getElementById('actionsSection');
+    const actionButtons = document.getElementById('actionButtons');
     const statusBar = document.getElementById('statusBar');
     const statusText = document.getElementById('statusText');
     const pairCard = document.getElementById('pairCard');
@@ -37,13 +41,28 @@
     let recognition = null;
     let isListening = false;
     let aiAvailable = false;
+    let permissions = null; // what this device may do, null until known
+    let scripts = []; // script commands from the desktop's scripts folder
+    let actions = []; // desktop actions this device may run
     let history = [];
     let aiProcessing = false;
+    let previewMode = null; // the AI mode of the preview in the input box
     let reconnectTimer = null;
     let wsConnectTimeout = null;
+    let closeNotice = '';
+    let replaced = false;
     let isPaired = false;
     let pairSubmitting = false;
-    let authToken = '';
+    let accessToken = '';
+    let refreshToken = '';
+    let pairNonce = '';
+    let pairMode = 'code';
+    let e2eKeyHex = '';
+    let e2eKey = null;
+    let connId = '';
+    let sendSeq = 0;
+    let sendChain = Promise.resolve();
+    let recvChain = Promise.resolve();
     const deviceId = getOrCreateDeviceId();
     let sendTimeout = null;
     let currentLang = 'zh-CN';
@@ -64,6 +83,11 @@
                 pairTimeout: '配对服务连接超时',
                 pairRequestTimeout: '配对请求超时',
                 micDenied: '麦克风权限被拒绝',
+                replaced: '另一台设备已连接，点此重新连接',
+                serverShutdown: '电脑端已退出',
+                pairExpiring: '配对将在 {minutes} 分钟后过期',
+                backendError: '电脑端错误：{error}',
+                permissionDenied: '此设备没有该权限',
             },
             pair: {
                 title: '设备配对',
@@ -74,12 +98,19 @@
                 hintNeedScan: '请使用电脑端二维码重新扫码打开页面',
                 msgNeedCodeConnect: '请输入 4 位配对码完成连接。',
                 msgAuthExpiredNeedCode: '链接授权已失效，请输入 4 位配对码。',
+                msgLinkExpired: '二维码已失效，请重新扫码或输入 4 位配对码。',
                 msgServiceUnavailable: '配对服务不可用，请重试。',
                 msgNeedCode: '请输入 4 位配对码。',
                 msgServiceConnectFailed: '配对服务连接失败，请检查网络。',
                 msgCodeInvalidFormat: '配对码必须是 4 位数字。',
                 msgCodeInvalid: '配对码错误，请重试。',
                 msgRequestFailed: '配对请求失败，请重试。',
+                requestApproval: '请求电脑端批准',
+                hintNeedApproval: '配对请求需要在电脑端批准',
+                msgNeedApproval: '请发送配对请求，并在电脑端批准。',
+                msgWaitingApproval: '等待电脑端批准...',
+                msgApprovalDenied: '配对请求被拒绝。',
+                msgApprovalExpired: '配对请求已超时，请重试。',
             },
             input: { placeholder: '在这里输入文字，使用手机键盘或语音...', voiceTitle: 'Web Speech API 语音输入' },
             send: { send: '发送', sending: '发送中...' },
@@ -97,6 +128,13 @@
                 paste: '粘贴',
                 escTitle: 'Escape 取消',
             },
+            scripts: { title: '脚本命令' },
+            actions: {
+                title: '电脑操作',
+                confirm: '确定要执行“{label}”吗？',
+                done: '“{label}”已执行',
+                exited: '“{label}”已结束，退出码 {code}',
+            },
             mode: {
                 title: 'AI 工具',
                 tidyTitle: '去重、去口头禅、加标点',
@@ -108,6 +146,7 @@
             },
             ai: {
                 disabledHint: 'AI 未启用，请先配置 API Key',
+                deniedHint: '此设备不能使用 AI',
                 done: '已{mode}，可编辑后发送',
                 failed: 'AI 处理失败',
                 processing: 'AI 处理中...',
@@ -129,12 +168,20 @@
                 modeFormal: '正式',
                 modeTranslate: '翻译',
             },
+            desktops: {
+                title: '🖥️ 电脑',
+                current: '当前',
+                searching: '正在查找局域网中的电脑...',
+                none: '没有找到其他电脑',
+                failed: '查找失败',
+            },
             settings: {
                 title: '⚙️ AI 设置',
                 lanIpLabel: 'LAN IP（或 auto）',
                 save: '保存',
                 saving: '保存中...',
                 needOneField: '请至少填写一项',
+                denied: '此设备不能修改设置',
                 saveOk: '已保存',
                 saveOkAiOn: '已保存，AI 已启用',
                 saveFailed: '保存失败',
@@ -157,6 +204,11 @@
                 pairTimeout: 'Pairing service timeout',
                 pairRequestTimeout: 'Pair request timeout',
                 micDenied: 'Microphone permission denied',
+                replaced: 'Another device connected. Tap to reconnect',
+                serverShutdown: 'Desktop app closed',
+                pairExpiring: 'Pairing expires in {minutes} min',
+                backendError: 'Desktop error: {error}',
+                permissionDenied: 'This device isn\'t allowed to do that',
             },
             pair: {
                 title: 'Device Pairing',
@@ -167,12 +219,19 @@
                 hintNeedScan: 'Use desktop QR code to rescan and open this page',
                 msgNeedCodeConnect: 'Enter 4-digit pair code to continue.',
                 msgAuthExpiredNeedCode: 'Link authorization expired, enter 4-digit pair code.',
+                msgLinkExpired: 'QR code expired, scan again or enter the 4-digit pair code.',
                 msgServiceUnavailable: 'Pairing service unavailable, please retry.',
                 msgNeedCode: 'Please enter the 4-digit pair code.',
                 msgServiceConnectFailed: 'Pairing service connection failed, check your network.',
                 msgCodeInvalidFormat: 'Pair code must be 4 digits.',
                 msgCodeInvalid: 'Invalid pair code, please retry.',
                 msgRequestFailed: 'Pair request failed, please retry.',
+                requestApproval: 'Request Approval',
+                hintNeedApproval: 'The pairing request must be approved on the desktop',
+                msgNeedApproval: 'Send a pairing request, then approve it on the desktop.',
+                msgWaitingApproval: 'Waiting for approval on the desktop...',
+                msgApprovalDenied: 'Pairing request was denied.',
+                msgApprovalExpired: 'Pairing request timed out, please retry.',
             },
             input: { placeholder: 'Type here using your phone keyboard or voice...', voiceTitle: 'Web Speech API Voice Input' },
             send: { send: 'Send', sending: 'Sending...' },
@@ -190,6 +249,13 @@
                 paste: 'Paste',
                 escTitle: 'Escape cancel',
             },
+            scripts: { title: 'Scripts' },
+            actions: {
+                title: 'Desktop Actions',
+                confirm: 'Run "{label}" on the computer?',
+                done: '"{label}" done',
+                exited: '"{label}" exited with code {code}',
+            },
             mode: {
                 title: 'AI Tools',
                 tidyTitle: 'Deduplicate, remove fillers, add punctuation',
@@ -201,6 +267,7 @@
             },
             ai: {
                 disabledHint: 'AI not enabled, configure API Key first',
+                deniedHint: 'This device isn\'t allowed to use AI',
                 done: '{mode} done, edit then send',
                 failed: 'AI processing failed',
                 processing: 'AI processing...',
@@ -222,12 +289,20 @@
                 modeFormal: 'Formal',
                 modeTranslate: 'Translate',
             },
+            desktops: {
+                title: '🖥️ Computers',
+                current: 'Current',
+                searching: 'Looking for computers on the network...',
+                none: 'No other computers found',
+                failed: 'Search failed',
+            },
             settings: {
                 title: '⚙️ AI Settings',
                 lanIpLabel: 'LAN IP (or auto)',
                 save: 'Save',
                 saving: 'Saving...',
                 needOneField: 'Please fill at least one field',
+                denied: 'This device isn\'t allowed to change settings',
                 saveOk: 'Saved',
                 saveOkAiOn: 'Saved, AI enabled',
                 saveFailed: 'Save failed',
@@ -261,7 +336,7 @@
             el.setAttribute('title', t(el.getAttribute('data-i18n-title')));
         });
         if (langSelect) langSelect.value = currentLang;
-        if (pairSubmitBtn && !pairSubmitting) pairSubmitBtn.textContent = t('pair.confirm');
+        if (pairSubmitBtn && !pairSubmitting) pairSubmitBtn.textContent = pairButtonLabel();
         if (sendBtn && !sendBtn.disabled) sendBtn.querySelector('span').textContent = t('send.send');
     }
 
@@ -308,55 +383,140 @@
         return id;
     }
 
-    function initAuthToken() {
-        const tokenInUrl = (new URLSearchParams(window.location.search).get('token') || '').trim();
-        const tokenInStorage = (localStorage.getItem('gtalk_auth_token') || '').trim();
-        if (tokenInUrl) {
-            authToken = tokenInUrl;
-            localStorage.setItem('gtalk_auth_token', tokenInUrl);
-            return;
+    function initAuthTokens() {
+        // Old builds put a shared token in the URL; drop it so it doesn't stay in history.
+        const params = new URLSearchParams(window.location.search);
+        if (params.has('token')) {
+            params.delete('token');
+            const qs = params.toString();
+            window.history.replaceState(null, '', location.pathname + (qs ? `?${qs}` : '') + location.hash);
+        }
+        localStorage.removeItem('gtalk_auth_token');
+
+        // One-time pairing link from the desktop QR code: #pair=<nonce>.
+        const hash = new URLSearchParams(location.hash.slice(1));
+        if (hash.has('pair')) {
+            pairNonce = (hash.get('pair') || '').trim();
+            window.history.replaceState(null, '', location.pathname + location.search);
+        }
+
+        accessToken = (localStorage.getItem('gtalk_access_token') || '').trim();
+        refreshToken = (localStorage.getItem('gtalk_refresh_token') || '').trim();
+        e2eKeyHex = (localStorage.getItem('gtalk_e2e_key') || '').trim();
+    }
+
+    // setE2EKey stores the SPAKE2 session key. Devices paired without SPAKE2
+    // (desktop approval only) have no key and talk plaintext over TLS.
+    function setE2EKey(hex) {
+        e2eKeyHex = hex || '';
+        e2eKey = null;
+        if (e2eKeyHex) {
+            localStorage.setItem('gtalk_e2e_key', e2eKeyHex);
+        } else {
+            localStorage.removeItem('gtalk_e2e_key');
         }
-        authToken = tokenInStorage;
     }
 
-    function setAuthToken(token) {
-        authToken = (token || '').trim();
-        if (authToken) {
-            localStorage.setItem('gtalk_auth_token', authToken);
+    function setAuthTokens(access, refresh) {
+        accessToken = (access || '').trim();
+        refreshToken = (refresh || '').trim();
+        if (accessToken) {
+            localStorage.setItem('gtalk_access_token', accessToken);
         } else {
-            localStorage.removeItem('gtalk_auth_token');
+            localStorage.removeItem('gtalk_access_token');
         }
+        if (refreshToken) {
+            localStorage.setItem('gtalk_refresh_token', refreshToken);
+        } else {
+            localStorage.removeItem('gtalk_refresh_token');
+        }
+    }
+
+    // csrfToken returns the token the server set in the gtalk_csrf cookie.
+    // Every POST has to echo it back in the X-CSRF-Token header.
+    function csrfToken() {
+        const match = document.cookie.match(/(?:^|;\s*)gtalk_csrf=([^;]*)/);
+        return match ? decodeURIComponent(match[1]) : '';
+    }
+
+    function authHeaders(headers) {
+        const h = { ...(headers || {}) };
+        if (accessToken) h['X-GTalk-Token'] = accessToken;
+        const csrf = csrfToken();
+        if (csrf) h['X-CSRF-Token'] = csrf;
+        return h;
     }
 
-    function withAuth(url) {
-        const params = new URLSearchParams();
-        if (authToken) params.set('token', authToken);
-        if (deviceId) params.set('device_id', deviceId);
-        const qs = params.toString();
-        if (!qs) return url;
-        const sep = url.includes('?') ? '&' : '?';
-        return `${url}${sep}${qs}`;
+    function authFetch(url, options) {
+        const opts = options || {};
+        return fetch(url, { ...opts, headers: authHeaders(opts.headers) });
     }
 
     async function fetchWithTimeout(url, options, timeoutMs) {
         const controller = new AbortController();
         const timeout = setTimeout(() => controller.abort(), timeoutMs || 8000);
         try {
-            return await fetch(url, { ...(options || {}), signal: controller.signal });
+            const opts = options || {};
+            return await fetch(url, { ...opts, headers: authHeaders(opts.headers), signal: controller.signal });
         } finally {
             clearTimeout(timeout);
         }
     }
 
+    // refreshAuthTokens rotates the access token. Returns false when the
+    // pairing session is gone and the user has to pair again.
+    async function refreshAuthTokens() {
+        if (!refreshToken) return false;
+        const resp = await fetchWithTimeout('api/token/refresh', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ refreshToken }),
+        }, 8000);
+        if (!resp.ok) {
+            setAuthTokens('', '');
+            return false;
+        }
+        const data = await resp.json();
+        setAuthTokens(data.accessToken, data.refreshToken);
+        return true;
+    }
+
+    // showPairCard shows the pairing card. needCode means the user can act:
+    // enter the pair code, or just send a request when the desktop approves.
     function showPairCard(message, needCode) {
+        const approveOnly = pairMode === 'approve';
         pairCard.classList.remove('hidden');
         pairMessage.textContent = message || '';
-        pairCodeInput.classList.toggle('hidden', !needCode);
+        pairCodeInput.classList.toggle('hidden', !needCode || approveOnly);
         pairSubmitBtn.classList.toggle('hidden', !needCode);
-        pairHint.textContent = needCode
-            ? t('pair.hintNeedCode')
-            : t('pair.hintNeedScan');
-        if (needCode) pairCodeInput.focus();
+        pairSubmitBtn.textContent = pairButtonLabel();
+        if (!needCode) {
+            pairHint.textContent = t('pair.hintNeedScan');
+        } else if (approveOnly) {
+            pairHint.textContent = t('pair.hintNeedApproval');
+        } else {
+            pairHint.textContent = t('pair.hintNeedCode');
+        }
+        if (needCode && !approveOnly) pairCodeInput.focus();
+    }
+
+    function pairButtonLabel() {
+        return pairMode === 'approve' ? t('pair.requestApproval') : t('pair.confirm');
+    }
+
+    function pairPromptMessage() {
+        return pairMode === 'approve' ? t('pair.msgNeedApproval') : t('pair.msgNeedCodeConnect');
+    }
+
+    // guessDeviceName gives the desktop a readable label for approval prompts.
+    function guessDeviceName() {
+        const ua = navigator.userAgent;
+        if (/iPhone/.test(ua)) return 'iPhone';
+        if (/iPad/.test(ua)) return 'iPad';
+        if (/Android/.test(ua)) return 'Android';
+        if (/Windows/.test(ua)) return 'Windows';
+        if (/Macintosh/.test(ua)) return 'Mac';
+        return 'Browser';
     }
 
     function hidePairCard() {
@@ -369,33 +529,80 @@
     }
 
     // ---- Pairing ----
+    // redeemPairLink pairs using the nonce from the scanned QR code.
+    // The nonce is single-use, so it is cleared whatever the outcome.
+    async function redeemPairLink() {
+        const nonce = pairNonce;
+        pairNonce = '';
+        try {
+            const result = await pakePair('nonce', nonce);
+            if (!result.ok) return false;
+            setAuthTokens(result.data.accessToken, result.data.refreshToken);
+            setE2EKey(result.key);
+            return true;
+        } catch (e) {
+            return false;
+        }
+    }
+
+    // pakePair pairs through SPAKE2 with the pair code or QR nonce as the
+    // password, so the secret itself never leaves the phone. On success the
+    // result carries the end-to-end key for WebSocket payloads.
+    async function pakePair(method, secret) {
+        const exchange = await GTalkPake.start(deviceId, secret);
+        let resp = await fetchWithTimeout('api/pair/pake', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ deviceId, deviceName: guessDeviceName(), method, share: exchange.share }),
+        }, 8000);
+        if (!resp.ok) return { ok: false, status: resp.status };
+        const step = await resp.json();
+
+        let keys;
+        try {
+            keys = await exchange.finish(step.share, step.confirm);
+        } catch (e) {
+            return { ok: false, status: 403 };
+        }
+
+        resp = await fetchWithTimeout('api/pair/pake/confirm', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ session: step.session, confirm: keys.confirm }),
+        }, 8000);
+        if (!resp.ok) return { ok: false, status: resp.status };
+        return { ok: true, status: resp.status, data: await resp.json(), key: keys.key };
+    }
+
         async function ensurePaired() {
-        if (!authToken) {
+        if (pairNonce && !(await redeemPairLink())) {
             setStatus('error', t('status.pairNeedCode'));
-            showPairCard(t('pair.msgNeedCodeConnect'), true);
+            showPairCard(t('pair.msgLinkExpired'), true);
             return false;
         }
 
         try {
-            const resp = await fetchWithTimeout(withAuth('/api/pair'), null, 8000);
-            if (resp.status === 401) {
-                setAuthToken('');
-                setStatus('error', t('status.authExpired'));
-                showPairCard(t('pair.msgAuthExpiredNeedCode'), true);
-                return false;
-            }
+            const resp = await fetchWithTimeout('api/pair', null, 8000);
             if (!resp.ok) {
                 setStatus('error', t('status.pairUnavailable'));
                 showPairCard(t('pair.msgServiceUnavailable'), true);
                 return false;
             }
             const data = await resp.json();
-            if (data.paired) {
+            pairMode = data.pairMode || 'code';
+            const hadSession = !!(accessToken || refreshToken);
+            if (data.paired || await refreshAuthTokens()) {
                 isPaired = true;
                 hidePairCard();
                 return true;
             }
-            showPairCard(t('pair.msgNeedCode'), true);
+            if (hadSession) {
+                setStatus('error', t('status.authExpired'));
+                showPairCard(pairMode === 'approve' ? t('pair.msgNeedApproval') : t('pair.msgAuthExpiredNeedCode'), true);
+            } else {
+                setStatus('error', t('status.pairNeedCode'));
+                showPairCard(pairPromptMessage(), true);
+            }
             return false;
         } catch (e) {
             setStatus('error', t('status.pairTimeout'));
@@ -407,7 +614,7 @@
         async function submitPairCode() {
         if (pairSubmitting) return;
         const code = (pairCodeInput.value || '').trim();
-        if (!/^\d{4}$/.test(code)) {
+        if (pairMode !== 'approve' && !/^\d{4}$/.test(code)) {
             showPairCard(t('pair.msgCodeInvalidFormat'), true);
             return;
         }
@@ -416,19 +623,28 @@
         pairSubmitBtn.disabled = true;
         pairSubmitBtn.textContent = t('pair.submitting');
         try {
-            const resp = await fetchWithTimeout(withAuth('/api/pair'), {
-                method: 'POST',
-                headers: { 'Content-Type': 'application/json' },
-                body: JSON.stringify({ code, deviceId }),
-            }, 8000);
-            if (!resp.ok) {
-                showPairCard(t('pair.msgCodeInvalid'), true);
+            let result;
+            if (pairMode === 'approve') {
+                // No shared secret to run SPAKE2 with; the desktop vouches instead.
+                const resp = await fetchWithTimeout('api/pair', {
+                    method: 'POST',
+                    headers: { 'Content-Type': 'application/json' },
+                    body: JSON.stringify({ deviceId, deviceName: guessDeviceName() }),
+                }, 8000);
+                result = { ok: resp.ok, status: resp.status, data: resp.ok ? await resp.json() : null, key: '' };
+            } else {
+                result = await pakePair('code', code);
+            }
+            if (result.status === 202) {
+                await waitForApproval(result.data.ticket, result.key);
                 return;
             }
-            const data = await resp.json();
-            if (data && data.token) {
-                setAuthToken(data.token);
+            if (!result.ok) {
+                showPairCard(t('pair.msgCodeInvalid'), true);
+                return;
             }
+            setAuthTokens(result.data.accessToken, result.data.refreshToken);
+            setE2EKey(result.key);
             isPaired = true;
             hidePairCard();
             connectWebSocket();
@@ -438,7 +654,36 @@
         } finally {
             pairSubmitting = false;
             pairSubmitBtn.disabled = false;
-            pairSubmitBtn.textContent = t('pair.confirm');
+            pairSubmitBtn.textContent = pairButtonLabel();
+        }
+    }
+
+    // waitForApproval polls until the desktop approves or denies the
+    // pairing request, or the request times out on the server.
+    async function waitForApproval(ticket, key) {
+        showPairCard(t('pair.msgWaitingApproval'), false);
+        for (;;) {
+            await new Promise(resolve => setTimeout(resolve, 2000));
+            const resp = await fetchWithTimeout('api/pair/wait', {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({ ticket }),
+            }, 8000);
+            if (!resp.ok) throw new Error(`pair wait failed: ${resp.status}`);
+            const data = await resp.json();
+            if (data.status === 'pending') continue;
+            if (data.status === 'approved') {
+                setAuthTokens(data.accessToken, data.refreshToken);
+                setE2EKey(key);
+                isPaired = true;
+                hidePairCard();
+                connectWebSocket();
+            } else if (data.status === 'denied') {
+                showPairCard(t('pair.msgApprovalDenied'), true);
+            } else {
+                showPairCard(t('pair.msgApprovalExpired'), true);
+            }
+            return;
         }
     }
 
@@ -451,8 +696,12 @@
             return;
         }
 
-        const protocol = location.protocol === 'https:' ? 'wss:' : 'ws:';
-        const wsUrl = `${protocol}//${location.host}${withAuth('/ws')}`;
+        // Resolve relative to the page so the app also works under a base path.
+        // The WebSocket handshake authenticates with the session cookie set by /api/pair.
+        const wsUrl = new URL('ws', location.href);
+        wsUrl.protocol = location.protocol === 'https:' ? 'wss:' : 'ws:';
+        wsUrl.hash = '';
+        wsUrl.search = '';
 
         try {
             ws = new WebSocket(wsUrl);
@@ -481,9 +730,11 @@
 
         ws.onclose = () => {
             clearTimeout(wsConnectTimeout);
-            setStatus('', t('status.disconnected'));
+            setStatus('', closeNotice || t('status.disconnected'));
+            closeNotice = '';
             ws = null;
-            scheduleReconnect();
+            // Don't take the connection back from the device that replaced us.
+            if (!replaced) scheduleReconnect();
         };
 
         ws.onerror = () => {
@@ -492,54 +743,143 @@
         };
 
         ws.onmessage = (event) => {
-            try {
-                const msg = JSON.parse(event.data);
-                switch (msg.type) {
-                    case 'ack':
-                        if (msg.original && msg.text !== msg.original && msg.mode !== 'raw') {
-                            updateLastHistory(msg.text, msg.original, 'sent');
-                        } else {
-                            updateLastHistoryStatus('sent');
-                        }
-                        enableSend();
-                        break;
-                    case 'ai_preview': {
-                        aiProcessing = false;
-                        inputText.disabled = false;
-                        inputText.value = msg.text;
-                        updateCharCount();
-                        updateLastHistory(msg.text, msg.original, 'preview');
-                        clearTimeout(sendTimeout);
-                        modeBtns.forEach(b => b.classList.remove('disabled'));
-                        updateModeButtons();
-                        const modeLabels = { tidy: t('mode.tidy'), formal: t('mode.formal'), translate: t('mode.translate') };
-                        showAIStatus('done', t('ai.done', { mode: modeLabels[msg.mode] || 'OK' }));
-                        inputText.focus();
-                        break;
+            // Decryption is async; chain frames so they are handled in order.
+            recvChain = recvChain.then(async () => {
+                try {
+                    let msg = JSON.parse(event.data);
+                    if (msg.type === 'hello') {
+                        connId = msg.conn;
+                        sendSeq = 0;
+                        if (msg.e2e && !e2eKey && e2eKeyHex) e2eKey = await GTalkPake.importKey(e2eKeyHex);
+                        return;
+                    }
+                    if (msg.type === 'enc') {
+                        if (!e2eKey) return;
+                        msg = await GTalkPake.open(e2eKey, connId, msg);
                     }
-                    case 'processing':
-                        updateLastHistoryStatus('processing');
-                        break;
-                    case 'ai_error':
-                        aiProcessing = false;
-                        inputText.disabled = false;
-                        updateLastHistoryStatus('ai_error', msg.error);
-                        enableSend();
-                        modeBtns.forEach(b => b.classList.remove('disabled'));
-                        updateModeButtons();
-                        showAIStatus('error', t('ai.failed'));
-                        break;
-                    case 'error':
-                        updateLastHistoryStatus('error', msg.error);
-                        enableSend();
-                        break;
+                    handleServerMessage(msg);
+                } catch (e) {
+                    console.error('Bad message:', e);
                 }
-            } catch (e) {
-                console.error('Bad message:', e);
-            }
+            });
         };
     }
 
+    function handleServerMessage(msg) {
+        switch (msg.type) {
+            case 'ack':
+                // The text typed differs from what was sent when AI or
+                // desktop filters rewrote it.
+                if (msg.original && msg.text !== msg.original) {
+                    updateLastHistory(msg.text, msg.original, 'sent');
+                } else {
+                    updateLastHistoryStatus('sent');
+                }
+                enableSend();
+                break;
+            case 'ai_preview': {
+                aiProcessing = false;
+                inputText.disabled = false;
+                inputText.value = msg.text;
+                previewMode = msg.mode;
+                updateCharCount();
+                updateLastHistory(msg.text, msg.original, 'preview');
+                clearTimeout(sendTimeout);
+                modeBtns.forEach(b => b.classList.remove('disabled'));
+                updateModeButtons();
+                const modeLabels = { tidy: t('mode.tidy'), formal: t('mode.formal'), translate: t('mode.translate') };
+                showAIStatus('done', t('ai.done', { mode: modeLabels[msg.mode] || 'OK' }));
+                inputText.focus();
+                break;
+            }
+            case 'processing':
+                updateLastHistoryStatus('processing');
+                break;
+            case 'ai_error':
+                aiProcessing = false;
+                inputText.disabled = false;
+                updateLastHistoryStatus('ai_error', msg.error);
+                enableSend();
+                modeBtns.forEach(b => b.classList.remove('disabled'));
+                updateModeButtons();
+                showAIStatus('error', msg.code === 'permission_denied' ? t('status.permissionDenied') : t('ai.failed'));
+                break;
+            case 'error':
+                updateLastHistoryStatus('error', msg.error);
+                enableSend();
+                if (msg.code === 'permission_denied') showAIStatus('error', t('status.permissionDenied'));
+                break;
+            case 'action_result':
+                showActionResult(msg.data || {});
+                break;
+            case 'config_saved':
+                aiAvailable = !!msg.aiAvailable;
+                updateModeButtons();
+                configDone(true, msg.aiAvailable ? t('settings.saveOkAiOn') : t('settings.saveOk'));
+                break;
+            case 'config_error':
+                configDone(false, msg.code === 'permission_denied' ? t('settings.denied') : t('settings.saveFailed'));
+                break;
+            case 'event':
+                handleServerEvent(msg.event, msg.data || {});
+                break;
+        }
+    }
+
+    // Events the desktop pushes, so the phone doesn't have to poll /api/status.
+    function handleServerEvent(event, data) {
+        switch (event) {
+            case 'ai_config_changed':
+                aiAvailable = !!data.aiAvailable;
+                updateModeButtons();
+                break;
+            case 'pair_expiring': {
+                const minutes = Math.max(1, Math.round((new Date(data.expiresAt) - Date.now()) / 60000));
+                showAIStatus('error', t('status.pairExpiring', { minutes }));
+                break;
+            }
+            case 'device_connected':
+                replaced = true;
+                closeNotice = t('status.replaced');
+                break;
+            case 'backend_error':
+                showAIStatus('error', t('status.backendError', { error: data.error || '' }));
+                break;
+            case 'server_shutdown':
+                closeNotice = t('status.serverShutdown');
+                break;
+            case 'scripts_changed':
+            case 'actions_changed':
+                fetchStatus();
+                break;
+        }
+    }
+
+    // wsSend sends a message, encrypting it when the device has an
+    // end-to-end key. Frames are queued so sequence numbers stay ordered.
+    function wsSend(obj) {
+        if (!ws || ws.readyState !== WebSocket.OPEN) return false;
+        const sock = ws;
+        if (!e2eKeyHex) {
+            sock.send(JSON.stringify(obj));
+            return true;
+        }
+        const seq = ++sendSeq;
+        const conn = connId;
+        sendChain = sendChain.then(async () => {
+            if (!e2eKey) e2eKey = await GTalkPake.importKey(e2eKeyHex);
+            const env = await GTalkPake.seal(e2eKey, conn, seq, obj);
+            if (sock.readyState === WebSocket.OPEN) sock.send(JSON.stringify(env));
+        }).catch(e => console.error('Encrypt failed:', e));
+        return true;
+    }
+
+    statusBar.addEventListener('click', () => {
+        if (!replaced) return;
+        replaced = false;
+        connectWebSocket();
+    });
+
     function scheduleReconnect() {
         if (reconnectTimer) return;
         reconnectTimer = setTimeout(() => {
@@ -549,36 +889,48 @@
     }
 
     function fetchStatus() {
-        fetch(withAuth('/api/status'))
+        authFetch('api/status')
             .then(r => r.json())
             .then(data => {
                 isPaired = !!data.paired;
                 aiAvailable = data.aiAvailable;
+                permissions = data.permissions || null;
+                scripts = data.scripts || [];
+                actions = data.actions || [];
                 updateModeButtons();
+                renderScripts();
+                renderActions();
+                updatePermittedControls();
+                serverNameEl.textContent = data.serverName ? ' · ' + data.serverName : '';
             })
             .catch(() => { });
     }
 
-    function sendText(text) {
-        if (ws && ws.readyState === WebSocket.OPEN && text.trim()) {
-            ws.send(JSON.stringify({ type: 'text', text: text.trim(), mode: 'raw' }));
-            return true;
-        }
-        return false;
+    // sendText types text. Confirming an AI preview keeps its mode, so the
+    // desktop's filters for that mode apply.
+    function sendText(text, mode) {
+        if (!text.trim()) return false;
+        if (!mode || mode === 'raw') return wsSend({ type: 'text', text: text.trim(), mode: 'raw' });
+        return wsSend({ type: 'text', text: text.trim(), mode, confirmed: true });
     }
 
     function sendAIProcess(text, mode) {
-        if (ws && ws.readyState === WebSocket.OPEN && text.trim()) {
-            ws.send(JSON.stringify({ type: 'text', text: text.trim(), mode }));
-            return true;
-        }
-        return false;
+        if (!text.trim()) return false;
+        return wsSend({ type: 'text', text: text.trim(), mode });
     }
 
     function sendCommand(cmd) {
-        if (ws && ws.readyState === WebSocket.OPEN) {
-            ws.send(JSON.stringify({ type: 'command', text: cmd }));
-        }
+        wsSend({ type: 'command', text: cmd });
+    }
+
+    function runScript(name) {
+        wsSend({ type: 'script', text: name });
+    }
+
+    // Actions marked confirm are only run once the user says so here.
+    function runAction(action) {
+        if (action.confirm && !window.confirm(t('actions.confirm', { label: action.label || action.name }))) return;
+        wsSend({ type: 'action', text: action.name, confirmed: action.confirm });
     }
 
     // ---- UI ----
@@ -604,11 +956,64 @@
         charCount.textContent = len > 0 ? len : '';
     }
 
+    function allowed(permission) {
+        return !permissions || permissions.includes(permission);
+    }
+
+    // Hide the controls this device's policy doesn't allow.
+    function updatePermittedControls() {
+        document.querySelectorAll('.shortcut-btn:not(.script-btn):not(.action-btn)').forEach(btn => {
+            btn.classList.toggle('hidden', !allowed('command'));
+        });
+        scriptsSection.classList.toggle('hidden', !scripts.length || !allowed('script'));
+        actionsSection.classList.toggle('hidden', !actions.length || !allowed('action'));
+        settingsToggle.classList.toggle('hidden', !allowed('config:read'));
+    }
+
+    // One button per script command the desktop offers.
+    function renderScripts() {
+        scriptButtons.innerHTML = '';
+        scripts.forEach(s => {
+            const btn = document.createElement('button');
+            btn.className = 'shortcut-btn script-btn';
+            btn.textContent = s.label || s.name;
+            btn.title = s.name;
+            btn.addEventListener('click', () => runScript(s.name));
+            scriptButtons.appendChild(btn);
+        });
+    }
+
+    // One button per desktop action; the server only lists those this
+    // device may run.
+    function renderActions() {
+        actionButtons.innerHTML = '';
+        actions.forEach(a => {
+            const btn = document.createElement('button');
+            btn.className = 'shortcut-btn action-btn';
+            btn.textContent = a.label || a.name;
+            btn.title = a.name;
+            btn.addEventListener('click', () => runAction(a));
+            actionButtons.appendChild(btn);
+        });
+    }
+
+    // Show what an action did, with the start of its output if it ran a program.
+    function showActionResult(res) {
+        const action = actions.find(a => a.name === res.name);
+        const label = action ? action.label : res.name;
+        let text = res.exitCode !== undefined
+            ? t('actions.exited', { label, code: res.exitCode })
+            : t('actions.done', { label });
+        const output = (res.output || '').trim();
+        if (output) text += ': ' + (output.length > 200 ? output.slice(0, 200) + '…' : output);
+        showAIStatus(res.exitCode ? 'error' : 'done', text);
+    }
+
     function updateModeButtons() {
         modeBtns.forEach(btn => {
-            if (!aiAvailable) {
+            if (!aiAvailable || !allowed('ai')) {
                 btn.classList.add('disabled');
-                btn.title = t('ai.disabledHint');
+                btn.title = aiAvailable ? t('ai.deniedHint') : t('ai.disabledHint');
             } else {
                 btn.classList.remove('disabled');
             }
@@ -620,8 +1025,10 @@
         const text = inputText.value.trim();
         if (!text) return;
 
-        const sent = sendText(text);
-        addHistory(text, sent ? 'sending' : 'error', 'raw');
+        const mode = previewMode || 'raw';
+        previewMode = null;
+        const sent = sendText(text, mode);
+        addHistory(text, sent ? 'sending' : 'error', mode);
 
         sendBtn.disabled = true;
         sendBtn.querySelector('span').textContent = t('send.sending');
@@ -636,9 +1043,10 @@
 
     function doAIProcess(mode) {
         const text = inputText.value.trim();
-        if (!text || !aiAvailable || aiProcessing) return;
+        if (!text || !aiAvailable || !allowed('ai') || aiProcessing) return;
 
         aiProcessing = true;
+        previewMode = null;
         sendAIProcess(text, mode);
         addHistory(text, 'processing', mode);
 
@@ -792,7 +1200,11 @@
 
     // ---- Events ----
     sendBtn.addEventListener('click', doSend);
-    inputText.addEventListener('input', updateCharCount);
+    inputText.addEventListener('input', () => {
+        // Text typed into an emptied box is no longer the AI preview.
+        if (!inputText.value) previewMode = null;
+        updateCharCount();
+    });
     inputText.addEventListener('keydown', e => {
         if ((e.ctrlKey || e.metaKey) && e.key === 'Enter') {
             e.preventDefault();
@@ -832,6 +1244,58 @@
         });
     }
 
+    // ---- Desktops ----
+    // Each server is its own origin, so the phone keeps separate
+    // credentials for every computer it has paired with.
+    const desktopsToggle = document.getElementById('desktopsToggle');
+    const desktopsPanel = document.getElementById('desktopsPanel');
+    const desktopsArrow = document.getElementById('desktopsArrow');
+    const desktopList = document.getElementById('desktopList');
+    const desktopsStatus = document.getElementById('desktopsStatus');
+    const serverNameEl = document.getElementById('serverName');
+
+    desktopsToggle.addEventListener('click', () => {
+        desktopsPanel.classList.toggle('hidden');
+        desktopsArrow.classList.toggle('open');
+        if (!desktopsPanel.classList.contains('hidden')) loadDesktops();
+    });
+
+    async function loadDesktops() {
+        if (!(await ensurePaired())) return;
+        desktopsStatus.textContent = t('desktops.searching');
+        desktopsStatus.className = 'config-status';
+        authFetch('api/discover')
+            .then(r => r.json())
+            .then(data => {
+                const servers = data.servers || [];
+                desktopList.innerHTML = '';
+                servers.forEach(server => {
+                    const li = document.createElement('li');
+                    const btn = document.createElement('button');
+                    btn.className = 'desktop-item';
+                    const name = document.createElement('span');
+                    name.textContent = server.name;
+                    const detail = document.createElement('small');
+                    detail.textContent = server.self ? t('desktops.current') : new URL(server.url).host;
+                    btn.append(name, detail);
+                    if (server.self) {
+                        btn.disabled = true;
+                    } else {
+                        btn.addEventListener('click', () => {
+                            location.href = server.url + '/';
+                        });
+                    }
+                    li.appendChild(btn);
+                    desktopList.appendChild(li);
+                });
+                desktopsStatus.textContent = servers.length > 1 ? '' : t('desktops.none');
+            })
+            .catch(() => {
+                desktopsStatus.textContent = t('desktops.failed');
+                desktopsStatus.className = 'config-status error';
+            });
+    }
+
     // ---- Settings ----
     const settingsToggle = document.getElementById('settingsToggle');
     const settingsPanel = document.getElementById('settingsPanel');
@@ -851,7 +1315,7 @@
 
     async function loadConfig() {
         if (!(await ensurePaired())) return;
-        fetch(withAuth('/api/config'))
+        authFetch('api/config')
             .then(r => r.json())
             .then(data => {
                 apiKeyInput.placeholder = data.apiKey || 'sk-...';
@@ -862,6 +1326,8 @@
             .catch(() => { });
     }
 
+    let configTimeout = null;
+
     saveConfigBtn.addEventListener('click', async () => {
         if (!(await ensurePaired())) return;
         const body = {};
@@ -876,38 +1342,31 @@
             return;
         }
 
+        // Settings go over the WebSocket, end-to-end encrypted, so the API
+        // key isn't protected by TLS alone; the reply is config_saved or
+        // config_error.
+        if (!wsSend({ type: 'config', config: body })) {
+            configDone(false, t('settings.networkError'));
+            return;
+        }
         saveConfigBtn.textContent = t('settings.saving');
-        fetch(withAuth('/api/config'), {
-            method: 'POST',
-            headers: { 'Content-Type': 'application/json' },
-            body: JSON.stringify(body),
-        })
-            .then(r => r.json())
-            .then(data => {
-                if (data.ok) {
-                    aiAvailable = data.aiAvailable;
-                    updateModeButtons();
-                    configStatus.textContent = data.aiAvailable ? t('settings.saveOkAiOn') : t('settings.saveOk');
-                    configStatus.className = 'config-status success';
-                    apiKeyInput.value = '';
-                    baseUrlInput.value = '';
-                    modelInput.value = '';
-                    lanIpInput.value = '';
-                    loadConfig();
-                } else {
-                    configStatus.textContent = t('settings.saveFailed');
-                    configStatus.className = 'config-status error';
-                }
-            })
-            .catch(() => {
-                configStatus.textContent = t('settings.networkError');
-                configStatus.className = 'config-status error';
-            })
-            .finally(() => {
-                saveConfigBtn.textContent = t('settings.save');
-            });
+        clearTimeout(configTimeout);
+        configTimeout = setTimeout(() => configDone(false, t('settings.networkError')), 10000);
     });
 
+    function configDone(ok, text) {
+        clearTimeout(configTimeout);
+        saveConfigBtn.textContent = t('settings.save');
+        configStatus.textContent = text;
+        configStatus.className = 'config-status ' + (ok ? 'success' : 'error');
+        if (!ok) return;
+        apiKeyInput.value = '';
+        baseUrlInput.value = '';
+        modelInput.value = '';
+        lanIpInput.value = '';
+        loadConfig();
+    }
+
     // ---- PWA ----
     const installBtn = document.getElementById('installBtn');
     let deferredPrompt = null;
@@ -944,7 +1403,7 @@
 
     // ---- Init ----
     initLanguage();
-    initAuthToken();
+    initAuthTokens();
     connectWebSocket();
     initRecognition();
     inputText.focus();
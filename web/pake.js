@@ -0,0 +1,202 @@
+// ============================================
+// Ginkgo Talk - SPAKE2 pairing & end-to-end encryption
+// ============================================
+// Client half of pake.go / e2e.go. SPAKE2 runs over the RFC 3526 2048-bit
+// MODP group with BigInt; hashing, HKDF, HMAC and AES-GCM use WebCrypto.
+
+(function () {
+    'use strict';
+
+    const GROUP_SIZE = 256;
+    const SERVER_ID = 'ginkgo-talk';
+    const P = BigInt('0x' +
+        'FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD1' +
+        '29024E088A67CC74020BBEA63B139B22514A08798E3404DD' +
+        'EF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245' +
+        'E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7ED' +
+        'EE386BFB5A899FA5AE9F24117C4B1FE649286651ECE45B3D' +
+        'C2007CB8A163BF0598DA48361C55D39A69163FA8FD24CF5F' +
+        '83655D23DCA3AD961C62F356208552BB9ED529077096966D' +
+        '670C354E4ABC9804F1746C08CA18217C32905E462E36CE3B' +
+        'E39E772C180E86039B2783A2EC07A28FB5C55DF06F4C52C9' +
+        'DE2BCBF6955817183995497CEA956AE515D2261898FA0510' +
+        '15728E5A8AACAA68FFFFFFFFFFFFFFFF');
+    const Q = (P - 1n) >> 1n;
+    const G = 2n;
+
+    const subtle = window.crypto.subtle;
+    const encoder = new TextEncoder();
+
+    function modPow(base, exp, mod) {
+        let result = 1n;
+        base %= mod;
+        while (exp > 0n) {
+            if (exp & 1n) result = (result * base) % mod;
+            exp >>= 1n;
+            base = (base * base) % mod;
+        }
+        return result;
+    }
+
+    function modInverse(a, mod) {
+        let [oldR, r] = [a % mod, mod];
+        let [oldS, s] = [1n, 0n];
+        while (r !== 0n) {
+            const q = oldR / r;
+            [oldR, r] = [r, oldR - q * r];
+            [oldS, s] = [s, oldS - q * s];
+        }
+        return ((oldS % mod) + mod) % mod;
+    }
+
+    function bytesToBig(bytes) {
+        let hex = '';
+        bytes.forEach(b => { hex += b.toString(16).padStart(2, '0'); });
+        return hex ? BigInt('0x' + hex) : 0n;
+    }
+
+    function bigToBytes(v, len) {
+        const hex = v.toString(16).padStart(len * 2, '0');
+        return hexToBytes(hex);
+    }
+
+    function bytesToHex(bytes) {
+        return Array.from(bytes).map(b => b.toString(16).padStart(2, '0')).join('');
+    }
+
+    function hexToBytes(hex) {
+        const out = new Uint8Array(hex.length / 2);
+        for (let i = 0; i < out.length; i++) out[i] = parseInt(hex.substr(i * 2, 2), 16);
+        return out;
+    }
+
+    function concat(parts) {
+        const total = parts.reduce((n, p) => n + p.length, 0);
+        const out = new Uint8Array(total);
+        let off = 0;
+        parts.forEach(p => { out.set(p, off); off += p.length; });
+        return out;
+    }
+
+    async function sha256(bytes) {
+        return new Uint8Array(await subtle.digest('SHA-256', bytes));
+    }
+
+    async function hashToGroup(label) {
+        const parts = [];
+        let len = 0;
+        for (let i = 0; len < GROUP_SIZE + 32; i++) {
+            const h = await sha256(concat([encoder.encode(label), new Uint8Array([i])]));
+            parts.push(h);
+            len += h.length;
+        }
+        const x = bytesToBig(concat(parts)) % P;
+        return modPow(x, 2n, P);
+    }
+
+    function lengthPrefixed(bytes) {
+        const prefix = new Uint8Array(8);
+        let n = bytes.length;
+        for (let i = 0; i < 8; i++) { prefix[i] = n & 0xff; n = Math.floor(n / 256); }
+        return concat([prefix, bytes]);
+    }
+
+    async function hkdf(ikm, info) {
+        const key = await subtle.importKey('raw', ikm, 'HKDF', false, ['deriveBits']);
+        const bits = await subtle.deriveBits(
+            { name: 'HKDF', hash: 'SHA-256', salt: new Uint8Array(0), info: encoder.encode(info) },
+            key, 256);
+        return new Uint8Array(bits);
+    }
+
+    async function hmac(keyBytes, msg) {
+        const key = await subtle.importKey('raw', keyBytes, { name: 'HMAC', hash: 'SHA-256' }, false, ['sign']);
+        return new Uint8Array(await subtle.sign('HMAC', key, msg));
+    }
+
+    function validElement(v) {
+        return v > 1n && v < P - 1n && modPow(v, Q, P) === 1n;
+    }
+
+    const groupPoints = Promise.all([hashToGroup('gtalk-spake2-M'), hashToGroup('gtalk-spake2-N')]);
+
+    // start begins a SPAKE2 exchange. It returns the client share to send and
+    // a finish function that checks the server's reply and derives the keys.
+    async function start(deviceId, secret) {
+        const [M, N] = await groupPoints;
+        const w = bytesToBig(await sha256(encoder.encode(`gtalk-spake2-w\0${deviceId}\0${secret}`)));
+        let x = bytesToBig(window.crypto.getRandomValues(new Uint8Array(32)));
+        if (x === 0n) x = 1n;
+
+        // X = g^x * M^w
+        const X = (modPow(G, x, P) * modPow(M, w, P)) % P;
+
+        async function finish(serverShareHex, serverConfirmHex) {
+            if (!serverShareHex || serverShareHex.length !== GROUP_SIZE * 2) throw new Error('invalid server share');
+            const Y = bytesToBig(hexToBytes(serverShareHex));
+            if (!validElement(Y)) throw new Error('invalid server share');
+
+            // K = (Y / N^w)^x
+            const K = modPow((Y * modInverse(modPow(N, w, P), P)) % P, x, P);
+
+            const tt = concat([
+                lengthPrefixed(encoder.encode(deviceId)),
+                lengthPrefixed(encoder.encode(SERVER_ID)),
+                lengthPrefixed(bigToBytes(X, GROUP_SIZE)),
+                lengthPrefixed(bigToBytes(Y, GROUP_SIZE)),
+                lengthPrefixed(bigToBytes(K, GROUP_SIZE)),
+                lengthPrefixed(bigToBytes(w, 32)),
+            ]);
+            const hash = await sha256(tt);
+            const key = await hkdf(hash, 'gtalk e2e key');
+            const clientConfirm = await hmac(await hkdf(hash, 'gtalk confirm client'), hash);
+            const serverConfirm = await hmac(await hkdf(hash, 'gtalk confirm server'), hash);
+
+            // A wrong pair code shows up here, before anything is sent back.
+            if (bytesToHex(serverConfirm) !== serverConfirmHex) throw new Error('key confirmation failed');
+            return { key: bytesToHex(key), confirm: bytesToHex(clientConfirm) };
+        }
+
+        return { share: bytesToHex(bigToBytes(X, GROUP_SIZE)), finish };
+    }
+
+    // ---- End-to-end envelopes (see e2e.go) ----
+
+    function b64encode(bytes) {
+        let s = '';
+        bytes.forEach(b => { s += String.fromCharCode(b); });
+        return btoa(s);
+    }
+
+    function b64decode(str) {
+        const s = atob(str);
+        const out = new Uint8Array(s.length);
+        for (let i = 0; i < s.length; i++) out[i] = s.charCodeAt(i);
+        return out;
+    }
+
+    function additionalData(dir, connId, seq) {
+        return encoder.encode(`gtalk-e2e|${dir}|${connId}|${seq}`);
+    }
+
+    async function importKey(hex) {
+        return subtle.importKey('raw', hexToBytes(hex), 'AES-GCM', false, ['encrypt', 'decrypt']);
+    }
+
+    async function seal(key, connId, seq, obj) {
+        const iv = window.crypto.getRandomValues(new Uint8Array(12));
+        const data = await subtle.encrypt(
+            { name: 'AES-GCM', iv, additionalData: additionalData('c2s', connId, seq) },
+            key, encoder.encode(JSON.stringify(obj)));
+        return { type: 'enc', seq, iv: b64encode(iv), data: b64encode(new Uint8Array(data)) };
+    }
+
+    async function open(key, connId, env) {
+        const plain = await subtle.decrypt(
+            { name: 'AES-GCM', iv: b64decode(env.iv), additionalData: additionalData('s2c', connId, env.seq) },
+            key, b64decode(env.data));
+        return JSON.parse(new TextDecoder().decode(plain));
+    }
+
+    window.GTalkPake = { start, importKey, seal, open };
+})();
@@ -0,0 +1,83 @@
+// ============================================
+// Ginkgo Talk - Desktop QR page
+// ============================================
+
+(function () {
+    'use strict';
+
+    const qrImage = document.getElementById('qrImage');
+    const qrExpiry = document.getElementById('qrExpiry');
+    const pairCode = document.getElementById('pairCode');
+    const qrAddresses = document.getElementById('qrAddresses');
+    const caInfo = document.getElementById('caInfo');
+    const caFingerprint = document.getElementById('caFingerprint');
+
+    let generation = 0;
+    let expiresAt = 0;
+    let selectedHost = '';
+    let defaultUrl = '';
+    let addressKey = '';
+
+    // The pairing link is single-use: reload the image whenever the server
+    // has issued a new one, either after a scan or after expiry.
+    async function poll() {
+        try {
+            const resp = await fetch('api/pairlink', { cache: 'no-store' });
+            if (resp.ok) {
+                const data = await resp.json();
+                if (data.generation !== generation) {
+                    generation = data.generation;
+                    updateImage();
+                }
+                defaultUrl = data.url || '';
+                renderAddresses(data.addresses || []);
+                expiresAt = Date.parse(data.expiresAt) || 0;
+                pairCode.textContent = data.pairCode || '----';
+                caFingerprint.textContent = data.caFingerprint || '';
+                caInfo.hidden = !data.caFingerprint;
+            }
+        } catch (e) { }
+        renderExpiry();
+    }
+
+    function updateImage() {
+        const host = selectedHost ? `&host=${encodeURIComponent(selectedHost)}` : '';
+        qrImage.src = `qrcode.png?g=${generation}${host}`;
+    }
+
+    // renderAddresses lists every address the phone could use. Picking one
+    // re-renders the QR code for it, for when the first guess is not the
+    // network the phone is on.
+    function renderAddresses(addresses) {
+        const key = addresses.map(a => a.host).join(',') + '|' + selectedHost + '|' + defaultUrl;
+        if (key === addressKey) return;
+        addressKey = key;
+
+        qrAddresses.textContent = '';
+        qrAddresses.hidden = addresses.length < 2;
+        addresses.forEach(addr => {
+            const item = document.createElement('li');
+            const button = document.createElement('button');
+            button.type = 'button';
+            button.textContent = `${addr.url} (${addr.interface})`;
+            const selected = selectedHost ? addr.host === selectedHost : addr.url === defaultUrl;
+            button.classList.toggle('selected', selected);
+            button.addEventListener('click', () => {
+                selectedHost = addr.host;
+                updateImage();
+                renderAddresses(addresses);
+            });
+            item.appendChild(button);
+            qrAddresses.appendChild(item);
+        });
+    }
+
+    function renderExpiry() {
+        const left = Math.max(0, Math.round((expiresAt - Date.now()) / 1000));
+        qrExpiry.textContent = left > 0 ? `Refreshes in ${left}s` : 'Refreshing...';
+    }
+
+    poll();
+    setInterval(poll, 2000);
+    setInterval(renderExpiry, 1000);
+})();